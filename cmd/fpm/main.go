@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dominikbraun/graph"
+	"github.com/jamesjellow/fpm"
+	"github.com/jamesjellow/fpm/handlers"
+	"github.com/jamesjellow/fpm/pkgmanager"
+)
+
+const usage = `
+Usage:
+
+fpm install        install all the dependencies in your project (--production skips devDependencies)
+                   --no-bail keeps installing past failures and reports them all at the end
+                   --max-depth=<n> limits how deep the dependency tree may go (default 100)
+                   --insecure skips TLS certificate verification (unsafe)
+                   --run-scripts runs lifecycle scripts of installed packages (skipped by default)
+                   --legacy-peer-deps ignores peer dependencies, --peer-deps=resolve installs versions satisfying them
+                   --prefix <dir> installs the project in <dir> instead of the working directory (for add too)
+                   -f, --package-json <path> installs the manifest at <path> into node_modules next to it (for add too)
+                   --tmpdir <dir> stages downloads and extractions in <dir>, FPM_TMPDIR or the system's by default (for add too)
+                   --metadata-dir <dir> resolves against the <name>.json metadata documents in <dir>, not the registry (for add too)
+                   --json prints what was installed, and any errors, as JSON (for add too)
+                   --json-lines streams every install event as a line of JSON as it happens (for add too)
+                   --reporter=<name> picks the output: default, json, json-lines, silent or ci for GitHub Actions (for add too)
+                   --timeout=<duration> aborts the install and removes what it added if it takes longer, e.g. 5m
+                   --timing[=<n>] lists the n (10) slowest packages with their resolve, download and extract times
+                   --max-rate=<bytes/s> caps the combined download rate, e.g. 500k or 2m (for add too)
+                   --node-linker=nested installs each dependency under its dependent, hoisted is the default (for add too)
+                   --legacy-bundling is --node-linker=nested, every package gets its own copy of what it declares
+                   --engine-strict fails packages whose engines.node excludes this Node.js, --ignore-engines skips the check (for add too)
+                   --check compares package.json with package-lock.json or yarn.lock without installing
+                   --repair removes packages an interrupted install left broken and installs just those again
+                   --check-files re-extracts only the packages whose files differ from the hashes --record-files took
+                   --upgrade-integrity fetches metadata for every package to record its sha512 integrity in the manifest
+                   --registry <url>, --modules-dir <dir>, --concurrency=<n> pick the registry, install dir and parallelism (for add too)
+                   --offline installs from the cache only, anything not cached fails instead of being fetched (for add too)
+fpm install <foo>  install and save the <foo> dependency (same as add)
+fpm add <foo> ...  add the <foo> dependencies to your project (-D/--save-dev dev, -E/--save-exact exact, -g global, --no-save leaves package.json alone)
+                   -B, --bundle also lists the packages in bundledDependencies so they ship with the published tarball
+                   --tag <tag> resolves packages given without a version through the <tag> dist-tag instead of latest
+                   --before <date> resolves to the newest versions published before <date>, e.g. 2023-01-01 (for install too)
+fpm why <foo>      show the dependency paths that pull in <foo> (--json for JSON)
+fpm audit          report known vulnerabilities in installed packages (--json for JSON)
+fpm cache verify   check every cached tarball against its shasum (--remove evicts corrupt ones)
+fpm run <script>   run a package.json script with node_modules/.bin on the PATH, args after -- are passed along
+fpm verify         check node_modules against the manifest written by the last install (--files re-hashes files recorded with install --record-files)
+fpm dedupe         hoist and remove nested copies in node_modules when one version satisfies every dependent
+fpm list           list the dependencies in package.json with their installed versions (--no-color,
+                   --json for the tree npm ls --json prints, --depth=<n> or --all for deeper levels)
+fpm outdated       show the current, wanted and latest version of each dependency (--no-color)
+fpm view <foo>     show the latest, or a given, version of <foo> on the registry (versions lists all, --json for JSON)
+fpm link           register the package in this directory globally, linking its bins into the global bin directory
+fpm link <foo>     symlink the globally linked <foo> into node_modules, to develop a library and an app together
+fpm prune          remove packages package.json no longer reaches (--production also removes dev, --dry-run lists them)
+
+`
+
+// Exit codes for each class of error, anything unclassified is treated as a usage error
+const (
+	exitUsage       = 1
+	exitNetwork     = 2
+	exitIntegrity   = 3
+	exitFilesystem  = 4
+	exitInterrupted = 130 // What shells report for a SIGINT
+)
+
+var handlerInstance handlers.HandlerInterface = handlers.RealHandlers{}
+
+// add and install go through the library like any other program using fpm
+var (
+	addPackages     = fpm.Add
+	installPackages = fpm.Install
+)
+
+func main() {
+	// Ctrl-C and SIGTERM cancel the install so downloads are aborted and partial files cleaned up
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, os.Args)
+	stop()
+	if err != nil {
+		log.SetFlags(0)
+		log.Print(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// Map an error to its exit code so scripts can tell, say, a flaky network from a checksum mismatch
+func exitCode(err error) int {
+	// A failing `fpm run` script exits with the script's own code
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, pkgmanager.ErrIntegrity):
+		return exitIntegrity
+	case errors.Is(err, pkgmanager.ErrNetwork):
+		return exitNetwork
+	case errors.Is(err, pkgmanager.ErrFilesystem):
+		return exitFilesystem
+	default:
+		return exitUsage
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		err := fmt.Errorf("expected a subcommand\n%s", usage)
+		return err
+	}
+
+	// Initialize the dependency graph
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	switch args[1] {
+	case "add":
+		timeout, args, err := parseTimeout(args)
+		if err != nil {
+			return err
+		}
+		reporter, args, err := parseReporter(args)
+		if err != nil {
+			return err
+		}
+		specs, opts, err := handlers.ParseAddArgs(args[2:])
+		if err != nil {
+			return err
+		}
+		return withTimeout(ctx, timeout, func(ctx context.Context) error {
+			return handlers.Report(reporter, opts, func(opts fpm.Options) (*fpm.Result, error) {
+				return addPackages(ctx, opts, specs...)
+			})
+		})
+	case "install":
+		timeout, args, err := parseTimeout(args)
+		if err != nil {
+			return err
+		}
+		reporter, args, err := parseReporter(args)
+		if err != nil {
+			return err
+		}
+		// Any packages listed after 'install' are installed and saved like 'add'
+		packages, opts, err := handlers.ParseInstallArgs(args[2:])
+		if err != nil {
+			return err
+		}
+		return withTimeout(ctx, timeout, func(ctx context.Context) error {
+			return handlers.Report(reporter, opts, func(opts fpm.Options) (*fpm.Result, error) {
+				return installPackages(ctx, opts, packages...)
+			})
+		})
+	case "why":
+		return handlerInstance.HandleWhy(args, &depGraph)
+	case "cache":
+		return handlerInstance.HandleCache(args)
+	case "audit":
+		return handlerInstance.HandleAudit(ctx, args)
+	case "dedupe":
+		return handlerInstance.HandleDedupe(args)
+	case "list", "ls":
+		return handlerInstance.HandleList(args)
+	case "outdated":
+		return handlerInstance.HandleOutdated(ctx, args)
+	case "view", "info":
+		return handlerInstance.HandleView(ctx, args)
+	case "prune":
+		return handlerInstance.HandlePrune(args, &depGraph)
+	case "verify":
+		return handlerInstance.HandleVerify(args)
+	case "run":
+		return handlerInstance.HandleRun(ctx, args)
+	case "link", "ln":
+		return handlerInstance.HandleLink(args)
+	default:
+		err := fmt.Errorf("unknown subcommand: %s\n%s", strings.Join(args[1:], " "), usage)
+		return err
+	}
+}
+
+// Take the --timeout=<duration> flag out of the args, a zero timeout means there is none
+func parseTimeout(args []string) (time.Duration, []string, error) {
+	var timeout time.Duration
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--timeout=") {
+			rest = append(rest, arg)
+			continue
+		}
+		value := strings.TrimPrefix(arg, "--timeout=")
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return 0, nil, fmt.Errorf("invalid value for --timeout: %s", value)
+		}
+		timeout = parsed
+	}
+	return timeout, rest, nil
+}
+
+// Take the --reporter=<name> flag, or --reporter <name>, out of the args. Without one the reporter is nil and the
+// handlers pick the spinner, or JSON for --json
+func parseReporter(args []string) (handlers.Reporter, []string, error) {
+	var name string
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--reporter" && i+1 < len(args):
+			i++
+			name = args[i]
+		case strings.HasPrefix(arg, "--reporter="):
+			name = strings.TrimPrefix(arg, "--reporter=")
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if name == "" {
+		return nil, rest, nil
+	}
+	reporter, err := handlers.NewReporter(name)
+	return reporter, rest, err
+}
+
+// Run an install with a deadline, an install that runs past it is cancelled and fails with a clear message
+func withTimeout(ctx context.Context, timeout time.Duration, install func(ctx context.Context) error) error {
+	if timeout == 0 {
+		return install(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := install(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("install exceeded %s", timeout)
+	}
+	return err
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dominikbraun/graph"
+	"github.com/jamesjellow/fpm"
+	"github.com/jamesjellow/fpm/pkgmanager"
+)
+
+type mockHandlers struct{}
+
+func (m mockHandlers) HandleWhy(args []string, depGraph *graph.Graph[string, string]) error {
+	return mockHandleWhy(args)
+}
+
+func (m mockHandlers) HandleCache(args []string) error {
+	return mockHandleCache(args)
+}
+
+func (m mockHandlers) HandleAudit(ctx context.Context, args []string) error {
+	return mockHandleAudit(args)
+}
+
+func (m mockHandlers) HandleDedupe(args []string) error {
+	return mockHandleDedupe(args)
+}
+
+func (m mockHandlers) HandleList(args []string) error {
+	return mockHandleList(args)
+}
+
+func (m mockHandlers) HandleOutdated(ctx context.Context, args []string) error {
+	return mockHandleOutdated(args)
+}
+
+func (m mockHandlers) HandleView(ctx context.Context, args []string) error {
+	return mockHandleView(args)
+}
+
+func (m mockHandlers) HandlePrune(args []string, depGraph *graph.Graph[string, string]) error {
+	return mockHandlePrune(args)
+}
+
+func (m mockHandlers) HandleVerify(args []string) error {
+	return mockHandleVerify(args)
+}
+
+func (m mockHandlers) HandleRun(ctx context.Context, args []string) error {
+	return mockHandleRun(args)
+}
+
+func (m mockHandlers) HandleLink(args []string) error {
+	return mockHandleLink(args)
+}
+
+var mockHandleAdd func(args []string) error
+var mockHandleInstall func(packages []string) error
+var mockHandleWhy func(args []string) error
+var mockHandleCache func(args []string) error
+var mockHandleAudit func(args []string) error
+var mockHandleDedupe func(args []string) error
+var mockHandleVerify func(args []string) error
+var mockHandlePrune func(args []string) error
+var mockHandleList func(args []string) error
+var mockHandleOutdated func(args []string) error
+var mockHandleView func(args []string) error
+var mockHandleRun func(args []string) error
+var mockHandleLink func(args []string) error
+
+// The context and options the last add or install got
+var mockInstallContext context.Context
+var mockInstallOptions fpm.Options
+
+func setup() func() {
+	originalHandlers, originalAdd, originalInstall := handlerInstance, addPackages, installPackages
+	handlerInstance = mockHandlers{}
+	addPackages = func(ctx context.Context, opts fpm.Options, specs ...string) (*fpm.Result, error) {
+		mockInstallContext, mockInstallOptions = ctx, opts
+		return nil, mockHandleAdd(specs)
+	}
+	installPackages = func(ctx context.Context, opts fpm.Options, packages ...string) (*fpm.Result, error) {
+		mockInstallContext, mockInstallOptions = ctx, opts
+		return nil, mockHandleInstall(packages)
+	}
+	return func() { handlerInstance, addPackages, installPackages = originalHandlers, originalAdd, originalInstall }
+}
+
+func TestRunNoArguments(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	err := run(context.Background(), []string{"fpm"})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if err != nil && (!strings.Contains(err.Error(), "expected a subcommand") || !strings.Contains(err.Error(), "fpm link")) {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
+
+func TestRunUnknownSubcommand(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	err := run(context.Background(), []string{"fpm", "unknown"})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if err != nil && !strings.Contains(err.Error(), "unknown subcommand: unknown") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
+
+func TestRunAddCommand(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	var got []string
+	mockHandleAdd = func(specs []string) error {
+		got = specs
+		return nil
+	}
+
+	err := run(context.Background(), []string{"fpm", "add", "package", "--save-dev"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if strings.Join(got, " ") != "package" || !mockInstallOptions.Dev {
+		t.Errorf("expected package added to devDependencies, got %v %+v", got, mockInstallOptions)
+	}
+}
+
+func TestRunInstallCommand(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	mockHandleInstall = func(_ []string) error {
+		return nil
+	}
+
+	err := run(context.Background(), []string{"fpm", "install"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRunAddCommandError(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	mockHandleAdd = func(_ []string) error {
+		return errors.New("add error")
+	}
+
+	err := run(context.Background(), []string{"fpm", "add", "package"})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if err != nil && err.Error() != "add error" {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
+
+func TestRunInstallCommandError(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	mockHandleInstall = func(_ []string) error {
+		return errors.New("install error")
+	}
+
+	err := run(context.Background(), []string{"fpm", "install"})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if err != nil && err.Error() != "install error" {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
+
+func TestRunInstallCommandWithPackages(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	var got []string
+	mockHandleInstall = func(packages []string) error {
+		got = packages
+		return nil
+	}
+
+	err := run(context.Background(), []string{"fpm", "install", "foo@1", "bar"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if strings.Join(got, " ") != "foo@1 bar" {
+		t.Errorf("unexpected packages: %v", got)
+	}
+}
+
+func TestRunWhyCommand(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	mockHandleWhy = func(args []string) error {
+		return nil
+	}
+
+	err := run(context.Background(), []string{"fpm", "why", "lodash"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRunCacheCommand(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	var got []string
+	mockHandleCache = func(args []string) error {
+		got = args
+		return nil
+	}
+
+	err := run(context.Background(), []string{"fpm", "cache", "verify"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if strings.Join(got, " ") != "fpm cache verify" {
+		t.Errorf("unexpected args: %v", got)
+	}
+}
+
+func TestRunAuditCommandError(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	mockHandleAudit = func(_ []string) error {
+		return errors.New("found 1 high or critical vulnerabilities")
+	}
+
+	err := run(context.Background(), []string{"fpm", "audit"})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestRunDedupeCommand(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	called := false
+	mockHandleDedupe = func(_ []string) error {
+		called = true
+		return nil
+	}
+
+	if err := run(context.Background(), []string{"fpm", "dedupe"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !called {
+		t.Errorf("expected HandleDedupe to be called")
+	}
+}
+
+func TestRunPruneCommand(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	var receivedArgs []string
+	mockHandlePrune = func(args []string) error {
+		receivedArgs = args
+		return nil
+	}
+
+	if err := run(context.Background(), []string{"fpm", "prune", "--dry-run"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(receivedArgs) != 3 || receivedArgs[2] != "--dry-run" {
+		t.Errorf("expected the prune args to be passed along, got %v", receivedArgs)
+	}
+}
+
+func TestRunListAndOutdatedCommands(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	var called []string
+	mockHandleList = func(args []string) error {
+		called = append(called, args[1])
+		return nil
+	}
+	mockHandleOutdated = func(args []string) error {
+		called = append(called, args[1])
+		return nil
+	}
+
+	for _, command := range []string{"list", "ls", "outdated"} {
+		if err := run(context.Background(), []string{"fpm", command, "--no-color"}); err != nil {
+			t.Errorf("unexpected error for %s: %v", command, err)
+		}
+	}
+	if strings.Join(called, ",") != "list,ls,outdated" {
+		t.Errorf("unexpected calls: %v", called)
+	}
+}
+
+func TestRunViewCommand(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	var receivedArgs []string
+	mockHandleView = func(args []string) error {
+		receivedArgs = args
+		return nil
+	}
+
+	if err := run(context.Background(), []string{"fpm", "info", "left-pad", "versions"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if strings.Join(receivedArgs, " ") != "fpm info left-pad versions" {
+		t.Errorf("expected the view args to be passed along, got %v", receivedArgs)
+	}
+}
+
+func TestRunVerifyCommandError(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	mockHandleVerify = func(_ []string) error {
+		return errors.New("node_modules has drifted from its manifest: 1 difference(s)")
+	}
+
+	if err := run(context.Background(), []string{"fpm", "verify"}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestRunRunCommand(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	var got []string
+	mockHandleRun = func(args []string) error {
+		got = args
+		return nil
+	}
+
+	if err := run(context.Background(), []string{"fpm", "run", "test", "--", "--watch"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if strings.Join(got, " ") != "fpm run test -- --watch" {
+		t.Errorf("unexpected args: %v", got)
+	}
+}
+
+func TestRunLinkCommand(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	var got []string
+	mockHandleLink = func(args []string) error {
+		got = args
+		return nil
+	}
+
+	if err := run(context.Background(), []string{"fpm", "ln", "@scope/lib"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if strings.Join(got, " ") != "fpm ln @scope/lib" {
+		t.Errorf("unexpected args: %v", got)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{errors.New("expected package name after 'add'"), exitUsage},
+		{pkgmanager.Classify(pkgmanager.ErrNetwork, errors.New("no such host")), exitNetwork},
+		{fmt.Errorf("react@18: %w", pkgmanager.Classify(pkgmanager.ErrIntegrity, errors.New("checksum mismatch"))), exitIntegrity},
+		{pkgmanager.Classify(pkgmanager.ErrFilesystem, errors.New("permission denied")), exitFilesystem},
+		{pkgmanager.Classify(pkgmanager.ErrNetwork, fmt.Errorf("Get \"https://registry.npmjs.org/react\": %w", context.Canceled)), exitInterrupted},
+	}
+
+	for _, test := range tests {
+		if got := exitCode(test.err); got != test.expected {
+			t.Errorf("exitCode(%v) = %d, expected %d", test.err, got, test.expected)
+		}
+	}
+}
+
+func TestRunInstallTimeout(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	var receivedPackages []string
+	mockHandleInstall = func(packages []string) error {
+		receivedPackages = packages
+		<-mockInstallContext.Done()
+		return mockInstallContext.Err()
+	}
+
+	err := run(context.Background(), []string{"fpm", "install", "--timeout=10ms", "react"})
+	if err == nil || err.Error() != "install exceeded 10ms" {
+		t.Errorf("expected the install to time out, got %v", err)
+	}
+	if len(receivedPackages) != 1 || receivedPackages[0] != "react" {
+		t.Errorf("expected --timeout to be removed from the args, got %v", receivedPackages)
+	}
+
+	if err := run(context.Background(), []string{"fpm", "install", "--timeout=soon"}); err == nil || !strings.Contains(err.Error(), "invalid value for --timeout") {
+		t.Errorf("expected an invalid timeout to be rejected, got %v", err)
+	}
+}
+
+func TestRunInstallReporter(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	var receivedPackages []string
+	mockHandleInstall = func(packages []string) error {
+		receivedPackages = packages
+		return nil
+	}
+	mockHandleAdd = func(_ []string) error {
+		return nil
+	}
+
+	if err := run(context.Background(), []string{"fpm", "install", "--reporter=silent", "react"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mockInstallOptions.Observer == nil || mockInstallOptions.Output != io.Discard {
+		t.Errorf("expected the silent reporter to be injected, got %T", mockInstallOptions.Observer)
+	}
+	if len(receivedPackages) != 1 || receivedPackages[0] != "react" {
+		t.Errorf("expected --reporter to be removed from the args, got %v", receivedPackages)
+	}
+
+	if err := run(context.Background(), []string{"fpm", "add", "react"}); err != nil || mockInstallOptions.Output != os.Stdout {
+		t.Errorf("expected the default reporter without --reporter, got %T %v", mockInstallOptions.Observer, err)
+	}
+	if err := run(context.Background(), []string{"fpm", "install", "--reporter", "fancy"}); err == nil || !strings.Contains(err.Error(), `unknown reporter "fancy", expected one of ci, default, json, json-lines, silent`) {
+		t.Errorf("expected an unknown reporter to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultRegistry is the public NPM registry
+const DefaultRegistry = "https://registry.npmjs.org/"
+
+// Config is the resolved set of .npmrc and .fpmrc settings fpm understands
+type Config struct {
+	Registry        string                       // registry=
+	ScopeRegistries map[string]string            // @scope:registry=, keyed by "@scope"
+	AuthTokens      map[string]string            // //host/path/:_authToken=, keyed by "//host/path/"
+	Headers         map[string]map[string]string // //host/path/:_header.<Name>=, header names to values keyed by "//host/path/"
+	StrictSSL       bool                         // strict-ssl=
+	CAFile          string                       // cafile=, FPM_CAFILE overrides it
+	Proxy           string                       // proxy=
+	HTTPSProxy      string                       // https-proxy=
+	NoProxy         string                       // noproxy=, comma separated hosts
+	ScriptShell     string                       // script-shell=, the shell lifecycle scripts run with
+	RestrictHosts   bool                         // restrict-tarball-hosts=, only follow redirects to the allowed hosts
+	TarballHosts    []string                     // tarball-hosts=, comma separated hosts allowed besides the registries, implies RestrictHosts
+	UserAgent       string                       // user-agent=, empty sends fpm/<version>
+	Abbreviated     bool                         // abbreviated-metadata=, ask registries for the smaller install-only metadata document
+	NodeLinker      string                       // node-linker=, hoisted or nested, empty is hoisted
+	SavePrefix      string                       // save-prefix=, ^ or ~ before saved versions, empty saves them exact
+}
+
+// Default returns the configuration used when no .npmrc sets anything
+func Default() *Config {
+	return &Config{
+		Registry:        DefaultRegistry,
+		ScopeRegistries: make(map[string]string),
+		AuthTokens:      make(map[string]string),
+		Headers:         make(map[string]map[string]string),
+		StrictSSL:       true,
+		Abbreviated:     true,
+	}
+}
+
+// Load reads ~/.npmrc, then the project .npmrc in projectDir and then the project .fpmrc next to it, a later file
+// wins. .fpmrc has the .npmrc syntax and holds settings only fpm reads, like registry headers, so npm never sees
+// them. NPM_CONFIG_USERCONFIG points at a different user config, like it does for npm
+func Load(projectDir string) (*Config, error) {
+	cfg := Default()
+
+	userConfig := os.Getenv("NPM_CONFIG_USERCONFIG")
+	if userConfig == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			userConfig = filepath.Join(home, ".npmrc")
+		}
+	}
+
+	for _, path := range []string{userConfig, filepath.Join(projectDir, ".npmrc"), filepath.Join(projectDir, ".fpmrc")} {
+		if path == "" {
+			continue
+		}
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if caFile := os.Getenv("FPM_CAFILE"); caFile != "" {
+		cfg.CAFile = caFile
+	}
+
+	return cfg, nil
+}
+
+// envReference matches a ${VAR} reference and the backslashes escaping it, like npm only bare $VAR is left alone
+var envReference = regexp.MustCompile(`(\\*)\$\{([^${}]+)\}`)
+
+// expandEnv replaces ${VAR} references with the variable's value and keeps those of unset variables as they are,
+// an odd number of backslashes escapes the reference
+func expandEnv(value string) string {
+	return envReference.ReplaceAllStringFunc(value, func(match string) string {
+		parts := envReference.FindStringSubmatch(match)
+		escapes, name := parts[1], parts[2]
+		if len(escapes)%2 == 1 {
+			return escapes[:len(escapes)/2] + match[len(escapes):]
+		}
+		if env, ok := os.LookupEnv(name); ok {
+			return escapes[:len(escapes)/2] + env
+		}
+		return escapes[:len(escapes)/2] + match[len(escapes):]
+	})
+}
+
+// RegistryKey normalizes a "//host/path" key to end in a slash, so it only matches URLs on that host and below
+// that path and never a host that merely starts with the same name
+func RegistryKey(key string) string {
+	if !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	return key
+}
+
+// loadFile merges the settings of one .npmrc or .fpmrc file, a missing file is not an error
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key=value", path, lineNumber)
+		}
+		key = strings.TrimSpace(key)
+		value = expandEnv(strings.Trim(strings.TrimSpace(value), `"'`))
+
+		if err := c.set(key, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return nil
+}
+
+// set applies one key, keys fpm doesn't use are ignored so existing npm setups keep working
+func (c *Config) set(key, value string) error {
+	switch {
+	case key == "registry":
+		c.Registry = value
+	case strings.HasPrefix(key, "@") && strings.HasSuffix(key, ":registry"):
+		c.ScopeRegistries[strings.TrimSuffix(key, ":registry")] = value
+	case strings.HasPrefix(key, "//") && strings.HasSuffix(key, ":_authToken"):
+		c.AuthTokens[RegistryKey(strings.TrimSuffix(key, ":_authToken"))] = value
+	case strings.HasPrefix(key, "//") && strings.Contains(key, ":_header."):
+		registry, name, _ := strings.Cut(key, ":_header.")
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			return fmt.Errorf("invalid header name in %s", key)
+		}
+		registry = RegistryKey(registry)
+		if c.Headers[registry] == nil {
+			c.Headers[registry] = make(map[string]string)
+		}
+		c.Headers[registry][textproto.CanonicalMIMEHeaderKey(name)] = value
+	case key == "strict-ssl":
+		switch value {
+		case "true":
+			c.StrictSSL = true
+		case "false":
+			c.StrictSSL = false
+		default:
+			return fmt.Errorf("invalid value for strict-ssl: %s", value)
+		}
+	case key == "cafile":
+		c.CAFile = value
+	case key == "proxy":
+		c.Proxy = value
+	case key == "https-proxy":
+		c.HTTPSProxy = value
+	case key == "noproxy":
+		c.NoProxy = value
+	case key == "script-shell":
+		c.ScriptShell = value
+	case key == "restrict-tarball-hosts":
+		switch value {
+		case "true":
+			c.RestrictHosts = true
+		case "false":
+			c.RestrictHosts = false
+		default:
+			return fmt.Errorf("invalid value for restrict-tarball-hosts: %s", value)
+		}
+	case key == "tarball-hosts":
+		c.TarballHosts = nil
+		for _, host := range strings.Split(value, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				c.TarballHosts = append(c.TarballHosts, host)
+			}
+		}
+		c.RestrictHosts = true
+	case key == "user-agent":
+		c.UserAgent = value
+	case key == "save-prefix":
+		if value != "" && value != "^" && value != "~" {
+			return fmt.Errorf("invalid value for save-prefix: %s, expected ^, ~ or nothing for exact versions", value)
+		}
+		c.SavePrefix = value
+	case key == "node-linker":
+		if value != "hoisted" && value != "nested" {
+			return fmt.Errorf("invalid value for node-linker: %s", value)
+		}
+		c.NodeLinker = value
+	case key == "abbreviated-metadata":
+		switch value {
+		case "true":
+			c.Abbreviated = true
+		case "false":
+			c.Abbreviated = false
+		default:
+			return fmt.Errorf("invalid value for abbreviated-metadata: %s", value)
+		}
+	}
+	return nil
+}
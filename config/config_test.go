@@ -0,0 +1,151 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeNpmrc(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, ".npmrc")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadMergesUserAndProjectConfig(t *testing.T) {
+	userConfig := writeNpmrc(t, t.TempDir(), `
+; user settings
+registry=https://user.example.com/
+@acme:registry=https://npm.acme.dev/
+//npm.acme.dev/:_authToken=${ACME_TOKEN}
+//npm.acme.dev/:_header.x-api-key=${ACME_TOKEN}
+strict-ssl=false
+`)
+	projectDir := t.TempDir()
+	writeNpmrc(t, projectDir, `
+# project settings win
+registry=https://project.example.com/
+proxy=http://proxy.example.com:8080
+tarball-hosts=cdn.example.com, mirror.example.com
+user-agent=fpm/{fpm-version} ci
+abbreviated-metadata=false
+node-linker=nested
+save-prefix=~
+//registry.example.com:_authToken=plain
+`)
+	t.Setenv("NPM_CONFIG_USERCONFIG", userConfig)
+	t.Setenv("ACME_TOKEN", "secret")
+
+	cfg, err := Load(projectDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.Registry != "https://project.example.com/" {
+		t.Errorf("expected the project registry to win, got %s", cfg.Registry)
+	}
+	if cfg.ScopeRegistries["@acme"] != "https://npm.acme.dev/" {
+		t.Errorf("unexpected scoped registry: %v", cfg.ScopeRegistries)
+	}
+	if cfg.AuthTokens["//npm.acme.dev/"] != "secret" {
+		t.Errorf("expected the token to be read with env expansion, got %v", cfg.AuthTokens)
+	}
+	if cfg.AuthTokens["//registry.example.com/"] != "plain" {
+		t.Errorf("expected a key without a trailing slash to be stored with one, got %v", cfg.AuthTokens)
+	}
+	if cfg.Headers["//npm.acme.dev/"]["X-Api-Key"] != "secret" {
+		t.Errorf("expected the header to be read under its canonical name, got %v", cfg.Headers)
+	}
+	if cfg.StrictSSL {
+		t.Errorf("expected strict-ssl=false")
+	}
+	if cfg.Proxy != "http://proxy.example.com:8080" {
+		t.Errorf("unexpected proxy: %s", cfg.Proxy)
+	}
+	if !cfg.RestrictHosts || len(cfg.TarballHosts) != 2 || cfg.TarballHosts[1] != "mirror.example.com" {
+		t.Errorf("expected tarball-hosts to restrict redirects to its hosts, got %v %v", cfg.RestrictHosts, cfg.TarballHosts)
+	}
+	if cfg.UserAgent != "fpm/{fpm-version} ci" || cfg.Abbreviated {
+		t.Errorf("unexpected user-agent and abbreviated-metadata: %q %v", cfg.UserAgent, cfg.Abbreviated)
+	}
+	if cfg.NodeLinker != "nested" || cfg.SavePrefix != "~" {
+		t.Errorf("expected the nested node-linker and the ~ save-prefix, got %q %q", cfg.NodeLinker, cfg.SavePrefix)
+	}
+}
+
+func TestLoadWithoutFiles(t *testing.T) {
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(t.TempDir(), "missing"))
+
+	cfg, err := Load(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Registry != DefaultRegistry || !cfg.StrictSSL || !cfg.Abbreviated {
+		t.Errorf("expected defaults, got %+v", cfg)
+	}
+}
+
+func TestLoadInvalidLine(t *testing.T) {
+	t.Setenv("NPM_CONFIG_USERCONFIG", writeNpmrc(t, t.TempDir(), "registry\n"))
+
+	if _, err := Load(t.TempDir()); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestLoadInvalidHeaderName(t *testing.T) {
+	t.Setenv("NPM_CONFIG_USERCONFIG", writeNpmrc(t, t.TempDir(), "//npm.acme.dev/:_header.X Api Key=secret\n"))
+
+	if _, err := Load(t.TempDir()); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestLoadFpmrcWinsOverNpmrc(t *testing.T) {
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(t.TempDir(), "missing-npmrc"))
+	projectDir := t.TempDir()
+	writeNpmrc(t, projectDir, "registry=https://npm.example.com/\n//npm.example.com/:_header.X-Api-Key=from-npmrc\n")
+	if err := os.WriteFile(filepath.Join(projectDir, ".fpmrc"), []byte("//npm.example.com:_header.X-Api-Key=from-fpmrc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(projectDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Registry != "https://npm.example.com/" {
+		t.Errorf("expected the .npmrc registry to be kept, got %s", cfg.Registry)
+	}
+	if got := cfg.Headers["//npm.example.com/"]["X-Api-Key"]; got != "from-fpmrc" {
+		t.Errorf("expected the .fpmrc header to win under the normalized key, got %v", cfg.Headers)
+	}
+}
+
+func TestLoadOnlyExpandsBracedEnvReferences(t *testing.T) {
+	t.Setenv("ACME_TOKEN", "secret")
+	t.Setenv("abc", "expanded")
+	t.Setenv("NPM_CONFIG_USERCONFIG", writeNpmrc(t, t.TempDir(), `
+//a.example.com/:_authToken=pa$abc$$word
+//b.example.com/:_authToken=${ACME_TOKEN}-${FPM_UNSET_TOKEN}
+//c.example.com/:_authToken=\${ACME_TOKEN}\\${ACME_TOKEN}
+`))
+
+	cfg, err := Load(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"//a.example.com/": "pa$abc$$word",
+		"//b.example.com/": "secret-${FPM_UNSET_TOKEN}",
+		"//c.example.com/": "${ACME_TOKEN}\\secret",
+	}
+	for key, token := range expected {
+		if cfg.AuthTokens[key] != token {
+			t.Errorf("expected %s to have the token %q, got %q", key, token, cfg.AuthTokens[key])
+		}
+	}
+}
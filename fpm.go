@@ -0,0 +1,48 @@
+// Package fpm installs npm packages from Go programs, the same way the fpm command does
+package fpm
+
+import (
+	"context"
+	"io"
+
+	"github.com/dominikbraun/graph"
+	"github.com/jamesjellow/fpm/handlers"
+	"github.com/jamesjellow/fpm/utils"
+)
+
+// Result is what an install put in node_modules
+type Result = utils.InstallResult
+
+// Observer is told about each package as it installs, embed utils.NopObserver to implement only some events
+type Observer = utils.Observer
+
+// Options configure an install, each field does what the command line flag noted on it does. The zero value
+// installs the project in the working directory like `fpm install`, a nil Observer tells nothing and a nil Output
+// prints nothing
+type Options = handlers.Options
+
+// Install installs the dependencies of the project in opts.Dir, or packages like Add does, and returns what was
+// installed. Cancelling ctx stops the install and removes what it added. Each install gets its own registry
+// client, so installs with different options can run at once
+func Install(ctx context.Context, opts Options, packages ...string) (*Result, error) {
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	return handlers.RunInstall(ctx, packages, quiet(opts), &depGraph)
+}
+
+// Add installs specs, package names with an optional version range or dist-tag like left-pad@^1.3.0, saves them
+// to the project's package.json and returns what was installed
+func Add(ctx context.Context, opts Options, specs ...string) (*Result, error) {
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	return handlers.RunAdd(ctx, specs, quiet(opts), &depGraph)
+}
+
+// Keep an install that wasn't given an observer or output from printing
+func quiet(opts Options) Options {
+	if opts.Observer == nil {
+		opts.Observer = utils.NopObserver{}
+	}
+	if opts.Output == nil {
+		opts.Output = io.Discard
+	}
+	return opts
+}
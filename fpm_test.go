@@ -0,0 +1,131 @@
+package fpm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jamesjellow/fpm/internal/fpmtest"
+	"github.com/jamesjellow/fpm/utils"
+)
+
+// Record the packages an install reports as installed
+type installedObserver struct {
+	utils.NopObserver
+	mu        sync.Mutex
+	installed []string
+}
+
+func (o *installedObserver) OnInstalled(name, version string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.installed = append(o.installed, name+"@"+version)
+}
+
+func TestAddAndInstall(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	dir := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(dir, "missing-npmrc"))
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(`{"name": "app"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	observer := &installedObserver{}
+	var output bytes.Buffer
+	result, err := Add(context.Background(), Options{Dir: dir, Registry: registry.URL, Dev: true, Observer: observer, Output: &output}, "left-pad@^1.0.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Packages) != 1 || result.Packages[0].Version != "1.3.0" {
+		t.Errorf("expected left-pad@1.3.0 to be added, got %+v", result.Packages)
+	}
+	if len(observer.installed) != 1 || observer.installed[0] != "left-pad@1.3.0" {
+		t.Errorf("expected the observer to be told about left-pad, got %v", observer.installed)
+	}
+	if !strings.Contains(output.String(), "left-pad") {
+		t.Errorf("expected the install to print to Output, got %q", output.String())
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packageJson struct {
+		DevDependencies map[string]string `json:"devDependencies"`
+	}
+	if err := json.Unmarshal(content, &packageJson); err != nil || packageJson.DevDependencies["left-pad"] == "" {
+		t.Errorf("expected left-pad in devDependencies, got %s", content)
+	}
+
+	// Production leaves the dev dependency out
+	nodeModulesDir := filepath.Join(t.TempDir(), "modules")
+	if result, err = Install(context.Background(), Options{Dir: dir, NodeModulesDir: nodeModulesDir, Registry: registry.URL, Production: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Packages) != 0 {
+		t.Errorf("expected no production packages, got %+v", result.Packages)
+	}
+
+	// Everything the first install fetched is cached, so the registry isn't needed
+	registry.Close()
+	if result, err = Install(context.Background(), Options{Dir: dir, NodeModulesDir: nodeModulesDir, Registry: registry.URL, Offline: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Packages) != 1 {
+		t.Errorf("expected left-pad to install from the cache, got %+v", result.Packages)
+	}
+	if _, err := os.Stat(filepath.Join(nodeModulesDir, "left-pad", "package.json")); err != nil {
+		t.Errorf("expected left-pad in NodeModulesDir: %v", err)
+	}
+}
+
+func TestInstallOfflineWithoutCache(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	dir := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(dir, "missing-npmrc"))
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(`{"name": "app", "dependencies": {"left-pad": "^1.0.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Install(context.Background(), Options{Dir: dir, Registry: registry.URL, Offline: true})
+	if err == nil || !strings.Contains(err.Error(), "offline") {
+		t.Errorf("expected the uncached install to fail offline, got %v", err)
+	}
+}
+
+func TestInstallsRunAtOnce(t *testing.T) {
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(t.TempDir(), "missing-npmrc"))
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	online := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	offline := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	offline.Close()
+
+	// An offline install with an empty cache runs alongside one that fetches, neither sees the other's settings
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, opts := range []Options{{Registry: online.URL}, {Registry: offline.URL, Offline: true}} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(`{"name": "app"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		opts.Dir = dir
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = Add(context.Background(), opts, "left-pad@^1.0.0")
+		}()
+	}
+	wg.Wait()
+	if errs[0] != nil {
+		t.Errorf("unexpected error: %v", errs[0])
+	}
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), "offline") {
+		t.Errorf("expected the offline install to fail, got %v", errs[1])
+	}
+}
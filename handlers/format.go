@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/jamesjellow/fpm/utils"
+)
+
+// ANSI colors the reporting commands use for a row
+const (
+	colorNone   = ""
+	colorGreen  = "\033[32m" // Up to date
+	colorYellow = "\033[33m" // A minor or patch update is available
+	colorRed    = "\033[31m" // A major update is available, or the package is missing
+	colorReset  = "\033[0m"
+)
+
+// reportTable collects rows of a report and prints them in aligned columns, each row in its own color
+type reportTable struct {
+	rows   [][]string
+	colors []string
+}
+
+func (t *reportTable) add(color string, cells ...string) {
+	t.rows = append(t.rows, cells)
+	t.colors = append(t.colors, color)
+}
+
+// Print the rows aligned by tabwriter. Colors are applied to whole lines afterwards, escape codes inside the
+// cells would throw off the column widths
+func (t *reportTable) print(out io.Writer, useColor bool) error {
+	var buffer bytes.Buffer
+	writer := tabwriter.NewWriter(&buffer, 0, 0, 2, ' ', 0)
+	for _, row := range t.rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " ")
+		if useColor && t.colors[i] != colorNone {
+			line = t.colors[i] + line + colorReset
+		}
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decide whether to color output: not with --no-color, when NO_COLOR is set or when out isn't a terminal
+func colorEnabled(out *os.File, noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := out.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Pick the color for a package at current whose newest version is latest
+func updateColor(current, latest string) string {
+	currentVersion, err := semver.NewVersion(current)
+	if err != nil {
+		return colorRed
+	}
+	latestVersion, err := semver.NewVersion(latest)
+	if err != nil {
+		return colorNone
+	}
+	switch {
+	case !currentVersion.LessThan(latestVersion):
+		return colorGreen
+	case currentVersion.Major() == latestVersion.Major():
+		return colorYellow
+	default:
+		return colorRed
+	}
+}
+
+// defaultTimingLimit is how many packages --timing lists without a number
+const defaultTimingLimit = 10
+
+// Print the limit slowest packages of an install with the time each phase took
+func printTimings(out io.Writer, timings []utils.PackageTiming, limit int) error {
+	if len(timings) == 0 {
+		return nil
+	}
+	if len(timings) > limit {
+		timings = timings[:limit]
+	}
+
+	fmt.Fprintf(out, "\nSlowest %d package(s):\n", len(timings))
+	table := &reportTable{}
+	table.add(colorNone, "Package", "Total", "Resolve", "Download", "Extract")
+	for _, timing := range timings {
+		table.add(colorNone, timing.Name+"@"+timing.Version, formatDuration(timing.Total()), formatDuration(timing.Resolve), formatDuration(timing.Download), formatDuration(timing.Extract))
+	}
+	return table.print(out, false)
+}
+
+// Round a duration to the millisecond, finer detail is noise in a report
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
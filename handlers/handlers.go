@@ -1,84 +1,805 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dominikbraun/graph"
+	"github.com/iancoleman/orderedmap"
+	"github.com/jamesjellow/fpm/config"
+	"github.com/jamesjellow/fpm/pkgmanager"
 	"github.com/jamesjellow/fpm/utils"
 )
 
 type HandlerInterface interface {
-	HandleAdd(args []string, depGraph *graph.Graph[string, string]) error
-	HandleInstall(depGraph *graph.Graph[string, string]) error
+	HandleWhy(args []string, depGraph *graph.Graph[string, string]) error
+	HandleCache(args []string) error
+	HandleAudit(ctx context.Context, args []string) error
+	HandleDedupe(args []string) error
+	HandleList(args []string) error
+	HandleOutdated(ctx context.Context, args []string) error
+	HandleView(ctx context.Context, args []string) error
+	HandlePrune(args []string, depGraph *graph.Graph[string, string]) error
+	HandleVerify(args []string) error
+	HandleRun(ctx context.Context, args []string) error
+	HandleLink(args []string) error
 }
 
 type RealHandlers struct{}
 
-func (h RealHandlers) HandleAdd(args []string, depGraph *graph.Graph[string, string]) error {
-	return HandleAdd(args, depGraph)
+func (h RealHandlers) HandleWhy(args []string, depGraph *graph.Graph[string, string]) error {
+	return HandleWhy(args, depGraph)
 }
 
-func (h RealHandlers) HandleInstall(depGraph *graph.Graph[string, string]) error {
-	return HandleInstall(depGraph)
+func (h RealHandlers) HandleCache(args []string) error {
+	return HandleCache(args)
 }
 
-var PackageJsonPath = "./package.json"
+func (h RealHandlers) HandleAudit(ctx context.Context, args []string) error {
+	return HandleAudit(ctx, args)
+}
 
-func HandleAdd(args []string, depGraph *graph.Graph[string, string]) error {
-	if len(args) < 3 {
-		return fmt.Errorf("expected package name after 'add'")
+func (h RealHandlers) HandleDedupe(args []string) error {
+	return HandleDedupe(args)
+}
+
+func (h RealHandlers) HandleList(args []string) error {
+	return HandleList(args)
+}
+
+func (h RealHandlers) HandleOutdated(ctx context.Context, args []string) error {
+	return HandleOutdated(ctx, args)
+}
+
+func (h RealHandlers) HandleView(ctx context.Context, args []string) error {
+	return HandleView(ctx, args)
+}
+
+func (h RealHandlers) HandlePrune(args []string, depGraph *graph.Graph[string, string]) error {
+	return HandlePrune(args, depGraph)
+}
+
+func (h RealHandlers) HandleVerify(args []string) error {
+	return HandleVerify(args)
+}
+
+func (h RealHandlers) HandleRun(ctx context.Context, args []string) error {
+	return HandleRun(ctx, args)
+}
+
+func (h RealHandlers) HandleLink(args []string) error {
+	return HandleLink(args)
+}
+
+// The package.json of a project in the working directory
+const defaultPackageJsonPath = "./package.json"
+
+// Create an install context for the given node_modules directory configured from the project and user .npmrc,
+// with the options taking precedence. The install's client gets its own proxy, TLS, auth, rate limit, metadata
+// mirror and offline settings, so installs with different options don't share them
+func newInstallContext(ctx context.Context, nodeModulesDir string, opts Options) (*utils.InstallContext, error) {
+	cfg, err := config.Load(filepath.Dir(opts.packageJsonPath()))
+	if err != nil {
+		return nil, err
+	}
+	if opts.Insecure {
+		cfg.StrictSSL = false
+	}
+	if opts.Registry != "" {
+		cfg.Registry = opts.Registry
+	}
+	client, err := pkgmanager.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client.Limiter = pkgmanager.NewRateLimiter(opts.MaxRate)
+	client.MetadataDir = opts.MetadataDir
+	client.Offline = opts.Offline
+
+	installCtx := utils.NewInstallContext(nodeModulesDir)
+	installCtx.Context = ctx
+	installCtx.Registry = cfg.Registry
+	installCtx.Client = client
+	installCtx.ScopeRegistries = cfg.ScopeRegistries
+	installCtx.ScriptShell = cfg.ScriptShell
+	installCtx.SavePrefix = cfg.SavePrefix
+	if installCtx.Layout, err = utils.ParseLayout(cfg.NodeLinker); err != nil {
+		return nil, err
+	}
+	if opts.Observer != nil {
+		installCtx.Observer = opts.Observer
 	}
+	opts.apply(installCtx)
+	if opts.Output != nil {
+		installCtx.Output = opts.Output
+	} else if reporter, ok := opts.Observer.(Reporter); ok {
+		installCtx.Output = reporter.Progress()
+	}
+	return installCtx, nil
+}
+
+// Options are the settings of an install, what the flags of `fpm install` and `fpm add` set. The zero value
+// installs the project found from the working directory like `fpm install` does
+type Options struct {
+	Dir            string             // --prefix=<dir>: the project root to install, empty finds it from the working directory
+	PackageJson    string             // -f, --package-json=<path>: the manifest to install, node_modules goes next to it
+	NodeModulesDir string             // --modules-dir=<dir>: where packages are installed, empty is node_modules next to package.json
+	Registry       string             // --registry=<url>: the registry of unscoped packages, empty uses the one from .npmrc
+	Concurrency    int                // --concurrency=<n>: how many top-level packages install at once, 0 keeps the default
+	Offline        bool               // --offline: install from the cache only, nothing is fetched from the network
+	MetadataDir    string             // --metadata-dir=<dir>: resolve against the metadata documents in dir instead of the registry
+	MaxRate        int64              // --max-rate=<bytes/s>: cap the combined download rate, 0 is unlimited
+	NoBail         bool               // --no-bail: install everything possible and report all failures at the end
+	MaxDepth       int                // --max-depth=<n>: how deep the dependency tree may go, 0 keeps the default
+	Insecure       bool               // --insecure: skip TLS certificate verification, same as strict-ssl=false
+	RunScripts     bool               // --run-scripts: run lifecycle scripts of installed packages, --ignore-scripts is the default
+	JSON           bool               // --json: print the result as JSON, progress messages go to stderr
+	JSONLines      bool               // --json-lines: stream every install event as a line of JSON
+	Peers          utils.PeerStrategy // --peer-deps=<strategy>, --legacy-peer-deps or --strict-peer-deps, empty keeps strict
+	TempDir        string             // --tmpdir=<dir>: where tarballs are staged, empty uses FPM_TMPDIR or the system's
+	Tag            string             // --tag=<tag>: the dist-tag packages given without a version resolve to, empty is latest
+	Before         time.Time          // --before=<date>: resolve to versions published before the date, zero allows every version
+	Timing         int                // --timing[=<n>]: list the n slowest packages once the install finishes, 0 lists none
+	EngineStrict   bool               // --engine-strict: fail packages whose engines.node excludes this Node.js
+	IgnoreEngines  bool               // --ignore-engines: don't check engines.node, without either mismatches are reported at the end
+	Layout         utils.Layout       // --node-linker=<layout> or --legacy-bundling, empty uses node-linker from .npmrc
+	RecordFiles    bool               // --record-files: hash every installed file into the manifest for `fpm verify --files`
+
+	Production       bool // install --production: skip devDependencies
+	Check            bool // install --check: compare package.json with its lockfile instead of installing
+	Repair           bool // install --repair: remove what an interrupted install left broken before installing
+	CheckFiles       bool // install --check-files: re-extract the packages whose files differ from their recorded hashes
+	UpgradeIntegrity bool // install --upgrade-integrity: record the sha512 integrity of every package in the manifest
 
-	// Parse the second arg "package@version"
-	packageName, packageVersion := utils.ParsePackageArg(args[2])
-	forDevDependency := len(args) == 4 && args[3] == "-D"
+	Dev    bool // add -D, --save-dev or --dev: save to devDependencies
+	Exact  bool // add -E or --save-exact: save the exact resolved version
+	Global bool // add -g: install into the global prefix and link bins, package.json is untouched
+	NoSave bool // add --no-save: install into node_modules without recording the packages in package.json
+	Bundle bool // add -B, --bundle or --save-bundle: also list the packages in bundledDependencies
 
-	// Ensure package.json exists
-	if _, err := os.Stat(PackageJsonPath); os.IsNotExist(err) {
-		return fmt.Errorf("package.json not found")
+	Observer utils.Observer // Told about each package as it installs, nil tells nothing
+	Output   io.Writer      // Where the install prints a line for each package, nil is stdout, or stderr with JSON
+}
+
+// Parse a flag shared by add and install, returns false when the arg isn't one of them
+func parseEngineFlag(arg string, opts *Options) (bool, error) {
+	switch {
+	case arg == "--bail":
+		opts.NoBail = false
+	case arg == "--no-bail":
+		opts.NoBail = true
+	case arg == "--insecure":
+		opts.Insecure = true
+	case arg == "--run-scripts":
+		opts.RunScripts = true
+	case arg == "--ignore-scripts":
+		opts.RunScripts = false
+	case arg == "--json":
+		opts.JSON = true
+	case arg == "--json-lines":
+		opts.JSONLines = true
+	case arg == "--legacy-peer-deps":
+		opts.Peers = utils.PeerLegacy
+	case arg == "--strict-peer-deps":
+		opts.Peers = utils.PeerStrict
+	case arg == "--legacy-bundling":
+		// What npm called the nested layout before it dropped it
+		opts.Layout = utils.LayoutNested
+	case arg == "--record-files":
+		opts.RecordFiles = true
+	case arg == "--offline":
+		opts.Offline = true
+	case arg == "--engine-strict":
+		opts.EngineStrict, opts.IgnoreEngines = true, false
+	case arg == "--ignore-engines":
+		opts.EngineStrict, opts.IgnoreEngines = false, true
+	case arg == "--timing":
+		opts.Timing = defaultTimingLimit
+	case strings.HasPrefix(arg, "--timing="):
+		limit, err := strconv.Atoi(strings.TrimPrefix(arg, "--timing="))
+		if err != nil || limit < 1 {
+			return true, fmt.Errorf("invalid value for --timing: %s", strings.TrimPrefix(arg, "--timing="))
+		}
+		opts.Timing = limit
+	case strings.HasPrefix(arg, "--max-rate="):
+		rate, err := parseByteSize(strings.TrimPrefix(arg, "--max-rate="))
+		if err != nil || rate < 1 {
+			return true, fmt.Errorf("invalid value for --max-rate: %s", strings.TrimPrefix(arg, "--max-rate="))
+		}
+		opts.MaxRate = rate
+	case strings.HasPrefix(arg, "--prefix="):
+		opts.Dir = strings.TrimPrefix(arg, "--prefix=")
+		if opts.Dir == "" {
+			return true, fmt.Errorf("expected a directory after --prefix")
+		}
+	case strings.HasPrefix(arg, "--registry="):
+		opts.Registry = strings.TrimPrefix(arg, "--registry=")
+		if opts.Registry == "" {
+			return true, fmt.Errorf("expected a URL after --registry")
+		}
+	case strings.HasPrefix(arg, "--modules-dir="):
+		opts.NodeModulesDir = strings.TrimPrefix(arg, "--modules-dir=")
+		if opts.NodeModulesDir == "" {
+			return true, fmt.Errorf("expected a directory after --modules-dir")
+		}
+	case strings.HasPrefix(arg, "--concurrency="):
+		concurrency, err := strconv.Atoi(strings.TrimPrefix(arg, "--concurrency="))
+		if err != nil || concurrency < 1 {
+			return true, fmt.Errorf("invalid value for --concurrency: %s", strings.TrimPrefix(arg, "--concurrency="))
+		}
+		opts.Concurrency = concurrency
+	case strings.HasPrefix(arg, "--tmpdir="):
+		opts.TempDir = strings.TrimPrefix(arg, "--tmpdir=")
+		if opts.TempDir == "" {
+			return true, fmt.Errorf("expected a directory after --tmpdir")
+		}
+	case strings.HasPrefix(arg, "--metadata-dir="):
+		opts.MetadataDir = strings.TrimPrefix(arg, "--metadata-dir=")
+		if opts.MetadataDir == "" {
+			return true, fmt.Errorf("expected a directory after --metadata-dir")
+		}
+	case strings.HasPrefix(arg, "--tag="):
+		opts.Tag = strings.TrimPrefix(arg, "--tag=")
+		if opts.Tag == "" {
+			return true, fmt.Errorf("expected a dist-tag after --tag")
+		}
+	case strings.HasPrefix(arg, "--before="):
+		before, err := parseDate(strings.TrimPrefix(arg, "--before="))
+		if err != nil {
+			return true, fmt.Errorf("invalid value for --before: %s, expected a date like 2023-01-01", strings.TrimPrefix(arg, "--before="))
+		}
+		opts.Before = before
+	case strings.HasPrefix(arg, "--package-json=") || strings.HasPrefix(arg, "-f="):
+		opts.PackageJson = arg[strings.Index(arg, "=")+1:]
+		if opts.PackageJson == "" {
+			return true, fmt.Errorf("expected a path after --package-json")
+		}
+	case strings.HasPrefix(arg, "--node-linker="):
+		layout, err := utils.ParseLayout(strings.TrimPrefix(arg, "--node-linker="))
+		if err != nil {
+			return true, err
+		}
+		opts.Layout = layout
+	case strings.HasPrefix(arg, "--peer-deps="):
+		strategy, err := utils.ParsePeerStrategy(strings.TrimPrefix(arg, "--peer-deps="))
+		if err != nil {
+			return true, err
+		}
+		opts.Peers = strategy
+	case strings.HasPrefix(arg, "--max-depth="):
+		maxDepth, err := strconv.Atoi(strings.TrimPrefix(arg, "--max-depth="))
+		if err != nil || maxDepth < 1 {
+			return true, fmt.Errorf("invalid value for --max-depth: %s", strings.TrimPrefix(arg, "--max-depth="))
+		}
+		opts.MaxDepth = maxDepth
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Parse a date such as 2023-01-01, which is midnight UTC, or a full RFC 3339 timestamp
+func parseDate(value string) (time.Time, error) {
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
 	}
+	return time.Parse(time.RFC3339, value)
+}
 
-	// Ensure the node_modules directory exists
-	if err := os.MkdirAll(utils.NodeModulesDir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create node_modules directory: %v", err)
+// Parse a byte count such as 500000, 500k or 2m, k and m are multiples of 1024
+func parseByteSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch lower := strings.ToLower(value); {
+	case strings.HasSuffix(lower, "k"):
+		multiplier, value = 1024, value[:len(value)-1]
+	case strings.HasSuffix(lower, "m"):
+		multiplier, value = 1024*1024, value[:len(value)-1]
 	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * multiplier, nil
+}
 
-	// Install the package
-	actualVersion, err := utils.RunInstallPackage(packageName, packageVersion, depGraph, forDevDependency)
+// Point the options at the project found from the working directory when --prefix isn't given, so commands
+// work from any subdirectory of it. A project in the working directory itself keeps the relative default paths
+func (o *Options) locateProject() error {
+	if o.Dir != "" && o.PackageJson != "" {
+		return fmt.Errorf("--prefix and --package-json both choose the project, pass only one of them")
+	}
+	if o.Dir != "" || o.PackageJson != "" {
+		return nil
+	}
+	root, err := utils.FindProjectRoot(".")
 	if err != nil {
 		return err
 	}
+	if wd, err := filepath.Abs("."); err == nil && wd == root {
+		return nil
+	}
+	o.Dir = root
+	return nil
+}
+
+// Find the project of a command that has no flags of its own for it, see locateProject
+func findProject() (Options, error) {
+	var opts Options
+	err := opts.locateProject()
+	return opts, err
+}
+
+// Get the package.json of the project being installed
+func (o Options) packageJsonPath() string {
+	switch {
+	case o.PackageJson != "":
+		return o.PackageJson
+	case o.Dir != "":
+		return filepath.Join(o.Dir, "package.json")
+	default:
+		return defaultPackageJsonPath
+	}
+}
+
+// Get the node_modules of the project being installed
+func (o Options) nodeModulesPath() string {
+	switch {
+	case o.NodeModulesDir != "":
+		return o.NodeModulesDir
+	case o.PackageJson != "":
+		return filepath.Join(filepath.Dir(o.PackageJson), "node_modules")
+	case o.Dir != "":
+		return filepath.Join(o.Dir, "node_modules")
+	default:
+		return utils.DefaultNodeModulesDir
+	}
+}
+
+// Turn flags given as two args, like `--prefix dir`, into the `--prefix=dir` form the parsers read
+func joinFlagValues(args []string, flags ...string) []string {
+	joined := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		for _, flag := range flags {
+			if arg == flag && i+1 < len(args) {
+				i++
+				arg = flag + "=" + args[i]
+				break
+			}
+		}
+		joined = append(joined, arg)
+	}
+	return joined
+}
+
+// Apply the shared flags to an install context
+func (o Options) apply(installCtx *utils.InstallContext) {
+	installCtx.Bail = !o.NoBail
+	installCtx.RunScripts = o.RunScripts
+	installCtx.Timing = o.Timing > 0
+	installCtx.RecordFiles = o.RecordFiles
+	installCtx.EngineStrict = o.EngineStrict
+	installCtx.IgnoreEngines = o.IgnoreEngines
+	if o.JSON {
+		installCtx.Output = os.Stderr
+	}
+	if o.Peers != "" {
+		installCtx.PeerStrategy = o.Peers
+	}
+	if o.Layout != "" {
+		installCtx.Layout = o.Layout
+	}
+	if o.TempDir != "" {
+		installCtx.TempDir = o.TempDir
+	}
+	installCtx.Before = o.Before
+	if o.MaxDepth > 0 {
+		installCtx.MaxDepth = o.MaxDepth
+	}
+	if o.Concurrency > 0 {
+		installCtx.Concurrency = o.Concurrency
+	}
+}
+
+// Add installs and saves the packages listed in args, the args after `add` on the command line,
+// and returns what was installed. observer, when not nil, is told about each package as it installs.
+// Cancelling ctx stops the install
+func Add(ctx context.Context, args []string, depGraph *graph.Graph[string, string], observer utils.Observer) (*utils.InstallResult, error) {
+	specs, opts, err := ParseAddArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	opts.Observer = observer
+	return RunAdd(ctx, specs, opts, depGraph)
+}
+
+// RunAdd installs and saves specs, package names with an optional version range or dist-tag, like Add does with
+// the settings of opts instead of command line args
+func RunAdd(ctx context.Context, specs []string, opts Options, depGraph *graph.Graph[string, string]) (*utils.InstallResult, error) {
+	if err := opts.checkAdd(specs); err != nil {
+		return nil, err
+	}
+	return installAndSave(ctx, specs, depGraph, opts)
+}
+
+// Print how many packages an install put on disk
+func printSummary(result *utils.InstallResult) {
+	dev := 0
+	for _, pkg := range result.Packages {
+		if pkg.Dev {
+			dev++
+		}
+	}
+	fmt.Printf("added %d packages (%d dev)\n", len(result.Packages), dev)
+}
+
+// installReport is what `add --json` and `install --json` print
+type installReport struct {
+	Added     []utils.ResolvedPackage `json:"added"`
+	ElapsedMs int64                   `json:"elapsedMs"`
+	Errors    []string                `json:"errors"`
+}
+
+// Print the result of an install, and its errors, as JSON on stdout. err is returned so the exit code still reflects it
+func printJSONReport(result *utils.InstallResult, err error, elapsed time.Duration) error {
+	report := installReport{Added: []utils.ResolvedPackage{}, ElapsedMs: elapsed.Milliseconds(), Errors: []string{}}
+	if result != nil {
+		report.Added = result.Packages
+	}
+
+	var failures installFailures
+	switch {
+	case errors.As(err, &failures):
+		for _, failure := range failures {
+			report.Errors = append(report.Errors, failure.Error())
+		}
+	case err != nil:
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	data, marshalErr := json.MarshalIndent(report, "", "  ")
+	if marshalErr != nil {
+		return fmt.Errorf("failed to encode install result: %v", marshalErr)
+	}
+	fmt.Println(string(data))
+	return err
+}
 
-	// Update the package.json file with the new dependency
-	if err = utils.UpdatePackageJson(PackageJsonPath, map[string]string{packageName: actualVersion}, forDevDependency); err != nil {
-		return fmt.Errorf("failed to update package.json: %v", err)
+// ParseAddArgs splits the args after `add` into package specs and the options their flags set, flags may appear
+// in any position
+func ParseAddArgs(args []string) ([]string, Options, error) {
+	var specs []string
+	var opts Options
+
+	for _, arg := range joinFlagValues(args, "--prefix", "--package-json", "-f", "--tmpdir", "--metadata-dir", "--tag", "--before", "--registry", "--modules-dir") {
+		switch arg {
+		case "-D", "--save-dev", "--dev":
+			opts.Dev = true
+		case "-E", "--save-exact":
+			opts.Exact = true
+		case "-g":
+			opts.Global = true
+		case "--no-save":
+			opts.NoSave = true
+		case "--bundle", "--save-bundle", "-B":
+			opts.Bundle = true
+		default:
+			if ok, err := parseEngineFlag(arg, &opts); ok || err != nil {
+				if err != nil {
+					return nil, opts, err
+				}
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				return nil, opts, fmt.Errorf("unknown flag for 'add': %s", arg)
+			}
+			specs = append(specs, arg)
+		}
+	}
 
+	if err := opts.checkAdd(specs); err != nil {
+		return nil, opts, err
 	}
+	return specs, opts, nil
+}
 
+// Check that an add has packages to add and options that work together
+func (o Options) checkAdd(specs []string) error {
+	if len(specs) == 0 {
+		return fmt.Errorf("expected package name after 'add'")
+	}
+	if o.Bundle && (o.NoSave || o.Global) {
+		return fmt.Errorf("--bundle records the packages in package.json, it doesn't work with --no-save or -g")
+	}
 	return nil
 }
 
-func HandleInstall(depGraph *graph.Graph[string, string]) error {
+// Install installs the project dependencies, or the packages listed in args like `add` does, and returns what
+// was installed. args are the args after `install` on the command line, ctx and observer work like they do for Add
+func Install(ctx context.Context, args []string, depGraph *graph.Graph[string, string], observer utils.Observer) (*utils.InstallResult, error) {
+	packages, opts, err := ParseInstallArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	opts.Observer = observer
+	return RunInstall(ctx, packages, opts, depGraph)
+}
+
+// RunInstall installs the project dependencies, or packages like RunAdd does, like Install does with the settings
+// of opts instead of command line args
+func RunInstall(ctx context.Context, packages []string, opts Options, depGraph *graph.Graph[string, string]) (_ *utils.InstallResult, err error) {
+	if err := opts.locateProject(); err != nil {
+		return nil, err
+	}
+
+	if opts.Check {
+		if len(packages) > 0 {
+			return nil, fmt.Errorf("--check compares package.json with its lockfile and doesn't take package names")
+		}
+		out := os.Stdout
+		if opts.JSON {
+			out = os.Stderr
+		}
+		return &utils.InstallResult{}, checkLockfile(out, opts.packageJsonPath())
+	}
+
+	// Explicit packages behave like `add` for each of them
+	if len(packages) > 0 {
+		if opts.Repair {
+			return nil, fmt.Errorf("--repair reinstalls what is broken in the project and doesn't take package names")
+		}
+		if opts.CheckFiles {
+			return nil, fmt.Errorf("--check-files re-extracts the project's changed packages and doesn't take package names")
+		}
+		if opts.UpgradeIntegrity {
+			return nil, fmt.Errorf("--upgrade-integrity upgrades the whole project's manifest and doesn't take package names")
+		}
+		return installAndSave(ctx, packages, depGraph, opts)
+	}
+
 	// Get the packageJSON  into a map
-	packageJSON, err := utils.ParsePackageJson(PackageJsonPath)
+	packageJSON, err := utils.ParsePackageJson(opts.packageJsonPath())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Ensure the node_modules directory exists
-	if err := os.MkdirAll(utils.NodeModulesDir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create node_modules directory: %v", err)
+	installCtx, err := newInstallContext(ctx, opts.nodeModulesPath(), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { removeCancelledInstall(installCtx, err) }()
+	if installCtx.Overrides, err = utils.ParseOverrides(packageJSON); err != nil {
+		return nil, err
+	}
+
+	// On the first install of a project another package manager set up, keep the versions its lockfile pinned
+	if manifest, err := utils.ReadManifest(installCtx); err == nil && manifest == nil {
+		pins, err := utils.ImportLockfile(filepath.Dir(opts.packageJsonPath()))
+		if err != nil {
+			return nil, err
+		}
+		if pins != nil {
+			fmt.Fprintf(installCtx.Output, "Importing %d pinned versions from %s\n", len(pins.Packages), pins.Source)
+			installCtx.Pins = pins
+		}
+	}
+
+	if err := pkgmanager.EnsureDir(installCtx.NodeModulesDir); err != nil {
+		return nil, fmt.Errorf("failed to create node_modules directory: %w", err)
+	}
+	installCtx.UpgradeSHA512 = opts.UpgradeIntegrity
+
+	// Remove what an interrupted install left broken, everything else is kept so only those are installed again
+	var repaired []utils.RepairedPackage
+	if opts.Repair {
+		installCtx.Repair = true
+		if repaired, err = utils.RepairInstall(installCtx); err != nil {
+			return nil, err
+		}
+		for _, pkg := range repaired {
+			fmt.Fprintf(installCtx.Output, "✘ Removed %s, %s\n", pkg.Path, pkg.Problem)
+		}
+	}
+
+	// Remove the packages whose files changed, the install extracts them again and hashes them anew
+	checked, changed := 0, []utils.RepairedPackage(nil)
+	if opts.CheckFiles {
+		if checked, changed, err = utils.CheckFiles(installCtx); err != nil {
+			return nil, err
+		}
+		if checked == 0 {
+			return nil, fmt.Errorf("no file hashes in %s, install with --record-files first", utils.ManifestFile)
+		}
+		installCtx.Repair = true
+		installCtx.RecordFiles = true
+		for _, pkg := range changed {
+			fmt.Fprintf(installCtx.Output, "✘ Removed %s, %s\n", pkg.Path, pkg.Problem)
+		}
+	}
+
+	// Link workspace members first so dependencies between members resolve to them
+	workspaces, err := utils.FindWorkspaces(opts.packageJsonPath(), packageJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.LinkWorkspaces(installCtx, workspaces); err != nil {
+		return nil, err
+	}
+
+	workspaceNames := make(map[string]bool)
+	for _, workspace := range workspaces {
+		workspaceNames[workspace.Name] = true
+	}
+
+	// Install the root dependencies, then each member's into the hoisted root node_modules
+	if err := installDependencies(installCtx, packageJSON, depGraph, workspaceNames, opts.Production); err != nil {
+		return nil, err
+	}
+	for _, workspace := range workspaces {
+		memberJSON, err := utils.ParsePackageJson(workspace.PackageJsonPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := installDependencies(installCtx, memberJSON, depGraph, workspaceNames, opts.Production); err != nil {
+			return nil, err
+		}
+	}
+	if err := utils.CheckPeerDependencies(installCtx, depGraph); err != nil {
+		return installCtx.Result(), err
+	}
+
+	if err := failuresError(installCtx); err != nil {
+		return installCtx.Result(), err
+	}
+	if err := checkGraphOnDisk(installCtx, depGraph); err != nil {
+		return installCtx.Result(), err
+	}
+	if err := utils.WriteManifest(installCtx, installCtx.Result()); err != nil {
+		return installCtx.Result(), err
+	}
+
+	if len(repaired) > 0 {
+		fmt.Fprintf(installCtx.Output, "✔ Repaired %d broken package(s)\n", len(repaired))
+	}
+	if opts.CheckFiles {
+		fmt.Fprintf(installCtx.Output, "✔ Checked the files of %d package(s), re-extracted %d\n", checked, len(changed))
+	}
+	if opts.Production {
+		fmt.Fprintln(installCtx.Output, "✔ All production packages installed successfully")
+	} else {
+		fmt.Fprintln(installCtx.Output, "✔ All packages installed successfully")
+	}
+	return installCtx.Result(), nil
+}
+
+// Remove what a failed install added once it was cancelled or timed out, its packages may be missing dependencies
+func removeCancelledInstall(installCtx *utils.InstallContext, err error) {
+	if err == nil || installCtx.Context.Err() == nil {
+		return
+	}
+	for _, pkg := range utils.RemoveInstalled(installCtx, installCtx.Result()) {
+		fmt.Fprintf(installCtx.Output, "✘ Removed %s@%s, the install didn't finish\n", pkg.Name, pkg.Version)
+	}
+}
+
+// ParseInstallArgs splits the args after `install` into package specs and the options their flags set
+func ParseInstallArgs(args []string) ([]string, Options, error) {
+	var specs []string
+	var opts Options
+
+	for _, arg := range joinFlagValues(args, "--prefix", "--package-json", "-f", "--tmpdir", "--metadata-dir", "--tag", "--before", "--registry", "--modules-dir") {
+		switch arg {
+		case "--production":
+			opts.Production = true
+		case "--check":
+			opts.Check = true
+		case "--repair":
+			opts.Repair = true
+		case "--check-files":
+			opts.CheckFiles = true
+		case "--upgrade-integrity":
+			opts.UpgradeIntegrity = true
+		default:
+			if ok, err := parseEngineFlag(arg, &opts); ok || err != nil {
+				if err != nil {
+					return nil, opts, err
+				}
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				return nil, opts, fmt.Errorf("unknown flag for 'install': %s", arg)
+			}
+			specs = append(specs, arg)
+		}
+	}
+
+	return specs, opts, nil
+}
+
+// Turn the failures that were logged and skipped during an install into a single error, after printing any warnings
+func failuresError(installCtx *utils.InstallContext) error {
+	for _, warning := range installCtx.Warnings() {
+		fmt.Fprintln(installCtx.Output, warning)
+	}
+	for _, line := range utils.EngineReport(installCtx.EngineMismatches()) {
+		fmt.Fprintln(installCtx.Output, line)
+	}
+
+	failures := installCtx.Failures()
+	if len(failures) == 0 {
+		return nil
+	}
+
+	return installFailures(failures)
+}
+
+// Fail a finished install whose dependency graph has packages that never made it into node_modules
+func checkGraphOnDisk(installCtx *utils.InstallContext, depGraph *graph.Graph[string, string]) error {
+	ghosts, err := utils.CheckGraphOnDisk(installCtx, depGraph)
+	if err != nil {
+		return err
+	}
+	if len(ghosts) == 0 {
+		return nil
+	}
+	failures := make(installFailures, len(ghosts))
+	for i, ghost := range ghosts {
+		failures[i] = pkgmanager.Classify(pkgmanager.ErrFilesystem, ghost)
+	}
+	return failures
+}
+
+// installFailures reports every failure of a --no-bail install while keeping each one matchable with errors.Is
+type installFailures []error
+
+func (f installFailures) Error() string {
+	messages := make([]string, len(f))
+	for i, failure := range f {
+		messages[i] = failure.Error()
+	}
+	return fmt.Sprintf("%d package(s) failed to install:\n  - %s", len(f), strings.Join(messages, "\n  - "))
+}
+
+func (f installFailures) Unwrap() []error {
+	return f
+}
+
+// Install the dependencies and devDependencies (unless production) of a package.json, skipping the ones provided locally
+func installDependencies(installCtx *utils.InstallContext, packageJSON *orderedmap.OrderedMap, depGraph *graph.Graph[string, string], skip map[string]bool, production bool) error {
+	depTypes := []string{"dependencies", "devDependencies"}
+	if production {
+		depTypes = depTypes[:1]
 	}
 
-	// Install each dependency
-	for _, depType := range []string{"dependencies", "devDependencies"} {
+	// Check every spec before installing anything, so a typo fails fast and names its package
+	type declaredDependency struct {
+		name, version string
+		dev           bool
+	}
+	var declared []declaredDependency
+	for _, depType := range depTypes {
 		deps, err := utils.ParseDependencies(packageJSON, depType)
 		if err != nil {
 			return err
 		}
 
 		for _, dep := range deps.Keys() {
+			if skip[dep] {
+				continue
+			}
+
 			version, ok := deps.Get(dep)
 			if !ok {
 				return fmt.Errorf("failed to get version for dependency: %s", dep)
@@ -89,14 +810,845 @@ func HandleInstall(depGraph *graph.Graph[string, string]) error {
 				return fmt.Errorf("version for dependency %s is not a string: %T", dep, version)
 			}
 
-			forDevDependency := depType == "devDependencies"
-			if _, err := utils.RunInstallPackage(dep, versionStr, depGraph, forDevDependency); err != nil {
+			if err := utils.ValidateVersionSpec(dep, versionStr); err != nil {
+				if err := installCtx.HandleFailure(fmt.Errorf("%s in package.json: %w", depType, err)); err != nil {
+					return err
+				}
+				continue
+			}
+			declared = append(declared, declaredDependency{name: dep, version: versionStr, dev: depType == "devDependencies"})
+		}
+	}
+
+	// Resolve the whole tree before downloading anything, then put it on disk dependencies first
+	roots := make(map[string]string)
+	for _, dep := range declared {
+		roots[dep.name] = dep.version
+	}
+	if err := utils.BuildGraph(installCtx, roots, depGraph); err != nil {
+		return err
+	}
+	if err := utils.ExtractInOrder(installCtx, depGraph); err != nil {
+		return err
+	}
+
+	for _, dep := range declared {
+		if _, err := utils.RunInstallPackage(installCtx, dep.name, dep.version, depGraph, dep.dev); err != nil {
+			if err := installCtx.HandleFailure(fmt.Errorf("%s@%s: %w", dep.name, dep.version, err)); err != nil {
 				return err
 			}
+		}
+	}
+
+	return nil
+}
+
+// Install the given "package@version" specs concurrently and save them all to package.json in one write
+func installAndSave(ctx context.Context, specs []string, depGraph *graph.Graph[string, string], opts Options) (_ *utils.InstallResult, err error) {
+	if !opts.Global {
+		if err := opts.locateProject(); err != nil {
+			return nil, err
+		}
+	}
+	nodeModulesDir := opts.nodeModulesPath()
+	var globalPrefix string
+	if opts.Global {
+		prefix, err := utils.GlobalPrefix()
+		if err != nil {
+			return nil, err
+		}
+		globalPrefix = prefix
+		nodeModulesDir = utils.GlobalNodeModulesDir(prefix)
+	} else if _, err := os.Stat(opts.packageJsonPath()); os.IsNotExist(err) {
+		// Ensure package.json exists
+		return nil, fmt.Errorf("package.json not found")
+	}
+
+	installCtx, err := newInstallContext(ctx, nodeModulesDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { removeCancelledInstall(installCtx, err) }()
+
+	// Overrides of the project apply to packages added to it too
+	if !opts.Global {
+		packageJSON, err := utils.ParsePackageJson(opts.packageJsonPath())
+		if err != nil {
+			return nil, err
+		}
+		if installCtx.Overrides, err = utils.ParseOverrides(packageJSON); err != nil {
+			return nil, err
+		}
+	}
+
+	// Ensure the node_modules directory exists
+	if err := pkgmanager.EnsureDir(installCtx.NodeModulesDir); err != nil {
+		return nil, fmt.Errorf("failed to create node_modules directory: %w", err)
+	}
 
+	for i, spec := range specs {
+		// --tag stands in for the version of the packages given without one
+		if opts.Tag != "" && !strings.Contains(strings.TrimPrefix(spec, "@"), "@") {
+			spec += "@" + opts.Tag
+			specs[i] = spec
 		}
+		packageName, packageVersion := utils.ParsePackageArg(spec)
+		if err := utils.ValidateVersionSpec(packageName, packageVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	// Resolve the whole tree before downloading anything, so the concurrent installs below can't race to build it,
+	// then put it on disk dependencies first
+	roots := make(map[string]string)
+	for _, spec := range specs {
+		packageName, packageVersion := utils.ParsePackageArg(spec)
+		roots[packageName] = packageVersion
+	}
+	if err := utils.BuildGraph(installCtx, roots, depGraph); err != nil {
+		return nil, err
+	}
+	if err := utils.ExtractInOrder(installCtx, depGraph); err != nil {
+		return nil, err
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		newDeps = make(map[string]string)
+		errChan = make(chan error, len(specs))
+		sem     = make(chan struct{}, installCtx.Concurrency)
+	)
+
+	for _, spec := range specs {
+		wg.Add(1)
+		go func(spec string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			// Parse the arg "package@version"
+			packageName, packageVersion := utils.ParsePackageArg(spec)
+
+			actualVersion, err := utils.RunInstallPackage(installCtx, packageName, packageVersion, depGraph, opts.Dev)
+			if err != nil {
+				if err := installCtx.HandleFailure(fmt.Errorf("%s@%s: %w", packageName, packageVersion, err)); err != nil {
+					errChan <- err
+				}
+				return
+			}
+
+			saved := utils.FormatVersionSpec(actualVersion, installCtx.SavePrefix, opts.Exact)
+			if target, _, ok := utils.ParseAlias(packageVersion); ok {
+				saved = "npm:" + target + "@" + saved
+			} else if strings.HasPrefix(packageVersion, "file:") {
+				saved = packageVersion
+			}
+			mu.Lock()
+			newDeps[packageName] = saved
+			mu.Unlock()
+		}(spec)
 	}
 
-	fmt.Println("✔ All packages installed successfully")
+	wg.Wait()
+	close(errChan)
+
+	if err := <-errChan; err != nil {
+		return installCtx.Result(), err
+	}
+	if err := utils.CheckPeerDependencies(installCtx, depGraph); err != nil {
+		return installCtx.Result(), err
+	}
+
+	// Global installs link their executables instead of being saved to package.json
+	if opts.Global {
+		if err := failuresError(installCtx); err != nil {
+			return installCtx.Result(), err
+		}
+		if err := checkGraphOnDisk(installCtx, depGraph); err != nil {
+			return installCtx.Result(), err
+		}
+
+		binDir := utils.GlobalBinDir(globalPrefix)
+		packageNames := make([]string, 0, len(newDeps))
+		for packageName := range newDeps {
+			packageNames = append(packageNames, packageName)
+		}
+		sort.Strings(packageNames)
+
+		for _, packageName := range packageNames {
+			linked, err := utils.LinkBins(installCtx, packageName, binDir)
+			if err != nil {
+				return installCtx.Result(), err
+			}
+			for _, name := range linked {
+				fmt.Fprintf(installCtx.Output, "✔ Linked %s into %s\n", name, binDir)
+			}
+		}
+		return installCtx.Result(), nil
+	}
+
+	// Update the package.json file with the new dependencies, save-prefix goes before them unless -E
+	if !opts.NoSave {
+		if err := utils.UpdatePackageJson(opts.packageJsonPath(), newDeps, opts.Dev, opts.Bundle); err != nil {
+			return installCtx.Result(), fmt.Errorf("failed to update package.json: %w", err)
+		}
+	}
+
+	if err := failuresError(installCtx); err != nil {
+		return installCtx.Result(), err
+	}
+	if err := checkGraphOnDisk(installCtx, depGraph); err != nil {
+		return installCtx.Result(), err
+	}
+	return installCtx.Result(), utils.WriteManifest(installCtx, installCtx.Result())
+}
+
+func HandleWhy(args []string, depGraph *graph.Graph[string, string]) error {
+	var packageName string
+	asJSON := false
+	for _, arg := range args[2:] {
+		switch {
+		case arg == "--json":
+			asJSON = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown flag for 'why': %s", arg)
+		default:
+			packageName = arg
+		}
+	}
+	if packageName == "" {
+		return fmt.Errorf("expected package name after 'why'")
+	}
+
+	project, err := findProject()
+	if err != nil {
+		return err
+	}
+	root, err := utils.BuildInstalledGraph(utils.NewInstallContext(project.nodeModulesPath()), project.packageJsonPath(), depGraph)
+	if err != nil {
+		return err
+	}
+
+	paths, err := utils.FindDependencyPaths(depGraph, root, packageName)
+	if err != nil {
+		if asJSON {
+			paths = [][]string{}
+		} else {
+			fmt.Printf("%s is not installed as a dependency of %s\n", packageName, root)
+			return nil
+		}
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(map[string]interface{}{
+			"package": packageName,
+			"paths":   paths,
+		}, "", "    ")
+		if err != nil {
+			return fmt.Errorf("failed to encode paths: %v", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	for _, path := range paths {
+		fmt.Println(strings.Join(path, " > "))
+	}
+	return nil
+}
+
+func HandleCache(args []string) error {
+	if len(args) < 3 || args[2] != "verify" {
+		return fmt.Errorf("expected 'verify' after 'cache'")
+	}
+
+	remove := false
+	for _, arg := range args[3:] {
+		if arg != "--remove" {
+			return fmt.Errorf("unknown flag for 'cache verify': %s", arg)
+		}
+		remove = true
+	}
+
+	cacheDir := pkgmanager.DefaultCacheDir()
+	checked, corrupt, err := pkgmanager.VerifyCache(cacheDir, remove)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range corrupt {
+		if remove {
+			fmt.Printf("✘ Removed corrupt %s\n", path)
+		} else {
+			fmt.Printf("✘ Corrupt %s\n", path)
+		}
+	}
+
+	if len(corrupt) > 0 && !remove {
+		return fmt.Errorf("%d of %d cached tarballs are corrupt, run 'fpm cache verify --remove' to evict them", len(corrupt), checked)
+	}
+
+	fmt.Printf("✔ Verified %d cached tarballs in %s\n", checked, cacheDir)
+	return nil
+}
+
+func HandleAudit(ctx context.Context, args []string) error {
+	asJSON := false
+	for _, arg := range args[2:] {
+		if arg != "--json" {
+			return fmt.Errorf("unknown flag for 'audit': %s", arg)
+		}
+		asJSON = true
+	}
+
+	project, err := findProject()
+	if err != nil {
+		return err
+	}
+	installCtx, err := newInstallContext(ctx, project.nodeModulesPath(), project)
+	if err != nil {
+		return err
+	}
+	installedPackages, err := utils.ListInstalledPackages(installCtx)
+	if err != nil {
+		return err
+	}
+
+	installed := make(map[string][]string)
+	for _, pkg := range installedPackages {
+		if pkg.Version != "" {
+			installed[pkg.Name] = append(installed[pkg.Name], pkg.Version)
+		}
+	}
+
+	advisories, err := installCtx.Client.FetchAdvisories(ctx, installCtx.Registry, installed)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(advisories))
+	severe := 0
+	for name, packageAdvisories := range advisories {
+		names = append(names, name)
+		for _, advisory := range packageAdvisories {
+			if advisory.Severity == "high" || advisory.Severity == "critical" {
+				severe++
+			}
+		}
+	}
+	sort.Strings(names)
+
+	if asJSON {
+		data, err := json.MarshalIndent(advisories, "", "    ")
+		if err != nil {
+			return fmt.Errorf("failed to encode advisories: %v", err)
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, name := range names {
+			for _, advisory := range advisories[name] {
+				fmt.Printf("%s %s: %s\n", advisory.Severity, name, advisory.Title)
+				fmt.Printf("  vulnerable: %s\n", advisory.VulnerableVersions)
+				if advisory.PatchedVersions != "" {
+					fmt.Printf("  patched:    %s\n", advisory.PatchedVersions)
+				}
+				if advisory.URL != "" {
+					fmt.Printf("  more info:  %s\n", advisory.URL)
+				}
+			}
+		}
+		if len(names) == 0 {
+			fmt.Printf("✔ No known vulnerabilities in %d installed packages\n", len(installedPackages))
+		}
+	}
+
+	if severe > 0 {
+		return fmt.Errorf("found %d high or critical vulnerabilities", severe)
+	}
+	return nil
+}
+
+func HandleDedupe(args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("unknown argument for 'dedupe': %s", args[2])
+	}
+
+	project, err := findProject()
+	if err != nil {
+		return err
+	}
+	installCtx := utils.NewInstallContext(project.nodeModulesPath())
+	result, err := utils.Dedupe(installCtx)
+	if err != nil {
+		return err
+	}
+
+	// Keep the manifest in step with the flattened tree if an install wrote one
+	if manifest, err := utils.ReadManifest(installCtx); err == nil && manifest != nil {
+		if err := utils.WriteManifest(installCtx, &utils.InstallResult{}); err != nil {
+			return err
+		}
+	}
+
+	for _, pkg := range result.Hoisted {
+		fmt.Printf("✔ Hoisted %s@%s from %s\n", pkg.Name, pkg.Version, pkg.Dir)
+	}
+	for _, pkg := range result.Removed {
+		fmt.Printf("✔ Removed %s@%s from %s\n", pkg.Name, pkg.Version, pkg.Dir)
+	}
+	fmt.Printf("removed %d packages, hoisted %d packages\n", len(result.Removed), len(result.Hoisted))
+	return nil
+}
+
+// Parse the flags of the reporting commands, only --no-color for now
+func parseReportArgs(command string, args []string) (noColor bool, err error) {
+	for _, arg := range args {
+		if arg != "--no-color" {
+			return false, fmt.Errorf("unknown flag for '%s': %s", command, arg)
+		}
+		noColor = true
+	}
+	return noColor, nil
+}
+
+// listOptions are the flags of 'list', depth only applies to --json
+type listOptions struct {
+	noColor bool
+	json    bool
+	depth   int
+}
+
+func parseListArgs(args []string) (listOptions, error) {
+	options := listOptions{}
+	for _, arg := range args {
+		switch {
+		case arg == "--no-color":
+			options.noColor = true
+		case arg == "--json":
+			options.json = true
+		case arg == "--all":
+			options.depth = -1
+		case strings.HasPrefix(arg, "--depth="):
+			depth, err := strconv.Atoi(strings.TrimPrefix(arg, "--depth="))
+			if err != nil || depth < 0 {
+				return options, fmt.Errorf("invalid value for --depth: %s", strings.TrimPrefix(arg, "--depth="))
+			}
+			options.depth = depth
+		default:
+			return options, fmt.Errorf("unknown flag for 'list': %s", arg)
+		}
+	}
+	if options.depth != 0 && !options.json {
+		return options, fmt.Errorf("--all and --depth only apply to 'list --json'")
+	}
+	return options, nil
+}
+
+func HandleList(args []string) error {
+	options, err := parseListArgs(args[2:])
+	if err != nil {
+		return err
+	}
+
+	project, err := findProject()
+	if err != nil {
+		return err
+	}
+	installCtx := utils.NewInstallContext(project.nodeModulesPath())
+	if options.json {
+		return printTree(os.Stdout, installCtx, project.packageJsonPath(), options.depth)
+	}
+	dependencies, err := utils.ListDependencies(installCtx, project.packageJsonPath())
+	if err != nil {
+		return err
+	}
+
+	table := &reportTable{}
+	table.add(colorNone, "Package", "Installed", "Wanted", "Type")
+	for _, dep := range dependencies {
+		installed, color := dep.Installed, colorGreen
+		if installed == "" {
+			installed, color = "missing", colorRed
+		} else if !dep.Satisfied() {
+			color = colorRed
+		}
+		table.add(color, dep.Name, installed, dep.Range, dep.Type)
+	}
+	return table.print(os.Stdout, colorEnabled(os.Stdout, options.noColor))
+}
+
+// Print the installed tree like `npm ls --json` and fail like it when the tree has problems
+func printTree(out io.Writer, installCtx *utils.InstallContext, pathToJSON string, depth int) error {
+	tree, err := utils.DependencyTree(installCtx, pathToJSON, depth)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(tree, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the dependency tree: %v", err)
+	}
+	fmt.Fprintln(out, string(data))
+	if len(tree.Problems) > 0 {
+		return fmt.Errorf("the dependency tree has %d problem(s)", len(tree.Problems))
+	}
+	return nil
+}
+
+func HandleOutdated(ctx context.Context, args []string) error {
+	noColor, err := parseReportArgs("outdated", args[2:])
+	if err != nil {
+		return err
+	}
+
+	project, err := findProject()
+	if err != nil {
+		return err
+	}
+	installCtx, err := newInstallContext(ctx, project.nodeModulesPath(), project)
+	if err != nil {
+		return err
+	}
+	dependencies, err := utils.ListDependencies(installCtx, project.packageJsonPath())
+	if err != nil {
+		return err
+	}
+
+	table := &reportTable{}
+	table.add(colorNone, "Package", "Current", "Wanted", "Latest", "Type")
+	for _, dep := range dependencies {
+		// An alias is checked against the package it installs
+		packageName, versionRange := dep.Name, dep.Range
+		if target, targetRange, ok := utils.ParseAlias(dep.Range); ok {
+			packageName, versionRange = target, targetRange
+		}
+		registry := installCtx.RegistryFor(packageName)
+		wanted, err := installCtx.Client.FetchPackageInfo(ctx, registry, packageName, versionRange, installCtx.CacheDir)
+		if err != nil {
+			return fmt.Errorf("%s@%s: %w", dep.Name, dep.Range, err)
+		}
+		latest, err := installCtx.Client.FetchPackageInfo(ctx, registry, packageName, "latest", installCtx.CacheDir)
+		if err != nil {
+			return fmt.Errorf("%s@latest: %w", dep.Name, err)
+		}
+
+		current := dep.Installed
+		if current == "" {
+			current = "missing"
+		}
+		table.add(updateColor(dep.Installed, latest.Version), dep.Name, current, wanted.Version, latest.Version, dep.Type)
+	}
+	return table.print(os.Stdout, colorEnabled(os.Stdout, noColor))
+}
+
+func HandleView(ctx context.Context, args []string) error {
+	var spec, field string
+	asJSON := false
+	for _, arg := range args[2:] {
+		switch {
+		case arg == "--json":
+			asJSON = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown flag for 'view': %s", arg)
+		case spec == "":
+			spec = arg
+		case field == "" && arg == "versions":
+			field = arg
+		default:
+			return fmt.Errorf("unknown argument for 'view': %s, only 'versions' can follow the package", arg)
+		}
+	}
+	if spec == "" {
+		return fmt.Errorf("expected package name after 'view'")
+	}
+
+	installCtx, err := newInstallContext(ctx, utils.DefaultNodeModulesDir, Options{})
+	if err != nil {
+		return err
+	}
+	packageName, versionRange := utils.ParsePackageArg(spec)
+	metadata, err := installCtx.Client.FetchPackageMetadata(ctx, installCtx.RegistryFor(packageName), packageName, installCtx.CacheDir, true)
+	if err != nil {
+		return fmt.Errorf("%s: %w", packageName, err)
+	}
+	if field == "versions" {
+		return printVersions(os.Stdout, metadata, asJSON)
+	}
+
+	packageInfo, document, err := metadata.Resolve(versionRange)
+	if err != nil {
+		return fmt.Errorf("%s: %w", spec, err)
+	}
+	if asJSON {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, document, "", "  "); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintln(os.Stdout, indented.String())
+		return err
+	}
+	return printView(os.Stdout, metadata, packageInfo)
+}
+
+// Print the version of a package `fpm view` resolved to, with its dist-tags, dependencies and tarball
+func printView(out io.Writer, metadata *pkgmanager.PackageMetadata, packageInfo *pkgmanager.PackageInfo) error {
+	fmt.Fprintf(out, "%s@%s\n", packageInfo.Name, packageInfo.Version)
+	if packageInfo.Description != "" {
+		fmt.Fprintln(out, packageInfo.Description)
+	}
+	if packageInfo.Deprecated != "" {
+		fmt.Fprintf(out, "DEPRECATED: %s\n", packageInfo.Deprecated)
+	}
+
+	fmt.Fprintf(out, "\ndist-tags:\n")
+	tags := make([]string, 0, len(metadata.DistTags))
+	for tag := range metadata.DistTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		fmt.Fprintf(out, "  %s: %s\n", tag, metadata.DistTags[tag])
+	}
+
+	fmt.Fprintf(out, "\ndependencies (%d):\n", len(packageInfo.Dependencies))
+	names := make([]string, 0, len(packageInfo.Dependencies))
+	for name := range packageInfo.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s: %s\n", name, packageInfo.Dependencies[name])
+	}
+
+	fmt.Fprintf(out, "\ntarball: %s\n", packageInfo.Tarball)
+	if packageInfo.Integrity != "" {
+		fmt.Fprintf(out, "integrity: %s\n", packageInfo.Integrity)
+	}
+	_, err := fmt.Fprintf(out, "shasum: %s\n", packageInfo.Shasum)
+	return err
+}
+
+// Print every published version of a package, oldest first, one per line or as a JSON array
+func printVersions(out io.Writer, metadata *pkgmanager.PackageMetadata, asJSON bool) error {
+	if asJSON {
+		versions := metadata.Versions
+		if versions == nil {
+			versions = []string{}
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(versions)
+	}
+	for _, version := range metadata.Versions {
+		if _, err := fmt.Fprintln(out, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func HandlePrune(args []string, depGraph *graph.Graph[string, string]) error {
+	production, dryRun := false, false
+	for _, arg := range args[2:] {
+		switch arg {
+		case "--production":
+			production = true
+		case "--dry-run":
+			dryRun = true
+		default:
+			return fmt.Errorf("unknown argument for 'prune': %s", arg)
+		}
+	}
+
+	project, err := findProject()
+	if err != nil {
+		return err
+	}
+	installCtx := utils.NewInstallContext(project.nodeModulesPath())
+	removed, err := utils.Prune(installCtx, project.packageJsonPath(), depGraph, production, dryRun)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		for _, pkg := range removed {
+			fmt.Printf("Would remove %s@%s from %s\n", pkg.Name, pkg.Version, pkg.Dir)
+		}
+		fmt.Printf("would remove %d packages\n", len(removed))
+		return nil
+	}
+
+	// Keep the manifest in step with the pruned tree if an install wrote one
+	if manifest, err := utils.ReadManifest(installCtx); err == nil && manifest != nil {
+		if err := utils.WriteManifest(installCtx, &utils.InstallResult{}); err != nil {
+			return err
+		}
+	}
+
+	for _, pkg := range removed {
+		fmt.Printf("✔ Removed %s@%s from %s\n", pkg.Name, pkg.Version, pkg.Dir)
+	}
+	fmt.Printf("removed %d packages\n", len(removed))
+	return nil
+}
+
+func HandleVerify(args []string) error {
+	files := false
+	for _, arg := range args[2:] {
+		if arg != "--files" {
+			return fmt.Errorf("unknown argument for 'verify': %s", arg)
+		}
+		files = true
+	}
+
+	project, err := findProject()
+	if err != nil {
+		return err
+	}
+	installCtx := utils.NewInstallContext(project.nodeModulesPath())
+	manifest, err := utils.ReadManifest(installCtx)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("no %s found in %s, run 'fpm install' first", utils.ManifestFile, installCtx.NodeModulesDir)
+	}
+
+	discrepancies, err := utils.VerifyManifest(installCtx, manifest)
+	if err != nil {
+		return err
+	}
+	checked := 0
+	if files {
+		var changed []string
+		checked, changed, err = utils.VerifyFiles(installCtx, manifest)
+		if err != nil {
+			return err
+		}
+		if checked == 0 {
+			return fmt.Errorf("no file hashes in %s, install with --record-files first", utils.ManifestFile)
+		}
+		discrepancies = append(discrepancies, changed...)
+	}
+	for _, discrepancy := range discrepancies {
+		fmt.Printf("✘ %s\n", discrepancy)
+	}
+	if len(discrepancies) > 0 {
+		return pkgmanager.Classify(pkgmanager.ErrIntegrity, fmt.Errorf("node_modules has drifted from its manifest: %d difference(s)", len(discrepancies)))
+	}
+
+	fmt.Printf("✔ node_modules matches its manifest (%d packages, %s)\n", len(manifest.Packages), manifest.Hash)
+	if files {
+		fmt.Printf("✔ the files of %d packages are unchanged since they were installed\n", checked)
+	}
+	return nil
+}
+
+// Print every inconsistency between package.json and its lockfile, failing like verify when there is one
+func checkLockfile(out io.Writer, pathToJSON string) error {
+	pins, problems, err := utils.CheckLockfile(pathToJSON)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(out, "✘ %s\n", problem)
+	}
+	if len(problems) > 0 {
+		return pkgmanager.Classify(pkgmanager.ErrIntegrity, fmt.Errorf("package.json and %s are inconsistent: %d problem(s)", pins.Source, len(problems)))
+	}
+
+	fmt.Fprintf(out, "✔ package.json and %s are consistent (%d packages)\n", pins.Source, len(pins.Packages))
+	return nil
+}
+
+func HandleRun(ctx context.Context, args []string) error {
+	// Like npm the scripts are those of the nearest package.json, a workspace member's own when run inside it
+	projectDir, err := utils.FindNearestPackage(".")
+	if err != nil {
+		return err
+	}
+
+	// Without a script name list the available ones
+	if len(args) < 3 {
+		packageJSON, err := utils.ParsePackageJson(filepath.Join(projectDir, "package.json"))
+		if err != nil {
+			return err
+		}
+		scripts, err := utils.ParseScripts(packageJSON)
+		if err != nil {
+			return err
+		}
+		if len(scripts.Keys()) == 0 {
+			fmt.Println("No scripts in package.json")
+			return nil
+		}
+		fmt.Println("Scripts available via `fpm run`:")
+		for _, name := range scripts.Keys() {
+			script, _ := scripts.Get(name)
+			fmt.Printf("  %s\n    %s\n", name, script)
+		}
+		return nil
+	}
+
+	// Everything after the script name is passed to it, a leading "--" only separates them
+	extraArgs := args[3:]
+	if len(extraArgs) > 0 && extraArgs[0] == "--" {
+		extraArgs = extraArgs[1:]
+	}
+
+	cfg, err := config.Load(projectDir)
+	if err != nil {
+		return err
+	}
+	return utils.RunScript(ctx, projectDir, cfg.ScriptShell, args[2], extraArgs)
+}
+
+// Link the package in the working directory globally, or link the globally linked packages named in args into
+// the project's node_modules
+func HandleLink(args []string) error {
+	var names []string
+	for _, arg := range args[2:] {
+		if strings.HasPrefix(arg, "-") {
+			return fmt.Errorf("unknown flag for 'link': %s", arg)
+		}
+		names = append(names, arg)
+	}
+
+	prefix, err := utils.GlobalPrefix()
+	if err != nil {
+		return err
+	}
+	projectDir, err := utils.FindNearestPackage(".")
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		removed, err := utils.RemoveStaleLinks(prefix)
+		if err != nil {
+			return err
+		}
+		for _, name := range removed {
+			fmt.Printf("Removed the stale global link of %s\n", name)
+		}
+		packageName, bins, err := utils.LinkGlobal(prefix, projectDir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✔ Linked %s globally to %s\n", packageName, projectDir)
+		for _, bin := range bins {
+			fmt.Printf("✔ Linked %s into %s\n", bin, utils.GlobalBinDir(prefix))
+		}
+		return nil
+	}
+
+	nodeModulesDir := filepath.Join(projectDir, "node_modules")
+	for _, name := range names {
+		target, err := utils.LinkFromGlobal(prefix, nodeModulesDir, name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✔ Linked %s to %s\n", filepath.Join(nodeModulesDir, name), target)
+	}
 	return nil
 }
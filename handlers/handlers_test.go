@@ -0,0 +1,1066 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dominikbraun/graph"
+	"github.com/jamesjellow/fpm/internal/fpmtest"
+	"github.com/jamesjellow/fpm/pkgmanager"
+	"github.com/jamesjellow/fpm/utils"
+)
+
+func TestParseAddArgsMultiplePackagesWithDev(t *testing.T) {
+	specs, opts, err := ParseAddArgs([]string{"react", "-D", "react-dom@18.2.0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(specs, []string{"react", "react-dom@18.2.0"}) {
+		t.Errorf("unexpected specs: %v", specs)
+	}
+	if !opts.Dev {
+		t.Errorf("expected -D to apply to all packages")
+	}
+	if opts.Exact {
+		t.Errorf("expected exact to be unset")
+	}
+}
+
+func TestParseAddArgsFlagBeforePackages(t *testing.T) {
+	specs, opts, err := ParseAddArgs([]string{"-D", "-E", "react", "react-dom"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(specs, []string{"react", "react-dom"}) {
+		t.Errorf("unexpected specs: %v", specs)
+	}
+	if !opts.Dev || !opts.Exact {
+		t.Errorf("expected -D and -E to be set, got %+v", opts)
+	}
+}
+
+func TestParseAddArgsLongForms(t *testing.T) {
+	for _, args := range [][]string{{"react", "--save-dev"}, {"--dev", "react"}, {"--save-exact", "react", "--save-dev", "--no-bail"}} {
+		specs, opts, err := ParseAddArgs(args)
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %v", args, err)
+		}
+		if !reflect.DeepEqual(specs, []string{"react"}) || !opts.Dev {
+			t.Errorf("expected %v to add react to devDependencies, got %v %+v", args, specs, opts)
+		}
+	}
+	if _, opts, _ := ParseAddArgs([]string{"react", "--save-exact"}); !opts.Exact {
+		t.Errorf("expected --save-exact to set exact")
+	}
+}
+
+func TestParseAddArgsBundle(t *testing.T) {
+	if _, opts, err := ParseAddArgs([]string{"lodash", "--bundle"}); err != nil || !opts.Bundle {
+		t.Errorf("expected --bundle to set bundle, got %+v %v", opts, err)
+	}
+	for _, args := range [][]string{{"lodash", "--bundle", "--no-save"}, {"-g", "-B", "typescript"}} {
+		if _, _, err := ParseAddArgs(args); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
+
+func TestParseAddArgsNoPackages(t *testing.T) {
+	if _, _, err := ParseAddArgs([]string{"-D"}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestParseAddArgsUnknownFlag(t *testing.T) {
+	if _, _, err := ParseAddArgs([]string{"react", "--bogus"}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestParseAddArgsGlobal(t *testing.T) {
+	specs, opts, err := ParseAddArgs([]string{"-g", "typescript"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(specs, []string{"typescript"}) {
+		t.Errorf("unexpected specs: %v", specs)
+	}
+	if !opts.Global {
+		t.Errorf("expected -g to set global")
+	}
+}
+
+func TestParseInstallArgsProduction(t *testing.T) {
+	specs, opts, err := ParseInstallArgs([]string{"--production"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(specs) != 0 {
+		t.Errorf("unexpected specs: %v", specs)
+	}
+	if !opts.Production {
+		t.Errorf("expected --production to be set")
+	}
+}
+
+func TestFailuresErrorNoFailures(t *testing.T) {
+	if err := failuresError(utils.NewInstallContext(t.TempDir())); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
+
+func TestParseBailFlags(t *testing.T) {
+	_, addOpts, err := ParseAddArgs([]string{"--no-bail", "react"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !addOpts.NoBail {
+		t.Errorf("expected --no-bail to be set for add")
+	}
+
+	_, installOpts, err := ParseInstallArgs([]string{"--no-bail", "--bail"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if installOpts.NoBail {
+		t.Errorf("expected the last of --no-bail/--bail to win")
+	}
+}
+
+func TestParseMaxDepthFlag(t *testing.T) {
+	_, opts, err := ParseInstallArgs([]string{"--max-depth=20"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	installCtx := utils.NewInstallContext(t.TempDir())
+	opts.apply(installCtx)
+	if installCtx.MaxDepth != 20 {
+		t.Errorf("expected max depth 20, got %d", installCtx.MaxDepth)
+	}
+
+	if _, _, err := ParseAddArgs([]string{"react", "--max-depth=zero"}); err == nil {
+		t.Errorf("expected error for an invalid max depth")
+	}
+}
+
+func TestParseRegistryAndModulesDirFlags(t *testing.T) {
+	_, opts, err := ParseInstallArgs([]string{"--registry", "http://localhost:4873", "--modules-dir", "vendor/modules", "--concurrency=2", "--offline"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.Registry != "http://localhost:4873" || !opts.Offline {
+		t.Errorf("expected the registry and offline to be set, got %+v", opts)
+	}
+	if opts.nodeModulesPath() != "vendor/modules" {
+		t.Errorf("expected packages to go to vendor/modules, got %s", opts.nodeModulesPath())
+	}
+	installCtx := utils.NewInstallContext(t.TempDir())
+	opts.apply(installCtx)
+	if installCtx.Concurrency != 2 {
+		t.Errorf("expected concurrency 2, got %d", installCtx.Concurrency)
+	}
+
+	if _, _, err := ParseAddArgs([]string{"react", "--concurrency=0"}); err == nil {
+		t.Errorf("expected error for an invalid concurrency")
+	}
+}
+
+func TestParseScriptFlags(t *testing.T) {
+	_, opts, err := ParseInstallArgs(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.RunScripts {
+		t.Errorf("expected scripts to be ignored by default")
+	}
+
+	_, addOpts, err := ParseAddArgs([]string{"--run-scripts", "esbuild"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	installCtx := utils.NewInstallContext(t.TempDir())
+	addOpts.apply(installCtx)
+	if !installCtx.RunScripts {
+		t.Errorf("expected --run-scripts to enable scripts")
+	}
+}
+
+func TestInstallFailuresKeepErrorClasses(t *testing.T) {
+	err := installFailures{
+		errors.New("left-pad@1.0.0: not found"),
+		fmt.Errorf("is-odd@1.0.0: %w", pkgmanager.Classify(pkgmanager.ErrNetwork, errors.New("timeout"))),
+	}
+	if !errors.Is(err, pkgmanager.ErrNetwork) {
+		t.Errorf("expected the network failure to be matchable")
+	}
+	if !strings.Contains(err.Error(), "2 package(s) failed to install") {
+		t.Errorf("unexpected message: %v", err)
+	}
+}
+
+// Run f and return what it printed to stdout
+func captureStdout(t *testing.T, f func() error) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	err = f()
+	os.Stdout = stdout
+	writer.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var out bytes.Buffer
+	out.ReadFrom(reader)
+	return out.String()
+}
+
+func TestHandleWhy(t *testing.T) {
+	dir := t.TempDir()
+	for path, content := range map[string]string{
+		"package.json":                `{"name": "app", "dependencies": {"a": "^1.0.0", "b": "^1.0.0"}}`,
+		"node_modules/a/package.json": `{"name": "a", "version": "1.0.0", "dependencies": {"c": "^1.0.0"}}`,
+		"node_modules/b/package.json": `{"name": "b", "version": "1.0.0", "dependencies": {"c": "^1.0.0"}}`,
+		"node_modules/c/package.json": `{"name": "c", "version": "1.0.0"}`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, dir)
+	why := func(args ...string) string {
+		depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+		return captureStdout(t, func() error { return HandleWhy(append([]string{"fpm", "why"}, args...), &depGraph) })
+	}
+
+	if out := why("c"); out != "app > a > c\napp > b > c\n" {
+		t.Errorf("expected both paths to c, got %q", out)
+	}
+
+	var report struct {
+		Package string     `json:"package"`
+		Paths   [][]string `json:"paths"`
+	}
+	if err := json.Unmarshal([]byte(why("c", "--json")), &report); err != nil {
+		t.Fatalf("expected JSON on stdout: %v", err)
+	}
+	if expected := [][]string{{"app", "a", "c"}, {"app", "b", "c"}}; report.Package != "c" || !reflect.DeepEqual(report.Paths, expected) {
+		t.Errorf("expected the paths to c, got %+v", report)
+	}
+
+	if out := why("d"); out != "d is not installed as a dependency of app\n" {
+		t.Errorf("unexpected output for a package outside the graph: %q", out)
+	}
+	if err := json.Unmarshal([]byte(why("d", "--json")), &report); err != nil || report.Paths == nil || len(report.Paths) != 0 {
+		t.Errorf("expected no paths in the JSON for a package outside the graph, got %+v, %v", report, err)
+	}
+}
+
+func TestPrintJSONReport(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	result := &utils.InstallResult{Packages: []utils.ResolvedPackage{{Name: "react", Version: "18.2.0", Integrity: "sha512-abc"}}}
+	failures := installFailures{errors.New("left-pad@1.0.0: not found")}
+	returned := printJSONReport(result, failures, 1500*time.Millisecond)
+	os.Stdout = stdout
+	writer.Close()
+
+	if !errors.Is(returned, failures[0]) {
+		t.Errorf("expected the install error to be returned, got %v", returned)
+	}
+
+	var report installReport
+	if err := json.NewDecoder(reader).Decode(&report); err != nil {
+		t.Fatalf("expected JSON on stdout: %v", err)
+	}
+	expected := installReport{Added: result.Packages, ElapsedMs: 1500, Errors: []string{"left-pad@1.0.0: not found"}}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected %+v, got %+v", expected, report)
+	}
+}
+
+func TestParseJSONFlag(t *testing.T) {
+	_, opts, err := ParseInstallArgs([]string{"--json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	installCtx := utils.NewInstallContext(t.TempDir())
+	opts.apply(installCtx)
+	if !opts.JSON || installCtx.Output != os.Stderr {
+		t.Errorf("expected --json to move progress messages to stderr")
+	}
+}
+
+func TestParsePeerFlags(t *testing.T) {
+	tests := map[string]utils.PeerStrategy{
+		"--legacy-peer-deps":  utils.PeerLegacy,
+		"--strict-peer-deps":  utils.PeerStrict,
+		"--peer-deps=resolve": utils.PeerResolve,
+	}
+	for flag, expected := range tests {
+		_, opts, err := ParseInstallArgs([]string{flag})
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", flag, err)
+		}
+		installCtx := utils.NewInstallContext(t.TempDir())
+		opts.apply(installCtx)
+		if installCtx.PeerStrategy != expected {
+			t.Errorf("expected %s to select %s, got %s", flag, expected, installCtx.PeerStrategy)
+		}
+	}
+
+	if _, _, err := ParseInstallArgs([]string{"--peer-deps=loose"}); err == nil {
+		t.Errorf("expected an unknown strategy to be rejected")
+	}
+}
+
+// Change the working directory for the rest of the test
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestInstallWithPrefix(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	prefix := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	if err := os.WriteFile(filepath.Join(prefix, ".npmrc"), []byte("registry="+registry.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(prefix, "package.json"), []byte(`{"name": "app", "dependencies": {"left-pad": "^1.0.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	result, err := Install(context.Background(), []string{"--prefix", prefix}, &depGraph, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Packages) != 1 || result.Packages[0].Version != "1.3.0" {
+		t.Errorf("unexpected result: %+v", result.Packages)
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "node_modules", "left-pad", "package.json")); err != nil {
+		t.Errorf("expected left-pad in the prefix node_modules: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "node_modules", utils.ManifestFile)); err != nil {
+		t.Errorf("expected the manifest in the prefix node_modules: %v", err)
+	}
+}
+
+func TestInstallRepair(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	prefix := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	if err := os.WriteFile(filepath.Join(prefix, ".npmrc"), []byte("registry="+registry.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(prefix, "package.json"), []byte(`{"name": "app", "dependencies": {"left-pad": "^1.0.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Install(context.Background(), []string{"--prefix", prefix}, &depGraph, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Still within the range, only the manifest knows it isn't what was installed
+	packageJsonPath := filepath.Join(prefix, "node_modules", "left-pad", "package.json")
+	if err := os.WriteFile(packageJsonPath, []byte(`{"name": "left-pad", "version": "1.2.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	result, err := Install(context.Background(), []string{"--prefix", prefix, "--repair"}, &depGraph, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Packages) != 1 || result.Packages[0].Version != "1.3.0" {
+		t.Errorf("expected left-pad to be installed again, got %+v", result.Packages)
+	}
+	if content, _ := os.ReadFile(packageJsonPath); !strings.Contains(string(content), "1.3.0") {
+		t.Errorf("expected left-pad@1.3.0 back in node_modules, got %s", content)
+	}
+
+	if _, err := Install(context.Background(), []string{"--prefix", prefix, "--repair", "left-pad"}, &depGraph, nil); err == nil || !strings.Contains(err.Error(), "--repair") {
+		t.Errorf("expected --repair with package names to fail, got %v", err)
+	}
+}
+
+func TestInstallCheckFiles(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	prefix := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	if err := os.WriteFile(filepath.Join(prefix, ".npmrc"), []byte("registry="+registry.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(prefix, "package.json"), []byte(`{"name": "app", "dependencies": {"left-pad": "^1.0.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Install(context.Background(), []string{"--prefix", prefix}, &depGraph, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Install(context.Background(), []string{"--prefix", prefix, "--check-files"}, &depGraph, nil); err == nil || !strings.Contains(err.Error(), "--record-files") {
+		t.Errorf("expected --check-files without recorded hashes to fail, got %v", err)
+	}
+
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Install(context.Background(), []string{"--prefix", prefix, "--record-files"}, &depGraph, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	added := filepath.Join(prefix, "node_modules", "left-pad", "extra.js")
+	if err := os.WriteFile(added, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	result, err := Install(context.Background(), []string{"--prefix", prefix, "--check-files"}, &depGraph, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Packages) != 1 || result.Packages[0].Name != "left-pad" {
+		t.Errorf("expected left-pad to be extracted again, got %+v", result.Packages)
+	}
+	if _, err := os.Stat(added); !os.IsNotExist(err) {
+		t.Errorf("expected the added file to be gone, got %v", err)
+	}
+
+	// Intact now, so nothing is extracted again
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if result, err = Install(context.Background(), []string{"--prefix", prefix, "--check-files"}, &depGraph, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Packages) != 0 {
+		t.Errorf("expected the intact left-pad to be kept, got %+v", result.Packages)
+	}
+}
+
+func TestInstallUpgradeIntegrity(t *testing.T) {
+	tarball := fpmtest.LeftPad.Tarball()
+	shasum := sha1.Sum(tarball)
+	sha1Integrity := "sha1-" + base64.StdEncoding.EncodeToString(shasum[:])
+	sha512Integrity := fpmtest.LeftPad.Integrity()
+
+	// Published before the registry computed sha512 integrities
+	integrity := sha1Integrity
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/left-pad":
+			fmt.Fprintf(w, `{"name": "left-pad", "dist-tags": {"latest": "1.3.0"}, "versions": {"1.3.0": {"name": "left-pad", "version": "1.3.0", "dist": {"tarball": "%s/left-pad.tgz", "shasum": "%x", "integrity": "%s"}}}}`, server.URL, shasum, integrity)
+		case "/left-pad.tgz":
+			w.Write(tarball)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	prefix := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	if err := os.WriteFile(filepath.Join(prefix, ".npmrc"), []byte("registry="+server.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(prefix, "package.json"), []byte(`{"name": "app", "dependencies": {"left-pad": "^1.0.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Install(context.Background(), []string{"--prefix", prefix}, &depGraph, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	installCtx := utils.NewInstallContext(filepath.Join(prefix, "node_modules"))
+	manifest, err := utils.ReadManifest(installCtx)
+	if err != nil || manifest.Packages["left-pad"].Integrity != sha1Integrity {
+		t.Fatalf("expected the sha1 integrity to be recorded, got %+v, %v", manifest, err)
+	}
+
+	// The sha1 recorded for the installed copy doesn't match what the registry publishes now
+	integrity = sha512Integrity
+	manifestPath := filepath.Join(prefix, "node_modules", utils.ManifestFile)
+	content, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherShasum := sha1.Sum([]byte("something else"))
+	tampered := strings.Replace(string(content), sha1Integrity, "sha1-"+base64.StdEncoding.EncodeToString(otherShasum[:]), 1)
+	if err := os.WriteFile(manifestPath, []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	}
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Install(context.Background(), []string{"--prefix", prefix, "--upgrade-integrity"}, &depGraph, nil); !errors.Is(err, pkgmanager.ErrIntegrity) {
+		t.Errorf("expected an integrity error for a changed shasum, got %v", err)
+	}
+
+	if err := os.WriteFile(manifestPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	result, err := Install(context.Background(), []string{"--prefix", prefix, "--upgrade-integrity"}, &depGraph, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Packages) != 0 {
+		t.Errorf("expected left-pad to be kept, got %+v", result.Packages)
+	}
+	if manifest, err = utils.ReadManifest(installCtx); err != nil || manifest.Packages["left-pad"].Integrity != sha512Integrity {
+		t.Errorf("expected the integrity to be upgraded to sha512, got %+v, %v", manifest, err)
+	}
+}
+
+func TestInstallFromSubdirectory(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	prefix := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	if err := os.WriteFile(filepath.Join(prefix, ".npmrc"), []byte("registry="+registry.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(prefix, "package.json"), []byte(`{"name": "app", "dependencies": {"left-pad": "^1.0.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	subdir := filepath.Join(prefix, "src", "lib")
+	if err := os.MkdirAll(subdir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	// Commands start looking from the working directory
+	chdir(t, subdir)
+
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Install(context.Background(), nil, &depGraph, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "node_modules", "left-pad", "package.json")); err != nil {
+		t.Errorf("expected left-pad in the project's node_modules: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(subdir, "node_modules")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be installed in the subdirectory, got %v", err)
+	}
+}
+
+func TestInstallFromPackageJsonPath(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	projectDir := filepath.Join(t.TempDir(), "ci")
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(projectDir, "missing-npmrc"))
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	if err := os.MkdirAll(projectDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(projectDir, ".npmrc"), []byte("registry="+registry.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(projectDir, "manifest.json")
+	if err := os.WriteFile(manifest, []byte(`{"name": "app", "dependencies": {"left-pad": "^1.0.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The working directory has a project of its own that must be left alone
+	chdir(t, t.TempDir())
+	if err := os.WriteFile("package.json", []byte(`{"name": "other", "dependencies": {"missing-pkg": "1.0.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Install(context.Background(), []string{"-f", manifest}, &depGraph, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(projectDir, "node_modules", "left-pad", "package.json")); err != nil {
+		t.Errorf("expected left-pad next to the manifest: %v", err)
+	}
+	if _, err := os.Stat("node_modules"); !os.IsNotExist(err) {
+		t.Errorf("expected nothing installed in the working directory, got %v", err)
+	}
+
+	if _, err := Install(context.Background(), []string{"--package-json=" + manifest, "--prefix", projectDir}, &depGraph, nil); err == nil || !strings.Contains(err.Error(), "pass only one of them") {
+		t.Errorf("expected --prefix and --package-json to conflict, got %v", err)
+	}
+}
+
+func TestAddNoSaveLeavesPackageJsonAlone(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	prefix := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	if err := os.WriteFile(filepath.Join(prefix, ".npmrc"), []byte("registry="+registry.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	packageJson := []byte(`{"name": "app"}`)
+	if err := os.WriteFile(filepath.Join(prefix, "package.json"), packageJson, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Add(context.Background(), []string{"left-pad", "--no-save", "-D", "-E", "--prefix", prefix}, &depGraph, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "node_modules", "left-pad", "package.json")); err != nil {
+		t.Errorf("expected left-pad to be installed: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(prefix, "package.json")); err != nil || !bytes.Equal(content, packageJson) {
+		t.Errorf("expected package.json to be untouched, got %s %v", content, err)
+	}
+}
+
+func TestAddSavesWithSavePrefix(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	for _, test := range []struct {
+		savePrefix string
+		args       []string
+		expected   string
+	}{
+		{"", nil, "1.3.0"},
+		{"save-prefix=^", nil, "^1.3.0"},
+		{"save-prefix=~", nil, "~1.3.0"},
+		{"save-prefix=~", []string{"-E"}, "1.3.0"},
+	} {
+		prefix := t.TempDir()
+		t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+		if err := os.WriteFile(filepath.Join(prefix, ".npmrc"), []byte("registry="+registry.URL+"\n"+test.savePrefix+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(prefix, "package.json"), []byte(`{"name": "app"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+		args := append([]string{"left-pad", "--prefix", prefix}, test.args...)
+		if _, err := Add(context.Background(), args, &depGraph, nil); err != nil {
+			t.Fatalf("%q %v: unexpected error: %v", test.savePrefix, test.args, err)
+		}
+		content, err := os.ReadFile(filepath.Join(prefix, "package.json"))
+		if err != nil || !bytes.Contains(content, []byte(`"left-pad": "`+test.expected+`"`)) {
+			t.Errorf("%q %v: expected left-pad saved as %s, got %s %v", test.savePrefix, test.args, test.expected, content, err)
+		}
+	}
+}
+
+func TestAddSavesAlias(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	prefix := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+	if err := os.WriteFile(filepath.Join(prefix, ".npmrc"), []byte("registry="+registry.URL+"\nsave-prefix=^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(prefix, "package.json"), []byte(`{"name": "app"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Add(context.Background(), []string{"pad@npm:left-pad@^1.0.0", "--prefix", prefix}, &depGraph, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(prefix, "package.json"))
+	if err != nil || !bytes.Contains(content, []byte(`"pad": "npm:left-pad@^1.3.0"`)) {
+		t.Errorf("expected the alias saved with its target, got %s %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "node_modules", "pad", "package.json")); err != nil {
+		t.Errorf("expected left-pad installed under the alias: %v", err)
+	}
+}
+
+// Add the packages in args through reporter like the CLI does
+func reportAdd(depGraph *graph.Graph[string, string], reporter Reporter, args ...string) error {
+	specs, opts, err := ParseAddArgs(args)
+	if err != nil {
+		return err
+	}
+	return Report(reporter, opts, func(opts Options) (*utils.InstallResult, error) {
+		return RunAdd(context.Background(), specs, opts, depGraph)
+	})
+}
+
+func TestCIReporter(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	prefix := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+	if err := os.WriteFile(filepath.Join(prefix, ".npmrc"), []byte("registry="+registry.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(prefix, "package.json"), []byte(`{"name": "app"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if err := reportAdd(&depGraph, &ciReporter{out: &out}, "left-pad", "--prefix", prefix); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lines := strings.Split(out.String(), "\n"); lines[0] != "::group::fpm install" || lines[1] != "✔ Installed left-pad@1.3.0" || lines[2] != "::endgroup::" || !strings.HasPrefix(lines[3], "added 1 packages (0 dev) in ") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	out.Reset()
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if err := reportAdd(&depGraph, &ciReporter{out: &out}, "missing-pkg", "--prefix", prefix); err == nil {
+		t.Fatal("expected the missing package to fail")
+	}
+	if !strings.Contains(out.String(), "::endgroup::\n::error title=fpm install::cannot resolve missing-pkg@latest, required by the root: ") {
+		t.Errorf("expected the failure annotated, got:\n%s", out.String())
+	}
+}
+
+func TestJSONLinesReporter(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.LeftPad)
+	t.Setenv("FPM_CACHE_DIR", t.TempDir())
+	prefix := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+	if err := os.WriteFile(filepath.Join(prefix, ".npmrc"), []byte("registry="+registry.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(prefix, "package.json"), []byte(`{"name": "app"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if err := reportAdd(&depGraph, &jsonLinesReporter{out: &out}, "left-pad", "--prefix", prefix); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var types []string
+	var last installEvent
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		var event installEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("expected a JSON object per line, got %q: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339, event.Timestamp); err != nil {
+			t.Errorf("expected an RFC 3339 timestamp, got %q", event.Timestamp)
+		}
+		if len(types) == 0 || types[len(types)-1] != event.Type {
+			types = append(types, event.Type)
+		}
+		last = event
+	}
+	if expected := []string{"start", "resolve", "progress", "installed", "done"}; !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected the events %v, got %v", expected, types)
+	}
+	if last.Added != 1 || len(last.Errors) != 0 {
+		t.Errorf("expected done to report 1 added package, got %+v", last)
+	}
+
+	// Concurrent installs report at the same time, every line has to stay whole
+	out.Reset()
+	reporter := &jsonLinesReporter{out: &out}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reporter.OnDownloadProgress(fmt.Sprintf("pkg-%d", i), int64(i), 100)
+		}(i)
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for _, line := range lines {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("expected whole lines, got %q", line)
+		}
+	}
+	if len(lines) != 20 {
+		t.Errorf("expected 20 lines, got %d", len(lines))
+	}
+}
+
+func TestEscapeWorkflowCommand(t *testing.T) {
+	if got := escapeWorkflowCommand("100% broken\r\nsee log"); got != "100%25 broken%0D%0Asee log" {
+		t.Errorf("unexpected escape: %s", got)
+	}
+}
+
+func TestInstallCheckDoesNotInstall(t *testing.T) {
+	prefix := t.TempDir()
+	files := map[string]string{
+		"package.json":      `{"name": "app", "dependencies": {"left-pad": "^1.0.0"}}`,
+		"package-lock.json": `{"lockfileVersion": 3, "packages": {"node_modules/left-pad": {"version": "1.3.0"}}}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(prefix, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := Install(context.Background(), []string{"--check", "--prefix", prefix}, &depGraph, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "node_modules")); !os.IsNotExist(err) {
+		t.Errorf("expected --check to leave node_modules alone, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(prefix, "package.json"), []byte(`{"dependencies": {"left-pad": "^2.0.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Install(context.Background(), []string{"--check", "--prefix", prefix}, &depGraph, nil); !errors.Is(err, pkgmanager.ErrIntegrity) {
+		t.Errorf("expected an integrity error for an inconsistent lockfile, got %v", err)
+	}
+	if _, err := Install(context.Background(), []string{"--check", "left-pad"}, &depGraph, nil); err == nil {
+		t.Errorf("expected --check with package names to fail")
+	}
+}
+
+func TestInstallNodeModulesIsAFile(t *testing.T) {
+	prefix := t.TempDir()
+	t.Setenv("NPM_CONFIG_USERCONFIG", filepath.Join(prefix, "missing-npmrc"))
+	for name, content := range map[string]string{"package.json": `{"dependencies": {"left-pad": "^1.0.0"}}`, "node_modules": "stray"} {
+		if err := os.WriteFile(filepath.Join(prefix, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	_, err := Install(context.Background(), []string{"--prefix", prefix}, &depGraph, nil)
+	if !errors.Is(err, pkgmanager.ErrFilesystem) || !strings.Contains(err.Error(), filepath.Join(prefix, "node_modules")+" exists but is a file, not a directory, remove it") {
+		t.Errorf("expected a filesystem error naming node_modules, got %v", err)
+	}
+}
+
+func TestParseListArgs(t *testing.T) {
+	options, err := parseListArgs([]string{"--json", "--all"})
+	if err != nil || !options.json || options.depth != -1 {
+		t.Errorf("expected --json --all to keep the whole tree, got %+v %v", options, err)
+	}
+	options, err = parseListArgs([]string{"--json", "--depth=2"})
+	if err != nil || options.depth != 2 {
+		t.Errorf("expected a depth of 2, got %+v %v", options, err)
+	}
+	for _, args := range [][]string{{"--depth=-1", "--json"}, {"--all"}, {"--long"}} {
+		if _, err := parseListArgs(args); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
+
+func TestParseTimingFlag(t *testing.T) {
+	if _, opts, _ := ParseInstallArgs([]string{"--timing"}); opts.Timing != defaultTimingLimit {
+		t.Errorf("expected the default limit, got %d", opts.Timing)
+	}
+	_, opts, err := ParseInstallArgs([]string{"--timing=3"})
+	if err != nil || opts.Timing != 3 {
+		t.Fatalf("expected a limit of 3, got %d %v", opts.Timing, err)
+	}
+	installCtx := utils.NewInstallContext(t.TempDir())
+	opts.apply(installCtx)
+	if !installCtx.Timing {
+		t.Errorf("expected --timing to turn on timing")
+	}
+	if _, _, err := ParseInstallArgs([]string{"--timing=0"}); err == nil {
+		t.Errorf("expected an error for a limit below 1")
+	}
+}
+
+func TestPrintTimings(t *testing.T) {
+	timings := []utils.PackageTiming{
+		{Name: "typescript", Version: "5.4.5", Resolve: 120 * time.Millisecond, Download: 2300 * time.Millisecond, Extract: 900 * time.Millisecond},
+		{Name: "left-pad", Version: "1.3.0", Resolve: 40 * time.Millisecond, Download: 15 * time.Millisecond, Extract: time.Millisecond},
+		{Name: "ms", Version: "2.1.3", Resolve: 30 * time.Millisecond},
+	}
+
+	var out bytes.Buffer
+	if err := printTimings(&out, timings, 2); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+Slowest 2 package(s):
+Package           Total  Resolve  Download  Extract
+typescript@5.4.5  3.32s  120ms    2.3s      900ms
+left-pad@1.3.0    56ms   40ms     15ms      1ms
+`
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestPrintView(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+		"name": "left-pad",
+		"dist-tags": {"latest": "1.3.0", "next": "2.0.0-beta.1"},
+		"versions": {
+			"1.3.0": {"name": "left-pad", "version": "1.3.0", "description": "String left pad", "dependencies": {"b": "^2.0.0", "a": "~1.0.0"},
+				"dist": {"tarball": "https://registry.example.com/left-pad-1.3.0.tgz", "shasum": "abc", "integrity": "sha512-xyz"}},
+			"1.10.0-rc.1": {"name": "left-pad", "version": "1.10.0-rc.1"},
+			"2.0.0-beta.1": {"name": "left-pad", "version": "2.0.0-beta.1"},
+			"1.0.0": {"name": "left-pad", "version": "1.0.0"}
+		}
+	}`))
+	}))
+	defer server.Close()
+
+	metadata, err := pkgmanager.FetchPackageMetadata(context.Background(), server.URL+"/", "left-pad", "", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	packageInfo, _, err := metadata.Resolve("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := printView(&out, metadata, packageInfo); err != nil {
+		t.Fatal(err)
+	}
+	expected := `left-pad@1.3.0
+String left pad
+
+dist-tags:
+  latest: 1.3.0
+  next: 2.0.0-beta.1
+
+dependencies (2):
+  a: ~1.0.0
+  b: ^2.0.0
+
+tarball: https://registry.example.com/left-pad-1.3.0.tgz
+integrity: sha512-xyz
+shasum: abc
+`
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	out.Reset()
+	if err := printVersions(&out, metadata, false); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "1.0.0\n1.3.0\n1.10.0-rc.1\n2.0.0-beta.1\n" {
+		t.Errorf("expected versions oldest first, got %q", out.String())
+	}
+}
+
+func TestHandleViewArgs(t *testing.T) {
+	for _, args := range [][]string{{"fpm", "view"}, {"fpm", "view", "left-pad", "readme"}, {"fpm", "view", "left-pad", "--long"}} {
+		if err := HandleView(context.Background(), args); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
+
+func TestReportTable(t *testing.T) {
+	table := &reportTable{}
+	table.add(colorNone, "Package", "Current", "Latest")
+	table.add(colorGreen, "react", "18.3.1", "18.3.1")
+	table.add(colorRed, "left-pad", "missing", "1.3.0")
+
+	var plain bytes.Buffer
+	if err := table.print(&plain, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Package   Current  Latest\nreact     18.3.1   18.3.1\nleft-pad  missing  1.3.0\n"
+	if plain.String() != expected {
+		t.Errorf("expected aligned columns:\n%s\ngot:\n%s", expected, plain.String())
+	}
+
+	var colored bytes.Buffer
+	if err := table.print(&colored, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(colored.String(), colorGreen+"react     18.3.1   18.3.1"+colorReset) || strings.HasPrefix(colored.String(), "\033") {
+		t.Errorf("expected only the package rows to be colored, got %q", colored.String())
+	}
+}
+
+func TestUpdateColor(t *testing.T) {
+	tests := []struct{ current, latest, expected string }{
+		{"18.3.1", "18.3.1", colorGreen},
+		{"18.2.0", "18.3.1", colorYellow},
+		{"18.3.0", "18.3.1", colorYellow},
+		{"17.0.2", "18.3.1", colorRed},
+		{"", "18.3.1", colorRed},
+	}
+	for _, test := range tests {
+		if got := updateColor(test.current, test.latest); got != test.expected {
+			t.Errorf("updateColor(%q, %q) = %q, expected %q", test.current, test.latest, got, test.expected)
+		}
+	}
+}
+
+func TestColorEnabled(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if colorEnabled(file, false) {
+		t.Errorf("expected no color when the output isn't a terminal")
+	}
+	t.Setenv("NO_COLOR", "1")
+	if colorEnabled(os.Stdout, false) {
+		t.Errorf("expected NO_COLOR to disable color")
+	}
+}
+
+func TestParseLayoutFlags(t *testing.T) {
+	for arg, expected := range map[string]utils.Layout{"--legacy-bundling": utils.LayoutNested, "--node-linker=nested": utils.LayoutNested, "--node-linker=hoisted": utils.LayoutHoisted} {
+		var opts Options
+		if ok, err := parseEngineFlag(arg, &opts); !ok || err != nil || opts.Layout != expected {
+			t.Errorf("expected %s to pick %s, got %q %v", arg, expected, opts.Layout, err)
+		}
+	}
+}
+
+func TestParseTagAndBefore(t *testing.T) {
+	specs, opts, err := ParseAddArgs([]string{"react", "--tag", "beta", "--before", "2023-01-01"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(specs) != 1 || opts.Tag != "beta" || !opts.Before.Equal(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected parse: %v %+v", specs, opts)
+	}
+	if _, err := parseEngineFlag("--before=2023-06-01T12:00:00+02:00", &opts); err != nil || opts.Before.UTC().Hour() != 10 {
+		t.Errorf("expected an RFC 3339 timestamp, got %v %v", opts.Before, err)
+	}
+	for _, arg := range []string{"--before=yesterday", "--before=", "--tag="} {
+		if _, err := parseEngineFlag(arg, &opts); err == nil {
+			t.Errorf("expected an error for %s", arg)
+		}
+	}
+}
+
+func TestParseMaxRate(t *testing.T) {
+	for value, expected := range map[string]int64{"500000": 500000, "500k": 500 * 1024, "2M": 2 * 1024 * 1024} {
+		var opts Options
+		if _, err := parseEngineFlag("--max-rate="+value, &opts); err != nil || opts.MaxRate != expected {
+			t.Errorf("expected %s to be %d bytes/s, got %d %v", value, expected, opts.MaxRate, err)
+		}
+	}
+	for _, value := range []string{"", "0", "fast", "k"} {
+		var opts Options
+		if _, err := parseEngineFlag("--max-rate="+value, &opts); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/briandowns/spinner"
+	"github.com/jamesjellow/fpm/utils"
+)
+
+// cliObserver is the default reporter, it drives the terminal spinner from install events and prints a summary
+type cliObserver struct {
+	utils.NopObserver
+	spinner *spinner.Spinner
+}
+
+// Create the spinner, it only runs between Start and Finish
+func newCLIObserver() *cliObserver {
+	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
+	s.Suffix = " Resolving dependencies"
+	return &cliObserver{spinner: s}
+}
+
+func (o *cliObserver) Start() {
+	o.spinner.Start()
+}
+
+func (o *cliObserver) Progress() io.Writer {
+	return os.Stdout
+}
+
+func (o *cliObserver) Finish(report InstallReport) error {
+	o.spinner.Stop()
+	if report.Err != nil || report.Result == nil {
+		return report.Err
+	}
+	printSummary(report.Result)
+	return printTimings(os.Stdout, report.Result.Timings, report.Timings)
+}
+
+func (o *cliObserver) OnResolve(name, versionRange, version string) {
+	o.setSuffix(fmt.Sprintf(" Installing %s@%s", name, version))
+}
+
+func (o *cliObserver) OnDownloadProgress(name string, done, total int64) {
+	if total > 0 {
+		o.setSuffix(fmt.Sprintf(" Downloading %s %d%%", name, done*100/total))
+	}
+}
+
+func (o *cliObserver) setSuffix(suffix string) {
+	o.spinner.Lock()
+	o.spinner.Suffix = suffix
+	o.spinner.Unlock()
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesjellow/fpm/utils"
+)
+
+// Reporter presents an install. It is told about each package through the Observer events and reports the
+// outcome once the install is over, select one with --reporter=<name>
+type Reporter interface {
+	utils.Observer
+	Start()                            // The install is about to begin
+	Progress() io.Writer               // Where the install prints a line for each package it installs
+	Finish(report InstallReport) error // The install is over, returns the error the command fails with
+}
+
+// InstallReport is what a reporter is given once an install is over
+type InstallReport struct {
+	Result  *utils.InstallResult // Nil when the install failed before it began
+	Err     error
+	Elapsed time.Duration
+	Timings int // How many of the slowest packages --timing asked to list, 0 lists none
+}
+
+var (
+	reportersMutex sync.Mutex
+	reporters      = map[string]func() Reporter{
+		"default":    func() Reporter { return newCLIObserver() },
+		"json":       func() Reporter { return jsonReporter{} },
+		"silent":     func() Reporter { return silentReporter{} },
+		"ci":         func() Reporter { return &ciReporter{out: os.Stdout} },
+		"json-lines": func() Reporter { return &jsonLinesReporter{out: os.Stdout} },
+	}
+)
+
+// RegisterReporter makes a reporter available to --reporter=<name>, replacing any registered under that name
+func RegisterReporter(name string, newReporter func() Reporter) {
+	reportersMutex.Lock()
+	defer reportersMutex.Unlock()
+	reporters[name] = newReporter
+}
+
+// NewReporter creates the reporter registered under name, an empty name is the default spinner
+func NewReporter(name string) (Reporter, error) {
+	if name == "" {
+		name = "default"
+	}
+	reportersMutex.Lock()
+	defer reportersMutex.Unlock()
+	newReporter, ok := reporters[name]
+	if !ok {
+		names := make([]string, 0, len(reporters))
+		for registered := range reporters {
+			names = append(names, registered)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown reporter %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return newReporter(), nil
+}
+
+// Report runs install, an add or install with opts, through reporter from Start to Finish. A nil reporter is
+// picked from opts, --json-lines and --json ask for their reporters and otherwise it is the spinner. The reporter
+// observes the install and gets its output, a check only reports as JSON as it installs nothing
+func Report(reporter Reporter, opts Options, install func(opts Options) (*utils.InstallResult, error)) error {
+	switch {
+	case reporter != nil:
+	case opts.JSONLines:
+		reporter = &jsonLinesReporter{out: os.Stdout}
+	case opts.JSON:
+		reporter = jsonReporter{}
+	default:
+		reporter = newCLIObserver()
+	}
+	if _, ok := reporter.(jsonReporter); opts.Check && !ok {
+		_, err := install(opts)
+		return err
+	}
+
+	opts.Observer = reporter
+	opts.Output = reporter.Progress()
+	start := time.Now()
+	reporter.Start()
+	result, err := install(opts)
+	return reporter.Finish(InstallReport{Result: result, Err: err, Elapsed: time.Since(start), Timings: opts.Timing})
+}
+
+// jsonReporter prints the result as JSON on stdout, like --json
+type jsonReporter struct {
+	utils.NopObserver
+}
+
+func (jsonReporter) Start() {}
+
+func (jsonReporter) Progress() io.Writer {
+	return os.Stderr
+}
+
+func (jsonReporter) Finish(report InstallReport) error {
+	return printJSONReport(report.Result, report.Err, report.Elapsed)
+}
+
+// silentReporter prints nothing, the exit code is all there is
+type silentReporter struct {
+	utils.NopObserver
+}
+
+func (silentReporter) Start() {}
+
+func (silentReporter) Progress() io.Writer {
+	return io.Discard
+}
+
+func (silentReporter) Finish(report InstallReport) error {
+	return report.Err
+}
+
+// jsonLinesReporter streams every install event as it happens, one JSON object per line on stdout, so a parent
+// process can drive its own progress bar. Events from concurrent installs are written one whole line at a time
+type jsonLinesReporter struct {
+	out   io.Writer
+	mu    sync.Mutex
+	start time.Time
+}
+
+// installEvent is one line of --json-lines output
+type installEvent struct {
+	Type      string   `json:"type"` // start, resolve, progress, installed, error or done
+	Package   string   `json:"package,omitempty"`
+	Range     string   `json:"range,omitempty"`   // resolve: the range the version was picked for
+	Version   string   `json:"version,omitempty"` // resolve and installed
+	Bytes     int64    `json:"bytes,omitempty"`   // progress: bytes of the tarball downloaded so far
+	Total     int64    `json:"total,omitempty"`   // progress: size of the tarball, -1 when the registry didn't say
+	Error     string   `json:"error,omitempty"`   // error
+	Added     int      `json:"added,omitempty"`   // done: how many packages were installed
+	Errors    []string `json:"errors,omitempty"`  // done: every failure of the install
+	ElapsedMs int64    `json:"elapsedMs,omitempty"`
+	Timestamp string   `json:"timestamp"` // RFC 3339 with milliseconds
+}
+
+func (r *jsonLinesReporter) Start() {
+	r.start = time.Now()
+	r.emit(installEvent{Type: "start"})
+}
+
+func (r *jsonLinesReporter) Progress() io.Writer {
+	return os.Stderr
+}
+
+func (r *jsonLinesReporter) OnResolve(name, versionRange, version string) {
+	r.emit(installEvent{Type: "resolve", Package: name, Range: versionRange, Version: version})
+}
+
+func (r *jsonLinesReporter) OnDownloadProgress(name string, done, total int64) {
+	r.emit(installEvent{Type: "progress", Package: name, Bytes: done, Total: total})
+}
+
+func (r *jsonLinesReporter) OnInstalled(name, version string) {
+	r.emit(installEvent{Type: "installed", Package: name, Version: version})
+}
+
+func (r *jsonLinesReporter) OnError(name string, err error) {
+	r.emit(installEvent{Type: "error", Package: name, Error: err.Error()})
+}
+
+func (r *jsonLinesReporter) Finish(report InstallReport) error {
+	event := installEvent{Type: "done", ElapsedMs: report.Elapsed.Milliseconds()}
+	if report.Result != nil {
+		event.Added = len(report.Result.Packages)
+	}
+	var failures installFailures
+	switch {
+	case errors.As(report.Err, &failures):
+		for _, failure := range failures {
+			event.Errors = append(event.Errors, failure.Error())
+		}
+	case report.Err != nil:
+		event.Errors = []string{report.Err.Error()}
+	}
+	r.emit(event)
+	return report.Err
+}
+
+// Write the event as one line and flush it, so the parent process sees it right away
+func (r *jsonLinesReporter) emit(event installEvent) {
+	event.Timestamp = time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.out.Write(append(data, '\n'))
+	if flusher, ok := r.out.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+}
+
+// ciReporter folds the install into a GitHub Actions log group and annotates every failure and engine mismatch
+type ciReporter struct {
+	utils.NopObserver
+	out      io.Writer
+	mu       sync.Mutex
+	failures []string
+}
+
+func (r *ciReporter) Start() {
+	fmt.Fprintln(r.out, "::group::fpm install")
+}
+
+func (r *ciReporter) Progress() io.Writer {
+	return r.out
+}
+
+func (r *ciReporter) OnError(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = append(r.failures, fmt.Sprintf("%s: %v", name, err))
+}
+
+func (r *ciReporter) Finish(report InstallReport) error {
+	fmt.Fprintln(r.out, "::endgroup::")
+
+	r.mu.Lock()
+	failures := r.failures
+	r.mu.Unlock()
+	if len(failures) == 0 && report.Err != nil {
+		failures = []string{report.Err.Error()}
+	}
+	for _, failure := range failures {
+		fmt.Fprintf(r.out, "::error title=fpm install::%s\n", escapeWorkflowCommand(failure))
+	}
+	if report.Result == nil {
+		return report.Err
+	}
+	for _, mismatch := range report.Result.Engines {
+		message := fmt.Sprintf("%s@%s wants node %s, this is %s", mismatch.Name, mismatch.Version, mismatch.Required, mismatch.Detected)
+		fmt.Fprintf(r.out, "::warning title=unsupported engine::%s\n", escapeWorkflowCommand(message))
+	}
+	if report.Err != nil {
+		return report.Err
+	}
+
+	dev := 0
+	for _, pkg := range report.Result.Packages {
+		if pkg.Dev {
+			dev++
+		}
+	}
+	fmt.Fprintf(r.out, "added %d packages (%d dev) in %s\n", len(report.Result.Packages), dev, formatDuration(report.Elapsed))
+	if report.Timings > 0 {
+		return printTimings(r.out, report.Result.Timings, report.Timings)
+	}
+	return nil
+}
+
+// Escape a workflow command message the way GitHub Actions expects, so a multi-line error stays one annotation
+func escapeWorkflowCommand(message string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(message)
+}
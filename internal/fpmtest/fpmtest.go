@@ -0,0 +1,118 @@
+// Package fpmtest serves packages like an npm registry for the tests of fpm's packages
+package fpmtest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Package is a package version served by NewRegistry, PackageJson is the tarball's package.json
+type Package struct {
+	Name        string
+	Version     string
+	PackageJson string
+}
+
+// Tarball packs packageJson as the only file of an npm tarball, the same package.json always packs to the same bytes
+func Tarball(packageJson string) []byte {
+	var buffer bytes.Buffer
+	gzw := gzip.NewWriter(&buffer)
+	tw := tar.NewWriter(gzw)
+	if err := tw.WriteHeader(&tar.Header{Name: "package/package.json", Mode: 0644, Size: int64(len(packageJson)), Typeflag: tar.TypeReg}); err != nil {
+		panic(err)
+	}
+	if _, err := tw.Write([]byte(packageJson)); err != nil {
+		panic(err)
+	}
+	tw.Close()
+	gzw.Close()
+	return buffer.Bytes()
+}
+
+// Tarball packs the package's package.json
+func (p Package) Tarball() []byte {
+	return Tarball(p.PackageJson)
+}
+
+// Shasum is the hex sha1 of the package's tarball, as published in dist.shasum
+func (p Package) Shasum() string {
+	return fmt.Sprintf("%x", sha1.Sum(p.Tarball()))
+}
+
+// Integrity is the sha512 of the package's tarball, as published in dist.integrity
+func (p Package) Integrity() string {
+	digest := sha512.Sum512(p.Tarball())
+	return "sha512-" + base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// NewRegistry serves the metadata of each package at /<name> and its tarball under /tarballs, like the npm
+// registry does. The metadata has an ETag so it can be cached, the server is closed when the test ends
+func NewRegistry(t testing.TB, packages ...Package) *httptest.Server {
+	t.Helper()
+
+	tarballs := make(map[string][]byte)
+	metadata := make(map[string]map[string]interface{})
+	server := httptest.NewUnstartedServer(nil)
+	baseURL := "http://" + server.Listener.Addr().String()
+
+	for _, pkg := range packages {
+		tarballPath := fmt.Sprintf("/tarballs/%s-%s.tgz", url.PathEscape(pkg.Name), pkg.Version)
+		tarballs[tarballPath] = pkg.Tarball()
+
+		if metadata[pkg.Name] == nil {
+			metadata[pkg.Name] = map[string]interface{}{
+				"name":      pkg.Name,
+				"dist-tags": map[string]interface{}{},
+				"versions":  map[string]interface{}{},
+			}
+		}
+		metadata[pkg.Name]["dist-tags"].(map[string]interface{})["latest"] = pkg.Version
+		// Like a real registry the version document is the package.json plus dist
+		versionDoc := map[string]interface{}{}
+		json.Unmarshal([]byte(pkg.PackageJson), &versionDoc)
+		versionDoc["name"] = pkg.Name
+		versionDoc["version"] = pkg.Version
+		versionDoc["dist"] = map[string]interface{}{
+			"tarball":   baseURL + tarballPath,
+			"shasum":    pkg.Shasum(),
+			"integrity": pkg.Integrity(),
+		}
+		metadata[pkg.Name]["versions"].(map[string]interface{})[pkg.Version] = versionDoc
+	}
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tarball, ok := tarballs[r.URL.EscapedPath()]; ok {
+			w.Write(tarball)
+			return
+		}
+		name, _ := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/"))
+		if packageMetadata, ok := metadata[name]; ok {
+			document, err := json.Marshal(packageMetadata)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha1.Sum(document)))
+			w.Write(document)
+			return
+		}
+		http.NotFound(w, r)
+	})
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// LeftPad is left-pad@1.3.0, the package most install tests need one of
+var LeftPad = Package{Name: "left-pad", Version: "1.3.0", PackageJson: `{"name": "left-pad", "version": "1.3.0"}`}
@@ -0,0 +1,62 @@
+package pkgmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Advisory is a known vulnerability returned by the NPM bulk advisory endpoint
+type Advisory struct {
+	ID                 int    `json:"id"`
+	Title              string `json:"title"`
+	URL                string `json:"url"`
+	Severity           string `json:"severity"`
+	VulnerableVersions string `json:"vulnerable_versions"`
+	PatchedVersions    string `json:"patched_versions,omitempty"`
+}
+
+// FetchAdvisories is Client.FetchAdvisories with the default settings
+func FetchAdvisories(ctx context.Context, registry string, installed map[string][]string) (map[string][]Advisory, error) {
+	return defaultClient.FetchAdvisories(ctx, registry, installed)
+}
+
+// FetchAdvisories posts the installed name -> versions set to the registry and returns the advisories per package
+func (c *Client) FetchAdvisories(ctx context.Context, registry string, installed map[string][]string) (map[string][]Advisory, error) {
+	body, err := json.Marshal(installed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit request: %v", err)
+	}
+
+	auditURL := fmt.Sprintf("%s/-/npm/v1/security/advisories/bulk", strings.TrimSuffix(registry, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, auditURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http().Do(req)
+	if err != nil {
+		return nil, Classify(ErrNetwork, fmt.Errorf("failed to fetch advisories: %v", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, Classify(ErrNetwork, fmt.Errorf("failed to fetch advisories: %v", resp.Status))
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, Classify(ErrNetwork, fmt.Errorf("failed to read advisories: %v", err))
+	}
+
+	advisories := make(map[string][]Advisory)
+	if err := json.Unmarshal(respBody, &advisories); err != nil {
+		return nil, fmt.Errorf("failed to decode advisories: %v", err)
+	}
+
+	return advisories, nil
+}
@@ -0,0 +1,58 @@
+package pkgmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchAdvisories(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/-/npm/v1/security/advisories/bulk" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+
+		var installed map[string][]string
+		if err := json.NewDecoder(r.Body).Decode(&installed); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		if len(installed["lodash"]) != 1 || installed["lodash"][0] != "4.17.15" {
+			t.Errorf("unexpected request body: %v", installed)
+		}
+
+		w.Write([]byte(`{"lodash": [{"id": 1, "title": "Prototype Pollution", "severity": "high", "vulnerable_versions": "<4.17.19"}]}`))
+	}))
+	defer server.Close()
+
+	advisories, err := FetchAdvisories(context.Background(), server.URL, map[string][]string{"lodash": {"4.17.15"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(advisories["lodash"]) != 1 || advisories["lodash"][0].Severity != "high" {
+		t.Errorf("unexpected advisories: %+v", advisories)
+	}
+}
+
+func TestFetchAdvisoriesErrors(t *testing.T) {
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`not json`))
+	}))
+	defer invalid.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	_, err := FetchAdvisories(context.Background(), invalid.URL, map[string][]string{"lodash": {"4.17.15"}})
+	if err == nil || !strings.HasPrefix(err.Error(), "failed to decode advisories: ") {
+		t.Errorf("expected a decode error, got %v", err)
+	}
+	_, err = FetchAdvisories(context.Background(), unavailable.URL, map[string][]string{"lodash": {"4.17.15"}})
+	if !errors.Is(err, ErrNetwork) || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected a network error with the status, got %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package pkgmanager
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultCacheDir returns the tarball cache location, FPM_CACHE_DIR overrides the default of ~/.fpm/cache
+func DefaultCacheDir() string {
+	if dir := os.Getenv("FPM_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".fpm", "cache")
+}
+
+// cachedTarballPath returns where a tarball with the given shasum lives in the cache
+func cachedTarballPath(cacheDir, shasum string) string {
+	return filepath.Join(cacheDir, "tarballs", shasum+".tgz")
+}
+
+// cachedIntegrityPath returns where the sha512 integrity a cached tarball was verified against is recorded
+func cachedIntegrityPath(cacheDir, shasum string) string {
+	return filepath.Join(cacheDir, "tarballs", shasum+".integrity")
+}
+
+// Read the integrity recorded for the tarball cached under shasum, empty when none was
+func recordedIntegrity(cacheDir, shasum string) string {
+	content, err := os.ReadFile(cachedIntegrityPath(cacheDir, shasum))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// Remove the tarball cached under shasum along with its recorded integrity
+func evictCacheEntry(cacheDir, shasum string) error {
+	if err := os.Remove(cachedTarballPath(cacheDir, shasum)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(cachedIntegrityPath(cacheDir, shasum)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Check the cached tarball at path against its shasum and the sha512 of integrity, or of the integrity recorded
+// for it when integrity has none
+func checkCacheEntry(cacheDir, shasum, integrity, path string) error {
+	calculatedShasum, err := fileShasum(path)
+	if err != nil {
+		return err
+	}
+	if calculatedShasum != shasum {
+		return fmt.Errorf("expected %s, got %s", shasum, calculatedShasum)
+	}
+	if SHA512(integrity) == "" {
+		integrity = recordedIntegrity(cacheDir, shasum)
+	}
+	return checkIntegrity(path, integrity)
+}
+
+// cachedMetadata is a registry metadata response kept for revalidation with its validators
+type cachedMetadata struct {
+	URL          string          `json:"url"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"lastModified,omitempty"`
+	Body         json.RawMessage `json:"body"`
+}
+
+// cachedMetadataPath returns where the metadata fetched from a URL lives in the cache
+func cachedMetadataPath(cacheDir, metadataURL string) string {
+	return filepath.Join(cacheDir, "metadata", fmt.Sprintf("%x.json", sha1.Sum([]byte(metadataURL))))
+}
+
+// readMetadataCache returns the cached metadata for a URL, or nil when there is none or it can't be read
+func readMetadataCache(cacheDir, metadataURL string) *cachedMetadata {
+	if cacheDir == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(cachedMetadataPath(cacheDir, metadataURL))
+	if err != nil {
+		return nil
+	}
+	var cached cachedMetadata
+	if err := json.Unmarshal(content, &cached); err != nil || cached.URL != metadataURL {
+		return nil
+	}
+	return &cached
+}
+
+// writeMetadataCache stores a metadata response that has a validator, failures only cost a future full fetch
+func writeMetadataCache(cacheDir string, cached *cachedMetadata) {
+	if cacheDir == "" || (cached.ETag == "" && cached.LastModified == "") {
+		return
+	}
+
+	content, err := json.Marshal(cached)
+	if err != nil {
+		log.Printf("failed to encode metadata cache entry: %v", err)
+		return
+	}
+
+	cachedPath := cachedMetadataPath(cacheDir, cached.URL)
+	if err := os.MkdirAll(filepath.Dir(cachedPath), os.ModePerm); err != nil {
+		log.Printf("failed to create cache directory: %v", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cachedPath), ".fpm-metadata-*")
+	if err != nil {
+		log.Printf("failed to write metadata cache entry: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		log.Printf("failed to write metadata cache entry: %v", err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		log.Printf("failed to write metadata cache entry: %v", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), cachedPath); err != nil {
+		log.Printf("failed to write metadata cache entry: %v", err)
+	}
+}
+
+// readFromCache copies a cached tarball to destPath after re-verifying its shasum and its sha512, against
+// integrity when the caller has one and otherwise against the integrity recorded with it. A corrupt entry is
+// evicted and reported as a miss so the caller falls back to a fresh download
+func readFromCache(cacheDir, shasum, integrity, destPath string) bool {
+	if cacheDir == "" || shasum == "" {
+		return false
+	}
+
+	cachedPath := cachedTarballPath(cacheDir, shasum)
+	if _, err := os.Stat(cachedPath); err != nil {
+		return false
+	}
+	if err := checkCacheEntry(cacheDir, shasum, integrity, cachedPath); err != nil {
+		log.Printf("evicting corrupt cache entry %s: %v", cachedPath, err)
+		if err := evictCacheEntry(cacheDir, shasum); err != nil {
+			log.Printf("failed to evict cache entry: %v", err)
+		}
+		return false
+	}
+
+	if err := copyFile(cachedPath, destPath); err != nil {
+		log.Printf("failed to copy cached tarball: %v", err)
+		return false
+	}
+	return true
+}
+
+// writeToCache stores a verified tarball in the cache along with its sha512 integrity, when it has one, so later
+// reads and `cache verify` check that too. Failures only cost a future download
+func writeToCache(cacheDir, shasum, integrity, srcPath string) {
+	if cacheDir == "" || shasum == "" {
+		return
+	}
+
+	cachedPath := cachedTarballPath(cacheDir, shasum)
+	if err := os.MkdirAll(filepath.Dir(cachedPath), os.ModePerm); err != nil {
+		log.Printf("failed to create cache directory: %v", err)
+		return
+	}
+	if err := copyFile(srcPath, cachedPath); err != nil {
+		log.Printf("failed to write cache entry: %v", err)
+		return
+	}
+	if digest := SHA512(integrity); digest != "" {
+		if err := os.WriteFile(cachedIntegrityPath(cacheDir, shasum), []byte("sha512-"+digest+"\n"), 0644); err != nil {
+			log.Printf("failed to record the integrity of cache entry: %v", err)
+		}
+	}
+}
+
+// VerifyCache re-hashes every cached tarball against its shasum and the sha512 integrity recorded with it, and
+// returns the total checked and the paths of corrupt entries, removing the corrupt ones when remove is set
+func VerifyCache(cacheDir string, remove bool) (int, []string, error) {
+	entries, err := os.ReadDir(filepath.Join(cacheDir, "tarballs"))
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read cache: %v", err)
+	}
+
+	checked := 0
+	var corrupt []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".tgz") {
+			continue
+		}
+		checked++
+
+		expectedShasum := strings.TrimSuffix(entry.Name(), ".tgz")
+		cachedPath := cachedTarballPath(cacheDir, expectedShasum)
+		if checkCacheEntry(cacheDir, expectedShasum, "", cachedPath) == nil {
+			continue
+		}
+
+		corrupt = append(corrupt, cachedPath)
+		if remove {
+			if err := evictCacheEntry(cacheDir, expectedShasum); err != nil {
+				return checked, corrupt, fmt.Errorf("failed to remove corrupt cache entry: %v", err)
+			}
+		}
+	}
+
+	sort.Strings(corrupt)
+	return checked, corrupt, nil
+}
+
+// fileShasum computes the hex sha1 of a file, the same digest the registry publishes as dist.shasum
+func fileShasum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha1.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// copyFile copies src to dst through a temp file so readers never see a partial dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".fpm-copy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
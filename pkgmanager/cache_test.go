@@ -0,0 +1,114 @@
+package pkgmanager
+
+import (
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func writeCacheEntry(t *testing.T, cacheDir string, content []byte, corrupt bool) string {
+	t.Helper()
+	shasum := fmt.Sprintf("%x", sha1.Sum(content))
+	path := cachedTarballPath(cacheDir, shasum)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if corrupt {
+		content = append(content, "garbage"...)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return shasum
+}
+
+func TestReadFromCacheEvictsCorruptEntry(t *testing.T) {
+	cacheDir := t.TempDir()
+	shasum := writeCacheEntry(t, cacheDir, []byte("tarball"), true)
+
+	destPath := filepath.Join(t.TempDir(), "pkg.tgz")
+	if readFromCache(cacheDir, shasum, "", destPath) {
+		t.Fatalf("expected a corrupt entry to be a cache miss")
+	}
+	if _, err := os.Stat(cachedTarballPath(cacheDir, shasum)); !os.IsNotExist(err) {
+		t.Errorf("expected corrupt entry to be evicted")
+	}
+}
+
+func TestReadFromCacheHit(t *testing.T) {
+	cacheDir := t.TempDir()
+	shasum := writeCacheEntry(t, cacheDir, []byte("tarball"), false)
+
+	destPath := filepath.Join(t.TempDir(), "pkg.tgz")
+	if !readFromCache(cacheDir, shasum, "", destPath) {
+		t.Fatalf("expected a cache hit")
+	}
+	content, err := os.ReadFile(destPath)
+	if err != nil || string(content) != "tarball" {
+		t.Errorf("unexpected cached content %q: %v", content, err)
+	}
+}
+
+func TestReadFromCacheChecksIntegrity(t *testing.T) {
+	cacheDir := t.TempDir()
+	shasum := writeCacheEntry(t, cacheDir, []byte("tarball"), false)
+	other := sha512.Sum512([]byte("something else"))
+	otherIntegrity := "sha512-" + base64.StdEncoding.EncodeToString(other[:])
+
+	// The caller's integrity is checked even though the shasum matches
+	if readFromCache(cacheDir, shasum, otherIntegrity, filepath.Join(t.TempDir(), "pkg.tgz")) {
+		t.Fatalf("expected an entry that fails the integrity to be a cache miss")
+	}
+	if _, err := os.Stat(cachedTarballPath(cacheDir, shasum)); !os.IsNotExist(err) {
+		t.Errorf("expected the entry failing the integrity to be evicted")
+	}
+
+	// Without one the integrity recorded with the entry is checked
+	shasum = writeCacheEntry(t, cacheDir, []byte("tarball"), false)
+	if err := os.WriteFile(cachedIntegrityPath(cacheDir, shasum), []byte(otherIntegrity), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if readFromCache(cacheDir, shasum, "", filepath.Join(t.TempDir(), "pkg.tgz")) {
+		t.Fatalf("expected an entry failing its recorded integrity to be a cache miss")
+	}
+	if _, err := os.Stat(cachedIntegrityPath(cacheDir, shasum)); !os.IsNotExist(err) {
+		t.Errorf("expected the recorded integrity to be evicted with the entry")
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	writeCacheEntry(t, cacheDir, []byte("good"), false)
+	badShasum := writeCacheEntry(t, cacheDir, []byte("bad"), true)
+	// The shasum of this one matches, the sha512 recorded with it doesn't
+	tamperedShasum := writeCacheEntry(t, cacheDir, []byte("tampered"), false)
+	other := sha512.Sum512([]byte("something else"))
+	if err := os.WriteFile(cachedIntegrityPath(cacheDir, tamperedShasum), []byte("sha512-"+base64.StdEncoding.EncodeToString(other[:])), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checked, corrupt, err := VerifyCache(cacheDir, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{cachedTarballPath(cacheDir, badShasum), cachedTarballPath(cacheDir, tamperedShasum)}
+	sort.Strings(expected)
+	if checked != 3 || !reflect.DeepEqual(corrupt, expected) {
+		t.Fatalf("unexpected result: checked=%d corrupt=%v", checked, corrupt)
+	}
+
+	if _, _, err := VerifyCache(cacheDir, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, path := range append(corrupt, cachedIntegrityPath(cacheDir, tamperedShasum)) {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", path)
+		}
+	}
+}
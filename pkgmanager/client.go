@@ -0,0 +1,359 @@
+package pkgmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/jamesjellow/fpm/config"
+)
+
+// Version is the fpm version sent in the User-Agent, release builds set it with
+// -ldflags "-X github.com/jamesjellow/fpm/pkgmanager.Version=1.2.3"
+var Version = "dev"
+
+// Accept headers for metadata requests. The abbreviated document only has what installs need, registries
+// that don't support it fall back to the full one
+const (
+	abbreviatedMetadataAccept = "application/vnd.npm.install-v1+json; q=1.0, application/json; q=0.8, */*"
+	fullMetadataAccept        = "application/json"
+)
+
+// Client fetches metadata, tarballs and advisories with the settings of one install, so installs with different
+// settings can run side by side. The zero value uses the defaults, NewClient applies the .npmrc settings
+type Client struct {
+	Transport RegistryClient // What metadata and tarballs are fetched through, nil fetches them from the registries over HTTP
+	Limiter   *RateLimiter   // Caps the combined rate of the client's downloads, nil is unlimited
+
+	// MetadataDir resolves versions against the metadata documents in it, one <dir>/<name>.json per package, like
+	// <dir>/@types/node.json, so resolution never touches the network. Tarballs still come from the tarball URLs
+	// in the documents, which may point at local files. Empty asks the registry
+	MetadataDir string
+
+	// Offline makes metadata come from the cached documents, without revalidating them, and tarballs from the
+	// cached copies. Anything not in the cache fails instead of being fetched
+	Offline bool
+
+	httpClient     *http.Client // nil uses defaultHTTPClient
+	metadataAccept string       // The Accept header of metadata requests, empty asks for the abbreviated document
+	flights        flightGroup  // Concurrent fetches of the same metadata document through this client
+}
+
+// NewClient builds a client with the proxy, TLS, auth, user-agent and metadata settings of cfg
+func NewClient(cfg *config.Config) (*Client, error) {
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	metadataAccept := fullMetadataAccept
+	if cfg.Abbreviated {
+		metadataAccept = abbreviatedMetadataAccept
+	}
+	return &Client{httpClient: httpClient, metadataAccept: metadataAccept}, nil
+}
+
+// defaultHTTPClient is what clients not built from a config send requests with, the defaults can't fail to build
+var defaultHTTPClient, _ = newHTTPClient(config.Default())
+
+// defaultClient is what the package-level functions fetch with
+var defaultClient = &Client{}
+
+func (c *Client) http() *http.Client {
+	if c.httpClient == nil {
+		return defaultHTTPClient
+	}
+	return c.httpClient
+}
+
+func (c *Client) accept() string {
+	if c.metadataAccept == "" {
+		return abbreviatedMetadataAccept
+	}
+	return c.metadataAccept
+}
+
+func (c *Client) transport() RegistryClient {
+	if c.Transport == nil {
+		return httpRegistryClient{client: c}
+	}
+	return c.Transport
+}
+
+// errNotAcceptable is returned when a registry answers 406 Not Acceptable to the Accept header
+var errNotAcceptable = errors.New("registry doesn't serve the requested metadata format")
+
+// getMetadata fetches a registry metadata document in the format accept asks for. A cached copy is revalidated
+// with If-None-Match and If-Modified-Since and reused when the registry answers 304 Not Modified
+func (c *Client) getMetadata(ctx context.Context, metadataURL, cacheDir, accept string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+
+	cacheKey := metadataCacheKey(metadataURL, accept)
+	cached := readMetadataCache(cacheDir, cacheKey)
+	if c.Offline {
+		if cached == nil {
+			return nil, errOffline(metadataURL)
+		}
+		return cached.Body, nil
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := c.doMetadataRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.Body, nil
+	}
+	if resp.StatusCode == http.StatusNotAcceptable {
+		return nil, errNotAcceptable
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, Classify(ErrNetwork, fmt.Errorf("failed to fetch package info: %v", resp.Status))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, Classify(ErrNetwork, err)
+	}
+
+	writeMetadataCache(cacheDir, &cachedMetadata{
+		URL:          cacheKey,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Body:         body,
+	})
+	return body, nil
+}
+
+// Send a metadata request through the shared throttle. A 429 slows every metadata request down and the
+// request is sent again once the throttle allows it, the last 429 is returned like any other response
+func (c *Client) doMetadataRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if err := metadataThrottle.wait(ctx); err != nil {
+			return nil, err
+		}
+		resp, err := c.http().Do(req)
+		if err != nil {
+			return nil, Classify(ErrNetwork, err)
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt == rateLimitAttempts {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		log.Printf("%s answered 429 Too Many Requests, slowing down metadata requests and retrying in %s", req.URL.Host, retryAfter)
+		metadataThrottle.backOff(retryAfter)
+	}
+}
+
+// metadataCacheKey is what a metadata response is cached under, the abbreviated and full documents are
+// different bodies with their own validators
+func metadataCacheKey(metadataURL, accept string) string {
+	if accept == fullMetadataAccept {
+		return metadataURL
+	}
+	return metadataURL + "#abbreviated"
+}
+
+// newHTTPClient builds a client with connection timeouts that uses the configured proxy, falling back to
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY, and sends the configured auth tokens to their registries
+func newHTTPClient(cfg *config.Config) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:           proxyFunc(cfg),
+		TLSClientConfig: tlsConfig,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &http.Client{
+		Transport:     &authTransport{base: &userAgentTransport{base: transport, userAgent: userAgent(cfg)}, tokens: cfg.AuthTokens, headers: cfg.Headers},
+		CheckRedirect: redirectPolicy(cfg),
+	}, nil
+}
+
+// publicRegistryHost serves the public registry's metadata and tarballs
+const publicRegistryHost = "registry.npmjs.org"
+
+// redirectPolicy keeps the default limit of 10 redirects and, with restrict-tarball-hosts, refuses redirects to
+// any host other than the registries, the public registry and the configured tarball-hosts
+func redirectPolicy(cfg *config.Config) func(*http.Request, []*http.Request) error {
+	allowed := map[string]bool{publicRegistryHost: true}
+	registries := []string{cfg.Registry}
+	for _, registry := range cfg.ScopeRegistries {
+		registries = append(registries, registry)
+	}
+	for _, registry := range registries {
+		if registryURL, err := url.Parse(registry); err == nil && registryURL.Hostname() != "" {
+			allowed[registryURL.Hostname()] = true
+		}
+	}
+	for _, host := range cfg.TarballHosts {
+		allowed[host] = true
+	}
+
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		if cfg.RestrictHosts && !allowed[req.URL.Hostname()] {
+			return fmt.Errorf("refusing redirect from %s to untrusted host %s, add it to tarball-hosts to allow it", via[0].URL.Hostname(), req.URL.Hostname())
+		}
+		return nil
+	}
+}
+
+// newTLSConfig trusts the system roots plus the configured CA bundle, or nothing at all when strict-ssl is off
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if !cfg.StrictSSL {
+		log.Printf("WARNING: TLS certificate verification is disabled (strict-ssl=false), registry traffic can be intercepted")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cafile: %v", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in cafile %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// proxyFunc prefers the .npmrc proxy settings and otherwise reads the proxy from the environment
+func proxyFunc(cfg *config.Config) func(*http.Request) (*url.URL, error) {
+	if cfg.Proxy == "" && cfg.HTTPSProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		for _, host := range strings.Split(cfg.NoProxy, ",") {
+			host = strings.TrimPrefix(strings.TrimSpace(host), ".")
+			if host != "" && (req.URL.Hostname() == host || strings.HasSuffix(req.URL.Hostname(), "."+host)) {
+				return nil, nil
+			}
+		}
+
+		proxy := cfg.Proxy
+		if req.URL.Scheme == "https" && cfg.HTTPSProxy != "" {
+			proxy = cfg.HTTPSProxy
+		}
+		if proxy == "" {
+			return nil, nil
+		}
+		return url.Parse(proxy)
+	}
+}
+
+// userAgent is the configured user-agent with {fpm-version}, {platform} and {arch} filled in, or fpm/<version>
+func userAgent(cfg *config.Config) string {
+	if cfg.UserAgent == "" {
+		return "fpm/" + Version
+	}
+	return strings.NewReplacer("{fpm-version}", Version, "{platform}", runtime.GOOS, "{arch}", runtime.GOARCH).Replace(cfg.UserAgent)
+}
+
+// userAgentTransport identifies fpm on every request, so registries and proxies can tell it from anonymous traffic
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
+
+// authTransport adds the bearer token and the extra headers configured for a registry to requests sent to that
+// registry only, so they never reach the CDN its tarballs are served from
+type authTransport struct {
+	base    http.RoundTripper
+	tokens  map[string]string
+	headers map[string]map[string]string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, _ := registryValue(t.tokens, req.URL)
+	headers, _ := registryValue(t.headers, req.URL)
+	if (token == "" || req.Header.Get("Authorization") != "") && len(headers) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	if token != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	// Headers the request already has, like the metadata Accept, win over configured ones
+	for name, value := range headers {
+		if req.Header.Get(name) == "" {
+			req.Header.Set(name, value)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// registryValue finds the value whose "//host/path/" key is the longest prefix of the request URL. Keys match on
+// a host and path segment boundary, //registry.example.com never matches registry.example.com.evil
+func registryValue[V any](values map[string]V, requestURL *url.URL) (V, bool) {
+	target := "//" + requestURL.Host + requestURL.Path
+	var best V
+	bestLength := 0
+	for key, value := range values {
+		key = config.RegistryKey(key)
+		if strings.HasPrefix(target, key) || target+"/" == key {
+			if len(key) > bestLength {
+				best, bestLength = value, len(key)
+			}
+		}
+	}
+	return best, bestLength > 0
+}
@@ -0,0 +1,353 @@
+package pkgmanager
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamesjellow/fpm/config"
+)
+
+func TestHTTPClientUsesProxyFromEnvironment(t *testing.T) {
+	// http.ProxyFromEnvironment reads the environment once per process, so the request runs in a fresh test process
+	if os.Getenv("FPM_PROXY_SUBTEST") == "1" {
+		client, err := newHTTPClient(config.Default())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp, err := client.Get("http://registry.example.test/react")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		return
+	}
+
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHost = r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHTTPClientUsesProxyFromEnvironment$")
+	cmd.Env = append(os.Environ(), "FPM_PROXY_SUBTEST=1", "HTTP_PROXY="+proxy.URL, "http_proxy="+proxy.URL, "NO_PROXY=", "no_proxy=")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("proxied request failed: %v\n%s", err, output)
+	}
+
+	if proxiedHost != "registry.example.test" {
+		t.Errorf("expected request to be routed through the proxy, got host %q", proxiedHost)
+	}
+}
+
+func TestHTTPClientSendsTokenOnlyToItsRegistry(t *testing.T) {
+	var registryAuth, cdnAuth string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryAuth = r.Header.Get("Authorization")
+	}))
+	defer registry.Close()
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnAuth = r.Header.Get("Authorization")
+	}))
+	defer cdn.Close()
+
+	cfg := config.Default()
+	cfg.AuthTokens["//"+strings.TrimPrefix(registry.URL, "http://")+"/"] = "secret"
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, target := range []string{registry.URL + "/@acme/widgets", cdn.URL + "/widgets-1.0.0.tgz"} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if registryAuth != "Bearer secret" {
+		t.Errorf("expected the registry to get the token, got %q", registryAuth)
+	}
+	if cdnAuth != "" {
+		t.Errorf("expected no token for other hosts, got %q", cdnAuth)
+	}
+}
+
+func TestRegistryValueMatchesOnHostBoundary(t *testing.T) {
+	tokens := map[string]string{"//registry.example.com": "secret", "//npm.example.com/team": "team"}
+	tests := map[string]string{
+		"https://registry.example.com/left-pad":      "secret",
+		"https://registry.example.com":               "secret",
+		"https://registry.example.com.evil/left-pad": "",
+		"https://registry.example.comevil/left-pad":  "",
+		"https://npm.example.com/team/left-pad":      "team",
+		"https://npm.example.com/teammate/left-pad":  "",
+	}
+	for target, expected := range tests {
+		parsed, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := registryValue(tokens, parsed); got != expected {
+			t.Errorf("expected %q for %s, got %q", expected, target, got)
+		}
+	}
+}
+
+func TestHTTPClientSendsHeadersOnlyToTheirRegistry(t *testing.T) {
+	var registryKey, registryAccept, cdnKey string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryKey, registryAccept = r.Header.Get("X-Api-Key"), r.Header.Get("Accept")
+	}))
+	defer registry.Close()
+	// The CDN runs on the same host as the registry, only the port tells them apart
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnKey = r.Header.Get("X-Api-Key")
+	}))
+	defer cdn.Close()
+
+	cfg := config.Default()
+	cfg.Headers["//"+strings.TrimPrefix(registry.URL, "http://")+"/"] = map[string]string{"X-Api-Key": "secret", "Accept": "text/plain"}
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, target := range []string{registry.URL + "/widgets", cdn.URL + "/widgets-1.0.0.tgz"} {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", fullMetadataAccept)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if registryKey != "secret" || registryAccept != fullMetadataAccept {
+		t.Errorf("expected the registry to get the header without it replacing Accept, got %q %q", registryKey, registryAccept)
+	}
+	if cdnKey != "" {
+		t.Errorf("expected no header for other hosts, got %q", cdnKey)
+	}
+}
+
+func TestHeadersWithoutTrailingSlashSkipLookAlikeHosts(t *testing.T) {
+	headers := map[string]map[string]string{"//registry.example.com": {"X-Api-Key": "secret"}}
+	for target, expected := range map[string]bool{
+		"https://registry.example.com/left-pad":      true,
+		"https://registry.example.com.evil/left-pad": false,
+		"https://registry.example.comevil/":          false,
+	} {
+		parsed, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := registryValue(headers, parsed); ok != expected {
+			t.Errorf("expected headers for %s: %v, got %v", target, expected, ok)
+		}
+	}
+}
+
+func TestHTTPClientTrustsConfiguredCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the CA the self-signed certificate is rejected
+	client, err := newHTTPClient(config.Default())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := client.Get(server.URL); err == nil {
+		t.Errorf("expected the self-signed certificate to be rejected")
+	}
+
+	cfg := config.Default()
+	cfg.CAFile = caFile
+	client, err = newHTTPClient(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the configured CA to be trusted: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestHTTPClientInsecure(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	cfg := config.Default()
+	cfg.StrictSSL = false
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected verification to be skipped: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestHTTPClientInvalidCAFile(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.CAFile = caFile
+	if _, err := newHTTPClient(cfg); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestHTTPClientRestrictsRedirectHosts(t *testing.T) {
+	untrusted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tarball"))
+	}))
+	defer untrusted.Close()
+
+	// The registry is reached as 127.0.0.1 and redirects to the same server as localhost, a different host
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(untrusted.URL, "127.0.0.1", "localhost", 1)+"/pkg.tgz", http.StatusFound)
+	}))
+	defer registry.Close()
+
+	cfg := config.Default()
+	cfg.Registry = registry.URL
+	cfg.RestrictHosts = true
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := client.Get(registry.URL + "/pkg.tgz"); err == nil || !strings.Contains(err.Error(), "untrusted host localhost") {
+		t.Errorf("expected the redirect to be refused, got %v", err)
+	}
+
+	cfg.TarballHosts = []string{"localhost"}
+	client, err = newHTTPClient(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := client.Get(registry.URL + "/pkg.tgz")
+	if err != nil {
+		t.Fatalf("expected an allowed redirect to be followed, got %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestRequestsSendUserAgentAndAccept(t *testing.T) {
+	var userAgent, accept string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent, accept = r.Header.Get("User-Agent"), r.Header.Get("Accept")
+		w.Write([]byte(`{"dist-tags": {"latest": "1.0.0"}, "versions": {"1.0.0": {"name": "foo", "version": "1.0.0"}}}`))
+	}))
+	defer server.Close()
+
+	if _, err := FetchPackageInfo(context.Background(), server.URL, "foo", "latest", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if userAgent != "fpm/"+Version || accept != abbreviatedMetadataAccept {
+		t.Errorf("expected the default user-agent and the abbreviated document, got %q %q", userAgent, accept)
+	}
+
+	cfg := config.Default()
+	cfg.UserAgent = "fpm/{fpm-version} {platform} ci"
+	cfg.Abbreviated = false
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FetchPackageInfo(context.Background(), server.URL, "foo", "latest", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if userAgent != "fpm/"+Version+" "+runtime.GOOS+" ci" || accept != fullMetadataAccept {
+		t.Errorf("expected the configured user-agent and the full document, got %q %q", userAgent, accept)
+	}
+}
+
+func TestMetadataRequestsSlowDownAfterTooManyRequests(t *testing.T) {
+	defer func(pause time.Duration) { defaultRetryAfter = pause }(defaultRetryAfter)
+	defaultRetryAfter = 50 * time.Millisecond
+	metadataThrottle = &registryThrottle{}
+	defer func() { metadataThrottle = &registryThrottle{} }()
+
+	var mu sync.Mutex
+	var arrivals []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		first := len(arrivals) == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"dist-tags": {"latest": "1.0.0"}, "versions": {"1.0.0": {"version": "1.0.0"}}}`))
+	}))
+	defer server.Close()
+
+	if _, err := FetchPackageInfo(context.Background(), server.URL, "foo", "latest", ""); err != nil {
+		t.Fatalf("expected the request to be retried after the 429, got %v", err)
+	}
+	if _, err := FetchPackageInfo(context.Background(), server.URL, "bar", "latest", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(arrivals) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(arrivals))
+	}
+	if gap := arrivals[1].Sub(arrivals[0]); gap < defaultRetryAfter {
+		t.Errorf("expected the retry to wait for the pause, it came after %s", gap)
+	}
+	// The throttle spaces out when requests are sent, allow for the first one taking longer to arrive
+	if gap := arrivals[2].Sub(arrivals[1]); gap < minThrottleSpacing/2 {
+		t.Errorf("expected the other package's request to be spaced out too, it came after %s", gap)
+	}
+}
+
+func TestRegistryThrottleRecovers(t *testing.T) {
+	throttle := &registryThrottle{spacing: time.Hour, next: time.Now().Add(time.Hour), cooldown: time.Now().Add(-time.Second)}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := throttle.wait(ctx); err != nil || throttle.spacing != 0 {
+		t.Errorf("expected no wait once the cooldown passed, got %v with spacing %s", err, throttle.spacing)
+	}
+
+	throttle.backOff(0)
+	throttle.backOff(0)
+	if throttle.spacing != 2*minThrottleSpacing || !throttle.cooldown.After(time.Now()) {
+		t.Errorf("expected each 429 to double the spacing, got %s", throttle.spacing)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for header, expected := range map[string]time.Duration{"3": 3 * time.Second, "": defaultRetryAfter, "soon": defaultRetryAfter, "3600": maxRetryAfter, "Wed, 21 Oct 2015 07:28:00 GMT": 0} {
+		if got := parseRetryAfter(header); got != expected {
+			t.Errorf("expected %s for %q, got %s", expected, header, got)
+		}
+	}
+}
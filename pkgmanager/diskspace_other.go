@@ -0,0 +1,23 @@
+//go:build !(linux || darwin || freebsd)
+
+package pkgmanager
+
+import (
+	"errors"
+	"syscall"
+)
+
+// FreeSpace reports -1 where fpm can't tell the free space of a volume, callers skip their checks
+func FreeSpace(dir string) (int64, error) {
+	return -1, nil
+}
+
+// Whether err means the volume is full
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// Ownership isn't checked here, see the unix version
+func rootOwned(path string) string {
+	return ""
+}
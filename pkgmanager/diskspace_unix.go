@@ -0,0 +1,45 @@
+//go:build linux || darwin || freebsd
+
+package pkgmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FreeSpace reports the bytes available to unprivileged users on the volume holding dir
+func FreeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Whether err means the volume, or the user's quota on it, is full
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// Find the nearest existing path at or above path when it is owned by root and fpm isn't running as root,
+// which is what an earlier `sudo` install leaves behind. Empty when it isn't
+func rootOwned(path string) string {
+	if os.Getuid() == 0 {
+		return ""
+	}
+	for {
+		if info, err := os.Lstat(path); err == nil {
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid == 0 {
+				return path
+			}
+			return ""
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return ""
+		}
+		path = parent
+	}
+}
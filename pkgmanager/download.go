@@ -1,51 +1,232 @@
 package pkgmanager
 
 import (
-	"crypto/sha1"
+	"context"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 )
 
-// DownloadPackage downloads the package tarball from the given URL and verifies the checksum
-func DownloadPackage(tarballURL, expectedShasum, destDir string) (string, error) {
-	resp, err := http.Get(tarballURL)
+// ProgressFunc is told how many bytes of a download are done out of total, total is -1 when the size is unknown
+type ProgressFunc func(done, total int64)
+
+// downloadAttempts is how many times an interrupted download is resumed before giving up
+const downloadAttempts = 3
+
+// DownloadPackage is Client.DownloadPackage with the default settings
+func DownloadPackage(ctx context.Context, tarballURL, expectedShasum, integrity, destDir, cacheDir string, progress ProgressFunc) (string, error) {
+	return defaultClient.DownloadPackage(ctx, tarballURL, expectedShasum, integrity, destDir, cacheDir, progress)
+}
+
+// DownloadPackage downloads the package tarball from the given URL, verifies the checksum and returns the
+// path of the staged tarball. Every download gets its own uniquely named file in destDir, so concurrent
+// downloads of tarballs that share a file name never collide.
+// A verified copy in cacheDir is used instead of the network when present, an empty cacheDir disables the cache.
+// progress, when not nil, is called as bytes arrive. Cancelling ctx aborts the download and removes the staged file.
+// Concurrent downloads of the same integrity share one fetch, each still gets its own staged copy.
+// A file:// URL or a bare path is read from disk, it is checked the same way but never cached. Only a metadata
+// mirror may point at one, registry metadata that does fails the download
+func (c *Client) DownloadPackage(ctx context.Context, tarballURL, expectedShasum, integrity, destDir, cacheDir string, progress ProgressFunc) (string, error) {
+	stagedFile, err := os.CreateTemp(destDir, "fpm-*-"+filepath.Base(tarballURL))
 	if err != nil {
-		log.Printf("failed to download package: %v", err)
+		log.Printf("failed to create file: %v", err)
+		return "", Classify(ErrFilesystem, err)
+	}
+	stagedFile.Close()
+	partPath := stagedFile.Name()
+
+	if err := c.stageTarball(ctx, tarballURL, expectedShasum, integrity, cacheDir, partPath, progress); err != nil {
+		os.Remove(partPath)
 		return "", err
 	}
-	defer resp.Body.Close()
+	return partPath, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("failed to download package: %v", resp.Status)
-		return "", fmt.Errorf("failed to download package: %v", resp.Status)
+// Put the tarball in partPath from disk, the cache or the registry and check it against expectedShasum
+func (c *Client) stageTarball(ctx context.Context, tarballURL, expectedShasum, integrity, cacheDir, partPath string, progress ProgressFunc) error {
+	if localPath, ok := localTarballPath(tarballURL); ok {
+		// A registry doesn't get to read files on this machine, only the documents of a mirror are trusted with that
+		if c.MetadataDir == "" {
+			return Classify(ErrIntegrity, fmt.Errorf("tarball %s is not an http or https URL, local tarballs are only read with --metadata-dir", tarballURL))
+		}
+		if err := copyLocalTarball(localPath, expectedShasum, partPath, progress); err != nil {
+			return err
+		}
+		return checkTarballIntegrity(tarballURL, partPath, integrity)
 	}
+	if readFromCache(cacheDir, expectedShasum, integrity, partPath) {
+		return nil
+	}
+	if c.Offline {
+		return errOffline(tarballURL)
+	}
+	return tarballFlights.do(ctx, integrity, partPath, func() error {
+		return c.downloadChecked(ctx, tarballURL, expectedShasum, integrity, cacheDir, partPath, progress)
+	})
+}
 
-	fileName := filepath.Base(tarballURL)
-	destPath := filepath.Join(destDir, fileName)
-	out, err := os.Create(destPath)
+// Get the path a file:// tarball URL, or one without a scheme, points to. Other URLs are fetched from the registry
+func localTarballPath(tarballURL string) (string, bool) {
+	if !strings.Contains(tarballURL, "://") {
+		return tarballURL, true
+	}
+	if !strings.HasPrefix(tarballURL, "file://") {
+		return "", false
+	}
+	parsed, err := url.Parse(tarballURL)
 	if err != nil {
-		log.Printf("failed to create file: %v", err)
-		return "", err
+		return "", false
 	}
-	defer out.Close()
+	path := parsed.Path
+	// file:///C:/pkg.tgz is C:/pkg.tgz on Windows
+	if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path), true
+}
 
-	hasher := sha1.New()
-	tee := io.TeeReader(resp.Body, hasher)
+// Copy the tarball at localPath into partPath and check it against expectedShasum
+func copyLocalTarball(localPath, expectedShasum, partPath string, progress ProgressFunc) error {
+	if err := copyFile(localPath, partPath); err != nil {
+		log.Printf("failed to read tarball: %v", err)
+		return Classify(ErrFilesystem, fmt.Errorf("failed to read tarball %s: %w", localPath, err))
+	}
+	if progress != nil {
+		if info, err := os.Stat(partPath); err == nil {
+			progress(info.Size(), info.Size())
+		}
+	}
 
-	_, err = io.Copy(out, tee)
+	calculatedShasum, err := fileShasum(partPath)
 	if err != nil {
-		log.Printf("failed to copy file: %v", err)
-		return "", err
+		log.Printf("failed to hash file: %v", err)
+		return Classify(ErrFilesystem, err)
+	}
+	if calculatedShasum != expectedShasum {
+		return Classify(ErrIntegrity, fmt.Errorf("checksum mismatch: expected %s, got %s", expectedShasum, calculatedShasum))
 	}
+	return nil
+}
+
+// A tarball matching the shasum has to match the sha512 integrity as well when the registry publishes one
+func checkTarballIntegrity(tarballURL, partPath, integrity string) error {
+	if err := checkIntegrity(partPath, integrity); err != nil {
+		return fmt.Errorf("%s: %w", tarballURL, err)
+	}
+	return nil
+}
 
-	calculatedShasum := fmt.Sprintf("%x", hasher.Sum(nil))
+// Download the tarball into partPath and check it against expectedShasum and integrity, storing it in the cache
+// only once it matches both
+func (c *Client) downloadChecked(ctx context.Context, tarballURL, expectedShasum, integrity, cacheDir, partPath string, progress ProgressFunc) error {
+	// A CDN can keep serving a corrupt copy, so a mismatch is downloaded once more past any caches
+	calculatedShasum, err := c.downloadVerified(ctx, tarballURL, partPath, progress, false)
+	if err == nil && calculatedShasum != expectedShasum {
+		log.Printf("checksum mismatch for %s, downloading it again with Cache-Control: no-cache", tarballURL)
+		firstShasum := calculatedShasum
+		if err = os.Truncate(partPath, 0); err != nil {
+			return Classify(ErrFilesystem, err)
+		}
+		calculatedShasum, err = c.downloadVerified(ctx, tarballURL, partPath, progress, true)
+		if err == nil && calculatedShasum != expectedShasum {
+			log.Printf("checksum mismatch for %s: expected %s, got %s and then %s", tarballURL, expectedShasum, firstShasum, calculatedShasum)
+		}
+	}
+	if err != nil {
+		return err
+	}
 	if calculatedShasum != expectedShasum {
-		return "", fmt.Errorf("checksum mismatch: expected %s, got %s", expectedShasum, calculatedShasum)
+		return Classify(ErrIntegrity, fmt.Errorf("checksum mismatch: expected %s, got %s", expectedShasum, calculatedShasum))
+	}
+	if err := checkTarballIntegrity(tarballURL, partPath, integrity); err != nil {
+		return err
 	}
 
-	return destPath, nil
+	writeToCache(cacheDir, expectedShasum, integrity, partPath)
+	return nil
+}
+
+// downloadVerified downloads the tarball into partPath, resuming interrupted attempts, and returns its shasum.
+// noCache asks caches between fpm and the origin to revalidate instead of serving their copy
+func (c *Client) downloadVerified(ctx context.Context, tarballURL, partPath string, progress ProgressFunc, noCache bool) (string, error) {
+	var err error
+	// Interrupted attempts resume from the bytes already in the staged file
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		if err = c.downloadToPart(ctx, tarballURL, partPath, progress, noCache); err == nil || ctx.Err() != nil {
+			break
+		}
+		log.Printf("download attempt %d of %d failed: %v", attempt, downloadAttempts, err)
+	}
+	if err != nil {
+		return "", Classify(ErrNetwork, err)
+	}
+
+	calculatedShasum, err := fileShasum(partPath)
+	if err != nil {
+		log.Printf("failed to hash file: %v", err)
+		return "", Classify(ErrFilesystem, err)
+	}
+	return calculatedShasum, nil
+}
+
+// downloadToPart fetches the tarball into partPath, asking for only the missing bytes when it isn't empty.
+// A client that can't resume sends the full body and the file is started over
+func (c *Client) downloadToPart(ctx context.Context, tarballURL, partPath string, progress ProgressFunc, noCache bool) error {
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	tarball, err := c.transport().FetchTarball(ctx, tarballURL, TarballRequest{Offset: offset, NoCache: noCache})
+	if err != nil {
+		log.Printf("failed to download package: %v", err)
+		return err
+	}
+	defer tarball.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if tarball.Offset > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	out, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		log.Printf("failed to create file: %v", err)
+		return Classify(ErrFilesystem, err)
+	}
+	defer out.Close()
+
+	body := limitRate(ctx, tarball, c.Limiter)
+	if progress != nil {
+		body = &progressReader{reader: body, done: tarball.Offset, total: tarball.Size, progress: progress}
+	}
+
+	if _, err := io.Copy(out, body); err != nil {
+		log.Printf("failed to copy file: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// progressReader reports the running byte count of a download as it is read
+type progressReader struct {
+	reader   io.Reader
+	done     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.done += int64(n)
+		r.progress(r.done, r.total)
+	}
+	return n, err
 }
@@ -0,0 +1,360 @@
+package pkgmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var tarballContent = bytes.Repeat([]byte("fpm tarball content "), 100)
+
+func tarballShasum() string {
+	return fmt.Sprintf("%x", sha1.Sum(tarballContent))
+}
+
+func TestDownloadPackageResumesInterruptedDownload(t *testing.T) {
+	var requests int
+	var rangeHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			// Promise the whole body but drop the connection halfway through
+			w.Header().Set("Content-Length", fmt.Sprint(len(tarballContent)))
+			w.Write(tarballContent[:500])
+			return
+		}
+		rangeHeader = r.Header.Get("Range")
+		http.ServeContent(w, r, "pkg.tgz", time.Time{}, bytes.NewReader(tarballContent))
+	}))
+	defer server.Close()
+
+	var done, total int64
+	progress := func(d, t int64) { done, total = d, t }
+
+	path, err := DownloadPackage(context.Background(), server.URL+"/pkg-1.0.0.tgz", tarballShasum(), "", t.TempDir(), "", progress)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rangeHeader != "bytes=500-" {
+		t.Errorf("expected a range request from the partial offset, got %q", rangeHeader)
+	}
+	if size := int64(len(tarballContent)); done != size || total != size {
+		t.Errorf("expected progress to end at %d of %d, got %d of %d", size, size, done, total)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(content, tarballContent) {
+		t.Errorf("unexpected downloaded content: %v", err)
+	}
+}
+
+func TestDownloadPackageRestartsWithoutRangeSupport(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", fmt.Sprint(len(tarballContent)))
+		if requests == 1 {
+			w.Write(tarballContent[:500])
+			return
+		}
+		// Ignore the range and send everything again
+		w.Write(tarballContent)
+	}))
+	defer server.Close()
+
+	path, err := DownloadPackage(context.Background(), server.URL+"/pkg-1.0.0.tgz", tarballShasum(), "", t.TempDir(), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(content, tarballContent) {
+		t.Errorf("unexpected downloaded content: %v", err)
+	}
+}
+
+func TestDownloadPackageUsesUniquePaths(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarballContent)
+	}))
+	defer server.Close()
+
+	// Two scopes publishing the same tarball file name
+	destDir := t.TempDir()
+	first, err := DownloadPackage(context.Background(), server.URL+"/@a/utils/-/utils-1.0.0.tgz", tarballShasum(), "", destDir, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := DownloadPackage(context.Background(), server.URL+"/@b/utils/-/utils-1.0.0.tgz", tarballShasum(), "", destDir, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first == second {
+		t.Errorf("expected unique download paths, both were %s", first)
+	}
+}
+
+func TestDownloadPackageChecksumMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarballContent)
+	}))
+	defer server.Close()
+
+	destDir := t.TempDir()
+	_, err := DownloadPackage(context.Background(), server.URL+"/pkg-1.0.0.tgz", "0000", "", destDir, "", nil)
+	if !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected an integrity error, got %v", err)
+	}
+	if entries, _ := os.ReadDir(destDir); len(entries) != 0 {
+		t.Errorf("expected the bad download to be removed, found %d files", len(entries))
+	}
+}
+
+func TestDownloadPackageChecksSHA512Integrity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarballContent)
+	}))
+	defer server.Close()
+
+	digest := sha512.Sum512(tarballContent)
+	integrity := "sha512-" + base64.StdEncoding.EncodeToString(digest[:])
+	destDir := t.TempDir()
+	if _, err := DownloadPackage(context.Background(), server.URL+"/pkg-1.0.0.tgz", tarballShasum(), integrity, destDir, "", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The shasum matches, the sha512 doesn't, so nothing is cached for later installs to pick up
+	cacheDir := t.TempDir()
+	other := sha512.Sum512([]byte("something else"))
+	_, err := DownloadPackage(context.Background(), server.URL+"/pkg-1.0.0.tgz", tarballShasum(), "sha512-"+base64.StdEncoding.EncodeToString(other[:]), t.TempDir(), cacheDir, nil)
+	if !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected an integrity error, got %v", err)
+	}
+	if _, err := os.Stat(cachedTarballPath(cacheDir, tarballShasum())); !os.IsNotExist(err) {
+		t.Errorf("expected the mismatching tarball to stay out of the cache, got %v", err)
+	}
+
+	// A verified download records its integrity next to the cached tarball
+	if _, err := DownloadPackage(context.Background(), server.URL+"/pkg-1.0.0.tgz", tarballShasum(), integrity, t.TempDir(), cacheDir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if recorded := recordedIntegrity(cacheDir, tarballShasum()); recorded != integrity {
+		t.Errorf("expected %s recorded with the cached tarball, got %q", integrity, recorded)
+	}
+}
+
+func TestIntegrityDigests(t *testing.T) {
+	shasum := sha1.Sum(tarballContent)
+	digest := sha512.Sum512(tarballContent)
+	integrity := "sha1-" + base64.StdEncoding.EncodeToString(shasum[:]) + " sha512-" + base64.StdEncoding.EncodeToString(digest[:])
+	if got := SHA1Shasum(integrity); got != tarballShasum() {
+		t.Errorf("expected the sha1 %s, got %s", tarballShasum(), got)
+	}
+	if got := SHA512(integrity); got != base64.StdEncoding.EncodeToString(digest[:]) {
+		t.Errorf("expected the sha512 digest, got %s", got)
+	}
+	if got := SHA512("sha512-not-a-digest"); got != "" {
+		t.Errorf("expected no digest for a malformed integrity, got %s", got)
+	}
+}
+
+func TestDownloadPackageRetriesStaleCopyWithoutCache(t *testing.T) {
+	var requests, noCacheRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Cache-Control") != "no-cache" {
+			w.Write([]byte("stale copy from the CDN"))
+			return
+		}
+		noCacheRequests++
+		w.Write(tarballContent)
+	}))
+	defer server.Close()
+
+	path, err := DownloadPackage(context.Background(), server.URL+"/pkg-1.0.0.tgz", tarballShasum(), "", t.TempDir(), "", nil)
+	if err != nil {
+		t.Fatalf("expected the re-download to succeed, got %v", err)
+	}
+	if content, _ := os.ReadFile(path); !bytes.Equal(content, tarballContent) {
+		t.Errorf("expected the fresh copy to be kept")
+	}
+	if requests != 2 || noCacheRequests != 1 {
+		t.Errorf("expected one download and one no-cache retry, got %d requests, %d without cache", requests, noCacheRequests)
+	}
+}
+
+func TestDownloadPackageCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(tarballContent)))
+		w.Write(tarballContent[:500])
+		w.(http.Flusher).Flush()
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	destDir := t.TempDir()
+	_, err := DownloadPackage(ctx, server.URL+"/pkg-1.0.0.tgz", tarballShasum(), "", destDir, "", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancellation error, got %v", err)
+	}
+
+	entries, err := os.ReadDir(destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the staged file to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestDownloadPackageFromFakeRegistry(t *testing.T) {
+	tarballURL := "https://registry.example.com/pkg/-/pkg-1.0.0.tgz"
+	fake := newFakeRegistry()
+	fake.AddTarball(tarballURL, tarballContent)
+	client := &Client{Transport: fake}
+
+	var done, total int64
+	path, err := client.DownloadPackage(context.Background(), tarballURL, tarballShasum(), "", t.TempDir(), "", func(d, t int64) { done, total = d, t })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(content, tarballContent) {
+		t.Errorf("unexpected downloaded content: %v", err)
+	}
+	if size := int64(len(tarballContent)); done != size || total != size {
+		t.Errorf("expected progress to end at %d of %d, got %d of %d", size, size, done, total)
+	}
+
+	if _, err := client.DownloadPackage(context.Background(), tarballURL, "0000", "", t.TempDir(), "", nil); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("expected an integrity error, got %v", err)
+	}
+	if fake.Requests(tarballURL) != 3 {
+		t.Errorf("expected the mismatch to be fetched twice more, got %d requests in total", fake.Requests(tarballURL))
+	}
+}
+
+func TestDownloadPackageFromLocalPath(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "pkg-1.0.0.tgz")
+	if err := os.WriteFile(source, tarballContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Registry metadata can't point at files on this machine
+	for _, tarballURL := range []string{"file://" + filepath.ToSlash(source), source} {
+		if _, err := DownloadPackage(context.Background(), tarballURL, tarballShasum(), "", t.TempDir(), "", nil); !errors.Is(err, ErrIntegrity) {
+			t.Errorf("expected %s from registry metadata to be refused, got %v", tarballURL, err)
+		}
+	}
+
+	mirrored := &Client{MetadataDir: t.TempDir()}
+	for _, tarballURL := range []string{"file://" + filepath.ToSlash(source), source} {
+		path, err := mirrored.DownloadPackage(context.Background(), tarballURL, tarballShasum(), "", t.TempDir(), "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", tarballURL, err)
+		}
+		if content, err := os.ReadFile(path); err != nil || !bytes.Equal(content, tarballContent) {
+			t.Errorf("unexpected content staged from %s: %v", tarballURL, err)
+		}
+	}
+
+	destDir := t.TempDir()
+	if _, err := mirrored.DownloadPackage(context.Background(), source, "deadbeef", "", destDir, "", nil); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("expected an integrity error, got %v", err)
+	}
+	if entries, _ := os.ReadDir(destDir); len(entries) != 0 {
+		t.Errorf("expected the staged file removed after a mismatch, found %d files", len(entries))
+	}
+	if _, err := mirrored.DownloadPackage(context.Background(), source+".missing", tarballShasum(), "", t.TempDir(), "", nil); !errors.Is(err, ErrFilesystem) {
+		t.Errorf("expected a filesystem error for a missing file, got %v", err)
+	}
+}
+
+func TestDownloadPackageMaxRateIsShared(t *testing.T) {
+	fake := newFakeRegistry()
+	urls := []string{"https://registry.example.com/a/-/a-1.0.0.tgz", "https://registry.example.com/b/-/b-1.0.0.tgz"}
+	for _, tarballURL := range urls {
+		fake.AddTarball(tarballURL, tarballContent)
+	}
+	// Two tarballs at a combined 8000 bytes/s take half a second, a per-download limit would take a quarter
+	client := &Client{Transport: fake, Limiter: NewRateLimiter(8000)}
+
+	start := time.Now()
+	errs := make(chan error, len(urls))
+	for _, tarballURL := range urls {
+		go func(tarballURL string) {
+			_, err := client.DownloadPackage(context.Background(), tarballURL, tarballShasum(), "", t.TempDir(), "", nil)
+			errs <- err
+		}(tarballURL)
+	}
+	for range urls {
+		if err := <-errs; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected the downloads to share the rate, they took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reader := limitRate(ctx, bytes.NewReader(tarballContent), client.Limiter)
+	if _, err := reader.Read(make([]byte, 1000)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled wait to fail, got %v", err)
+	}
+}
+
+func TestDownloadPackageSharesConcurrentDownloadsByIntegrity(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Write(tarballContent)
+	}))
+	defer server.Close()
+
+	destDir := t.TempDir()
+	var wg sync.WaitGroup
+	paths := make([]string, 4)
+	for i := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, err := DownloadPackage(context.Background(), server.URL+"/pkg-1.0.0.tgz", tarballShasum(), "sha512-pkg", destDir, "", nil)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			paths[i] = path
+		}()
+	}
+	// Let every caller join the download before the registry answers
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected one download for the same integrity, got %d", got)
+	}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil || !bytes.Equal(content, tarballContent) || seen[path] {
+			t.Errorf("expected every caller to get its own copy, got %s %v", path, err)
+		}
+		seen[path] = true
+	}
+}
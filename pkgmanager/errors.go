@@ -0,0 +1,32 @@
+package pkgmanager
+
+import "errors"
+
+// Error classes callers can match with errors.Is to react differently to each kind of failure
+var (
+	ErrNetwork    = errors.New("network error")
+	ErrIntegrity  = errors.New("integrity error")
+	ErrFilesystem = errors.New("filesystem error")
+)
+
+// classifiedError tags an error with its class without changing its message
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() []error {
+	return []error{e.class, e.err}
+}
+
+// Classify tags err with one of the error classes, nil stays nil
+func Classify(class error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: class, err: err}
+}
@@ -2,28 +2,69 @@ package pkgmanager
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
-// ExtractTarball extracts a tarball to a directory named after the package within the specified destination directory
-func ExtractTarball(tarballPath, destDir, packageName string) error {
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// CheckDir fails when path exists but isn't a directory, e.g. a stray file named node_modules, a missing path is fine
+func CheckDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+	return Classify(ErrFilesystem, fmt.Errorf("%s exists but is a file, not a directory, remove it and try again", path))
+}
+
+// EnsureDir creates dir and its parents like os.MkdirAll, naming the file in the way when part of the path is one
+func EnsureDir(dir string) error {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err == nil {
+		return nil
+	}
+	for path := dir; filepath.Dir(path) != path; path = filepath.Dir(path) {
+		if _, statErr := os.Stat(path); statErr == nil {
+			if dirErr := CheckDir(path); dirErr != nil {
+				return dirErr
+			}
+			break
+		}
+	}
+	return Classify(ErrFilesystem, err)
+}
+
+// ExtractTarball extracts a tarball, gzipped or plain, to a directory named after the package within the specified
+// destination directory. Cancelling ctx stops between entries
+func ExtractTarball(ctx context.Context, tarballPath, destDir, packageName string) error {
 	// Create the package directory with just the package name
 	packageDir := filepath.Join(destDir, packageName)
-	if err := os.MkdirAll(packageDir, os.ModePerm); err != nil {
+	if err := EnsureDir(packageDir); err != nil {
 		log.Printf("failed to create package directory: %v", err)
-		return err
+		// A file in the way is explained already
+		var pathErr *os.PathError
+		if !errors.As(err, &pathErr) {
+			return err
+		}
+		return extractError(packageName, "create directory", packageDir, err)
 	}
 
 	file, err := os.Open(tarballPath)
 	if err != nil {
 		log.Printf("failed to open tarball: %v", err)
-		return err
+		return Classify(ErrFilesystem, err)
 	}
 	defer file.Close()
 
@@ -34,57 +75,160 @@ func ExtractTarball(tarballPath, destDir, packageName string) error {
 		}
 	}()
 
-	gzr, err := gzip.NewReader(file)
-	if err != nil {
-		log.Printf("failed to create gzip reader: %v", err)
-		return err
+	// Registries serve gzipped tarballs but plain ones are valid too, peeking leaves the bytes for the reader
+	buffered := bufio.NewReader(file)
+	var archive io.Reader = buffered
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, gzipMagic) {
+		gzr, err := gzip.NewReader(buffered)
+		if err != nil {
+			log.Printf("failed to create gzip reader: %v", err)
+			return Classify(ErrIntegrity, err)
+		}
+		defer gzr.Close()
+		archive = gzr
+	}
+
+	// Directory times are applied last, extracting their files would change them again
+	type dirTime struct {
+		path   string
+		header *tar.Header
 	}
-	defer gzr.Close()
+	var dirTimes []dirTime
 
-	tarReader := tar.NewReader(gzr)
+	tarReader := tar.NewReader(archive)
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			log.Printf("failed to read tarball: %v", err)
-			return err
+			return Classify(ErrIntegrity, err)
 		}
 
-		// Skip the initial 'package' directory
-		header.Name = strings.TrimPrefix(header.Name, "package/")
-
-		path := filepath.Join(packageDir, header.Name)
+		path, err := entryPath(packageDir, header.Name)
+		if err != nil {
+			log.Printf("failed to extract %s: %v", packageName, err)
+			return err
+		}
+		path = longPath(path)
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(path, os.FileMode(header.Mode)); err != nil {
+			if err := os.MkdirAll(path, os.ModePerm); err != nil {
 				log.Printf("failed to create directory: %v", err)
-				return err
+				return extractError(packageName, "create directory", path, err)
+			}
+			if err := os.Chmod(path, entryMode(header)); err != nil {
+				log.Printf("failed to set directory mode: %v", err)
+				return extractError(packageName, "set the mode of", path, err)
 			}
+			dirTimes = append(dirTimes, dirTime{path, header})
 		case tar.TypeReg:
 			// Ensure the directory exists
 			if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
 				log.Printf("failed to create directory: %v", err)
-				return err
+				return extractError(packageName, "create directory", filepath.Dir(path), err)
 			}
 
 			outFile, err := os.Create(path)
 			if err != nil {
 				log.Printf("failed to create file: %v", err)
-				return err
+				return extractError(packageName, "create", path, err)
 			}
 			if _, err := io.Copy(outFile, tarReader); err != nil {
 				outFile.Close()
 				log.Printf("failed to copy file: %v", err)
-				return err
+				// Only failed writes name the file, a failed read is the tarball's fault
+				var pathErr *os.PathError
+				if !errors.As(err, &pathErr) {
+					return Classify(ErrFilesystem, err)
+				}
+				return extractError(packageName, "write", path, err)
+			}
+			// Some filesystems only report a full disk once the file is closed
+			if err := outFile.Close(); err != nil {
+				log.Printf("failed to close file: %v", err)
+				return extractError(packageName, "write", path, err)
+			}
+
+			// Chmod rather than create with the mode, so the umask doesn't change the result
+			if err := os.Chmod(path, entryMode(header)); err != nil {
+				log.Printf("failed to set file mode: %v", err)
+				return extractError(packageName, "set the mode of", path, err)
 			}
-			outFile.Close()
+			applyModTime(path, header)
 		default:
 			log.Printf("unsupported tar header type: %v", header.Typeflag)
-			return fmt.Errorf("unsupported tar header type: %v", header.Typeflag)
+			return Classify(ErrIntegrity, fmt.Errorf("unsupported tar header type: %v", header.Typeflag))
 		}
 	}
 
+	// Deepest first, setting a directory's time doesn't touch its parent
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		applyModTime(dirTimes[i].path, dirTimes[i].header)
+	}
+
 	return nil
 }
+
+// Explain a filesystem failure while extracting packageName, naming the package and the path and adding a hint
+// for the usual causes: a full disk, or a node_modules an earlier `sudo` install left owned by root
+func extractError(packageName, action, path string, err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err // The path is in the message already
+	}
+	err = fmt.Errorf("failed to extract %s: can't %s %s: %w", packageName, action, strings.TrimPrefix(path, `\\?\`), pathError(path, err))
+	switch {
+	case isDiskFull(err):
+		err = fmt.Errorf("%w, the disk is full, free up space and try again", err)
+	case errors.Is(err, fs.ErrPermission):
+		if owner := rootOwned(path); owner != "" {
+			err = fmt.Errorf("%w, %s is owned by root, likely from an earlier sudo install, run `sudo chown -R $(whoami) %s` and try again", err, owner, owner)
+		} else {
+			err = fmt.Errorf("%w, check that you can write to %s", err, filepath.Dir(path))
+		}
+	}
+	return Classify(ErrFilesystem, err)
+}
+
+// Map a tarball entry name to its path in packageDir. Tarballs packed on Windows can name entries with
+// backslashes, npm's wrapping "package" directory is dropped, and a name that would land outside the package
+// is refused
+func entryPath(packageDir, name string) (string, error) {
+	name = strings.TrimPrefix(strings.ReplaceAll(name, `\`, "/"), "package/")
+	cleaned := path.Clean(name)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") || filepath.VolumeName(filepath.FromSlash(cleaned)) != "" {
+		return "", Classify(ErrIntegrity, fmt.Errorf("tarball entry %q points outside the package directory", name))
+	}
+	return filepath.Join(packageDir, filepath.FromSlash(cleaned)), nil
+}
+
+// entryMode is the permission bits of a tarball entry. The owner can always read and write files and enter
+// directories, a tarball with 0444 or 0000 entries would otherwise leave a tree fpm can't update or remove
+func entryMode(header *tar.Header) os.FileMode {
+	mode := os.FileMode(header.Mode).Perm()
+	if header.Typeflag == tar.TypeDir {
+		return mode | 0700
+	}
+	return mode | 0600
+}
+
+// applyModTime sets the modification time of an extracted entry from its header, so extracting the same tarball
+// always gives the same tree. Zero and pre-1970 times, which some packing tools write, are left as extracted
+func applyModTime(path string, header *tar.Header) {
+	if header.ModTime.IsZero() || header.ModTime.Unix() <= 0 {
+		return
+	}
+	accessTime := header.AccessTime
+	if accessTime.IsZero() || accessTime.Unix() <= 0 {
+		accessTime = header.ModTime
+	}
+	if err := os.Chtimes(path, accessTime, header.ModTime); err != nil {
+		log.Printf("failed to set the time of %s: %v", path, err)
+	}
+}
@@ -0,0 +1,196 @@
+package pkgmanager
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Build a tarball in the npm layout holding a single package.json
+func writeTarball(t *testing.T, path string, gzipped bool) {
+	t.Helper()
+	content := []byte(`{"name": "left-pad", "version": "1.3.0"}`)
+
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	if err := tw.WriteHeader(&tar.Header{Name: "package/package.json", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	data := tarball.Bytes()
+	if gzipped {
+		var compressed bytes.Buffer
+		gzw := gzip.NewWriter(&compressed)
+		gzw.Write(data)
+		gzw.Close()
+		data = compressed.Bytes()
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractTarballGzippedAndPlain(t *testing.T) {
+	for _, gzipped := range []bool{true, false} {
+		dir := t.TempDir()
+		tarballPath := filepath.Join(dir, "left-pad.tgz")
+		writeTarball(t, tarballPath, gzipped)
+
+		destDir := filepath.Join(dir, "node_modules")
+		if err := ExtractTarball(context.Background(), tarballPath, destDir, "left-pad"); err != nil {
+			t.Fatalf("gzipped=%v: unexpected error: %v", gzipped, err)
+		}
+		content, err := os.ReadFile(filepath.Join(destDir, "left-pad", "package.json"))
+		if err != nil || !bytes.Contains(content, []byte(`"version": "1.3.0"`)) {
+			t.Errorf("gzipped=%v: expected package.json to be extracted, got %q, %v", gzipped, content, err)
+		}
+	}
+}
+
+func TestExtractTarballIntoAFile(t *testing.T) {
+	destDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(destDir, "@scope"), []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tarballPath := filepath.Join(t.TempDir(), "pkg.tgz")
+	writeTarball(t, tarballPath, true)
+
+	err := ExtractTarball(context.Background(), tarballPath, destDir, "@scope/pkg")
+	if !errors.Is(err, ErrFilesystem) || !strings.Contains(err.Error(), filepath.Join(destDir, "@scope")+" exists but is a file") {
+		t.Errorf("expected a filesystem error naming the file, got %v", err)
+	}
+}
+
+func TestExtractTarballRestoresModesAndTimes(t *testing.T) {
+	modTime := time.Date(1985, 10, 26, 8, 15, 0, 0, time.UTC)
+	entries := []struct {
+		header  tar.Header
+		content string
+	}{
+		{tar.Header{Name: "package/bin/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: modTime}, ""},
+		{tar.Header{Name: "package/bin/cli.js", Mode: 0755, Typeflag: tar.TypeReg, ModTime: modTime}, "#!/usr/bin/env node"},
+		{tar.Header{Name: "package/README.md", Mode: 0444, Typeflag: tar.TypeReg, ModTime: modTime}, "read only"},
+		{tar.Header{Name: "package/package.json", Mode: 0644, Typeflag: tar.TypeReg}, "{}"},
+	}
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	for _, entry := range entries {
+		entry.header.Size = int64(len(entry.content))
+		if err := tw.WriteHeader(&entry.header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(entry.content))
+	}
+	tw.Close()
+
+	tarballPath := filepath.Join(t.TempDir(), "pkg.tar")
+	if err := os.WriteFile(tarballPath, tarball.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	destDir := t.TempDir()
+	if err := ExtractTarball(context.Background(), tarballPath, destDir, "pkg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]os.FileMode{"bin": 0755 | os.ModeDir, "bin/cli.js": 0755, "README.md": 0644, "package.json": 0644}
+	for name, mode := range expected {
+		info, err := os.Stat(filepath.Join(destDir, "pkg", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != mode {
+			t.Errorf("%s: expected mode %v, got %v", name, mode, info.Mode())
+		}
+		if name != "package.json" && !info.ModTime().Equal(modTime) {
+			t.Errorf("%s: expected the header time %v, got %v", name, modTime, info.ModTime())
+		}
+	}
+	if info, err := os.Stat(filepath.Join(destDir, "pkg", "package.json")); err != nil || info.ModTime().Unix() <= 0 {
+		t.Errorf("expected an entry without a time to keep the extraction time, got %v %v", info.ModTime(), err)
+	}
+}
+
+func TestExtractTarballEntryPaths(t *testing.T) {
+	extract := func(names ...string) (string, error) {
+		var tarball bytes.Buffer
+		tw := tar.NewWriter(&tarball)
+		for _, name := range names {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 2, Typeflag: tar.TypeReg}); err != nil {
+				t.Fatal(err)
+			}
+			tw.Write([]byte("{}"))
+		}
+		tw.Close()
+		tarballPath := filepath.Join(t.TempDir(), "pkg.tar")
+		if err := os.WriteFile(tarballPath, tarball.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		destDir := filepath.Join(t.TempDir(), "node_modules")
+		return destDir, ExtractTarball(context.Background(), tarballPath, destDir, "pkg")
+	}
+
+	destDir, err := extract("package/package.json", `package\lib\index.js`, "package/./docs//guide.md")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"package.json", "lib/index.js", "docs/guide.md"} {
+		if _, err := os.Stat(filepath.Join(destDir, "pkg", filepath.FromSlash(name))); err != nil {
+			t.Errorf("expected %s to be extracted: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"package/../../evil.js", `package\..\..\evil.js`, "/etc/evil.js"} {
+		destDir, err := extract(name)
+		if !errors.Is(err, ErrIntegrity) || !strings.Contains(err.Error(), "points outside the package directory") {
+			t.Errorf("%s: expected the entry to be refused, got %v", name, err)
+		}
+		if _, statErr := os.Stat(filepath.Join(filepath.Dir(destDir), "evil.js")); statErr == nil {
+			t.Errorf("%s: the entry was written outside the package", name)
+		}
+	}
+}
+
+func TestExtractErrorHints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node_modules", "left-pad", "index.js")
+	full := extractError("left-pad", "write", path, &os.PathError{Op: "write", Path: path, Err: syscall.ENOSPC})
+	if !errors.Is(full, ErrFilesystem) || !errors.Is(full, syscall.ENOSPC) || !strings.Contains(full.Error(), "failed to extract left-pad: can't write "+path+": ") || !strings.HasSuffix(full.Error(), ", the disk is full, free up space and try again") {
+		t.Errorf("expected a full disk explained, got %v", full)
+	}
+	denied := extractError("left-pad", "create", path, &os.PathError{Op: "open", Path: path, Err: syscall.EACCES})
+	if !errors.Is(denied, fs.ErrPermission) || strings.Count(denied.Error(), path) != 1 || !strings.Contains(denied.Error(), "check that you can write to "+filepath.Dir(path)) {
+		t.Errorf("expected a permission error explained, got %v", denied)
+	}
+}
+
+func TestExtractTarballPermissionDenied(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() == 0 {
+		t.Skip("needs a filesystem that enforces permissions on the test user")
+	}
+	dir := t.TempDir()
+	tarballPath := filepath.Join(dir, "left-pad.tgz")
+	writeTarball(t, tarballPath, true)
+	destDir := filepath.Join(dir, "node_modules")
+	if err := os.MkdirAll(destDir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(destDir, 0755)
+
+	err := ExtractTarball(context.Background(), tarballPath, destDir, "left-pad")
+	if !errors.Is(err, ErrFilesystem) || !strings.Contains(err.Error(), "failed to extract left-pad: can't create directory") || !strings.Contains(err.Error(), "check that you can write to") {
+		t.Errorf("expected the read-only node_modules explained, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package pkgmanager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// fakeRegistry is an in-memory RegistryClient serving fixtures, for tests that shouldn't need the network.
+// Metadata is looked up by package name on any registry and tarballs by their full URL
+type fakeRegistry struct {
+	mu       sync.Mutex
+	metadata map[string][]byte
+	tarballs map[string][]byte
+	requests map[string]int
+}
+
+// newFakeRegistry returns an empty fakeRegistry, add fixtures with AddMetadata and AddTarball
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		metadata: map[string][]byte{},
+		tarballs: map[string][]byte{},
+		requests: map[string]int{},
+	}
+}
+
+// AddMetadata serves document as the metadata of packageName
+func (f *fakeRegistry) AddMetadata(packageName string, document []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.metadata[packageName] = document
+}
+
+// AddTarball serves content at tarballURL
+func (f *fakeRegistry) AddTarball(tarballURL string, content []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tarballs[tarballURL] = content
+}
+
+// Requests reports how many times a package name or tarball URL was fetched
+func (f *fakeRegistry) Requests(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[key]
+}
+
+func (f *fakeRegistry) FetchMetadata(ctx context.Context, registry, packageName, cacheDir string, full bool) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Classify(ErrNetwork, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[packageName]++
+	document, ok := f.metadata[packageName]
+	if !ok {
+		return nil, Classify(ErrNetwork, fmt.Errorf("failed to fetch package info: 404 Not Found"))
+	}
+	return document, nil
+}
+
+// FetchTarball resumes from req.Offset like a server supporting range requests
+func (f *fakeRegistry) FetchTarball(ctx context.Context, tarballURL string, req TarballRequest) (*TarballBody, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[tarballURL]++
+	content, ok := f.tarballs[tarballURL]
+	if !ok {
+		return nil, fmt.Errorf("failed to download package: 404 Not Found")
+	}
+
+	offset := req.Offset
+	if offset < 0 || offset > int64(len(content)) {
+		offset = 0
+	}
+	return &TarballBody{
+		ReadCloser: io.NopCloser(bytes.NewReader(content[offset:])),
+		Offset:     offset,
+		Size:       int64(len(content)),
+	}, nil
+}
@@ -1,121 +1,323 @@
 package pkgmanager
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/jamesjellow/fpm/config"
 )
 
 // PackageInfo represents the structure of the package info returned by the NPM registry
 type PackageInfo struct {
-	Name    string                 `json:"name"`
-	Version string                 `json:"version"`
-	Dist    map[string]interface{} `json:"dist"`
+	Name                 string                 `json:"name"`
+	Version              string                 `json:"version"`
+	Description          string                 `json:"description"`
+	Dependencies         DependencyMap          `json:"dependencies"`
+	OptionalDependencies DependencyMap          `json:"optionalDependencies"`
+	Dist                 map[string]interface{} `json:"dist"` // Everything the registry sent in dist, prefer the typed fields below
+	Tarball              string                 `json:"-"`    // dist.tarball, the URL of the tarball
+	Shasum               string                 `json:"-"`    // dist.shasum, the sha1 the download is verified against
+	Integrity            string                 `json:"-"`    // dist.integrity, empty when the registry doesn't publish one
+	UnpackedSize         int64                  `json:"-"`    // dist.unpackedSize in bytes, 0 when the registry doesn't publish it
+	Deprecated           Deprecation            `json:"deprecated"`
+	OS                   StringList             `json:"os"`      // Platforms the package supports in npm's naming, "!name" excludes one
+	CPU                  StringList             `json:"cpu"`     // Architectures the package supports, like OS
+	Engines              DependencyMap          `json:"engines"` // Runtime ranges the package supports, like {"node": ">=18"}
 }
 
-// FetchPackageInfo fetches package information from the NPM registry
-func FetchPackageInfo(packageName, version string) (*PackageInfo, error) {
-	encodedPackageName := url.PathEscape(packageName)
-	registryURL := fmt.Sprintf("https://registry.npmjs.org/%s", encodedPackageName)
-	resp, err := http.Get(registryURL)
+// StringList is a list of strings that also accepts a single string, some metadata has `"os": "darwin"`
+type StringList []string
+
+// UnmarshalJSON accepts an array or a single string and ignores anything else
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*l = list
+		return nil
+	}
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = StringList{single}
+		return nil
+	}
+	*l = nil
+	return nil
+}
+
+// DependencyMap is a package name to version range map, entries whose range isn't a string are dropped
+type DependencyMap map[string]string
+
+// UnmarshalJSON keeps the string ranges of an object and ignores anything else
+func (m *DependencyMap) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		*m = nil
+		return nil
+	}
+	*m = make(DependencyMap, len(raw))
+	for name, value := range raw {
+		if versionRange, ok := value.(string); ok {
+			(*m)[name] = versionRange
+		}
+	}
+	return nil
+}
+
+// Deprecation is the message the registry sets on deprecated versions, empty when the version isn't deprecated
+type Deprecation string
+
+// UnmarshalJSON accepts the message string and ignores anything else, some old metadata uses `false`
+func (d *Deprecation) UnmarshalJSON(data []byte) error {
+	var message string
+	if err := json.Unmarshal(data, &message); err != nil {
+		*d = ""
+		return nil
+	}
+	*d = Deprecation(message)
+	return nil
+}
+
+// UnmarshalJSON decodes a version document and fills the typed dist fields, dist values that aren't strings are
+// left empty
+func (p *PackageInfo) UnmarshalJSON(data []byte) error {
+	type packageInfo PackageInfo // Without the method, so decoding doesn't recurse
+	if err := json.Unmarshal(data, (*packageInfo)(p)); err != nil {
+		return err
+	}
+	p.Tarball, _ = p.Dist["tarball"].(string)
+	p.Shasum, _ = p.Dist["shasum"].(string)
+	p.Integrity, _ = p.Dist["integrity"].(string)
+	if size, ok := p.Dist["unpackedSize"].(float64); ok && size > 0 {
+		p.UnpackedSize = int64(size)
+	}
+	return nil
+}
+
+// CheckDist errors instead of letting the download fail obscurely when a malformed or partial registry response
+// is missing the tarball URL or shasum
+func (p *PackageInfo) CheckDist() error {
+	if p.Tarball == "" {
+		return fmt.Errorf("registry response missing tarball URL for %s@%s", p.Name, p.Version)
+	}
+	if p.Shasum == "" {
+		return fmt.Errorf("registry response missing shasum for %s@%s", p.Name, p.Version)
+	}
+	return nil
+}
+
+// DefaultRegistry is the public NPM registry
+const DefaultRegistry = config.DefaultRegistry
+
+// FetchPackageInfo is Client.FetchPackageInfo with the default settings
+func FetchPackageInfo(ctx context.Context, registry, packageName, version, cacheDir string) (*PackageInfo, error) {
+	return defaultClient.FetchPackageInfo(ctx, registry, packageName, version, cacheDir)
+}
+
+// FetchPackageInfo fetches package information from the given registry, revalidating the copy in cacheDir
+// when there is one. An empty cacheDir always fetches the full document
+func (c *Client) FetchPackageInfo(ctx context.Context, registry, packageName, version, cacheDir string) (*PackageInfo, error) {
+	metadata, err := c.FetchPackageMetadata(ctx, registry, packageName, cacheDir, false)
 	if err != nil {
-		log.Printf("failed to fetch package info: %v", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
+	packageInfo, _, err := metadata.Resolve(version)
+	return packageInfo, err
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("failed to fetch package info: %v", resp.Status)
-		return nil, fmt.Errorf("failed to fetch package info: %v", resp.Status)
-	}
+// PackageMetadata is the registry document of a package, covering every published version
+type PackageMetadata struct {
+	Name      string
+	DistTags  map[string]string // Tag to version, like latest
+	Versions  []string          // Every published version that is valid semver, oldest first
+	versions  map[string]json.RawMessage
+	parsed    map[string]*semver.Version
+	published map[string]time.Time // When each version was published, only the full document has these
+}
+
+// FetchPackageMetadata is Client.FetchPackageMetadata with the default settings
+func FetchPackageMetadata(ctx context.Context, registry, packageName, cacheDir string, full bool) (*PackageMetadata, error) {
+	return defaultClient.FetchPackageMetadata(ctx, registry, packageName, cacheDir, full)
+}
 
-	body, err := io.ReadAll(resp.Body)
+// FetchPackageMetadata fetches the registry document of a package, caching it in cacheDir like FetchPackageInfo.
+// Unless full is set this is the abbreviated document, which leaves out descriptions and readmes. Concurrent
+// callers asking the same client for the same document share one request, the returned metadata is read only
+func (c *Client) FetchPackageMetadata(ctx context.Context, registry, packageName, cacheDir string, full bool) (*PackageMetadata, error) {
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%t", registry, packageName, cacheDir, full)
+	return c.flights.do(ctx, key, func() (*PackageMetadata, error) {
+		return c.fetchPackageMetadata(ctx, registry, packageName, cacheDir, full)
+	})
+}
+
+func (c *Client) fetchPackageMetadata(ctx context.Context, registry, packageName, cacheDir string, full bool) (*PackageMetadata, error) {
+	var body []byte
+	var err error
+	if c.MetadataDir != "" {
+		body, err = readMirroredMetadata(c.MetadataDir, packageName)
+	} else {
+		body, err = c.transport().FetchMetadata(ctx, registry, packageName, cacheDir, full)
+	}
 	if err != nil {
-		log.Printf("failed to read response body: %v", err)
+		log.Printf("failed to fetch package info: %v", err)
 		return nil, err
 	}
 
-	var metadata map[string]interface{}
-	if err := json.Unmarshal(body, &metadata); err != nil {
+	metadata, err := parsePackageMetadata(packageName, body)
+	if err != nil {
 		log.Printf("failed to unmarshal JSON: %v", err)
 		return nil, err
 	}
+	return metadata, nil
+}
+
+// packument is the part of a metadata document resolution reads, the abbreviated and full documents share it.
+// Version documents stay raw until one is picked, most of a document is versions that are never looked at
+type packument struct {
+	DistTags map[string]interface{}     `json:"dist-tags"`
+	Versions map[string]json.RawMessage `json:"versions"`
+	Time     map[string]interface{}     `json:"time"` // Version to publish time, plus created and modified
+}
+
+// parsePackageMetadata decodes a metadata document without decoding the version documents in it
+func parsePackageMetadata(packageName string, body []byte) (*PackageMetadata, error) {
+	var document packument
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, err
+	}
 
+	metadata := &PackageMetadata{
+		Name:      packageName,
+		DistTags:  make(map[string]string),
+		versions:  document.Versions,
+		parsed:    make(map[string]*semver.Version),
+		published: make(map[string]time.Time),
+	}
+	for tag, version := range document.DistTags {
+		if versionStr, ok := version.(string); ok {
+			metadata.DistTags[tag] = versionStr
+		}
+	}
+	for version, value := range document.Time {
+		if timestamp, ok := value.(string); ok {
+			if published, err := time.Parse(time.RFC3339, timestamp); err == nil {
+				metadata.published[version] = published
+			}
+		}
+	}
+
+	// Only valid semver can be ordered, registries sometimes carry junk keys that would break the sort
+	var versions []*semver.Version
+	for v := range document.Versions {
+		parsed, err := semver.NewVersion(v)
+		if err != nil {
+			log.Printf("skipping invalid version %q: %v", v, err)
+			continue
+		}
+		versions = append(versions, parsed)
+		metadata.parsed[v] = parsed
+	}
+	sort.Sort(semver.Collection(versions))
+	for _, v := range versions {
+		metadata.Versions = append(metadata.Versions, v.Original())
+	}
+	return metadata, nil
+}
+
+// Resolve picks the version a range or dist-tag means and returns its version document, decoded and as sent
+func (m *PackageMetadata) Resolve(versionRange string) (*PackageInfo, json.RawMessage, error) {
+	return m.ResolveBefore(versionRange, time.Time{})
+}
+
+// ResolveBefore is Resolve among the versions published before the cutoff, like npm's --before. The publish times
+// are only in the full document, a zero cutoff considers every version
+func (m *PackageMetadata) ResolveBefore(versionRange string, before time.Time) (*PackageInfo, json.RawMessage, error) {
 	// Resolve the version range to a specific version
-	resolvedVersion, err := resolveVersion(metadata, version)
+	resolvedVersion, err := resolveVersion(m, versionRange, before)
 	if err != nil {
 		log.Printf("failed to resolve version: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Fetch the specific version info
+	// Decode only the version that was picked
 	packageInfo := &PackageInfo{}
-	if v, ok := metadata["versions"].(map[string]interface{})[resolvedVersion]; ok {
-		packageInfoJSON, err := json.Marshal(v)
-		if err != nil {
-			log.Printf("failed to marshal package info: %v", err)
-			return nil, err
-		}
+	packageInfoJSON, ok := m.versions[resolvedVersion]
+	if ok {
 		if err := json.Unmarshal(packageInfoJSON, packageInfo); err != nil {
 			log.Printf("failed to unmarshal package info: %v", err)
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	return packageInfo, nil
+	return packageInfo, packageInfoJSON, nil
 }
 
-// resolveVersion resolves a version range to a specific version
-func resolveVersion(metadata map[string]interface{}, versionRange string) (string, error) {
-	if versionRange == "latest" {
-		if distTags, ok := metadata["dist-tags"].(map[string]interface{}); ok {
-			if latest, ok := distTags["latest"].(string); ok {
-				return latest, nil
-			}
-		}
+// resolveVersion resolves a version range to a specific version, one published before the cutoff unless it is zero
+func resolveVersion(metadata *PackageMetadata, versionRange string, before time.Time) (string, error) {
+	if !before.IsZero() && len(metadata.published) == 0 {
+		return "", fmt.Errorf("the registry sent no publish times for %s, resolving versions before a date needs them", metadata.Name)
+	}
+	publishedInTime := func(version string) bool {
+		published, ok := metadata.published[version]
+		return before.IsZero() || ok && published.Before(before)
 	}
 
-	versions := []string{}
-	if versionMap, ok := metadata["versions"].(map[string]interface{}); ok {
-		for v := range versionMap {
-			versions = append(versions, v)
-		}
+	// An empty range and "*" both mean any version, which npm resolves to the latest tag
+	versionRange = strings.TrimSpace(versionRange)
+	anyVersion := versionRange == "" || versionRange == "*"
+	if anyVersion {
+		versionRange = "*"
 	}
 
-	// Sort versions using semver
-	sort.Slice(versions, func(i, j int) bool {
-		vi, err := semver.NewVersion(versions[i])
-		if err != nil {
-			return false
-		}
-		vj, err := semver.NewVersion(versions[j])
-		if err != nil {
-			return false
+	// A dist-tag such as latest, next or beta resolves to the version it points at
+	tag := versionRange
+	if anyVersion {
+		tag = "latest"
+	}
+	if tagged, ok := metadata.DistTags[tag]; ok {
+		if publishedInTime(tagged) {
+			return tagged, nil
 		}
-		return vi.GreaterThan(vj)
-	})
+		// Tagged after the cutoff, take the newest version up to the tagged one that was out by then
+		versionRange = "<=" + tagged
+	}
+	// Without a latest tag, latest is the newest stable version
+	untaggedLatest := tag == "latest" && metadata.DistTags[tag] == ""
+	if untaggedLatest {
+		versionRange = "*"
+	}
 
 	// Match version range
 	constraint, err := semver.NewConstraint(versionRange)
 	if err != nil {
-		return "", fmt.Errorf("invalid version range: %s", versionRange)
+		return "", fmt.Errorf("%q is neither a version range nor a dist-tag of the package", versionRange)
 	}
 
-	for _, v := range versions {
-		ver, err := semver.NewVersion(v)
-		if err != nil {
-			continue
-		}
-		if constraint.Check(ver) {
+	// Versions are sorted oldest first, the newest match wins
+	for i := len(metadata.Versions) - 1; i >= 0; i-- {
+		if v := metadata.Versions[i]; constraint.Check(metadata.parsed[v]) && publishedInTime(v) {
 			return v, nil
 		}
 	}
+	// Or the newest prerelease when nothing stable was published
+	if untaggedLatest {
+		for i := len(metadata.Versions) - 1; i >= 0; i-- {
+			if v := metadata.Versions[i]; publishedInTime(v) {
+				return v, nil
+			}
+		}
+	}
 
+	if len(metadata.Versions) == 0 {
+		return "", fmt.Errorf("%s has no published versions", metadata.Name)
+	}
+	if !before.IsZero() {
+		return "", fmt.Errorf("no matching version found for range: %s published before %s", versionRange, before.Format(time.RFC3339))
+	}
 	return "", fmt.Errorf("no matching version found for range: %s", versionRange)
 }
@@ -0,0 +1,463 @@
+package pkgmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// versionsFixture builds registry metadata with the given published versions and dist-tags
+func versionsFixture(distTags map[string]interface{}, versions ...string) *PackageMetadata {
+	versionMap := make(map[string]interface{})
+	for _, v := range versions {
+		versionMap[v] = map[string]interface{}{"version": v}
+	}
+	metadata := map[string]interface{}{"versions": versionMap}
+	if distTags != nil {
+		metadata["dist-tags"] = distTags
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		panic(err)
+	}
+	parsed, err := parsePackageMetadata("fixture", body)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func TestResolveVersionRanges(t *testing.T) {
+	metadata := versionsFixture(
+		map[string]interface{}{"latest": "2.1.0"},
+		"0.9.0", "1.0.0", "1.1.0", "1.2.0", "1.2.5", "1.3.0", "2.0.0", "2.1.0", "3.0.0-beta.1",
+	)
+
+	tests := []struct {
+		versionRange string
+		expected     string
+	}{
+		{"latest", "2.1.0"},
+		{"", "2.1.0"},
+		{"*", "2.1.0"},
+		{"1.2.0", "1.2.0"},
+		{"1.x", "1.3.0"},
+		{"1.2.x", "1.2.5"},
+		{"1", "1.3.0"},
+		{"~1.2", "1.2.5"},
+		{"~1.2.0", "1.2.5"},
+		{"^1.1.0", "1.3.0"},
+		{"^0.9.0", "0.9.0"},
+		{">=1 <2", "1.3.0"},
+		{">=1.0.0, <1.2.0", "1.1.0"},
+		{">1.2.0 <=2.0.0", "2.0.0"},
+		{"1.0.0 || 2.0.0", "2.0.0"},
+		{"<1.0.0", "0.9.0"},
+		{"x", "2.1.0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.versionRange, func(t *testing.T) {
+			got, err := resolveVersion(metadata, test.versionRange, time.Time{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestResolveVersionDistTags(t *testing.T) {
+	metadata := versionsFixture(
+		map[string]interface{}{"latest": "18.2.0", "next": "19.0.0-rc.1", "beta": "19.0.0-beta.3"},
+		"18.2.0", "19.0.0-beta.3", "19.0.0-rc.1",
+	)
+
+	for tag, expected := range map[string]string{"next": "19.0.0-rc.1", "beta": "19.0.0-beta.3", "latest": "18.2.0"} {
+		got, err := resolveVersion(metadata, tag, time.Time{})
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", tag, err)
+		}
+		if got != expected {
+			t.Errorf("expected %s for %s, got %s", expected, tag, got)
+		}
+	}
+
+	if _, err := resolveVersion(metadata, "canary", time.Time{}); err == nil {
+		t.Errorf("expected an error for an unknown tag")
+	}
+}
+
+func TestResolveVersionNoMatch(t *testing.T) {
+	metadata := versionsFixture(map[string]interface{}{"latest": "1.0.0"}, "1.0.0")
+
+	if _, err := resolveVersion(metadata, "^2.0.0", time.Time{}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestResolveVersionLatestWithoutDistTags(t *testing.T) {
+	metadata := versionsFixture(nil, "1.0.0", "1.2.0", "2.0.0-beta.1")
+	for _, versionRange := range []string{"latest", "", "*"} {
+		got, err := resolveVersion(metadata, versionRange, time.Time{})
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", versionRange, err)
+		}
+		if got != "1.2.0" {
+			t.Errorf("expected the newest stable 1.2.0 for %q, got %s", versionRange, got)
+		}
+	}
+
+	// Only prereleases, the newest of them is the latest
+	if got, err := resolveVersion(versionsFixture(nil, "1.0.0-alpha.1", "1.0.0-beta.2"), "latest", time.Time{}); err != nil || got != "1.0.0-beta.2" {
+		t.Errorf("expected 1.0.0-beta.2, got %s, %v", got, err)
+	}
+	if _, err := resolveVersion(versionsFixture(nil), "latest", time.Time{}); err == nil || !strings.Contains(err.Error(), "no published versions") {
+		t.Errorf("expected an error without any versions, got %v", err)
+	}
+}
+
+func TestResolveVersionSkipsInvalidVersions(t *testing.T) {
+	metadata := versionsFixture(nil, "1.0.0", "not-a-version", "1.4.0", "", "v1.2-garbage!", "1.3.0")
+
+	for i := 0; i < 10; i++ {
+		got, err := resolveVersion(metadata, "^1.0.0", time.Time{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != "1.4.0" {
+			t.Fatalf("expected 1.4.0, got %s", got)
+		}
+	}
+}
+
+func TestResolveVersionBefore(t *testing.T) {
+	body := []byte(`{
+		"dist-tags": {"latest": "2.0.0", "beta": "2.1.0-beta.1"},
+		"versions": {
+			"1.0.0": {"version": "1.0.0"},
+			"1.1.0": {"version": "1.1.0"},
+			"2.0.0": {"version": "2.0.0"},
+			"2.1.0-beta.1": {"version": "2.1.0-beta.1"}
+		},
+		"time": {
+			"created": "2021-06-01T00:00:00.000Z",
+			"modified": "2023-06-01T00:00:00.000Z",
+			"1.0.0": "2021-06-01T00:00:00.000Z",
+			"1.1.0": "2022-06-01T00:00:00.000Z",
+			"2.0.0": "2023-03-01T00:00:00.000Z",
+			"2.1.0-beta.1": "2023-06-01T00:00:00.000Z"
+		}
+	}`)
+	metadata, err := parsePackageMetadata("fixture", body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		versionRange string
+		before       string
+		expected     string
+	}{
+		{"latest", "2023-01-01", "1.1.0"},
+		{"", "2024-01-01", "2.0.0"},
+		{"^1.0.0", "2022-01-01", "1.0.0"},
+		{"beta", "2023-04-01", "2.0.0"},
+		{"beta", "2024-01-01", "2.1.0-beta.1"},
+		{"1.1.0", "2022-06-01T00:00:01Z", "1.1.0"},
+	}
+	for _, test := range tests {
+		before, err := time.Parse(time.RFC3339, test.before)
+		if err != nil {
+			before, _ = time.Parse("2006-01-02", test.before)
+		}
+		got, err := resolveVersion(metadata, test.versionRange, before)
+		if err != nil {
+			t.Fatalf("unexpected error for %q before %s: %v", test.versionRange, test.before, err)
+		}
+		if got != test.expected {
+			t.Errorf("expected %s for %q before %s, got %s", test.expected, test.versionRange, test.before, got)
+		}
+	}
+
+	if _, err := resolveVersion(metadata, "^2.0.0", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Errorf("expected an error when nothing in the range was published before the cutoff")
+	}
+	if _, err := resolveVersion(versionsFixture(nil, "1.0.0"), "1.0.0", time.Now()); err == nil {
+		t.Errorf("expected an error for metadata without publish times")
+	}
+}
+
+func TestFetchPackageInfoDeprecated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"dist-tags": {"latest": "1.2.3"},
+			"versions": {
+				"1.2.2": {"name": "foo", "version": "1.2.2", "deprecated": false},
+				"1.2.3": {"name": "foo", "version": "1.2.3", "deprecated": "use bar instead"}
+			}
+		}`))
+	}))
+	defer server.Close()
+
+	packageInfo, err := FetchPackageInfo(context.Background(), server.URL, "foo", "latest", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if packageInfo.Deprecated != "use bar instead" {
+		t.Errorf("unexpected deprecation: %q", packageInfo.Deprecated)
+	}
+
+	packageInfo, err = FetchPackageInfo(context.Background(), server.URL, "foo", "1.2.2", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if packageInfo.Deprecated != "" {
+		t.Errorf("expected no deprecation, got %q", packageInfo.Deprecated)
+	}
+}
+
+func TestFetchPackageInfoRevalidatesWithETag(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"dist-tags": {"latest": "1.0.0"}, "versions": {"1.0.0": {"name": "foo", "version": "1.0.0"}}}`))
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		packageInfo, err := FetchPackageInfo(context.Background(), server.URL, "foo", "latest", cacheDir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if packageInfo.Version != "1.0.0" {
+			t.Errorf("unexpected version: %s", packageInfo.Version)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+	if cached := readMetadataCache(cacheDir, metadataCacheKey(server.URL+"/foo", abbreviatedMetadataAccept)); cached == nil || cached.ETag != `"v1"` {
+		t.Errorf("expected the response to be cached with its ETag, got %+v", cached)
+	}
+}
+
+func TestFetchPackageInfoFallsBackToFullMetadata(t *testing.T) {
+	var accepts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepts = append(accepts, r.Header.Get("Accept"))
+		if r.Header.Get("Accept") != fullMetadataAccept {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Write([]byte(`{"name": "foo", "readme": "long", "dist-tags": {"latest": "1.0.0"}, "versions": {"1.0.0": {"name": "foo", "version": "1.0.0"}}}`))
+	}))
+	defer server.Close()
+
+	packageInfo, err := FetchPackageInfo(context.Background(), server.URL, "foo", "^1.0.0", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if packageInfo.Version != "1.0.0" {
+		t.Errorf("unexpected version: %s", packageInfo.Version)
+	}
+	if len(accepts) != 2 || accepts[0] != abbreviatedMetadataAccept || accepts[1] != fullMetadataAccept {
+		t.Errorf("expected an abbreviated request then a full one, got %q", accepts)
+	}
+}
+
+func TestPackageInfoDistFields(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"dist-tags": {"latest": "1.2.3"},
+			"versions": {
+				"1.2.1": {"name": "foo", "version": "1.2.1", "dist": {"tarball": "https://registry.example/foo-1.2.1.tgz", "shasum": "abc", "integrity": "sha512-xyz"}},
+				"1.2.2": {"name": "foo", "version": "1.2.2", "dist": {"tarball": 42, "shasum": "abc"}},
+				"1.2.3": {"name": "foo", "version": "1.2.3", "dist": {"shasum": "abc"}}
+			}
+		}`))
+	}))
+	defer server.Close()
+
+	for _, version := range []string{"1.2.2", "1.2.3"} {
+		packageInfo, err := FetchPackageInfo(context.Background(), server.URL, "foo", version, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		err = packageInfo.CheckDist()
+		if err == nil || err.Error() != "registry response missing tarball URL for foo@"+version {
+			t.Errorf("expected a missing tarball error for %s, got %v", version, err)
+		}
+	}
+
+	packageInfo, err := FetchPackageInfo(context.Background(), server.URL, "foo", "1.2.1", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := packageInfo.CheckDist(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if packageInfo.Tarball != "https://registry.example/foo-1.2.1.tgz" || packageInfo.Shasum != "abc" || packageInfo.Integrity != "sha512-xyz" {
+		t.Errorf("unexpected dist fields %+v", packageInfo)
+	}
+}
+
+func TestFetchPackageInfoFromFakeRegistry(t *testing.T) {
+	fake := newFakeRegistry()
+	fake.AddMetadata("@scope/foo", []byte(`{
+		"dist-tags": {"latest": "2.0.0"},
+		"versions": {
+			"1.4.0": {"name": "@scope/foo", "version": "1.4.0"},
+			"2.0.0": {"name": "@scope/foo", "version": "2.0.0"}
+		}
+	}`))
+	client := &Client{Transport: fake}
+
+	packageInfo, err := client.FetchPackageInfo(context.Background(), DefaultRegistry, "@scope/foo", "^1.0.0", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if packageInfo.Version != "1.4.0" {
+		t.Errorf("expected 1.4.0, got %s", packageInfo.Version)
+	}
+	if fake.Requests("@scope/foo") != 1 {
+		t.Errorf("expected one metadata request, got %d", fake.Requests("@scope/foo"))
+	}
+
+	if _, err := client.FetchPackageInfo(context.Background(), DefaultRegistry, "missing", "latest", ""); !errors.Is(err, ErrNetwork) {
+		t.Errorf("expected a network error for an unknown package, got %v", err)
+	}
+}
+
+func TestFetchPackageInfoFromMetadataDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "@scope"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	document := []byte(`{"dist-tags": {"latest": "1.4.0"}, "versions": {"1.4.0": {"name": "@scope/foo", "version": "1.4.0"}}}`)
+	if err := os.WriteFile(filepath.Join(dir, "@scope", "foo.json"), document, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeRegistry()
+	client := &Client{Transport: fake, MetadataDir: dir}
+
+	packageInfo, err := client.FetchPackageInfo(context.Background(), DefaultRegistry, "@scope/foo", "^1.0.0", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if packageInfo.Version != "1.4.0" || fake.Requests("@scope/foo") != 0 {
+		t.Errorf("expected 1.4.0 from the mirror without a request, got %s after %d requests", packageInfo.Version, fake.Requests("@scope/foo"))
+	}
+
+	_, err = client.FetchPackageInfo(context.Background(), DefaultRegistry, "missing", "latest", "")
+	if !errors.Is(err, ErrFilesystem) || !strings.Contains(err.Error(), filepath.Join(dir, "missing.json")) {
+		t.Errorf("expected an error naming the missing document, got %v", err)
+	}
+	if _, err := client.FetchPackageInfo(context.Background(), DefaultRegistry, "../outside", "latest", ""); err == nil {
+		t.Errorf("expected an error for a name outside the mirror")
+	}
+}
+
+func TestFetchPackageInfoSharesConcurrentRequests(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Write([]byte(`{"dist-tags": {"latest": "1.1.0"}, "versions": {"1.0.0": {"name": "foo", "version": "1.0.0"}, "1.1.0": {"name": "foo", "version": "1.1.0"}}}`))
+	}))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	versions := make([]string, 8)
+	for i := range versions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			versionRange := []string{"latest", "1.0.0"}[i%2]
+			packageInfo, err := FetchPackageInfo(context.Background(), server.URL, "foo", versionRange, "")
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			versions[i] = packageInfo.Version
+		}()
+	}
+	// Let every caller join the request before the registry answers
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected concurrent callers to share one request, got %d", got)
+	}
+	for i, version := range versions {
+		if expected := []string{"1.1.0", "1.0.0"}[i%2]; version != expected {
+			t.Errorf("expected %s for caller %d, got %s", expected, i, version)
+		}
+	}
+
+	// Finished fetches aren't remembered
+	if _, err := FetchPackageInfo(context.Background(), server.URL, "foo", "latest", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("expected a later fetch to request again, got %d requests", got)
+	}
+}
+
+func TestMetadataFlightRetriesAfterCancelledStarter(t *testing.T) {
+	group := &flightGroup{calls: make(map[string]*flight)}
+	started := make(chan struct{})
+	starterCtx, cancel := context.WithCancel(context.Background())
+
+	var starterErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, starterErr = group.do(starterCtx, "foo", func() (*PackageMetadata, error) {
+			close(started)
+			<-starterCtx.Done()
+			return nil, Classify(ErrNetwork, starterCtx.Err())
+		})
+	}()
+	<-started
+
+	waiterDone := make(chan *PackageMetadata)
+	go func() {
+		metadata, err := group.do(context.Background(), "foo", func() (*PackageMetadata, error) {
+			return &PackageMetadata{Name: "foo"}, nil
+		})
+		if err != nil {
+			t.Errorf("expected the waiter to fetch again, got %v", err)
+		}
+		waiterDone <- metadata
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-done
+
+	if !errors.Is(starterErr, context.Canceled) {
+		t.Errorf("expected the starter to be cancelled, got %v", starterErr)
+	}
+	if metadata := <-waiterDone; metadata == nil || metadata.Name != "foo" {
+		t.Errorf("expected the waiter's own fetch, got %+v", metadata)
+	}
+}
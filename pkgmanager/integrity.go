@@ -0,0 +1,80 @@
+package pkgmanager
+
+import (
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// SHA512 gets the base64 sha512 digest of an integrity string, which lists one or more space separated
+// <algorithm>-<base64> hashes like dist.integrity does. Empty when it has no valid one
+func SHA512(integrity string) string {
+	if digest := integrityDigest(integrity, "sha512", sha512.Size); digest != nil {
+		return base64.StdEncoding.EncodeToString(digest)
+	}
+	return ""
+}
+
+// SHA1Shasum gets the sha1 of an integrity string as the hex shasum the registry publishes next to it, empty when
+// it has no valid one
+func SHA1Shasum(integrity string) string {
+	if digest := integrityDigest(integrity, "sha1", sha1.Size); digest != nil {
+		return hex.EncodeToString(digest)
+	}
+	return ""
+}
+
+// Decode the first hash of algorithm in integrity that is size bytes long
+func integrityDigest(integrity, algorithm string, size int) []byte {
+	for _, hash := range strings.Fields(integrity) {
+		if digest, ok := strings.CutPrefix(hash, algorithm+"-"); ok {
+			// Options after a ? aren't part of the digest
+			digest, _, _ = strings.Cut(digest, "?")
+			if decoded, err := base64.StdEncoding.DecodeString(digest); err == nil && len(decoded) == size {
+				return decoded
+			}
+		}
+	}
+	return nil
+}
+
+// Check the file at path against the sha512 of integrity, an integrity without one isn't checked. The sha1
+// shasum is checked separately, so while both are published a tarball has to match both
+func checkIntegrity(path, integrity string) error {
+	expected := SHA512(integrity)
+	if expected == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return Classify(ErrFilesystem, err)
+	}
+	defer file.Close()
+
+	hasher := sha512.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return Classify(ErrFilesystem, err)
+	}
+	if calculated := base64.StdEncoding.EncodeToString(hasher.Sum(nil)); calculated != expected {
+		return Classify(ErrIntegrity, fmt.Errorf("integrity mismatch: expected sha512-%s, got sha512-%s", expected, calculated))
+	}
+	return nil
+}
+
+// VerifyCachedIntegrity checks the tarball cached under shasum against the sha512 of integrity, a tarball that
+// isn't cached has nothing to check
+func VerifyCachedIntegrity(cacheDir, shasum, integrity string) error {
+	if cacheDir == "" || shasum == "" {
+		return nil
+	}
+	cachedPath := cachedTarballPath(cacheDir, shasum)
+	if _, err := os.Stat(cachedPath); err != nil {
+		return nil
+	}
+	return checkIntegrity(cachedPath, integrity)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package pkgmanager
+
+// Paths are only limited on Windows
+func longPath(path string) string {
+	return path
+}
+
+func pathError(path string, err error) error {
+	return err
+}
@@ -0,0 +1,35 @@
+package pkgmanager
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is the length Windows refuses paths from without the extended-length prefix, less the 12 characters
+// CreateDirectory keeps free for an 8.3 file name
+const maxPath = 260 - 12
+
+// Give a path too long for Windows the \\?\ prefix, which has to be on an absolute path. os only adds it to paths
+// that are already absolute, and node_modules usually isn't
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil || len(abs) < maxPath {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// Explain a failure to create a path that is longer than Windows allows without long path support
+func pathError(path string, err error) error {
+	if len(strings.TrimPrefix(path, `\\?\`)) < maxPath {
+		return err
+	}
+	return fmt.Errorf("%v: the path is %d characters long, enable Windows long path support (LongPathsEnabled) or install closer to the drive root", err, len(path))
+}
@@ -0,0 +1,22 @@
+package pkgmanager
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLongPath(t *testing.T) {
+	short := `C:\project\node_modules\left-pad\index.js`
+	if got := longPath(short); got != short {
+		t.Errorf("expected a short path to stay as is, got %s", got)
+	}
+
+	long := `C:\project` + strings.Repeat(`\node_modules\dependency`, 12) + `\index.js`
+	if got := longPath(long); got != `\\?\`+long {
+		t.Errorf("expected the extended-length prefix, got %s", got)
+	}
+	unc := `\\server\share` + strings.Repeat(`\node_modules\dependency`, 12)
+	if got := longPath(unc); got != `\\?\UNC\server\share`+strings.Repeat(`\node_modules\dependency`, 12) {
+		t.Errorf("expected the UNC extended-length prefix, got %s", got)
+	}
+}
@@ -0,0 +1,26 @@
+package pkgmanager
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Read the metadata document of packageName from the mirror in dir
+func readMirroredMetadata(dir, packageName string) ([]byte, error) {
+	name := filepath.FromSlash(packageName) + ".json"
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid package name %q for the metadata mirror", packageName)
+	}
+	path := filepath.Join(dir, name)
+	body, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, Classify(ErrFilesystem, fmt.Errorf("%s is missing from the metadata mirror, expected its document at %s", packageName, path))
+	}
+	if err != nil {
+		return nil, Classify(ErrFilesystem, fmt.Errorf("failed to read %s from the metadata mirror: %w", packageName, err))
+	}
+	return body, nil
+}
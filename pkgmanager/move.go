@@ -0,0 +1,139 @@
+package pkgmanager
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// DefaultTempDir returns where tarballs are staged before they are moved into node_modules, FPM_TMPDIR overrides
+// the system temporary directory
+func DefaultTempDir() string {
+	if dir := os.Getenv("FPM_TMPDIR"); dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// MoveDir moves the directory src to dst, which must not exist yet. A rename across filesystems isn't possible, so
+// then the tree is copied and src removed. A failed copy leaves nothing at dst
+func MoveDir(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !isCrossDevice(err) {
+		return Classify(ErrFilesystem, pathError(dst, err))
+	}
+
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return Classify(ErrFilesystem, fmt.Errorf("failed to copy %s to %s: %v", src, dst, err))
+	}
+	if err := os.RemoveAll(src); err != nil {
+		log.Printf("failed to remove %s after copying it: %v", src, err)
+	}
+	return nil
+}
+
+// Copy the tree at src to dst keeping modes and modification times. Directory times are set once their contents
+// are in place
+func copyTree(src, dst string) error {
+	var dirs []string
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := longPath(filepath.Join(dst, rel))
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			dirs = append(dirs, path)
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			if err := copyRegularFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deepest first, like extracting does
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(dirs[i])
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, dirs[i])
+		target := longPath(filepath.Join(dst, rel))
+		if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyFiles copies the files listed as slash separated paths relative to srcDir into dstDir, creating the
+// directories they are in and keeping their modes
+func CopyFiles(srcDir, dstDir string, files []string) error {
+	for _, file := range files {
+		src := filepath.Join(srcDir, filepath.FromSlash(file))
+		dst := filepath.Join(dstDir, filepath.FromSlash(file))
+		info, err := os.Stat(src)
+		if err != nil {
+			return Classify(ErrFilesystem, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return Classify(ErrFilesystem, err)
+		}
+		if err := copyRegularFile(src, dst, info.Mode().Perm()); err != nil {
+			return Classify(ErrFilesystem, err)
+		}
+	}
+	return nil
+}
+
+func copyRegularFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// Open applies the umask, the extracted mode is what the tarball asked for
+	return os.Chmod(dst, mode)
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package pkgmanager
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Whether a rename failed because src and dst are on different filesystems
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
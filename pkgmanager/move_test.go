@@ -0,0 +1,67 @@
+package pkgmanager
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMoveDir(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "left-pad")
+	if err := os.MkdirAll(filepath.Join(src, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "lib", "index.js"), []byte("module.exports = 1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "node_modules", "left-pad")
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MoveDir(src, dst); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dst, "lib", "index.js")); err != nil || string(content) != "module.exports = 1" {
+		t.Errorf("expected the package at its destination, got %q %v", content, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("expected the staged package to be gone, got %v", err)
+	}
+}
+
+// A rename across filesystems falls back to copying, which must give the same tree
+func TestCopyTreeKeepsModesAndTimes(t *testing.T) {
+	src := t.TempDir()
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "bin", "cli.js"), []byte("#!/usr/bin/env node"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(src, "bin", "cli.js"), filepath.Join(src, "bin")} {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(t.TempDir(), "copy")
+	if err := copyTree(src, dst); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, path := range []string{filepath.Join("bin", "cli.js"), "bin"} {
+		info, err := os.Stat(filepath.Join(dst, path))
+		if err != nil {
+			t.Fatalf("expected %s to be copied: %v", path, err)
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("expected %s to keep its time, got %v", path, info.ModTime())
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dst, "bin", "cli.js")); err == nil && runtime.GOOS != "windows" && info.Mode().Perm() != 0755 {
+		t.Errorf("expected cli.js to stay executable, got %v", info.Mode().Perm())
+	}
+}
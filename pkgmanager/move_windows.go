@@ -0,0 +1,14 @@
+package pkgmanager
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errorNotSameDevice is ERROR_NOT_SAME_DEVICE, what MoveFile fails with across volumes
+const errorNotSameDevice = syscall.Errno(17)
+
+// Whether a rename failed because src and dst are on different volumes
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice)
+}
@@ -0,0 +1,8 @@
+package pkgmanager
+
+import "fmt"
+
+// The error for what has to be fetched while offline
+func errOffline(what string) error {
+	return Classify(ErrNetwork, fmt.Errorf("%s isn't in the cache and fpm is offline", what))
+}
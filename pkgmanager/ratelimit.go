@@ -0,0 +1,81 @@
+package pkgmanager
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket of bytes. The downloads of a Client share its limiter so the downloads together,
+// not each of them, stay under the rate
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	tokens float64 // Bytes that may be read now, negative while reads wait for their share
+	last   time.Time
+}
+
+// NewRateLimiter caps the combined rate of the downloads sharing it at bytesPerSecond, 0 returns nil, which is
+// unlimited
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: float64(bytesPerSecond), last: time.Now()}
+}
+
+// Take n bytes from the bucket, waiting until the rate allows them or ctx is cancelled. The bucket holds at most
+// a second's worth so a pause doesn't turn into a burst above the rate
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rateLimitedReader reads through a shared limiter in chunks of at most a second's worth
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+// Wrap reader in limiter, or return it as is when limiter is nil and downloads are unlimited
+func limitRate(ctx context.Context, reader io.Reader, limiter *RateLimiter) io.Reader {
+	if limiter == nil {
+		return reader
+	}
+	return &rateLimitedReader{ctx: ctx, reader: reader, limiter: limiter}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if max := int(r.limiter.rate); len(p) > max && max > 0 {
+		p = p[:max]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
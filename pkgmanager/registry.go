@@ -0,0 +1,101 @@
+package pkgmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RegistryClient fetches metadata documents and tarballs. A Client goes through its Transport, which is HTTP
+// unless a test swaps in a fake
+type RegistryClient interface {
+	// FetchMetadata returns the metadata document of packageName on registry, the complete one when full is set
+	// and otherwise preferably the abbreviated one. A client may keep a copy in cacheDir and revalidate it, an
+	// empty cacheDir always fetches the document
+	FetchMetadata(ctx context.Context, registry, packageName, cacheDir string, full bool) ([]byte, error)
+	// FetchTarball opens the tarball at tarballURL, asking for the bytes from req.Offset onwards
+	FetchTarball(ctx context.Context, tarballURL string, req TarballRequest) (*TarballBody, error)
+}
+
+// TarballRequest is what FetchTarball asks for
+type TarballRequest struct {
+	Offset  int64 // The bytes already downloaded, a client that can't resume starts over at 0
+	NoCache bool  // Ask caches between fpm and the origin to revalidate instead of serving their copy
+}
+
+// TarballBody is an open tarball download
+type TarballBody struct {
+	io.ReadCloser
+	Offset int64 // Where the body starts in the tarball, 0 when the download starts over
+	Size   int64 // The size of the whole tarball, -1 when unknown
+}
+
+// MetadataURL is where registry serves the metadata of packageName. Like npm, the slash of a scoped name is
+// escaped, @types/node is fetched from <registry>/@types%2Fnode, while the @ and any path of registry are kept
+func MetadataURL(registry, packageName string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(registry, "/"), url.PathEscape(packageName))
+}
+
+// httpRegistryClient talks to real registries with the settings of client
+type httpRegistryClient struct {
+	client *Client
+}
+
+func (h httpRegistryClient) FetchMetadata(ctx context.Context, registry, packageName, cacheDir string, full bool) ([]byte, error) {
+	metadataURL := MetadataURL(registry, packageName)
+	accept := h.client.accept()
+	if full {
+		accept = fullMetadataAccept
+	}
+
+	body, err := h.client.getMetadata(ctx, metadataURL, cacheDir, accept)
+	if errors.Is(err, errNotAcceptable) && accept != fullMetadataAccept {
+		log.Printf("%s doesn't serve abbreviated metadata, fetching the full document", registry)
+		return h.client.getMetadata(ctx, metadataURL, cacheDir, fullMetadataAccept)
+	}
+	return body, err
+}
+
+// FetchTarball sends a range request when req.Offset isn't 0. Servers that don't support ranges answer with
+// the full body, which starts the download over
+func (h httpRegistryClient) FetchTarball(ctx context.Context, tarballURL string, tarballReq TarballRequest) (*TarballBody, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tarballURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if tarballReq.Offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", tarballReq.Offset))
+	}
+	if tarballReq.NoCache {
+		req.Header.Set("Cache-Control", "no-cache")
+		req.Header.Set("Pragma", "no-cache")
+	}
+
+	resp, err := h.client.http().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && tarballReq.Offset > 0:
+		size := int64(-1)
+		if resp.ContentLength >= 0 {
+			size = tarballReq.Offset + resp.ContentLength
+		}
+		return &TarballBody{ReadCloser: resp.Body, Offset: tarballReq.Offset, Size: size}, nil
+	case resp.StatusCode == http.StatusOK:
+		return &TarballBody{ReadCloser: resp.Body, Size: resp.ContentLength}, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && tarballReq.Offset > 0:
+		// Nothing left to fetch, the checksum decides whether the file is complete
+		resp.Body.Close()
+		return &TarballBody{ReadCloser: http.NoBody, Offset: tarballReq.Offset, Size: tarballReq.Offset}, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download package: %v", resp.Status)
+	}
+}
@@ -0,0 +1,288 @@
+package pkgmanager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResolvedTree is a dependency tree with every range resolved to a version, without anything installed.
+// Packages are keyed by name@version so a version many dependents share appears once
+type ResolvedTree struct {
+	Root     map[string]string        `json:"root"`             // Each root dependency's name and the version it resolved to
+	Packages map[string]*ResolvedNode `json:"packages"`         // Every package of the tree, keyed by name@version
+	Ranges   map[string]string        `json:"ranges"`           // Each name@range a dependent asked for and the version it resolved to
+	Cycles   [][]string               `json:"cycles,omitempty"` // Dependency cycles as name@version paths ending where they started
+}
+
+// ResolvedNode is one package version of a ResolvedTree
+type ResolvedNode struct {
+	Name         string            `json:"name"`
+	Version      string            `json:"version"`
+	AliasOf      string            `json:"aliasOf,omitempty"`      // The package installed under Name, when it is an alias of one
+	Integrity    string            `json:"integrity,omitempty"`    // dist.integrity, empty when the registry doesn't publish one
+	Tarball      string            `json:"tarball"`                // Empty for a package resolved by Local`
+	Optional     bool              `json:"optional,omitempty"`     // Only reached through optionalDependencies
+	Dependencies map[string]string `json:"dependencies,omitempty"` // Each dependency's name and the version it resolved to
+}
+
+// UnresolvableError is a dependency that couldn't be resolved, with the path from the root that asked for it
+type UnresolvableError struct {
+	Name  string
+	Range string
+	Path  []string // name@version of each dependent from the root down, empty for a root dependency
+	Err   error
+}
+
+func (e *UnresolvableError) Error() string {
+	requiredBy := "the root"
+	if len(e.Path) > 0 {
+		requiredBy = strings.Join(e.Path, " > ")
+	}
+	return fmt.Sprintf("cannot resolve %s@%s, required by %s: %v", e.Name, e.Range, requiredBy, e.Err)
+}
+
+func (e *UnresolvableError) Unwrap() error {
+	return e.Err
+}
+
+// Resolver resolves dependency trees from registry metadata. It downloads no tarballs and writes nothing but the
+// metadata cache, and fetches the metadata of a package once however often it is asked to resolve it. The zero
+// value resolves against the default registry without a cache
+type Resolver struct {
+	Context         context.Context                                      // Cancelling it stops the resolution, nil never cancels
+	Registry        string                                               // Base URL of the registry metadata is fetched from, empty is the default registry
+	ScopeRegistries map[string]string                                    // Registries for scoped packages, keyed by "@scope"
+	CacheDir        string                                               // Where metadata is cached, empty disables the cache
+	Client          *Client                                              // What metadata is fetched with, nil uses the default settings
+	Before          time.Time                                            // Only resolve to versions published before this, zero resolves among every version
+	MaxDepth        int                                                  // How many levels of dependencies below the root ones the tree may have, 0 is unlimited
+	Rewrite         func(name, versionRange string) (string, string)     // Gives the package and range a dependency resolves with, e.g. for aliases and overrides, nil resolves it as written
+	Local           func(name, versionRange string) (*PackageInfo, bool) // Resolves a rewritten dependency without the registry, e.g. a file: directory, nil asks the registry for all of them
+	Leaf            func(packageInfo *PackageInfo) bool                  // Leaves the dependencies of a version out of the tree, e.g. of a package for another platform, nil leaves none out
+
+	metadataMutex sync.Mutex
+	metadata      map[string]*PackageMetadata
+}
+
+// ResolveTree resolves rootDeps, a package name to range map like package.json dependencies, with the default
+// registry and cache
+func ResolveTree(rootDeps map[string]string) (*ResolvedTree, error) {
+	resolver := &Resolver{Context: context.Background(), Registry: DefaultRegistry, CacheDir: DefaultCacheDir()}
+	return resolver.ResolveTree(rootDeps)
+}
+
+// ResolveTree resolves rootDeps and everything they depend on. A dependency no version satisfies, or one deeper
+// than MaxDepth, fails with an *UnresolvableError, unless it is optional, which leaves it out of the tree
+func (r *Resolver) ResolveTree(rootDeps map[string]string) (*ResolvedTree, error) {
+	walk := &treeWalk{
+		resolver: r,
+		tree:     &ResolvedTree{Root: make(map[string]string), Packages: make(map[string]*ResolvedNode), Ranges: make(map[string]string)},
+		onPath:   make(map[string]bool),
+	}
+	for _, name := range sortedKeys(rootDeps) {
+		version, err := walk.resolve(name, rootDeps[name], false, nil)
+		if err != nil {
+			return nil, err
+		}
+		walk.tree.Root[name] = version
+	}
+	return walk.tree, nil
+}
+
+// treeWalk is the state of one ResolveTree, which walks depth first
+type treeWalk struct {
+	resolver *Resolver
+	tree     *ResolvedTree
+	onPath   map[string]bool // name@version of the packages whose dependencies are being resolved
+}
+
+// Resolve one dependency and, the first time its version is seen, its own dependencies. Returns the version
+func (w *treeWalk) resolve(name, versionRange string, optional bool, path []string) (string, error) {
+	if err := w.resolver.context().Err(); err != nil {
+		return "", err
+	}
+
+	if maxDepth := w.resolver.MaxDepth; maxDepth > 0 && len(path) > maxDepth {
+		return "", &UnresolvableError{Name: name, Range: versionRange, Path: path, Err: fmt.Errorf("dependency tree deeper than the max depth of %d", maxDepth)}
+	}
+
+	// A range is resolved once, keyed as the dependent wrote it
+	rangeKey := name + "@" + versionRange
+	version, ok := w.tree.Ranges[rangeKey]
+	if !ok {
+		targetName, targetRange := w.resolver.rewrite(name, versionRange)
+		packageInfo, err := w.resolver.resolveDependency(name, targetName, targetRange)
+		if err != nil {
+			return "", &UnresolvableError{Name: name, Range: versionRange, Path: path, Err: err}
+		}
+		version = packageInfo.Version
+		w.tree.Ranges[rangeKey] = version
+
+		key := name + "@" + version
+		if _, seen := w.tree.Packages[key]; !seen {
+			node := &ResolvedNode{Name: name, Version: version, Integrity: packageInfo.Integrity, Tarball: packageInfo.Tarball, Optional: optional}
+			if targetName != name {
+				node.AliasOf = targetName
+			}
+			w.tree.Packages[key] = node
+			if w.resolver.Leaf != nil && w.resolver.Leaf(packageInfo) {
+				return version, nil
+			}
+			if err := w.dependencies(node, packageInfo, path); err != nil {
+				return "", err
+			}
+			return version, nil
+		}
+	}
+
+	key := name + "@" + version
+	node := w.tree.Packages[key]
+	if !optional {
+		node.Optional = false
+	}
+	if w.onPath[key] {
+		w.addCycle(path, key)
+	}
+	return version, nil
+}
+
+// Resolve the dependencies of a package version seen for the first time
+func (w *treeWalk) dependencies(node *ResolvedNode, packageInfo *PackageInfo, path []string) error {
+	key := node.Name + "@" + node.Version
+	w.onPath[key] = true
+	defer delete(w.onPath, key)
+	path = append(append([]string(nil), path...), key)
+
+	deps := make(map[string]string, len(packageInfo.Dependencies)+len(packageInfo.OptionalDependencies))
+	for name, versionRange := range packageInfo.Dependencies {
+		deps[name] = versionRange
+	}
+	// Like npm an optional dependency wins over a regular one of the same name
+	for name, versionRange := range packageInfo.OptionalDependencies {
+		deps[name] = versionRange
+	}
+
+	for _, name := range sortedKeys(deps) {
+		_, isOptional := packageInfo.OptionalDependencies[name]
+		version, err := w.resolve(name, deps[name], node.Optional || isOptional, path)
+		if err != nil {
+			if isOptional {
+				continue
+			}
+			return err
+		}
+		if node.Dependencies == nil {
+			node.Dependencies = make(map[string]string)
+		}
+		node.Dependencies[name] = version
+	}
+	return nil
+}
+
+// Record the cycle closed by a dependency on key, which is one of the dependents in path
+func (w *treeWalk) addCycle(path []string, key string) {
+	for i, dependent := range path {
+		if dependent == key {
+			cycle := append(append([]string(nil), path[i:]...), key)
+			w.tree.Cycles = append(w.tree.Cycles, cycle)
+			return
+		}
+	}
+}
+
+// Resolve gets the version of name that versionRange resolves to, among the versions published before the
+// resolver's Before cutoff. The range is used as given, Rewrite only applies to the dependencies of a tree
+func (r *Resolver) Resolve(name, versionRange string) (*PackageInfo, error) {
+	metadata, err := r.Metadata(name)
+	if err != nil {
+		return nil, err
+	}
+	packageInfo, _, err := metadata.ResolveBefore(versionRange, r.Before)
+	return packageInfo, err
+}
+
+// Metadata gets the registry document of name, fetching it the first time. A Before cutoff needs the publish
+// times, which only the full document has
+func (r *Resolver) Metadata(name string) (*PackageMetadata, error) {
+	if metadata, ok := r.Fetched(name); ok {
+		return metadata, nil
+	}
+	metadata, err := r.client().FetchPackageMetadata(r.context(), r.RegistryFor(name), name, r.CacheDir, !r.Before.IsZero())
+	if err != nil {
+		return nil, err
+	}
+	r.metadataMutex.Lock()
+	defer r.metadataMutex.Unlock()
+	if r.metadata == nil {
+		r.metadata = make(map[string]*PackageMetadata)
+	}
+	r.metadata[name] = metadata
+	return metadata, nil
+}
+
+// Fetched gets the registry document of name if the resolver fetched it already
+func (r *Resolver) Fetched(name string) (*PackageMetadata, bool) {
+	r.metadataMutex.Lock()
+	defer r.metadataMutex.Unlock()
+	metadata, ok := r.metadata[name]
+	return metadata, ok
+}
+
+// RegistryFor gets the registry the metadata of a package is fetched from, scoped packages can have their own
+func (r *Resolver) RegistryFor(packageName string) string {
+	if strings.HasPrefix(packageName, "@") {
+		scope := strings.SplitN(packageName, "/", 2)[0]
+		if registry, ok := r.ScopeRegistries[scope]; ok {
+			return registry
+		}
+	}
+	if r.Registry == "" {
+		return DefaultRegistry
+	}
+	return r.Registry
+}
+
+// Resolve the version of a dependency, installed under name, that the rewritten targetName@targetRange asks for
+func (r *Resolver) resolveDependency(name, targetName, targetRange string) (*PackageInfo, error) {
+	if r.Local != nil {
+		if packageInfo, ok := r.Local(name, targetRange); ok {
+			return packageInfo, nil
+		}
+	}
+	return r.Resolve(targetName, targetRange)
+}
+
+// Get the package and range a dependency resolves with
+func (r *Resolver) rewrite(name, versionRange string) (string, string) {
+	if r.Rewrite == nil {
+		return name, versionRange
+	}
+	return r.Rewrite(name, versionRange)
+}
+
+func (r *Resolver) context() context.Context {
+	if r.Context == nil {
+		return context.Background()
+	}
+	return r.Context
+}
+
+func (r *Resolver) client() *Client {
+	if r.Client == nil {
+		return defaultClient
+	}
+	return r.Client
+}
+
+func sortedKeys(deps map[string]string) []string {
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
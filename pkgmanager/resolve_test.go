@@ -0,0 +1,100 @@
+package pkgmanager
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolveTree(t *testing.T) {
+	fake := newFakeRegistry()
+	for name, document := range map[string]string{
+		"app":    `{"dist-tags": {"latest": "1.0.0"}, "versions": {"1.0.0": {"name": "app", "version": "1.0.0", "dependencies": {"a": "^1.0.0", "b": "^1.0.0"}, "optionalDependencies": {"native": "^1.0.0", "gone": "^1.0.0"}, "dist": {"tarball": "https://registry.example/app-1.0.0.tgz", "integrity": "sha512-app"}}}}`,
+		"a":      `{"dist-tags": {"latest": "1.2.0"}, "versions": {"1.1.0": {"name": "a", "version": "1.1.0"}, "1.2.0": {"name": "a", "version": "1.2.0", "dependencies": {"b": "1.x"}}}}`,
+		"b":      `{"dist-tags": {"latest": "1.0.1"}, "versions": {"1.0.1": {"name": "b", "version": "1.0.1", "dependencies": {"a": "~1.2.0"}}}}`,
+		"native": `{"dist-tags": {"latest": "1.0.0"}, "versions": {"1.0.0": {"name": "native", "version": "1.0.0"}}}`,
+	} {
+		fake.AddMetadata(name, []byte(document))
+	}
+
+	resolver := &Resolver{Context: context.Background(), Registry: DefaultRegistry, Client: &Client{Transport: fake}}
+	tree, err := resolver.ResolveTree(map[string]string{"app": "latest"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(tree.Root, map[string]string{"app": "1.0.0"}) {
+		t.Errorf("unexpected root %v", tree.Root)
+	}
+	app := tree.Packages["app@1.0.0"]
+	if app == nil || app.Integrity != "sha512-app" || app.Tarball != "https://registry.example/app-1.0.0.tgz" {
+		t.Fatalf("expected app with its dist fields, got %+v", app)
+	}
+	if expected := map[string]string{"a": "1.2.0", "b": "1.0.1", "native": "1.0.0"}; !reflect.DeepEqual(app.Dependencies, expected) {
+		t.Errorf("expected %v, got %v", expected, app.Dependencies)
+	}
+	if len(tree.Packages) != 4 || !tree.Packages["native@1.0.0"].Optional || tree.Packages["a@1.2.0"].Optional {
+		t.Errorf("expected app, a, b and the optional native, got %+v", tree.Packages)
+	}
+	if expected := [][]string{{"a@1.2.0", "b@1.0.1", "a@1.2.0"}}; !reflect.DeepEqual(tree.Cycles, expected) {
+		t.Errorf("expected the a > b > a cycle, got %v", tree.Cycles)
+	}
+	if fake.Requests("a") != 1 {
+		t.Errorf("expected a's metadata to be fetched once, got %d", fake.Requests("a"))
+	}
+}
+
+func TestResolveTreeUnresolvable(t *testing.T) {
+	fake := newFakeRegistry()
+	fake.AddMetadata("app", []byte(`{"dist-tags": {"latest": "1.0.0"}, "versions": {"1.0.0": {"name": "app", "version": "1.0.0", "dependencies": {"a": "^2.0.0"}}}}`))
+	fake.AddMetadata("a", []byte(`{"dist-tags": {"latest": "1.0.0"}, "versions": {"1.0.0": {"name": "a", "version": "1.0.0"}}}`))
+
+	resolver := &Resolver{Context: context.Background(), Registry: DefaultRegistry, Client: &Client{Transport: fake}}
+	_, err := resolver.ResolveTree(map[string]string{"app": "^1.0.0"})
+	var unresolvable *UnresolvableError
+	if !errors.As(err, &unresolvable) || unresolvable.Name != "a" || !reflect.DeepEqual(unresolvable.Path, []string{"app@1.0.0"}) {
+		t.Fatalf("expected a to be unresolvable below app, got %v", err)
+	}
+	if expected := "cannot resolve a@^2.0.0, required by app@1.0.0: no matching version found for range: ^2.0.0"; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+
+	_, err = resolver.ResolveTree(map[string]string{"missing": "latest"})
+	if !errors.As(err, &unresolvable) || !errors.Is(err, ErrNetwork) || len(unresolvable.Path) != 0 {
+		t.Errorf("expected an unresolvable root dependency keeping its network class, got %v", err)
+	}
+}
+
+func TestResolveTreeRewriteAndBefore(t *testing.T) {
+	fake := newFakeRegistry()
+	fake.AddMetadata("app", []byte(`{"dist-tags": {"latest": "1.0.0"}, "versions": {"1.0.0": {"name": "app", "version": "1.0.0", "dependencies": {"pad": "^1.0.0", "b": "^1.0.0"}}}, "time": {"1.0.0": "2016-01-01T00:00:00Z"}}`))
+	fake.AddMetadata("left-pad", []byte(`{"dist-tags": {"latest": "1.3.0"}, "versions": {"1.1.0": {"name": "left-pad", "version": "1.1.0"}, "1.3.0": {"name": "left-pad", "version": "1.3.0"}}, "time": {"1.1.0": "2016-01-01T00:00:00Z", "1.3.0": "2018-01-01T00:00:00Z"}}`))
+	fake.AddMetadata("b", []byte(`{"dist-tags": {"latest": "2.0.0"}, "versions": {"1.0.0": {"name": "b", "version": "1.0.0"}, "2.0.0": {"name": "b", "version": "2.0.0"}}, "time": {"1.0.0": "2016-01-01T00:00:00Z", "2.0.0": "2016-01-01T00:00:00Z"}}`))
+
+	// pad is an alias of left-pad and b is overridden to 2.0.0
+	resolver := &Resolver{
+		Client: &Client{Transport: fake},
+		Before: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		Rewrite: func(name, versionRange string) (string, string) {
+			switch name {
+			case "pad":
+				return "left-pad", versionRange
+			case "b":
+				return name, "2.0.0"
+			}
+			return name, versionRange
+		},
+	}
+	tree, err := resolver.ResolveTree(map[string]string{"app": "1.0.0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]string{"pad": "1.1.0", "b": "2.0.0"}; !reflect.DeepEqual(tree.Packages["app@1.0.0"].Dependencies, expected) {
+		t.Errorf("expected %v, got %v", expected, tree.Packages["app@1.0.0"].Dependencies)
+	}
+	if _, ok := resolver.Fetched("left-pad"); !ok {
+		t.Errorf("expected the alias target's metadata to be kept")
+	}
+}
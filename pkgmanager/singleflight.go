@@ -0,0 +1,129 @@
+package pkgmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// flightGroup shares one metadata fetch between the callers asking for the same document at the same time.
+// Results aren't kept once the fetch returns, so a failed fetch is retried by the next caller and caching is left
+// to the metadata cache. The zero value is ready to use
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+// flight is a fetch in progress, done is closed once metadata and err are set
+type flight struct {
+	done     chan struct{}
+	metadata *PackageMetadata
+	err      error
+}
+
+// Run fetch for key unless it is already in flight, then share its result. A waiting caller whose own context is
+// cancelled stops waiting, one whose shared fetch was cancelled by the caller that started it fetches again
+func (g *flightGroup) do(ctx context.Context, key string, fetch func() (*PackageMetadata, error)) (*PackageMetadata, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, Classify(ErrNetwork, ctx.Err())
+		case <-call.done:
+		}
+		if ctx.Err() == nil && (errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded)) {
+			return g.do(ctx, key, fetch)
+		}
+		return call.metadata, call.err
+	}
+	call := &flight{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.metadata, call.err = fetch()
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(call.done)
+	return call.metadata, call.err
+}
+
+// tarballFlightGroup shares one tarball download between the callers staging the same integrity at the same time.
+// Every caller has its own staged file, the download is copied into the waiting ones before they are released
+type tarballFlightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*tarballFlight
+}
+
+// tarballFlight is a download in progress. waiters maps each waiting staged path to the error of copying into it
+type tarballFlight struct {
+	done    chan struct{}
+	mu      sync.Mutex
+	waiters map[string]error
+	err     error
+}
+
+// tarballFlights deduplicates the tarball downloads of concurrent installs, keyed by integrity
+var tarballFlights = &tarballFlightGroup{calls: make(map[string]*tarballFlight)}
+
+// Run download into partPath unless the same integrity is already downloading, then wait for a copy of it in
+// partPath instead. An empty integrity can't be matched, so it always downloads
+func (g *tarballFlightGroup) do(ctx context.Context, integrity, partPath string, download func() error) error {
+	if integrity == "" {
+		return download()
+	}
+
+	g.mu.Lock()
+	if call, ok := g.calls[integrity]; ok {
+		call.mu.Lock()
+		call.waiters[partPath] = nil
+		call.mu.Unlock()
+		g.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			// Withdraw so the download isn't copied into a file the caller removes
+			call.mu.Lock()
+			delete(call.waiters, partPath)
+			call.mu.Unlock()
+			return Classify(ErrNetwork, ctx.Err())
+		case <-call.done:
+		}
+		if ctx.Err() == nil && (errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded)) {
+			return g.do(ctx, integrity, partPath, download)
+		}
+		if call.err != nil {
+			return call.err
+		}
+		call.mu.Lock()
+		copyErr := call.waiters[partPath]
+		call.mu.Unlock()
+		if copyErr != nil {
+			return Classify(ErrFilesystem, fmt.Errorf("failed to copy the shared download: %v", copyErr))
+		}
+		return nil
+	}
+	call := &tarballFlight{done: make(chan struct{}), waiters: make(map[string]error)}
+	g.calls[integrity] = call
+	g.mu.Unlock()
+
+	call.err = download()
+	g.mu.Lock()
+	delete(g.calls, integrity)
+	g.mu.Unlock()
+
+	// No waiter can join any more, copy into the ones still waiting before releasing them
+	call.mu.Lock()
+	if call.err == nil {
+		for waiter := range call.waiters {
+			call.waiters[waiter] = copyFile(partPath, waiter)
+		}
+	}
+	call.mu.Unlock()
+	close(call.done)
+	return call.err
+}
@@ -0,0 +1,88 @@
+package pkgmanager
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitAttempts  = 5                      // How many times a metadata request answered with 429 is sent
+	maxRetryAfter      = time.Minute            // The longest Retry-After that is honored
+	throttleCooldown   = 30 * time.Second       // How long requests stay spaced out after the last 429
+	minThrottleSpacing = 100 * time.Millisecond // The gap between request starts after a first 429
+	maxThrottleSpacing = 2 * time.Second        // The gap it doubles up to while 429s keep coming
+)
+
+// defaultRetryAfter is the pause after a 429 that came without a Retry-After
+var defaultRetryAfter = time.Second
+
+// registryThrottle slows every metadata request of the process down once the registry answers 429 Too Many
+// Requests. Requests pause for the Retry-After, then start at most one per spacing until a cooldown passes
+// without another 429, so a large install backs off as a whole instead of each request retrying on its own
+type registryThrottle struct {
+	mu       sync.Mutex
+	paused   time.Time     // No request starts before this
+	spacing  time.Duration // The gap between request starts during the cooldown, 0 once recovered
+	next     time.Time     // When the next request may start during the cooldown
+	cooldown time.Time     // When the spacing is lifted
+}
+
+// metadataThrottle is shared by every metadata request
+var metadataThrottle = &registryThrottle{}
+
+// Wait until a request may start, or ctx is cancelled
+func (t *registryThrottle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	now := time.Now()
+	start := now
+	if t.paused.After(start) {
+		start = t.paused
+	}
+	if now.Before(t.cooldown) {
+		if t.next.After(start) {
+			start = t.next
+		}
+		t.next = start.Add(t.spacing)
+	} else {
+		t.spacing = 0
+	}
+	t.mu.Unlock()
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Pause every request for retryAfter and space them out further for the cooldown
+func (t *registryThrottle) backOff(retryAfter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if paused := time.Now().Add(retryAfter); paused.After(t.paused) {
+		t.paused = paused
+	}
+	t.spacing = min(max(t.spacing*2, minThrottleSpacing), maxThrottleSpacing)
+	t.cooldown = t.paused.Add(throttleCooldown)
+}
+
+// Read a Retry-After header, given in seconds or as an HTTP date. A missing or invalid one is the default pause
+func parseRetryAfter(header string) time.Duration {
+	delay := defaultRetryAfter
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = time.Until(date)
+	}
+	return min(max(delay, 0), maxRetryAfter)
+}
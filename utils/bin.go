@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Get the global install prefix, FPM_PREFIX overrides the default of ~/.fpm
+func GlobalPrefix() (string, error) {
+	if prefix := os.Getenv("FPM_PREFIX"); prefix != "" {
+		return prefix, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory for global prefix: %v", err)
+	}
+	return filepath.Join(home, ".fpm"), nil
+}
+
+// The node_modules directory global packages are installed into
+func GlobalNodeModulesDir(prefix string) string {
+	return filepath.Join(prefix, "global", "node_modules")
+}
+
+// The directory global package executables are linked into, this is the one to add to PATH
+func GlobalBinDir(prefix string) string {
+	return filepath.Join(prefix, "bin")
+}
+
+// Link the executables declared in an installed package's "bin" field into binDir and return the linked names
+func LinkBins(installCtx *InstallContext, packageName string, binDir string) ([]string, error) {
+	packageDir := filepath.Join(installCtx.NodeModulesDir, packageName)
+	bins, err := getBinsFromPackageJson(filepath.Join(packageDir, "package.json"), packageName)
+	if err != nil {
+		return nil, err
+	}
+	if len(bins) == 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(binDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create bin directory: %v", err)
+	}
+
+	names := make([]string, 0, len(bins))
+	for name := range bins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		target, err := filepath.Abs(filepath.Join(packageDir, bins[name]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve bin %s: %v", name, err)
+		}
+		if _, err := os.Stat(target); err != nil {
+			return nil, fmt.Errorf("bin %s for %s not found: %v", name, packageName, err)
+		}
+		if err := os.Chmod(target, 0755); err != nil {
+			return nil, fmt.Errorf("failed to make bin %s executable: %v", name, err)
+		}
+
+		linkPath := filepath.Join(binDir, name)
+		if err := os.Remove(linkPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to replace existing bin %s: %v", name, err)
+		}
+		if err := os.Symlink(target, linkPath); err != nil {
+			return nil, fmt.Errorf("failed to link bin %s: %v", name, err)
+		}
+	}
+
+	return names, nil
+}
+
+// Read the "bin" field of a package.json, which is either a single path or a map of command names to paths
+func getBinsFromPackageJson(packageJsonPath string, packageName string) (map[string]string, error) {
+	content, err := os.ReadFile(packageJsonPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package.json: %v", err)
+	}
+
+	var packageJson map[string]interface{}
+	if err := json.Unmarshal(content, &packageJson); err != nil {
+		return nil, fmt.Errorf("failed to parse package.json: %v", err)
+	}
+
+	bins := make(map[string]string)
+	switch bin := packageJson["bin"].(type) {
+	case string:
+		// A single bin is named after the package, without its scope
+		name := packageName
+		if idx := strings.LastIndex(name, "/"); idx != -1 {
+			name = name[idx+1:]
+		}
+		bins[name] = bin
+	case map[string]interface{}:
+		for name, path := range bin {
+			if pathStr, ok := path.(string); ok {
+				bins[name] = pathStr
+			}
+		}
+	}
+
+	return bins, nil
+}
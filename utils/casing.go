@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/jamesjellow/fpm/pkgmanager"
+)
+
+// caseInsensitive is whether node_modules is assumed to be on a case-insensitive filesystem, as it is by default
+// on macOS and Windows. A variable so tests can pick either
+var caseInsensitive = runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+
+// Claim packagePath for packageName, failing when another package of this install already claimed a path that
+// differs only by case. On a case-insensitive filesystem both would land in the same directory and overwrite each
+// other, elsewhere it is only a warning since the tree wouldn't survive being copied to one
+func (c *InstallContext) claimPath(packageName, packagePath string) error {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	if c.paths == nil {
+		c.paths = make(map[string]string)
+	}
+	folded := strings.ToLower(packagePath)
+	claimed, ok := c.paths[folded]
+	if !ok {
+		c.paths[folded] = packagePath
+		return nil
+	}
+	if claimed == packagePath {
+		return nil
+	}
+
+	message := fmt.Sprintf("%s and %s differ only by case", claimed, packagePath)
+	if caseInsensitive {
+		return pkgmanager.Classify(pkgmanager.ErrFilesystem, fmt.Errorf("can't install %s: %s and would overwrite each other on this case-insensitive filesystem", packageName, message))
+	}
+	c.warnings = append(c.warnings, fmt.Sprintf("fpm WARN %s, they would overwrite each other on a case-insensitive filesystem", message))
+	return nil
+}
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// DedupeResult lists what a dedupe changed in node_modules
+type DedupeResult struct {
+	Removed []InstalledPackage // Nested copies that were deleted, including their own nested packages
+	Hoisted []InstalledPackage // Nested copies that were moved up to the top level node_modules
+}
+
+// Flatten node_modules: move nested copies to the top level when nothing is there yet, and remove nested copies
+// when the version every consumer would fall back to still satisfies all of their ranges. Anything that can't be
+// proven safe, e.g. a range that isn't semver, is left alone
+func Dedupe(installCtx *InstallContext) (*DedupeResult, error) {
+	root := filepath.Clean(installCtx.NodeModulesDir)
+	result := &DedupeResult{}
+
+	// Every change moves directories around, so start over from a fresh listing until nothing changes
+	for {
+		installed, err := ListInstalledPackages(installCtx)
+		if err != nil {
+			return nil, err
+		}
+
+		changed, err := dedupeOnce(root, installed, result)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			return result, nil
+		}
+	}
+}
+
+// Apply the first safe hoist or removal found, returns false when there is nothing left to do
+func dedupeOnce(root string, installed []InstalledPackage, result *DedupeResult) (bool, error) {
+	versions := make(map[string]string, len(installed))
+	for _, pkg := range installed {
+		versions[pkg.Dir] = pkg.Version
+	}
+
+	dependencies := make(map[string]map[string]string, len(installed))
+	for _, pkg := range installed {
+		deps, err := getDependenciesFromPackageJson(filepath.Join(pkg.Dir, "package.json"))
+		if err != nil {
+			return false, err
+		}
+		dependencies[pkg.Dir] = deps
+	}
+
+	for _, pkg := range installed {
+		if containingNodeModules(pkg.Dir, pkg.Name) == root {
+			continue
+		}
+
+		target := filepath.Join(root, pkg.Name)
+		if _, ok := versions[target]; ok {
+			if !canRemoveCopy(root, pkg, installed, versions, dependencies) {
+				continue
+			}
+			if err := os.RemoveAll(pkg.Dir); err != nil {
+				return false, fmt.Errorf("failed to remove %s: %v", pkg.Dir, err)
+			}
+			for _, removed := range installed {
+				if isInside(removed.Dir, pkg.Dir) {
+					result.Removed = append(result.Removed, removed)
+				}
+			}
+			return true, nil
+		}
+
+		if !canHoistCopy(root, pkg, installed, versions, dependencies) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return false, fmt.Errorf("failed to create %s: %v", filepath.Dir(target), err)
+		}
+		if err := os.Rename(pkg.Dir, target); err != nil {
+			return false, fmt.Errorf("failed to hoist %s: %v", pkg.Dir, err)
+		}
+		result.Hoisted = append(result.Hoisted, pkg)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// A nested copy can be removed when every package that resolves to it falls back to a version satisfying its range
+func canRemoveCopy(root string, nested InstalledPackage, installed []InstalledPackage, versions map[string]string, dependencies map[string]map[string]string) bool {
+	for _, dependent := range installed {
+		versionRange, ok := dependencies[dependent.Dir][nested.Name]
+		if !ok || isInside(dependent.Dir, nested.Dir) {
+			continue
+		}
+
+		chain := nodeModulesChain(root, dependent.Dir, dependent.Name)
+		if resolveIn(chain, nested.Name, "") != nested.Dir {
+			continue
+		}
+		fallback := resolveIn(chain, nested.Name, nested.Dir)
+		if fallback == "" || !satisfies(versions[fallback], versionRange) {
+			return false
+		}
+	}
+	return true
+}
+
+// A nested copy can move to the top level when its consumers would all find it there and its own dependencies
+// still resolve to satisfying versions from its new location
+func canHoistCopy(root string, nested InstalledPackage, installed []InstalledPackage, versions map[string]string, dependencies map[string]map[string]string) bool {
+	for _, dependent := range installed {
+		if _, ok := dependencies[dependent.Dir][nested.Name]; !ok || isInside(dependent.Dir, nested.Dir) {
+			continue
+		}
+		chain := nodeModulesChain(root, dependent.Dir, dependent.Name)
+		if resolveIn(chain, nested.Name, "") == nested.Dir && resolveIn(chain, nested.Name, nested.Dir) != "" {
+			return false
+		}
+	}
+
+	for depName, versionRange := range dependencies[nested.Dir] {
+		if _, err := os.Stat(filepath.Join(nested.Dir, "node_modules", depName, "package.json")); err == nil {
+			continue // Moves along with the package
+		}
+		hoisted := filepath.Join(root, depName)
+		if _, ok := versions[hoisted]; !ok || !satisfies(versions[hoisted], versionRange) {
+			return false
+		}
+	}
+	return true
+}
+
+// The node_modules directories Node searches, in order, for the dependencies of the package in packageDir
+func nodeModulesChain(root, packageDir, packageName string) []string {
+	chain := []string{filepath.Join(packageDir, "node_modules")}
+	for {
+		nodeModulesDir := containingNodeModules(packageDir, packageName)
+		if nodeModulesDir == "" {
+			return chain
+		}
+		chain = append(chain, nodeModulesDir)
+		if nodeModulesDir == root {
+			return chain
+		}
+
+		// Continue from the package that owns this node_modules
+		packageDir = filepath.Dir(nodeModulesDir)
+		packageName = filepath.Base(packageDir)
+		if scope := filepath.Base(filepath.Dir(packageDir)); strings.HasPrefix(scope, "@") {
+			packageName = scope + "/" + packageName
+		}
+	}
+}
+
+// The node_modules directory an installed package lives in, empty when it isn't in one
+func containingNodeModules(packageDir, packageName string) string {
+	nodeModulesDir := strings.TrimSuffix(packageDir, string(filepath.Separator)+filepath.FromSlash(packageName))
+	if nodeModulesDir == packageDir || filepath.Base(nodeModulesDir) != "node_modules" {
+		return ""
+	}
+	return nodeModulesDir
+}
+
+// Find the first directory in the chain that has the package, skipping the excluded one as if it were removed
+func resolveIn(chain []string, packageName, exclude string) string {
+	for _, nodeModulesDir := range chain {
+		candidate := filepath.Join(nodeModulesDir, packageName)
+		if candidate == exclude {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(candidate, "package.json")); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// Check a version against a semver range, anything that can't be parsed is treated as unsatisfied
+func satisfies(version, versionRange string) bool {
+	if strings.TrimSpace(versionRange) == "" {
+		versionRange = "*"
+	}
+	constraint, err := semver.NewConstraint(versionRange)
+	if err != nil {
+		return false
+	}
+	parsed, err := semver.NewVersion(version)
+	if err != nil {
+		return false
+	}
+	return constraint.Check(parsed)
+}
+
+// Whether path is dir or somewhere inside it
+func isInside(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/jamesjellow/fpm/pkgmanager"
+)
+
+// freeSpace reports the free bytes on the volume of a directory, -1 when unknown. Tests replace it
+var freeSpace = pkgmanager.FreeSpace
+
+// Make sure the volume of node_modules has room for a package that unpacks to size bytes on top of the
+// extractions in progress, and hold that room until the returned function is called. Packages whose metadata
+// has no dist.unpackedSize, and platforms where the free space is unknown, aren't checked
+func (c *InstallContext) reserveSpace(packageName, version string, size int64) (func(), error) {
+	if size <= 0 {
+		return func() {}, nil
+	}
+	free, err := freeSpace(c.NodeModulesDir)
+	if err != nil || free < 0 {
+		return func() {}, nil
+	}
+
+	c.slotsMutex.Lock()
+	defer c.slotsMutex.Unlock()
+	if needed := c.reservedSpace + size; free < needed {
+		return nil, pkgmanager.Classify(pkgmanager.ErrFilesystem, fmt.Errorf("not enough disk space to extract %s@%s: it unpacks to %s, %s is free on the volume of %s", packageName, version, formatBytes(size), formatBytes(free-c.reservedSpace), c.NodeModulesDir))
+	}
+	c.reservedSpace += size
+	return func() {
+		c.slotsMutex.Lock()
+		defer c.slotsMutex.Unlock()
+		c.reservedSpace -= size
+	}, nil
+}
+
+// Format a byte count with a binary unit, e.g. 1.5 MiB
+func formatBytes(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", max(size, 0))
+	}
+	value, unit := float64(size)/1024, 0
+	for value >= 1024 && unit < 3 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, []string{"KiB", "MiB", "GiB", "TiB"}[unit])
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EngineMismatch is a package whose engines.node range the Node.js version doesn't satisfy
+type EngineMismatch struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Required string `json:"required"` // The package's engines.node range
+	Detected string `json:"detected"` // The Node.js version it was checked against
+}
+
+var (
+	detectedNodeVersion string
+	detectNodeOnce      sync.Once
+)
+
+// The Node.js version engines are checked against, empty when there is no node on PATH
+func (c *InstallContext) nodeVersion() string {
+	if c.NodeVersion != "" {
+		return strings.TrimPrefix(c.NodeVersion, "v")
+	}
+	detectNodeOnce.Do(func() {
+		output, err := exec.Command("node", "--version").Output()
+		if err == nil {
+			detectedNodeVersion = strings.TrimPrefix(strings.TrimSpace(string(output)), "v")
+		}
+	})
+	return detectedNodeVersion
+}
+
+// Check a package's engines.node against the Node.js version. A mismatch fails the package with EngineStrict and
+// is recorded for the end of install report otherwise. Ranges that aren't semver and an unknown Node.js version
+// aren't checked
+func (c *InstallContext) checkEngines(packageName, version string, engines map[string]string) error {
+	required := strings.TrimSpace(engines["node"])
+	if c.IgnoreEngines || required == "" || !isSemverRange(required) {
+		return nil
+	}
+	detected := c.nodeVersion()
+	if detected == "" || satisfies(detected, required) {
+		return nil
+	}
+	if c.EngineStrict {
+		return fmt.Errorf("unsupported engine for %s@%s: wants node %s, this is %s", packageName, version, required, detected)
+	}
+
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+	for _, existing := range c.engines {
+		if existing.Name == packageName && existing.Version == version {
+			return nil
+		}
+	}
+	c.engines = append(c.engines, EngineMismatch{Name: packageName, Version: version, Required: required, Detected: detected})
+	return nil
+}
+
+// Get the engine mismatches recorded so far, sorted by name and version
+func (c *InstallContext) EngineMismatches() []EngineMismatch {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+	return c.engineMismatchesSorted()
+}
+
+func (c *InstallContext) engineMismatchesSorted() []EngineMismatch {
+	mismatches := append([]EngineMismatch(nil), c.engines...)
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].Name != mismatches[j].Name {
+			return mismatches[i].Name < mismatches[j].Name
+		}
+		return mismatches[i].Version < mismatches[j].Version
+	})
+	return mismatches
+}
+
+// EngineReport groups mismatches by the range they require into the lines printed once an install finishes,
+// nil when there are none
+func EngineReport(mismatches []EngineMismatch) []string {
+	if len(mismatches) == 0 {
+		return nil
+	}
+	byRange := make(map[string][]string)
+	var ranges []string
+	for _, mismatch := range mismatches {
+		if byRange[mismatch.Required] == nil {
+			ranges = append(ranges, mismatch.Required)
+		}
+		byRange[mismatch.Required] = append(byRange[mismatch.Required], mismatch.Name+"@"+mismatch.Version)
+	}
+	sort.Strings(ranges)
+
+	noun := "packages"
+	if len(mismatches) == 1 {
+		noun = "package"
+	}
+	lines := []string{fmt.Sprintf("fpm WARN %d %s don't support node %s, pass --engine-strict to fail them or --ignore-engines to hide this", len(mismatches), noun, mismatches[0].Detected)}
+	for _, versionRange := range ranges {
+		lines = append(lines, fmt.Sprintf("  node %s: %s", versionRange, strings.Join(byRange[versionRange], ", ")))
+	}
+	return lines
+}
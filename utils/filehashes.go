@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Hash every file of the package installed at dir, keyed by slash separated path relative to dir. Nested
+// node_modules belong to other packages and are left out
+func hashPackageFiles(dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := walkPackageDir(dir, func(path string) error {
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash the files of %s: %v", dir, err)
+	}
+	return files, nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256-%x", hasher.Sum(nil)), nil
+}
+
+// Re-hash the files of every package whose manifest entry recorded them and describe each file that was modified,
+// removed or added since. Returns how many packages had recorded files to check
+func VerifyFiles(installCtx *InstallContext, manifest *Manifest) (int, []string, error) {
+	checked := 0
+	var discrepancies []string
+	for path, entry := range manifest.Packages {
+		if entry.Files == nil {
+			continue
+		}
+		dir := filepath.Join(installCtx.NodeModulesDir, filepath.FromSlash(path))
+		if _, err := os.Stat(dir); err != nil {
+			continue // VerifyManifest reports the missing package
+		}
+		checked++
+
+		files, err := hashPackageFiles(dir)
+		if err != nil {
+			return checked, nil, err
+		}
+		for file, recorded := range entry.Files {
+			hash, ok := files[file]
+			switch {
+			case !ok:
+				discrepancies = append(discrepancies, fmt.Sprintf("removed %s/%s from %s@%s", path, file, entry.Name, entry.Version))
+			case hash != recorded:
+				discrepancies = append(discrepancies, fmt.Sprintf("modified %s/%s of %s@%s", path, file, entry.Name, entry.Version))
+			}
+		}
+		for file := range files {
+			if _, ok := entry.Files[file]; !ok {
+				discrepancies = append(discrepancies, fmt.Sprintf("added %s/%s to %s@%s", path, file, entry.Name, entry.Version))
+			}
+		}
+	}
+
+	sort.Strings(discrepancies)
+	return checked, discrepancies, nil
+}
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dominikbraun/graph"
+)
+
+// Rebuild the dependency graph from the project package.json and the packages already in node_modules.
+// Returns the name of the root vertex, which is the project itself
+func BuildInstalledGraph(installCtx *InstallContext, pathToJSON string, depGraph *graph.Graph[string, string]) (string, error) {
+	packageJson, err := ParsePackageJson(pathToJSON)
+	if err != nil {
+		return "", err
+	}
+
+	root := "root"
+	if name, ok := packageJson.Get("name"); ok {
+		if nameStr, ok := name.(string); ok && nameStr != "" {
+			root = nameStr
+		}
+	}
+	if err := (*depGraph).AddVertex(root); err != nil && err != graph.ErrVertexAlreadyExists {
+		return "", fmt.Errorf("failed to add vertex: %v", err)
+	}
+
+	var queue []string
+	for _, depType := range []string{"dependencies", "devDependencies"} {
+		deps, err := ParseDependencies(packageJson, depType)
+		if err != nil {
+			return "", err
+		}
+		for _, dep := range deps.Keys() {
+			if addGraphEdge(depGraph, root, dep) {
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	// Walk the installed packages breadth first, following the dependencies in their package.json files
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		packageName := queue[0]
+		queue = queue[1:]
+		if seen[packageName] {
+			continue
+		}
+		seen[packageName] = true
+
+		dependencies, err := getDependenciesFromPackageJson(filepath.Join(installCtx.NodeModulesDir, packageName, "package.json"))
+		if err != nil {
+			// Not installed, it stays a leaf in the graph
+			continue
+		}
+
+		for _, depName := range sortedDependencyNames(dependencies) {
+			if addGraphEdge(depGraph, packageName, depName) {
+				queue = append(queue, depName)
+			}
+		}
+	}
+
+	return root, nil
+}
+
+// Check that every package in the dependency graph of a finished install is in node_modules with a package.json
+// that parses, so a swallowed error can't leave a partial install looking complete. Packages the install skipped
+// on purpose are left out. Returns an error for each ghost, sorted by package name
+func CheckGraphOnDisk(installCtx *InstallContext, depGraph *graph.Graph[string, string]) ([]error, error) {
+	adjacency, err := (*depGraph).AdjacencyMap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the dependency graph: %v", err)
+	}
+	names := make([]string, 0, len(adjacency))
+	for name := range adjacency {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	installCtx.reportMutex.Lock()
+	skipped := installCtx.skipped
+	installCtx.reportMutex.Unlock()
+
+	// A nested layout keeps most packages below their dependents, any copy of a name counts
+	nestedDirs := make(map[string]string)
+	if installCtx.Layout == LayoutNested {
+		installed, err := ListInstalledPackages(installCtx)
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range installed {
+			if _, ok := nestedDirs[pkg.Name]; !ok {
+				nestedDirs[pkg.Name] = pkg.Dir
+			}
+		}
+	}
+
+	var ghosts []error
+	for _, name := range names {
+		if skipped[name] {
+			continue
+		}
+		packageJsonPath := filepath.Join(installCtx.NodeModulesDir, name, "package.json")
+		if dir, ok := nestedDirs[name]; ok {
+			packageJsonPath = filepath.Join(dir, "package.json")
+		}
+		content, err := os.ReadFile(packageJsonPath)
+		if err != nil {
+			ghosts = append(ghosts, fmt.Errorf("%s is in the dependency graph but missing from %s", name, installCtx.NodeModulesDir))
+			continue
+		}
+		var packageJson map[string]interface{}
+		if err := json.Unmarshal(content, &packageJson); err != nil {
+			ghosts = append(ghosts, fmt.Errorf("%s is in the dependency graph but %s is invalid: %v", name, packageJsonPath, err))
+		}
+	}
+	return ghosts, nil
+}
+
+// Add an edge between two packages, creating the target vertex if needed. Returns false if the edge was skipped
+func addGraphEdge(depGraph *graph.Graph[string, string], from, to string) bool {
+	if err := (*depGraph).AddVertex(to); err != nil && err != graph.ErrVertexAlreadyExists {
+		return false
+	}
+	if err := (*depGraph).AddEdge(from, to); err != nil {
+		// Already known edges are fine, cycles are dropped like during install
+		return err == graph.ErrEdgeAlreadyExists
+	}
+	return true
+}
+
+// Find every path through the dependency graph from the root down to the given package, sorted for stable output
+func FindDependencyPaths(depGraph *graph.Graph[string, string], root, packageName string) ([][]string, error) {
+	if _, err := (*depGraph).Vertex(packageName); err != nil {
+		return nil, fmt.Errorf("package %s is not in the dependency graph", packageName)
+	}
+
+	paths, err := graph.AllPathsBetween(*depGraph, root, packageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find dependency paths for %s: %v", packageName, err)
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Join(paths[i], ">") < strings.Join(paths[j], ">")
+	})
+
+	return paths, nil
+}
+
+// Group the packages of the dependency graph into layers in the order they can be installed, every package comes
+// in a later layer than all of its dependencies so the packages of one layer can be installed at the same time.
+// The graph prevents cycles, a graph that has one anyway can't be ordered and fails. Each layer is sorted
+func InstallOrder(depGraph *graph.Graph[string, string]) ([][]string, error) {
+	order, err := graph.TopologicalSort(*depGraph)
+	if err != nil {
+		return nil, fmt.Errorf("failed to order the dependency graph: %v", err)
+	}
+	adjacency, err := (*depGraph).AdjacencyMap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the dependency graph: %v", err)
+	}
+
+	// Dependents come before their dependencies in a topological sort, so walk it backwards
+	layerOf := make(map[string]int, len(order))
+	var layers [][]string
+	for i := len(order) - 1; i >= 0; i-- {
+		name := order[i]
+		layer := 0
+		for dependency := range adjacency[name] {
+			layer = max(layer, layerOf[dependency]+1)
+		}
+		layerOf[name] = layer
+		if layer == len(layers) {
+			layers = append(layers, nil)
+		}
+		layers[layer] = append(layers[layer], name)
+	}
+	for _, layer := range layers {
+		sort.Strings(layer)
+	}
+	return layers, nil
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// InstalledPackage is a package found on disk in node_modules
+type InstalledPackage struct {
+	Name    string
+	Version string
+	Dir     string
+}
+
+// Walk node_modules, including scoped and nested node_modules directories, and list every installed package
+func ListInstalledPackages(installCtx *InstallContext) ([]InstalledPackage, error) {
+	var installed []InstalledPackage
+	if err := listInstalledPackages(installCtx.NodeModulesDir, &installed); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(installed, func(i, j int) bool {
+		if installed[i].Name != installed[j].Name {
+			return installed[i].Name < installed[j].Name
+		}
+		return installed[i].Dir < installed[j].Dir
+	})
+	return installed, nil
+}
+
+func listInstalledPackages(nodeModulesDir string, installed *[]InstalledPackage) error {
+	entries, err := os.ReadDir(nodeModulesDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", nodeModulesDir, err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		// Scoped packages live one level deeper, e.g. node_modules/@types/node
+		if strings.HasPrefix(name, "@") {
+			scopedEntries, err := os.ReadDir(filepath.Join(nodeModulesDir, name))
+			if err != nil {
+				continue
+			}
+			for _, scopedEntry := range scopedEntries {
+				addInstalledPackage(nodeModulesDir, name+"/"+scopedEntry.Name(), installed)
+			}
+			continue
+		}
+
+		addInstalledPackage(nodeModulesDir, name, installed)
+	}
+
+	return nil
+}
+
+func addInstalledPackage(nodeModulesDir, packageName string, installed *[]InstalledPackage) {
+	packageDir := filepath.Join(nodeModulesDir, packageName)
+	content, err := os.ReadFile(filepath.Join(packageDir, "package.json"))
+	if err != nil {
+		return // Not a package, e.g. a stray file or an incomplete install
+	}
+
+	var packageJson struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(content, &packageJson); err != nil {
+		return
+	}
+
+	*installed = append(*installed, InstalledPackage{Name: packageName, Version: packageJson.Version, Dir: packageDir})
+
+	// Nested copies under this package's own node_modules
+	_ = listInstalledPackages(filepath.Join(packageDir, "node_modules"), installed)
+}
+
+// DependencyStatus is a dependency declared in package.json and what node_modules has for it
+type DependencyStatus struct {
+	Name      string
+	Range     string // The range package.json asks for
+	Type      string // "dependencies", "devDependencies" or "optionalDependencies"
+	Installed string // The version at the top level of node_modules, empty when it is missing
+}
+
+// Satisfied reports whether the installed version is within the declared range
+func (d DependencyStatus) Satisfied() bool {
+	return d.Installed != "" && satisfies(d.Installed, d.Range)
+}
+
+// List the dependencies package.json declares, in the order it declares them, with their installed versions
+func ListDependencies(installCtx *InstallContext, pathToJSON string) ([]DependencyStatus, error) {
+	packageJson, err := ParsePackageJson(pathToJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []DependencyStatus
+	for _, depType := range []string{"dependencies", "devDependencies", "optionalDependencies"} {
+		deps, err := ParseDependencies(packageJson, depType)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range deps.Keys() {
+			versionRange, _ := deps.Get(name)
+			rangeStr, _ := versionRange.(string)
+			statuses = append(statuses, DependencyStatus{
+				Name:      name,
+				Range:     rangeStr,
+				Type:      depType,
+				Installed: installedVersion(filepath.Join(installCtx.NodeModulesDir, name)),
+			})
+		}
+	}
+	return statuses, nil
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Layout is how an install places packages in node_modules
+type Layout string
+
+const (
+	LayoutHoisted Layout = "hoisted" // Every package at the top level, the first version of a name wins
+	LayoutNested  Layout = "nested"  // Every dependency in its dependent's own node_modules, like npm 2
+)
+
+// ParseLayout checks a --node-linker value, empty is hoisted
+func ParseLayout(value string) (Layout, error) {
+	switch layout := Layout(value); layout {
+	case "":
+		return LayoutHoisted, nil
+	case LayoutHoisted, LayoutNested:
+		return layout, nil
+	default:
+		return "", fmt.Errorf("invalid node linker %q, expected hoisted or nested", value)
+	}
+}
+
+// Get the node_modules directory the dependencies of the package installed at packagePath go into
+func (c *InstallContext) dependenciesDir(nodeModulesDir, packagePath string) string {
+	if c.Layout == LayoutNested {
+		return filepath.Join(packagePath, "node_modules")
+	}
+	return nodeModulesDir
+}
+
+// Find the package directory of an ancestor named packageName that nodeModulesDir is nested in. require finds
+// an ancestor walking up from its dependents, so a nested layout breaks cycles there instead of nesting forever
+func nestedAncestor(root, nodeModulesDir, packageName string) (string, bool) {
+	rel, err := filepath.Rel(root, nodeModulesDir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	// rel is like a/node_modules/@scope/b/node_modules, every package it passes through is an ancestor
+	rel = strings.TrimSuffix(filepath.ToSlash(rel), "/node_modules")
+	dir := root
+	for _, ancestor := range strings.Split(rel, "/node_modules/") {
+		dir = filepath.Join(dir, filepath.FromSlash(ancestor))
+		if ancestor == packageName {
+			return dir, true
+		}
+		dir = filepath.Join(dir, "node_modules")
+	}
+	return "", false
+}
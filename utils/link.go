@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Register the package in packageDir globally like `npm link`, by symlinking it into the global node_modules
+// and linking its bins into the global bin directory. Returns the package name and the linked bins
+func LinkGlobal(prefix, packageDir string) (string, []string, error) {
+	target, err := filepath.Abs(packageDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve %s: %v", packageDir, err)
+	}
+	packageJSON, err := ParsePackageJson(filepath.Join(target, "package.json"))
+	if err != nil {
+		return "", nil, err
+	}
+	name, _ := packageJSON.Get("name")
+	packageName, ok := name.(string)
+	if !ok || packageName == "" {
+		return "", nil, fmt.Errorf("package.json in %s has no name to link it under", target)
+	}
+
+	globalDir := GlobalNodeModulesDir(prefix)
+	if err := replaceWithLink(filepath.Join(globalDir, packageName), target); err != nil {
+		return "", nil, err
+	}
+	bins, err := LinkBins(NewInstallContext(globalDir), packageName, GlobalBinDir(prefix))
+	if err != nil {
+		return "", nil, err
+	}
+	return packageName, bins, nil
+}
+
+// Symlink the globally linked packageName into nodeModulesDir, pointing straight at the linked directory, and
+// link its bins into node_modules/.bin. Returns the linked directory
+func LinkFromGlobal(prefix, nodeModulesDir, packageName string) (string, error) {
+	globalLink := filepath.Join(GlobalNodeModulesDir(prefix), packageName)
+	info, err := os.Lstat(globalLink)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return "", fmt.Errorf("%s isn't linked globally, run `fpm link` in its directory first", packageName)
+	}
+	target, err := filepath.EvalSymlinks(globalLink)
+	if err != nil {
+		// The directory it was linked from is gone, the link is of no use to anyone
+		os.Remove(globalLink)
+		return "", fmt.Errorf("the global link of %s points to a directory that no longer exists, it was removed, run `fpm link` in its new directory", packageName)
+	}
+
+	if err := replaceWithLink(filepath.Join(nodeModulesDir, packageName), target); err != nil {
+		return "", err
+	}
+	if _, err := LinkBins(NewInstallContext(nodeModulesDir), packageName, filepath.Join(nodeModulesDir, ".bin")); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// Remove the links in the global node_modules, scoped ones included, whose directory no longer exists.
+// Returns the names of the removed links
+func RemoveStaleLinks(prefix string) ([]string, error) {
+	globalDir := GlobalNodeModulesDir(prefix)
+	var removed []string
+	var scan func(dir, scope string) error
+	scan = func(dir, scope string) error {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", dir, err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if scope == "" && strings.HasPrefix(entry.Name(), "@") && entry.IsDir() {
+				if err := scan(path, entry.Name()); err != nil {
+					return err
+				}
+				continue
+			}
+			if entry.Type()&os.ModeSymlink == 0 {
+				continue
+			}
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				if err := os.Remove(path); err != nil {
+					return fmt.Errorf("failed to remove stale link %s: %v", path, err)
+				}
+				removed = append(removed, filepath.ToSlash(filepath.Join(scope, entry.Name())))
+			}
+		}
+		return nil
+	}
+	return removed, scan(globalDir, "")
+}
+
+// Replace whatever is at linkPath, a stale link or an installed copy, with a symlink to target
+func replaceWithLink(linkPath, target string) error {
+	if err := os.MkdirAll(filepath.Dir(linkPath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", linkPath, err)
+	}
+	if err := os.RemoveAll(linkPath); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", linkPath, err)
+	}
+	if err := os.Symlink(target, linkPath); err != nil {
+		return fmt.Errorf("failed to link %s to %s: %v", linkPath, target, err)
+	}
+	return nil
+}
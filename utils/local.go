@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/dominikbraun/graph"
+	"github.com/jamesjellow/fpm/pkgmanager"
+)
+
+// Install the package in the directory of a file: spec by copying the files it would publish, so its tests and
+// build leftovers stay behind. A relative directory is relative to the project. The copy is made on every
+// install since the directory may have changed since the last one
+func installLocal(installCtx *InstallContext, nodeModulesDir, packageName, localDir, packagePath string, depGraph *graph.Graph[string, string], visited map[string]bool, depth int, dev, optional bool) (string, error) {
+	if version, ok := installCtx.resolvedVersion(packageName); ok && installCtx.Layout != LayoutNested {
+		return version, nil
+	}
+	if !filepath.IsAbs(localDir) {
+		localDir = filepath.Join(filepath.Dir(installCtx.NodeModulesDir), localDir)
+	}
+	if info, err := os.Stat(localDir); err != nil || !info.IsDir() {
+		return "", installCtx.fail(packageName, fmt.Errorf("file:%s is not a package directory", localDir))
+	}
+	files, err := PackFiles(localDir)
+	if err != nil {
+		return "", installCtx.fail(packageName, err)
+	}
+	version := installedVersion(localDir)
+	installCtx.Observer.OnResolve(packageName, "file:"+localDir, version)
+
+	if installCtx.TempDir != "" {
+		if err := pkgmanager.EnsureDir(installCtx.TempDir); err != nil {
+			return "", installCtx.fail(packageName, err)
+		}
+	}
+	stagingDir, err := os.MkdirTemp(installCtx.TempDir, "fpm-local-*")
+	if err != nil {
+		return "", installCtx.fail(packageName, pkgmanager.Classify(pkgmanager.ErrFilesystem, fmt.Errorf("failed to create a staging directory: %v", err)))
+	}
+	defer func() {
+		if err := os.RemoveAll(stagingDir); err != nil {
+			log.Printf("failed to remove staging directory %s: %v", stagingDir, err)
+		}
+	}()
+	if err := pkgmanager.CopyFiles(localDir, stagingDir, files); err != nil {
+		return "", installCtx.fail(packageName, fmt.Errorf("failed to copy %s: %w", localDir, err))
+	}
+	if err := os.RemoveAll(packagePath); err != nil {
+		return "", installCtx.fail(packageName, pkgmanager.Classify(pkgmanager.ErrFilesystem, fmt.Errorf("failed to remove %s: %v", packagePath, err)))
+	}
+	if err := pkgmanager.EnsureDir(filepath.Dir(packagePath)); err != nil {
+		return "", installCtx.fail(packageName, err)
+	}
+	if err := pkgmanager.MoveDir(stagingDir, packagePath); err != nil {
+		return "", installCtx.fail(packageName, err)
+	}
+
+	if err := (*depGraph).AddVertex(packageName); err != nil && err != graph.ErrVertexAlreadyExists {
+		return "", fmt.Errorf("failed to add vertex: %v", err)
+	}
+	installCtx.addResolved(ResolvedPackage{Name: packageName, Version: version, Dev: dev, Optional: optional})
+	installCtx.Observer.OnInstalled(packageName, version)
+
+	packageJsonPath := filepath.Join(packagePath, "package.json")
+	if err := processPackageJson(installCtx, installCtx.dependenciesDir(nodeModulesDir, packagePath), packageJsonPath, packageName, depGraph, visited, depth, dev, optional); err != nil {
+		return "", err
+	}
+	if err := runLifecycleScripts(installCtx, packageJsonPath, packageName, version); err != nil {
+		return "", installCtx.fail(packageName, err)
+	}
+	return version, nil
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// Check package.json, and its workspaces, against the package-lock.json or yarn.lock next to it without touching
+// node_modules or the network. Every dependency must be locked at a version satisfying its range and every lock
+// entry must be reachable from package.json. Returns the lockfile's pins and a line for each inconsistency
+func CheckLockfile(pathToJSON string) (*LockPins, []string, error) {
+	pins, err := ImportLockfile(filepath.Dir(pathToJSON))
+	if err != nil {
+		return nil, nil, err
+	}
+	if pins == nil {
+		return nil, nil, fmt.Errorf("no package-lock.json or yarn.lock next to %s to check it against", pathToJSON)
+	}
+
+	packageJson, err := ParsePackageJson(pathToJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	workspaces, err := FindWorkspaces(pathToJSON, packageJson)
+	if err != nil {
+		return nil, nil, err
+	}
+	members := make(map[string]bool)
+	rootJsons := []string{pathToJSON}
+	for _, workspace := range workspaces {
+		members[workspace.Name] = true
+		rootJsons = append(rootJsons, workspace.PackageJsonPath)
+	}
+
+	var problems []string
+	var queue []string
+	for _, rootJson := range rootJsons {
+		for _, depType := range []string{"dependencies", "devDependencies", "optionalDependencies"} {
+			deps, err := readDependencies(rootJson, depType)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, name := range sortedDependencyNames(deps) {
+				if members[name] {
+					continue // Linked, never locked
+				}
+				queue = append(queue, name)
+
+				versionRange := deps[name]
+				locked, ok := pins.byRange[name+"@"+versionRange]
+				if !ok {
+					locked, ok = pins.byName[name]
+				}
+				switch {
+				case !ok:
+					problems = append(problems, fmt.Sprintf("%s@%s is not in %s", name, versionRange, pins.Source))
+				case isSemverRange(versionRange) && !satisfies(locked, versionRange):
+					problems = append(problems, fmt.Sprintf("%s@%s is locked at %s in %s, which doesn't satisfy it", name, versionRange, locked, pins.Source))
+				}
+			}
+		}
+	}
+
+	// Whatever the dependencies don't lead to is left over from a removed dependency
+	reachable := make(map[string]bool)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if reachable[name] {
+			continue
+		}
+		reachable[name] = true
+		queue = append(queue, pins.requires[name]...)
+	}
+	var orphans []string
+	for name := range pins.byName {
+		if !reachable[name] {
+			orphans = append(orphans, name)
+		}
+	}
+	sort.Strings(orphans)
+	for _, name := range orphans {
+		problems = append(problems, fmt.Sprintf("%s@%s is in %s but nothing in package.json depends on it", name, pins.byName[name], pins.Source))
+	}
+
+	return pins, problems, nil
+}
+
+// Report whether versionRange can be checked offline, dist-tags, URLs and git specs need the registry
+func isSemverRange(versionRange string) bool {
+	_, err := semver.NewConstraint(versionRange)
+	return err == nil
+}
@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// LockPins are the versions another package manager's lockfile pinned, imported so a first fpm install of an
+// existing project gets the versions it already runs with instead of resolving everything again
+type LockPins struct {
+	Source   string              // The lockfile the pins came from
+	Packages []ResolvedPackage   // Every pinned package, sorted by name and version
+	byRange  map[string]string   // "name@range" to version, yarn records which ranges each version satisfies
+	byName   map[string]string   // name to the version installed at the top level of node_modules
+	requires map[string][]string // name to the names of its dependencies, optional and peer dependencies
+}
+
+// Look up the pinned version for a dependency on name@versionRange, a pin by name only counts when it still
+// satisfies the range, so an edited package.json resolves normally
+func (p *LockPins) Version(name, versionRange string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	if version, ok := p.byRange[name+"@"+versionRange]; ok {
+		return version, true
+	}
+	version, ok := p.byName[name]
+	if !ok {
+		return "", false
+	}
+	if _, err := semver.NewConstraint(versionRange); err == nil && !satisfies(version, versionRange) {
+		return "", false
+	}
+	return version, true
+}
+
+// Look for a package-lock.json, then a yarn.lock, in projectDir and read its pins. Returns nil when there is neither
+func ImportLockfile(projectDir string) (*LockPins, error) {
+	parsers := []struct {
+		file  string
+		parse func([]byte) (*LockPins, error)
+	}{
+		{"package-lock.json", parseNpmLockfile},
+		{"yarn.lock", parseYarnLockfile},
+	}
+
+	for _, parser := range parsers {
+		path := filepath.Join(projectDir, parser.file)
+		content, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+
+		pins, err := parser.parse(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import %s: %v", path, err)
+		}
+		pins.Source = parser.file
+		sort.Slice(pins.Packages, func(i, j int) bool {
+			if pins.Packages[i].Name != pins.Packages[j].Name {
+				return pins.Packages[i].Name < pins.Packages[j].Name
+			}
+			return pins.Packages[i].Version < pins.Packages[j].Version
+		})
+		return pins, nil
+	}
+	return nil, nil
+}
+
+// An entry of a package-lock.json, the same shape in the "packages" and the older "dependencies" section
+type npmLockEntry struct {
+	Version   string `json:"version"`
+	Integrity string `json:"integrity"`
+	Dev       bool   `json:"dev"`
+	Optional  bool   `json:"optional"`
+	Link      bool   `json:"link"`
+
+	// Version 1 lists the dependencies of an entry under "requires" and its nested copies under "dependencies",
+	// the "packages" of versions 2 and 3 list them under "dependencies"
+	Requires             map[string]string          `json:"requires"`
+	Dependencies         map[string]json.RawMessage `json:"dependencies"`
+	OptionalDependencies map[string]string          `json:"optionalDependencies"`
+	PeerDependencies     map[string]string          `json:"peerDependencies"`
+}
+
+// Read the top level packages of a package-lock.json, lockfileVersion 2 and 3 key them by their node_modules
+// path under "packages", version 1 by name under "dependencies"
+func parseNpmLockfile(content []byte) (*LockPins, error) {
+	var lockfile struct {
+		Packages     map[string]npmLockEntry `json:"packages"`
+		Dependencies map[string]npmLockEntry `json:"dependencies"`
+	}
+	if err := json.Unmarshal(content, &lockfile); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]npmLockEntry)
+	requires := make(map[string][]string)
+	if len(lockfile.Packages) > 0 {
+		for path, entry := range lockfile.Packages {
+			name, ok := strings.CutPrefix(path, "node_modules/")
+			if !ok || strings.Contains(name, "/node_modules/") {
+				continue // The root package or a nested copy, fpm installs everything at the top level
+			}
+			entries[name] = entry
+			for _, deps := range []map[string]string{entry.OptionalDependencies, entry.PeerDependencies} {
+				for dep := range deps {
+					requires[name] = append(requires[name], dep)
+				}
+			}
+			for dep := range entry.Dependencies {
+				requires[name] = append(requires[name], dep)
+			}
+		}
+	} else {
+		entries = lockfile.Dependencies
+		for name, entry := range entries {
+			for dep := range entry.Requires {
+				requires[name] = append(requires[name], dep)
+			}
+		}
+	}
+
+	pins := &LockPins{byRange: map[string]string{}, byName: map[string]string{}, requires: requires}
+	for name, entry := range entries {
+		if entry.Link || entry.Version == "" {
+			continue // Workspace links aren't fetched from the registry
+		}
+		pins.byName[name] = entry.Version
+		pins.Packages = append(pins.Packages, ResolvedPackage{Name: name, Version: entry.Version, Dev: entry.Dev, Optional: entry.Optional, Integrity: entry.Integrity})
+	}
+	return pins, nil
+}
+
+// Read a yarn.lock, both the classic v1 format and the YAML one of yarn 2+. Each entry starts with the specs it
+// satisfies, like `"left-pad@^1.2.0", left-pad@^1.3.0:`, followed by an indented version and integrity
+func parseYarnLockfile(content []byte) (*LockPins, error) {
+	pins := &LockPins{byRange: map[string]string{}, byName: map[string]string{}, requires: map[string][]string{}}
+
+	var specs, requires []string
+	var current *ResolvedPackage
+	section := ""
+	finish := func() {
+		if current == nil || current.Version == "" {
+			return
+		}
+		for _, spec := range specs {
+			pins.byRange[spec] = current.Version
+		}
+		pins.byName[current.Name] = current.Version
+		pins.requires[current.Name] = append(pins.requires[current.Name], requires...)
+		pins.Packages = append(pins.Packages, *current)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// An unindented line opens the next entry
+		if !strings.HasPrefix(line, " ") {
+			finish()
+			specs, requires, current, section = nil, nil, nil, ""
+			if !strings.HasSuffix(trimmed, ":") {
+				return nil, fmt.Errorf("line %d: expected an entry like `name@range:`, got %q", lineNumber, trimmed)
+			}
+			for _, spec := range strings.Split(strings.TrimSuffix(trimmed, ":"), ",") {
+				spec = strings.Trim(strings.TrimSpace(spec), `"`)
+				name, versionRange := ParsePackageArg(spec)
+				if name == "" || !strings.Contains(spec[1:], "@") || strings.HasPrefix(versionRange, "workspace:") {
+					continue // e.g. yarn 2's __metadata or a workspace
+				}
+				versionRange = strings.TrimPrefix(versionRange, "npm:")
+				specs = append(specs, name+"@"+versionRange)
+				if current == nil {
+					current = &ResolvedPackage{Name: name}
+				}
+			}
+			continue
+		}
+
+		// Fields are indented by two spaces, deeper lines belong to nested objects like dependencies
+		if current == nil {
+			continue
+		}
+		key, value, _ := strings.Cut(trimmed, " ")
+		key = strings.TrimSuffix(key, ":")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if strings.HasPrefix(line, "   ") {
+			switch section {
+			case "dependencies", "optionalDependencies", "peerDependencies":
+				requires = append(requires, strings.Trim(key, `"`))
+			}
+			continue
+		}
+		section = ""
+		if value == "" {
+			section = key
+		}
+		switch key {
+		case "version":
+			current.Version = value
+		case "integrity":
+			current.Integrity = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	finish()
+
+	return pins, nil
+}
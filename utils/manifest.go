@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/jamesjellow/fpm/pkgmanager"
+)
+
+// ManifestFile is written into node_modules after every successful install to record what it contains
+const ManifestFile = ".fpm-manifest.json"
+
+// ManifestEntry is one installed package as recorded by the manifest
+type ManifestEntry struct {
+	Name      string            `json:"name"`
+	Version   string            `json:"version"`
+	Integrity string            `json:"integrity,omitempty"`
+	Files     map[string]string `json:"files,omitempty"` // sha256 of every file by path in the package, with InstallContext.RecordFiles
+}
+
+// Manifest records the installed tree, keyed by each package's path relative to node_modules, and a hash of it
+type Manifest struct {
+	Hash     string                   `json:"hash"`
+	Packages map[string]ManifestEntry `json:"packages"`
+}
+
+// Record the current contents of node_modules in its manifest. Integrities come from the install result,
+// or the previous manifest for packages this install didn't touch. Untouched packages without a sha512 integrity
+// get the registry's, see upgradeIntegrities. With RecordFiles the files of the packages this install put on disk
+// are hashed, untouched packages keep the hashes recorded when they were installed
+func WriteManifest(installCtx *InstallContext, result *InstallResult) error {
+	previous, _ := ReadManifest(installCtx)
+
+	integrities := make(map[string]string)
+	for _, pkg := range result.Packages {
+		integrities[pkg.Name+"@"+pkg.Version] = pkg.Integrity
+	}
+
+	packages, err := installedManifestEntries(installCtx)
+	if err != nil {
+		return err
+	}
+	var untouched []string
+	for path, entry := range packages {
+		integrity, touched := integrities[entry.Name+"@"+entry.Version]
+		if touched {
+			entry.Integrity = integrity
+		} else if previous != nil {
+			if old, ok := previous.Packages[path]; ok && old.Name == entry.Name && old.Version == entry.Version {
+				entry.Integrity = old.Integrity
+				entry.Files = old.Files
+			}
+		}
+		if !touched {
+			untouched = append(untouched, path)
+		}
+		if installCtx.RecordFiles && (touched || entry.Files == nil) {
+			files, err := hashPackageFiles(filepath.Join(installCtx.NodeModulesDir, filepath.FromSlash(path)))
+			if err != nil {
+				return err
+			}
+			entry.Files = files
+		}
+		packages[path] = entry
+	}
+
+	upgraded, err := installCtx.upgradeIntegrities(packages, untouched)
+	if err != nil {
+		return err
+	}
+	if upgraded > 0 {
+		fmt.Fprintf(installCtx.Output, "✔ Upgraded the integrity of %d package(s) to sha512\n", upgraded)
+	}
+
+	manifest := Manifest{Hash: manifestHash(packages), Packages: packages}
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(installCtx.NodeModulesDir, ManifestFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// Record the registry's sha512 integrity for the packages at paths whose entry has none, older manifests only have
+// the sha1 one or nothing. The metadata this install fetched anyway is used, UpgradeSHA512 fetches it for each
+// of them. The sha1 the entry recorded has to match the registry's shasum and the cached tarball, when there is
+// one, the sha512, otherwise the registry serves something else for the version than was installed and the
+// manifest isn't written. Returns how many entries were upgraded
+func (c *InstallContext) upgradeIntegrities(packages map[string]ManifestEntry, paths []string) (int, error) {
+	sort.Strings(paths)
+	if c.UpgradeSHA512 {
+		c.fetchMissingMetadata(packages, paths)
+	}
+
+	upgraded := 0
+	for _, path := range paths {
+		entry := packages[path]
+		if pkgmanager.SHA512(entry.Integrity) != "" {
+			continue
+		}
+		metadata, ok := c.resolver().Fetched(entry.Name)
+		// Linked and file: packages, or versions the registry doesn't have, keep what they have
+		if !ok || !slices.Contains(metadata.Versions, entry.Version) {
+			continue
+		}
+		packageInfo, _, err := metadata.Resolve(entry.Version)
+		if err != nil || pkgmanager.SHA512(packageInfo.Integrity) == "" {
+			continue
+		}
+		if recorded := pkgmanager.SHA1Shasum(entry.Integrity); recorded != "" && packageInfo.Shasum != "" && recorded != packageInfo.Shasum {
+			return upgraded, pkgmanager.Classify(pkgmanager.ErrIntegrity, fmt.Errorf("%s@%s was installed with shasum %s but the registry now publishes %s for it", entry.Name, entry.Version, recorded, packageInfo.Shasum))
+		}
+		if err := pkgmanager.VerifyCachedIntegrity(c.CacheDir, packageInfo.Shasum, packageInfo.Integrity); err != nil {
+			return upgraded, fmt.Errorf("cached tarball of %s@%s: %w", entry.Name, entry.Version, err)
+		}
+		entry.Integrity = packageInfo.Integrity
+		packages[path] = entry
+		upgraded++
+	}
+	return upgraded, nil
+}
+
+// Fetch the metadata this install doesn't have yet of the packages at paths without a sha512 integrity,
+// concurrently up to the install's Concurrency. Packages that fail to fetch are logged and keep their integrity
+func (c *InstallContext) fetchMissingMetadata(packages map[string]ManifestEntry, paths []string) {
+	resolver := c.resolver()
+	names := make(map[string]bool)
+	for _, path := range paths {
+		if entry := packages[path]; pkgmanager.SHA512(entry.Integrity) == "" {
+			if _, ok := resolver.Fetched(entry.Name); !ok {
+				names[entry.Name] = true
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(c.Concurrency, 1))
+	for name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if _, err := resolver.Metadata(name); err != nil {
+				log.Printf("failed to fetch the metadata of %s to upgrade its integrity: %v", name, err)
+			}
+		}(name)
+	}
+	wg.Wait()
+}
+
+// Read the manifest of node_modules, it is nil when no install has written one
+func ReadManifest(installCtx *InstallContext) (*Manifest, error) {
+	content, err := os.ReadFile(filepath.Join(installCtx.NodeModulesDir, ManifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+// Compare node_modules against its manifest and describe every difference, none means nothing drifted
+func VerifyManifest(installCtx *InstallContext, manifest *Manifest) ([]string, error) {
+	packages, err := installedManifestEntries(installCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The recorded integrities aren't on disk, carry them over so only names, versions and paths are compared
+	for path, entry := range packages {
+		if recorded, ok := manifest.Packages[path]; ok && recorded.Name == entry.Name && recorded.Version == entry.Version {
+			entry.Integrity = recorded.Integrity
+			packages[path] = entry
+		}
+	}
+	if manifestHash(packages) == manifest.Hash {
+		return nil, nil
+	}
+
+	var discrepancies []string
+	for path, recorded := range manifest.Packages {
+		entry, ok := packages[path]
+		switch {
+		case !ok:
+			discrepancies = append(discrepancies, fmt.Sprintf("missing %s@%s at %s", recorded.Name, recorded.Version, path))
+		case entry.Version != recorded.Version || entry.Name != recorded.Name:
+			discrepancies = append(discrepancies, fmt.Sprintf("changed %s at %s: expected %s, found %s", recorded.Name, path, recorded.Version, entry.Version))
+		}
+	}
+	for path, entry := range packages {
+		if _, ok := manifest.Packages[path]; !ok {
+			discrepancies = append(discrepancies, fmt.Sprintf("unexpected %s@%s at %s", entry.Name, entry.Version, path))
+		}
+	}
+	if len(discrepancies) == 0 {
+		discrepancies = append(discrepancies, "manifest hash does not match its packages")
+	}
+
+	sort.Strings(discrepancies)
+	return discrepancies, nil
+}
+
+// List node_modules as manifest entries keyed by path relative to node_modules
+func installedManifestEntries(installCtx *InstallContext) (map[string]ManifestEntry, error) {
+	installed, err := ListInstalledPackages(installCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := make(map[string]ManifestEntry, len(installed))
+	for _, pkg := range installed {
+		path, err := filepath.Rel(installCtx.NodeModulesDir, pkg.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %v", pkg.Dir, err)
+		}
+		packages[filepath.ToSlash(path)] = ManifestEntry{Name: pkg.Name, Version: pkg.Version}
+	}
+	return packages, nil
+}
+
+// Hash the entries in path order so the same tree always has the same hash
+func manifestHash(packages map[string]ManifestEntry) string {
+	paths := make([]string, 0, len(packages))
+	for path := range packages {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	hasher := sha256.New()
+	for _, path := range paths {
+		entry := packages[path]
+		fmt.Fprintf(hasher, "%s %s@%s %s\n", path, entry.Name, entry.Version, entry.Integrity)
+	}
+	return fmt.Sprintf("sha256-%x", hasher.Sum(nil))
+}
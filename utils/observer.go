@@ -0,0 +1,23 @@
+package utils
+
+// Observer is told what an install is doing, so a CLI or an embedding program can present progress its own way
+type Observer interface {
+	OnResolve(name, versionRange, version string)      // A version was picked for a dependency
+	OnDownloadProgress(name string, done, total int64) // Bytes of a tarball arrived, total is -1 when unknown
+	OnInstalled(name, version string)                  // A package was extracted into node_modules
+	OnError(name string, err error)                    // A package failed to install, whether or not the install bails
+}
+
+// NopObserver ignores every event, embed it to implement only the events you care about
+type NopObserver struct{}
+
+func (NopObserver) OnResolve(name, versionRange, version string)      {}
+func (NopObserver) OnDownloadProgress(name string, done, total int64) {}
+func (NopObserver) OnInstalled(name, version string)                  {}
+func (NopObserver) OnError(name string, err error)                    {}
+
+// Tell the observer a package failed and hand the error back for returning
+func (c *InstallContext) fail(packageName string, err error) error {
+	c.Observer.OnError(packageName, err)
+	return err
+}
@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/iancoleman/orderedmap"
+)
+
+// Read the top level "overrides" of the root package.json into package name to version. A "$name" value refers
+// to the version of that name in the root dependencies, like npm. Nested, path specific overrides aren't
+// supported yet, only their "." entry is used. Yarn "resolutions" are applied the same way, and "overrides"
+// wins for a package both of them set
+func ParseOverrides(packageJson *orderedmap.OrderedMap) (map[string]string, error) {
+	overrides, err := parseResolutions(packageJson)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := packageJson.Get("overrides")
+	if !ok || value == nil {
+		return overrides, nil
+	}
+	resolutions := make(map[string]string, len(overrides))
+	for name, version := range overrides {
+		resolutions[name] = version
+	}
+
+	overridesMap, err := ParseDependencies(packageJson, "overrides")
+	if err != nil {
+		return nil, fmt.Errorf("\"overrides\" must be an object, got %T", value)
+	}
+
+	for _, name := range overridesMap.Keys() {
+		raw, _ := overridesMap.Get(name)
+
+		var version string
+		switch v := raw.(type) {
+		case string:
+			version = v
+		case orderedmap.OrderedMap:
+			version = nestedOverrideVersion(name, &v)
+		case *orderedmap.OrderedMap:
+			version = nestedOverrideVersion(name, v)
+		default:
+			return nil, fmt.Errorf("override for %s must be a string or an object, got %T", name, raw)
+		}
+		if version == "" {
+			continue
+		}
+
+		if strings.HasPrefix(version, "$") {
+			referenced := strings.TrimPrefix(version, "$")
+			resolved, ok := rootDependencyVersion(packageJson, referenced)
+			if !ok {
+				return nil, fmt.Errorf("override for %s references %s, which is not a dependency of the root package", name, version)
+			}
+			version = resolved
+		}
+		if resolution, ok := resolutions[name]; ok && resolution != version {
+			log.Printf("Warning: overrides sets %s to %s and resolutions sets it to %s, using %s from overrides", name, version, resolution, version)
+		}
+		overrides[name] = version
+	}
+
+	return overrides, nil
+}
+
+// Read the yarn "resolutions" of the root package.json into package name to version. "**/name" applies
+// everywhere like a plain name, path specific ("parent/name") and range specific ("name@^1.0.0") keys can't be
+// expressed as an override and are skipped with a warning
+func parseResolutions(packageJson *orderedmap.OrderedMap) (map[string]string, error) {
+	resolutions := make(map[string]string)
+	if value, ok := packageJson.Get("resolutions"); !ok || value == nil {
+		return resolutions, nil
+	}
+
+	resolutionsMap, err := ParseDependencies(packageJson, "resolutions")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range resolutionsMap.Keys() {
+		raw, _ := resolutionsMap.Get(key)
+		version, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("resolution for %s must be a string, got %T", key, raw)
+		}
+
+		name, ok := resolutionName(key)
+		if !ok {
+			log.Printf("Warning: resolution %s only applies to part of the tree, which is not supported yet, ignoring it", key)
+			continue
+		}
+		if existing, ok := resolutions[name]; ok && existing != version {
+			log.Printf("Warning: resolutions sets %s to both %s and %s, using %s", name, existing, version, version)
+		}
+		resolutions[name] = version
+	}
+
+	return resolutions, nil
+}
+
+// Normalize a resolutions key to the package name it forces everywhere, reporting false for keys that only
+// target some of its copies
+func resolutionName(key string) (string, bool) {
+	name := strings.TrimPrefix(key, "**/")
+
+	// A scoped name has exactly one slash after the scope, anything more is a path
+	segments := strings.Split(name, "/")
+	if strings.HasPrefix(name, "@") {
+		if len(segments) != 2 {
+			return "", false
+		}
+	} else if len(segments) != 1 {
+		return "", false
+	}
+
+	// "name@range" only applies to the copies requested with that range
+	if strings.Contains(strings.TrimPrefix(name, "@"), "@") {
+		return "", false
+	}
+	return name, name != "" && !strings.Contains(name, "*")
+}
+
+// Use the "." entry of a nested override, the version of the package itself, and skip the rest
+func nestedOverrideVersion(name string, nested *orderedmap.OrderedMap) string {
+	version := ""
+	for _, key := range nested.Keys() {
+		value, _ := nested.Get(key)
+		if key == "." {
+			version, _ = value.(string)
+			continue
+		}
+		log.Printf("Warning: nested override %s > %s is not supported yet, ignoring it", name, key)
+	}
+	return version
+}
+
+// Look a package up in the root dependencies and devDependencies
+func rootDependencyVersion(packageJson *orderedmap.OrderedMap, name string) (string, bool) {
+	for _, depType := range []string{"dependencies", "devDependencies"} {
+		if _, ok := packageJson.Get(depType); !ok {
+			continue
+		}
+		deps, err := ParseDependencies(packageJson, depType)
+		if err != nil {
+			continue
+		}
+		if version, ok := deps.Get(name); ok {
+			if versionStr, ok := version.(string); ok {
+				return versionStr, true
+			}
+		}
+	}
+	return "", false
+}
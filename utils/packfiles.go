@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Names left out of every package wherever they appear, like npm-packlist does
+var neverPacked = map[string]bool{
+	".git": true, ".svn": true, ".hg": true, "CVS": true, "node_modules": true, ".npmignore": true, ".gitignore": true,
+	".npmrc": true, ".DS_Store": true, ".lock-wscript": true, "npm-debug.log": true, "config.gypi": true,
+}
+
+// Root files left out of every package
+var neverPackedAtRoot = map[string]bool{"package-lock.json": true, "yarn.lock": true, "pnpm-lock.yaml": true}
+
+// Root files packed whatever files and the ignore files say, besides package.json and the main and bin files
+var alwaysPackedAtRoot = regexp.MustCompile(`(?i)^(readme|license|licence|copying)(\..*)?$`)
+
+// PackFiles lists the files of the package in packageDir that npm would publish, as slash separated paths
+// relative to it and sorted. With a "files" field only the files it lists are packed, otherwise everything is.
+// Either way .npmignore, or .gitignore where a directory has no .npmignore, leaves files out, except that the
+// root ignore file doesn't apply to what "files" lists. package.json, the readme, the license and the main and bin
+// files are always packed, VCS directories, node_modules and lockfiles never are
+func PackFiles(packageDir string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(packageDir, "package.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package.json: %v", err)
+	}
+	var manifest struct {
+		Files []string        `json:"files"`
+		Main  string          `json:"main"`
+		Bin   json.RawMessage `json:"bin"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse package.json: %v", err)
+	}
+
+	always := map[string]bool{"package.json": true}
+	if manifest.Main != "" {
+		always[cleanPackPath(manifest.Main)] = true
+	}
+	var bins map[string]string
+	var bin string
+	if json.Unmarshal(manifest.Bin, &bins) != nil && json.Unmarshal(manifest.Bin, &bin) == nil {
+		bins = map[string]string{"": bin}
+	}
+	for _, binPath := range bins {
+		always[cleanPackPath(binPath)] = true
+	}
+
+	var allowlist []ignoreRule
+	for _, entry := range manifest.Files {
+		allowlist = append(allowlist, parseIgnoreLine("/"+cleanPackPath(strings.TrimPrefix(entry, "!")), strings.HasPrefix(entry, "!")))
+	}
+
+	ignores := make(map[string][]ignoreRule) // Directory, relative to the package, to the rules of its ignore file
+	ignoredDirs := make(map[string]bool)     // Ignored directories that hold a main or bin file
+	var files []string
+	err = filepath.WalkDir(packageDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(packageDir, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			ignores["."] = readIgnoreFile(filePath, manifest.Files != nil)
+			return nil
+		}
+
+		name := entry.Name()
+		isDir := entry.IsDir()
+		atRoot := !strings.Contains(rel, "/")
+		if neverPacked[name] || strings.HasPrefix(name, "._") || strings.HasSuffix(name, ".orig") || (strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".swp")) || (atRoot && neverPackedAtRoot[name]) {
+			if isDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+
+		if !isDir && (always[rel] || (atRoot && alwaysPackedAtRoot.MatchString(name))) {
+			files = append(files, rel)
+			return nil
+		}
+		if ignoredDirs[path.Dir(rel)] || ignoredBy(ignores, rel, isDir) {
+			if !isDir {
+				return nil
+			}
+			// An ignored directory is only entered for the main or bin files in it
+			if !packsUnder(always, rel) {
+				return filepath.SkipDir
+			}
+			ignoredDirs[rel] = true
+			return nil
+		}
+		if isDir {
+			ignores[rel] = readIgnoreFile(filePath, false)
+			return nil
+		}
+		if manifest.Files != nil && !allowed(allowlist, rel) {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the files of %s: %v", packageDir, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Normalize a path from package.json, like ./lib/index.js, to lib/index.js
+func cleanPackPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+}
+
+// ignoreRule is one line of a .npmignore or .gitignore
+type ignoreRule struct {
+	pattern  string // Without the leading ! and /, or the trailing /
+	negate   bool   // A ! line puts back what an earlier line left out
+	dirOnly  bool   // A line ending in / only matches directories
+	anchored bool   // A line with a / before its end matches from the ignore file's directory, others match any name
+}
+
+// Parse an ignore file line, negate is set for "files" entries that start with !
+func parseIgnoreLine(line string, negate bool) ignoreRule {
+	rule := ignoreRule{negate: negate}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	rule.anchored = strings.Contains(line, "/")
+	rule.pattern = strings.TrimPrefix(line, "/")
+	return rule
+}
+
+// Read the .npmignore of dir, or its .gitignore when there is none. skip leaves the root ignore file out once
+// "files" decides what is packed
+func readIgnoreFile(dir string, skip bool) []ignoreRule {
+	if skip {
+		return nil
+	}
+	content, err := os.ReadFile(filepath.Join(dir, ".npmignore"))
+	if err != nil {
+		if content, err = os.ReadFile(filepath.Join(dir, ".gitignore")); err != nil {
+			return nil
+		}
+	}
+	var rules []ignoreRule
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, parseIgnoreLine(line, false))
+	}
+	return rules
+}
+
+// Check whether the ignore files of rel's ancestors leave it out, a deeper file and a later line win
+func ignoredBy(ignores map[string][]ignoreRule, rel string, isDir bool) bool {
+	ignored := false
+	dir := "."
+	for {
+		relToDir := rel
+		if dir != "." {
+			relToDir = strings.TrimPrefix(rel, dir+"/")
+		}
+		for _, rule := range ignores[dir] {
+			if rule.matches(relToDir, isDir) {
+				ignored = !rule.negate
+			}
+		}
+		next, _, found := strings.Cut(relToDir, "/")
+		if !found {
+			return ignored
+		}
+		if dir == "." {
+			dir = next
+		} else {
+			dir = dir + "/" + next
+		}
+	}
+}
+
+// Check whether any of the always packed paths is inside dir
+func packsUnder(always map[string]bool, dir string) bool {
+	for packed := range always {
+		if strings.HasPrefix(packed, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the "files" entries include rel, an entry naming a directory includes everything in it
+func allowed(allowlist []ignoreRule, rel string) bool {
+	included := false
+	for _, rule := range allowlist {
+		for candidate := rel; ; {
+			if rule.matches(candidate, candidate != rel) {
+				included = !rule.negate
+				break
+			}
+			parent := path.Dir(candidate)
+			if parent == "." {
+				break
+			}
+			candidate = parent
+		}
+	}
+	return included
+}
+
+// Check whether the rule matches rel, a slash separated path relative to the ignore file's directory
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if !r.anchored {
+		matched, _ := path.Match(r.pattern, path.Base(rel))
+		return matched
+	}
+	return matchSegments(strings.Split(r.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// Match path segments against pattern segments, where ** matches any number of segments
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
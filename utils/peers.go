@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dominikbraun/graph"
+)
+
+// PeerStrategy is how an install handles peerDependencies that are missing or conflict with the installed version
+type PeerStrategy string
+
+const (
+	PeerStrict  PeerStrategy = "strict"           // Fail on a conflicting peer, a missing one is a warning
+	PeerLegacy  PeerStrategy = "legacy-peer-deps" // Ignore peerDependencies, like npm's --legacy-peer-deps
+	PeerResolve PeerStrategy = "resolve"          // Install the highest version satisfying every range asking for the peer
+)
+
+// ParsePeerStrategy checks a --peer-deps value
+func ParsePeerStrategy(value string) (PeerStrategy, error) {
+	switch strategy := PeerStrategy(value); strategy {
+	case PeerStrict, PeerLegacy, PeerResolve:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid peer dependency strategy %q, expected strict, legacy-peer-deps or resolve", value)
+	}
+}
+
+// A peer dependency one installed package declares
+type peerRequest struct {
+	from         string // name@version of the package declaring it
+	versionRange string
+	optional     bool // Marked optional in peerDependenciesMeta, it is fine for it to be missing
+}
+
+// Check the peerDependencies of every package this install put on disk against the top level node_modules,
+// handling missing and conflicting peers the way installCtx.PeerStrategy says
+func CheckPeerDependencies(installCtx *InstallContext, depGraph *graph.Graph[string, string]) error {
+	if installCtx.PeerStrategy == PeerLegacy {
+		return nil
+	}
+
+	requests := make(map[string][]peerRequest)
+	for _, pkg := range installCtx.Result().Packages {
+		peers, err := readPeerDependencies(filepath.Join(installCtx.NodeModulesDir, pkg.Name, "package.json"))
+		if err != nil {
+			return err
+		}
+		for _, peer := range peers {
+			peer.request.from = pkg.Name + "@" + pkg.Version
+			requests[peer.name] = append(requests[peer.name], peer.request)
+		}
+	}
+
+	names := make([]string, 0, len(requests))
+	for name := range requests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var conflicts []string
+	for _, name := range names {
+		installed := installedVersion(filepath.Join(installCtx.NodeModulesDir, name))
+		var unsatisfied []peerRequest
+		for _, request := range requests[name] {
+			if installed == "" && request.optional {
+				continue
+			}
+			if installed == "" || !satisfies(installed, request.versionRange) {
+				unsatisfied = append(unsatisfied, request)
+			}
+		}
+		if len(unsatisfied) == 0 {
+			continue
+		}
+
+		if installCtx.PeerStrategy == PeerResolve {
+			if err := resolvePeer(installCtx, depGraph, name, installed, requests[name]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, request := range unsatisfied {
+			if installed == "" {
+				installCtx.addWarning(fmt.Sprintf("fpm WARN %s needs peer %s@%s, which is not installed", request.from, name, request.versionRange))
+			} else {
+				conflicts = append(conflicts, fmt.Sprintf("%s needs peer %s@%s but %s is installed", request.from, name, request.versionRange, installed))
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("peer dependency conflict:\n  - %s\npass --legacy-peer-deps to ignore peers or --peer-deps=resolve to install a version satisfying them", strings.Join(conflicts, "\n  - "))
+	}
+	return nil
+}
+
+// Replace a missing or conflicting peer with the highest version satisfying every range that asks for it
+func resolvePeer(installCtx *InstallContext, depGraph *graph.Graph[string, string], name, installed string, requests []peerRequest) error {
+	ranges := make([]string, 0, len(requests))
+	for _, request := range requests {
+		ranges = append(ranges, request.versionRange)
+	}
+	combined := intersectRanges(ranges)
+
+	if installed != "" {
+		if err := os.RemoveAll(filepath.Join(installCtx.NodeModulesDir, name)); err != nil {
+			return fmt.Errorf("failed to remove %s@%s: %v", name, installed, err)
+		}
+		installCtx.forgetResolved(name, installed)
+	}
+	version, err := installPackage(installCtx, installCtx.NodeModulesDir, name, combined, depGraph, make(map[string]bool), 0, false, false)
+	if err != nil {
+		return fmt.Errorf("no version of peer %s satisfies %s: %w", name, strings.Join(ranges, " and "), err)
+	}
+	log.Printf("peer: installed %s@%s for %s", name, version, combined)
+	return nil
+}
+
+// Combine ranges into one that only matches versions satisfying all of them, "||" alternatives are expanded
+// so e.g. "^1.0.0 || ^2.0.0" and ">=1.5.0" become "^1.0.0, >=1.5.0 || ^2.0.0, >=1.5.0"
+func intersectRanges(ranges []string) string {
+	combined := []string{""}
+	for _, versionRange := range ranges {
+		if strings.TrimSpace(versionRange) == "" {
+			versionRange = "*"
+		}
+		var next []string
+		for _, prefix := range combined {
+			for _, alternative := range strings.Split(versionRange, "||") {
+				alternative = strings.TrimSpace(alternative)
+				if prefix != "" {
+					alternative = prefix + ", " + alternative
+				}
+				next = append(next, alternative)
+			}
+		}
+		combined = next
+	}
+	return strings.Join(combined, " || ")
+}
+
+// A peer dependency declared in a package.json
+type declaredPeer struct {
+	name    string
+	request peerRequest
+}
+
+// Get the peerDependencies of a package.json, with the optional flag from peerDependenciesMeta
+func readPeerDependencies(packageJsonPath string) ([]declaredPeer, error) {
+	content, err := os.ReadFile(packageJsonPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package.json: %v", err)
+	}
+
+	var packageJson struct {
+		PeerDependencies     map[string]interface{} `json:"peerDependencies"`
+		PeerDependenciesMeta map[string]struct {
+			Optional bool `json:"optional"`
+		} `json:"peerDependenciesMeta"`
+	}
+	if err := json.Unmarshal(content, &packageJson); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", packageJsonPath, err)
+	}
+
+	var peers []declaredPeer
+	for name, versionRange := range packageJson.PeerDependencies {
+		rangeStr, ok := versionRange.(string)
+		if !ok {
+			continue
+		}
+		peers = append(peers, declaredPeer{name: name, request: peerRequest{
+			versionRange: rangeStr,
+			optional:     packageJson.PeerDependenciesMeta[name].Optional,
+		}})
+	}
+	return peers, nil
+}
+
+// Get the version of the package installed in packageDir, empty when there is none
+func installedVersion(packageDir string) string {
+	content, err := os.ReadFile(filepath.Join(packageDir, "package.json"))
+	if err != nil {
+		return ""
+	}
+	var packageJson struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(content, &packageJson); err != nil {
+		return ""
+	}
+	return packageJson.Version
+}
@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dominikbraun/graph"
+	"github.com/jamesjellow/fpm/pkgmanager"
+)
+
+// Resolve the whole dependency tree of roots, package names to ranges, with the install's resolver and add it to
+// depGraph before anything is downloaded. The tree is the plan of the install, which takes the version of every
+// package it installs from it. The tree is walked a level at a time and the edges of a level are added in sorted
+// order, so the graph and the edges it rejects as cycles are the same on every run, and the hoisted layout puts
+// the first version of a name the walk reaches at the top level. A dependency that can't be resolved, or is deeper
+// than the install's MaxDepth, fails the plan
+func BuildGraph(installCtx *InstallContext, roots map[string]string, depGraph *graph.Graph[string, string]) error {
+	tree, err := installCtx.resolver().ResolveTree(roots)
+	if err != nil {
+		return err
+	}
+
+	plan := make(map[string]*pkgmanager.ResolvedNode)
+	seen := make(map[*pkgmanager.ResolvedNode]bool)
+	var level []*pkgmanager.ResolvedNode
+	for _, name := range sortedDependencyNames(roots) {
+		if err := (*depGraph).AddVertex(name); err != nil && err != graph.ErrVertexAlreadyExists {
+			return err
+		}
+		node := tree.Packages[name+"@"+tree.Root[name]]
+		seen[node] = true
+		level = append(level, node)
+	}
+	for len(level) > 0 {
+		var next []*pkgmanager.ResolvedNode
+		for _, node := range level {
+			if _, ok := plan[node.Name]; !ok {
+				plan[node.Name] = node
+			}
+			for _, depName := range sortedDependencyNames(node.Dependencies) {
+				if err := (*depGraph).AddVertex(depName); err != nil && err != graph.ErrVertexAlreadyExists {
+					return err
+				}
+				// A rejected cycle is rejected again when the install walks the same edge
+				if err := (*depGraph).AddEdge(node.Name, depName); err != nil && !errors.Is(err, graph.ErrEdgeAlreadyExists) && !errors.Is(err, graph.ErrEdgeCreatesCycle) {
+					return err
+				}
+				dep := tree.Packages[depName+"@"+node.Dependencies[depName]]
+				if !seen[dep] {
+					seen[dep] = true
+					next = append(next, dep)
+				}
+			}
+		}
+		level = next
+	}
+
+	installCtx.planMutex.Lock()
+	defer installCtx.planMutex.Unlock()
+	installCtx.tree, installCtx.plan = tree, plan
+	return nil
+}
+
+// Get the package and version the plan installs for a dependency on packageName, with the range as the dependent
+// asked for it. The hoisted layout installs the version planned for the top level wherever the name appears
+func (c *InstallContext) planned(packageName, versionRange string) (*pkgmanager.ResolvedNode, bool) {
+	c.planMutex.Lock()
+	defer c.planMutex.Unlock()
+	if c.tree == nil {
+		return nil, false
+	}
+	if node, ok := c.plan[packageName]; ok && c.Layout != LayoutNested {
+		return node, true
+	}
+	node, ok := c.tree.Packages[packageName+"@"+c.tree.Ranges[packageName+"@"+versionRange]]
+	return node, ok
+}
+
+// Resolve a dependency from disk when the install doesn't need the registry for it, a file: directory or a copy
+// at the top of node_modules that the install keeps. The versions of other packages come from the registry
+func (c *InstallContext) resolveLocal(packageName, versionRange string) (*pkgmanager.PackageInfo, bool) {
+	packageDir := filepath.Join(c.NodeModulesDir, packageName)
+	if localDir, ok := strings.CutPrefix(versionRange, "file:"); ok {
+		if !filepath.IsAbs(localDir) {
+			localDir = filepath.Join(filepath.Dir(c.NodeModulesDir), localDir)
+		}
+		packageDir = localDir
+	} else if installed := installedVersion(packageDir); installed == "" || (isSemverRange(orAny(versionRange)) && !satisfies(installed, orAny(versionRange))) {
+		return nil, false
+	}
+
+	// A package.json that can't be read leaves the package without dependencies, installing it reports why
+	packageJsonPath := filepath.Join(packageDir, "package.json")
+	packageInfo := &pkgmanager.PackageInfo{Name: packageName, Version: installedVersion(packageDir)}
+	packageInfo.Dependencies, _ = getDependenciesFromPackageJson(packageJsonPath)
+	packageInfo.OptionalDependencies, _ = readDependencies(packageJsonPath, "optionalDependencies")
+	return packageInfo, true
+}
+
+// An empty range means any version
+func orAny(versionRange string) string {
+	if strings.TrimSpace(versionRange) == "" {
+		return "*"
+	}
+	return versionRange
+}
+
+// extractedPackage is a package ExtractInOrder put in place before the install reached it
+type extractedPackage struct {
+	download, extract time.Duration
+}
+
+// Download and extract the planned packages of a hoisted install a layer of InstallOrder at a time, so every
+// package is on disk before its dependents and before the install links bins or runs lifecycle scripts. The
+// packages of a layer are installed concurrently up to the install's Concurrency, a package that fails stops the
+// install once its layer is over and the first failure of the layer is returned. The install that follows finds
+// the packages in place and only records them, processes their dependencies and runs their scripts. A nested
+// layout places copies per dependent and is left to the install entirely
+func ExtractInOrder(installCtx *InstallContext, depGraph *graph.Graph[string, string]) error {
+	if installCtx.tree == nil || installCtx.Layout == LayoutNested {
+		return nil
+	}
+	layers, err := InstallOrder(depGraph)
+	if err != nil {
+		return err
+	}
+
+	installCtx.planMutex.Lock()
+	plan := make(map[string]*pkgmanager.ResolvedNode, len(installCtx.plan))
+	folded := make(map[string]int)
+	for name, node := range installCtx.plan {
+		plan[name] = node
+		folded[strings.ToLower(name)]++
+	}
+	installCtx.planMutex.Unlock()
+
+	for _, layer := range layers {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, max(installCtx.Concurrency, 1))
+		errs := make([]error, len(layer))
+		for i, name := range layer {
+			node, ok := plan[name]
+			// Names differing only by case are left to the install, which decides whether they can coexist
+			if !ok || folded[strings.ToLower(name)] > 1 {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, node *pkgmanager.ResolvedNode) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				errs[i] = installCtx.extractPlanned(node)
+			}(i, node)
+		}
+		wg.Wait()
+		if err := installCtx.Context.Err(); err != nil {
+			return err
+		}
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Put the planned version of a package at the top level of node_modules. A package the plan read from disk, a
+// file: directory or a kept copy, has nothing to download and a package for another platform is left for the
+// install to skip. A copy an earlier install left that isn't the planned version is replaced
+func (c *InstallContext) extractPlanned(node *pkgmanager.ResolvedNode) error {
+	if node.Tarball == "" {
+		return nil
+	}
+	packageName, targetName := node.Name, node.Name
+	if node.AliasOf != "" {
+		targetName = node.AliasOf
+	}
+	packagePath := filepath.Join(c.NodeModulesDir, packageName)
+	if err := pkgmanager.CheckDir(packagePath); err != nil {
+		return c.fail(packageName, fmt.Errorf("%s@%s: %w", packageName, node.Version, err))
+	}
+	if _, keep, err := keepInstalled(c, packageName, node.Version, packagePath); err != nil {
+		return c.fail(packageName, fmt.Errorf("%s@%s: %w", packageName, node.Version, err))
+	} else if keep {
+		return nil
+	}
+	packageInfo, err := c.fetchPackageInfo(targetName, node.Version)
+	if err != nil {
+		return c.fail(packageName, fmt.Errorf("%s@%s: failed to fetch package info: %w", packageName, node.Version, err))
+	}
+	if unsupportedPlatform(packageInfo.OS, packageInfo.CPU) != "" {
+		return nil
+	}
+	if err := c.checkEngines(packageName, packageInfo.Version, packageInfo.Engines); err != nil {
+		return c.fail(packageName, fmt.Errorf("%s@%s: %w", packageName, node.Version, err))
+	}
+	c.Observer.OnResolve(packageName, node.Version, packageInfo.Version)
+	download, extract, err := fetchIntoPlace(c, packageInfo, packageName, packagePath)
+	if err != nil {
+		return c.fail(packageName, fmt.Errorf("%s@%s: %w", packageName, node.Version, err))
+	}
+
+	c.planMutex.Lock()
+	defer c.planMutex.Unlock()
+	if c.extracted == nil {
+		c.extracted = make(map[string]extractedPackage)
+	}
+	c.extracted[packagePath] = extractedPackage{download: download, extract: extract}
+	return nil
+}
+
+// Take the package ExtractInOrder put at packagePath, the install reaching it records it instead of downloading it
+func (c *InstallContext) takeExtracted(packagePath string) (extractedPackage, bool) {
+	c.planMutex.Lock()
+	defer c.planMutex.Unlock()
+	extracted, ok := c.extracted[packagePath]
+	delete(c.extracted, packagePath)
+	return extracted, ok
+}
+
+// Check whether ExtractInOrder put a package at packagePath that the install hasn't reached yet
+func (c *InstallContext) isExtracted(packagePath string) bool {
+	c.planMutex.Lock()
+	defer c.planMutex.Unlock()
+	_, ok := c.extracted[packagePath]
+	return ok
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// npm names platforms after Node's process.platform, which only differs from GOOS for these
+var npmPlatforms = map[string]string{
+	"windows": "win32",
+	"solaris": "sunos",
+	"illumos": "sunos",
+}
+
+// npm names architectures after Node's process.arch
+var npmArchs = map[string]string{
+	"amd64":   "x64",
+	"386":     "ia32",
+	"ppc64le": "ppc64",
+	"mipsle":  "mipsel",
+}
+
+// Map a GOOS to the name npm uses for it in the `os` field
+func npmPlatform(goos string) string {
+	if platform, ok := npmPlatforms[goos]; ok {
+		return platform
+	}
+	return goos
+}
+
+// Map a GOARCH to the name npm uses for it in the `cpu` field
+func npmArch(goarch string) string {
+	if arch, ok := npmArchs[goarch]; ok {
+		return arch
+	}
+	return goarch
+}
+
+// Check current against an `os` or `cpu` list: "!name" entries exclude a platform, and when there are plain
+// entries current has to be one of them. An empty list supports everything
+func platformSupported(allowed []string, current string) bool {
+	hasAllowed := false
+	supported := false
+	for _, entry := range allowed {
+		if excluded, ok := strings.CutPrefix(entry, "!"); ok {
+			if excluded == current {
+				return false
+			}
+			continue
+		}
+		hasAllowed = true
+		if entry == current {
+			supported = true
+		}
+	}
+	return supported || !hasAllowed
+}
+
+// Explain why a package with these `os` and `cpu` lists can't be installed here, empty when it can
+func unsupportedPlatform(osList, cpuList []string) string {
+	if platform := npmPlatform(runtime.GOOS); !platformSupported(osList, platform) {
+		return fmt.Sprintf("it supports os %s, this is %s", strings.Join(osList, ","), platform)
+	}
+	if arch := npmArch(runtime.GOARCH); !platformSupported(cpuList, arch) {
+		return fmt.Sprintf("it supports cpu %s, this is %s", strings.Join(cpuList, ","), arch)
+	}
+	return ""
+}
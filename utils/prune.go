@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dominikbraun/graph"
+)
+
+// Remove the top level packages in node_modules that nothing in package.json reaches anymore, along with their
+// nested node_modules. production leaves out devDependencies, dryRun only lists what would be removed
+func Prune(installCtx *InstallContext, pathToJSON string, depGraph *graph.Graph[string, string], production, dryRun bool) ([]InstalledPackage, error) {
+	reachable, err := reachablePackages(installCtx, pathToJSON, depGraph, production)
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := ListInstalledPackages(installCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	root := filepath.Clean(installCtx.NodeModulesDir)
+	var removed []InstalledPackage
+	for _, pkg := range installed {
+		if containingNodeModules(pkg.Dir, pkg.Name) != root || reachable[pkg.Name] {
+			continue
+		}
+		removed = append(removed, pkg)
+		if dryRun {
+			continue
+		}
+
+		if err := os.RemoveAll(pkg.Dir); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %v", pkg.Dir, err)
+		}
+		// Drop the scope directory once its last package is gone, this fails harmlessly while it isn't empty
+		if strings.HasPrefix(pkg.Name, "@") {
+			os.Remove(filepath.Dir(pkg.Dir))
+		}
+	}
+
+	return removed, nil
+}
+
+// Walk the dependency graph from package.json, and its workspaces, through the installed packages and return
+// the name of every package reached. Optional and peer dependencies of installed packages count as reached
+func reachablePackages(installCtx *InstallContext, pathToJSON string, depGraph *graph.Graph[string, string], production bool) (map[string]bool, error) {
+	packageJson, err := ParsePackageJson(pathToJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	depTypes := []string{"dependencies", "optionalDependencies", "devDependencies"}
+	if production {
+		depTypes = depTypes[:2]
+	}
+
+	root := "root"
+	if name, ok := packageJson.Get("name"); ok {
+		if nameStr, ok := name.(string); ok && nameStr != "" {
+			root = nameStr
+		}
+	}
+	if err := (*depGraph).AddVertex(root); err != nil && err != graph.ErrVertexAlreadyExists {
+		return nil, fmt.Errorf("failed to add vertex: %v", err)
+	}
+
+	// Workspace members are linked into node_modules and their dependencies are installed next to the root's
+	var queue []string
+	rootJsons := []string{pathToJSON}
+	workspaces, err := FindWorkspaces(pathToJSON, packageJson)
+	if err != nil {
+		return nil, err
+	}
+	for _, workspace := range workspaces {
+		addGraphEdge(depGraph, root, workspace.Name)
+		queue = append(queue, workspace.Name)
+		rootJsons = append(rootJsons, workspace.PackageJsonPath)
+	}
+	for _, rootJson := range rootJsons {
+		for _, depType := range depTypes {
+			deps, err := readDependencies(rootJson, depType)
+			if err != nil {
+				return nil, err
+			}
+			for _, dep := range sortedDependencyNames(deps) {
+				addGraphEdge(depGraph, root, dep)
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	reachable := make(map[string]bool)
+	for len(queue) > 0 {
+		packageName := queue[0]
+		queue = queue[1:]
+		if reachable[packageName] {
+			continue
+		}
+		reachable[packageName] = true
+
+		packageJsonPath := filepath.Join(installCtx.NodeModulesDir, packageName, "package.json")
+		for _, depType := range []string{"dependencies", "optionalDependencies", "peerDependencies"} {
+			deps, err := readDependencies(packageJsonPath, depType)
+			if err != nil {
+				break // Not installed, nothing to follow
+			}
+			for _, depName := range sortedDependencyNames(deps) {
+				addGraphEdge(depGraph, packageName, depName)
+				queue = append(queue, depName)
+			}
+		}
+	}
+
+	return reachable, nil
+}
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jamesjellow/fpm/pkgmanager"
+)
+
+// RepairedPackage is a broken package directory RepairInstall removed
+type RepairedPackage struct {
+	Path    string `json:"path"` // Relative to node_modules, slash separated
+	Name    string `json:"name"`
+	Problem string `json:"problem"`
+}
+
+// Find the package directories of node_modules an interrupted install left broken and remove them, so the install
+// that follows puts just those back and keeps everything else. A directory is broken when its package.json is
+// missing or doesn't parse, when the manifest recorded another version at its path, or when its files changed
+// since the manifest hashed them. Linked packages are left alone. Returns the removed directories sorted by path
+func RepairInstall(installCtx *InstallContext) ([]RepairedPackage, error) {
+	var broken []RepairedPackage
+	if err := findBrokenPackages(installCtx.NodeModulesDir, "", &broken); err != nil {
+		return nil, err
+	}
+
+	manifest, err := ReadManifest(installCtx)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		installed, err := installedManifestEntries(installCtx)
+		if err != nil {
+			return nil, err
+		}
+		for path, recorded := range manifest.Packages {
+			entry, ok := installed[path]
+			if !ok || entry.Name != recorded.Name {
+				continue
+			}
+			if entry.Version != recorded.Version {
+				broken = append(broken, RepairedPackage{Path: path, Name: entry.Name, Problem: fmt.Sprintf("expected version %s, found %s", recorded.Version, entry.Version)})
+			}
+		}
+		_, changed, err := changedFiles(installCtx, manifest, installed)
+		if err != nil {
+			return nil, err
+		}
+		broken = append(broken, changed...)
+	}
+
+	return broken, removeBroken(installCtx, broken)
+}
+
+// Re-hash the files of every package whose manifest entry recorded them and remove the packages with a file that
+// is missing, changed or wasn't there when it was installed, so the install that follows extracts just those again.
+// Returns how many packages had recorded files to check and the removed ones sorted by path
+func CheckFiles(installCtx *InstallContext) (int, []RepairedPackage, error) {
+	manifest, err := ReadManifest(installCtx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if manifest == nil {
+		return 0, nil, nil
+	}
+	installed, err := installedManifestEntries(installCtx)
+	if err != nil {
+		return 0, nil, err
+	}
+	checked, changed, err := changedFiles(installCtx, manifest, installed)
+	if err != nil {
+		return checked, nil, err
+	}
+	return checked, changed, removeBroken(installCtx, changed)
+}
+
+// Find the installed packages whose files differ from the hashes the manifest recorded for them. A package at
+// another version than recorded isn't compared. Returns how many packages were compared
+func changedFiles(installCtx *InstallContext, manifest *Manifest, installed map[string]ManifestEntry) (int, []RepairedPackage, error) {
+	checked := 0
+	var changed []RepairedPackage
+	for path, recorded := range manifest.Packages {
+		entry, ok := installed[path]
+		if !ok || recorded.Files == nil || entry.Name != recorded.Name || entry.Version != recorded.Version {
+			continue
+		}
+		checked++
+		files, err := hashPackageFiles(filepath.Join(installCtx.NodeModulesDir, filepath.FromSlash(path)))
+		if err != nil {
+			return checked, nil, err
+		}
+		if !maps.Equal(files, recorded.Files) {
+			changed = append(changed, RepairedPackage{Path: path, Name: entry.Name, Problem: "its files changed since it was installed"})
+		}
+	}
+	return checked, changed, nil
+}
+
+// Sort the broken packages by path and remove them from node_modules
+func removeBroken(installCtx *InstallContext, broken []RepairedPackage) error {
+	sort.Slice(broken, func(i, j int) bool { return broken[i].Path < broken[j].Path })
+	for _, pkg := range broken {
+		dir := filepath.Join(installCtx.NodeModulesDir, filepath.FromSlash(pkg.Path))
+		if err := os.RemoveAll(dir); err != nil {
+			return pkgmanager.Classify(pkgmanager.ErrFilesystem, fmt.Errorf("failed to remove %s: %v", dir, err))
+		}
+	}
+	return nil
+}
+
+// Add the package directories in nodeModulesDir, scoped and nested ones included, whose package.json is missing or
+// doesn't parse to broken. prefix is nodeModulesDir's path relative to the top level node_modules
+func findBrokenPackages(nodeModulesDir, prefix string, broken *[]RepairedPackage) error {
+	entries, err := os.ReadDir(nodeModulesDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", nodeModulesDir, err)
+	}
+
+	var packageNames []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !entry.IsDir() {
+			continue
+		}
+		if !strings.HasPrefix(name, "@") {
+			packageNames = append(packageNames, name)
+			continue
+		}
+		scopedEntries, err := os.ReadDir(filepath.Join(nodeModulesDir, name))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", filepath.Join(nodeModulesDir, name), err)
+		}
+		for _, scopedEntry := range scopedEntries {
+			if scopedEntry.IsDir() {
+				packageNames = append(packageNames, name+"/"+scopedEntry.Name())
+			}
+		}
+	}
+
+	for _, packageName := range packageNames {
+		packageDir := filepath.Join(nodeModulesDir, filepath.FromSlash(packageName))
+		path := prefix + packageName
+		content, err := os.ReadFile(filepath.Join(packageDir, "package.json"))
+		if err != nil {
+			*broken = append(*broken, RepairedPackage{Path: path, Name: packageName, Problem: "package.json is missing"})
+			continue
+		}
+		var packageJson map[string]interface{}
+		if err := json.Unmarshal(content, &packageJson); err != nil {
+			*broken = append(*broken, RepairedPackage{Path: path, Name: packageName, Problem: fmt.Sprintf("package.json is invalid: %v", err)})
+			continue
+		}
+		if err := findBrokenPackages(filepath.Join(packageDir, "node_modules"), path+"/node_modules/", broken); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check whether a repair has yet to walk the dependencies of the kept package at packagePath, a linked package's
+// dependencies aren't this install's to walk
+func (c *InstallContext) walkOnce(packagePath string) bool {
+	if info, err := os.Lstat(packagePath); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		return false
+	}
+	c.planMutex.Lock()
+	defer c.planMutex.Unlock()
+	if c.walked == nil {
+		c.walked = make(map[string]bool)
+	}
+	if c.walked[packagePath] {
+		return false
+	}
+	c.walked[packagePath] = true
+	return true
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ResolvedPackage is a package an install resolved and put on disk
+type ResolvedPackage struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Dev       bool   `json:"dev"`               // Only needed by devDependencies
+	Optional  bool   `json:"optional"`          // Only needed by optionalDependencies
+	Integrity string `json:"integrity"`         // The registry's dist.integrity, empty when it doesn't publish one
+	AliasOf   string `json:"aliasOf,omitempty"` // The real package when Name is an npm: alias
+}
+
+// InstallResult is what an install did, for callers embedding fpm that want more than the console output
+type InstallResult struct {
+	Packages []ResolvedPackage `json:"packages"`
+	Timings  []PackageTiming   `json:"timings,omitempty"` // Slowest first, only recorded with InstallContext.Timing
+	Engines  []EngineMismatch  `json:"engineMismatches,omitempty"`
+}
+
+// Record a package the install put on disk, a package reached from both dependency types isn't dev or optional
+func (c *InstallContext) addResolved(pkg ResolvedPackage) {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	if c.resolved == nil {
+		c.resolved = make(map[string]ResolvedPackage)
+	}
+	key := pkg.Name + "@" + pkg.Version
+	if existing, ok := c.resolved[key]; ok {
+		pkg.Dev = pkg.Dev && existing.Dev
+		pkg.Optional = pkg.Optional && existing.Optional
+	}
+	c.resolved[key] = pkg
+}
+
+// Clear the dev flag of a package that was installed for dev and is also reached from production dependencies
+func (c *InstallContext) markProduction(packageName string) {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	for key, pkg := range c.resolved {
+		if pkg.Name == packageName {
+			pkg.Dev = false
+			c.resolved[key] = pkg
+		}
+	}
+}
+
+// Clear the optional flag of a package that was installed as optional and is also a regular dependency
+func (c *InstallContext) markRequired(packageName string) {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	for key, pkg := range c.resolved {
+		if pkg.Name == packageName {
+			pkg.Optional = false
+			c.resolved[key] = pkg
+		}
+	}
+}
+
+// Look up the version of a package this install already put on disk
+func (c *InstallContext) resolvedVersion(packageName string) (string, bool) {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	for _, pkg := range c.resolved {
+		if pkg.Name == packageName {
+			return pkg.Version, true
+		}
+	}
+	return "", false
+}
+
+// Drop a package from the result after it was removed from disk again
+func (c *InstallContext) forgetResolved(packageName, version string) {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+	delete(c.resolved, packageName+"@"+version)
+}
+
+// Record a package the install deliberately didn't put on disk although it is in the dependency graph
+func (c *InstallContext) addSkipped(packageName string) {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	if c.skipped == nil {
+		c.skipped = make(map[string]bool)
+	}
+	c.skipped[packageName] = true
+}
+
+// Get the result of the install so far, packages are sorted by name and version
+func (c *InstallContext) Result() *InstallResult {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+
+	result := &InstallResult{Packages: make([]ResolvedPackage, 0, len(c.resolved))}
+	for _, pkg := range c.resolved {
+		result.Packages = append(result.Packages, pkg)
+	}
+	sort.Slice(result.Packages, func(i, j int) bool {
+		if result.Packages[i].Name != result.Packages[j].Name {
+			return result.Packages[i].Name < result.Packages[j].Name
+		}
+		return result.Packages[i].Version < result.Packages[j].Version
+	})
+	result.Timings = c.timingsSlowestFirst()
+	result.Engines = c.engineMismatchesSorted()
+	return result
+}
+
+// RemoveInstalled deletes the packages of result from node_modules, so an install that didn't finish doesn't leave
+// packages behind that look installed but miss dependencies. It returns the packages it removed
+func RemoveInstalled(installCtx *InstallContext, result *InstallResult) []ResolvedPackage {
+	var removed []ResolvedPackage
+	for _, pkg := range result.Packages {
+		if err := os.RemoveAll(filepath.Join(installCtx.NodeModulesDir, pkg.Name)); err != nil {
+			log.Printf("failed to remove %s: %v", pkg.Name, err)
+			continue
+		}
+		removed = append(removed, pkg)
+	}
+	return removed
+}
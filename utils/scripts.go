@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/iancoleman/orderedmap"
+)
+
+// The install lifecycle scripts in the order npm runs them
+var lifecycleScripts = []string{"preinstall", "install", "postinstall"}
+
+// Run the install lifecycle scripts of an installed package when RunScripts is set, otherwise warn about the
+// ones that were skipped. A script that exits non-zero fails the package with its output
+func runLifecycleScripts(installCtx *InstallContext, packageJsonPath, packageName, version string) error {
+	scripts, err := getLifecycleScripts(packageJsonPath)
+	if err != nil {
+		return err
+	}
+	if len(scripts) == 0 {
+		return nil
+	}
+
+	if !installCtx.RunScripts {
+		names := make([]string, 0, len(scripts))
+		for _, event := range lifecycleScripts {
+			if _, ok := scripts[event]; ok {
+				names = append(names, event)
+			}
+		}
+		installCtx.addWarning(fmt.Sprintf("fpm WARN skipped %s scripts of %s@%s, pass --run-scripts to run them", strings.Join(names, "/"), packageName, version))
+		return nil
+	}
+
+	shell := installCtx.ScriptShell
+	if shell == "" {
+		shell = "sh"
+	}
+
+	packageDir := filepath.Dir(packageJsonPath)
+	binDir, err := filepath.Abs(filepath.Join(installCtx.NodeModulesDir, ".bin"))
+	if err != nil {
+		return fmt.Errorf("failed to resolve bin directory: %v", err)
+	}
+
+	for _, event := range lifecycleScripts {
+		script, ok := scripts[event]
+		if !ok {
+			continue
+		}
+
+		cmd := exec.CommandContext(installCtx.Context, shell, "-c", script)
+		cmd.Dir = packageDir
+		cmd.Env = append(os.Environ(),
+			"PATH="+binDir+string(os.PathListSeparator)+os.Getenv("PATH"),
+			"npm_lifecycle_event="+event,
+			"npm_package_name="+packageName,
+			"npm_package_version="+version,
+		)
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s script failed (%s): %v\n%s", event, script, err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	return nil
+}
+
+// Read the install lifecycle scripts declared in the "scripts" field of a package.json
+func getLifecycleScripts(packageJsonPath string) (map[string]string, error) {
+	content, err := os.ReadFile(packageJsonPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package.json: %v", err)
+	}
+
+	var packageJson map[string]interface{}
+	if err := json.Unmarshal(content, &packageJson); err != nil {
+		return nil, fmt.Errorf("failed to parse package.json: %v", err)
+	}
+
+	scripts := make(map[string]string)
+	declared, _ := packageJson["scripts"].(map[string]interface{})
+	for _, event := range lifecycleScripts {
+		if script, ok := declared[event].(string); ok && script != "" {
+			scripts[event] = script
+		}
+	}
+
+	return scripts, nil
+}
+
+// Run a script from the "scripts" of the package.json in projectDir the way `npm run` does: its pre and post
+// scripts run around it, node_modules/.bin is on the PATH and stdio is the caller's. extraArgs are appended to
+// the command, quoted for the shell. A script exiting non-zero returns its *exec.ExitError
+func RunScript(ctx context.Context, projectDir, shell, name string, extraArgs []string) error {
+	packageJsonPath := filepath.Join(projectDir, "package.json")
+	packageJson, err := ParsePackageJson(packageJsonPath)
+	if err != nil {
+		return err
+	}
+	scripts, err := ParseScripts(packageJson)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := scripts.Get(name); !ok {
+		return fmt.Errorf("missing script: %s", name)
+	}
+	if shell == "" {
+		shell = "sh"
+	}
+
+	binDir, err := filepath.Abs(filepath.Join(projectDir, "node_modules", ".bin"))
+	if err != nil {
+		return fmt.Errorf("failed to resolve bin directory: %v", err)
+	}
+	packageName, _ := packageJson.Get("name")
+	packageVersion, _ := packageJson.Get("version")
+	packageNameStr, _ := packageName.(string)
+	packageVersionStr, _ := packageVersion.(string)
+
+	for _, event := range []string{"pre" + name, name, "post" + name} {
+		script, ok := scripts.Get(event)
+		if !ok {
+			continue
+		}
+		scriptStr := script.(string)
+		if event == name {
+			for _, arg := range extraArgs {
+				scriptStr += " " + shellQuote(arg)
+			}
+		}
+
+		fmt.Printf("> %s\n", scriptStr)
+		cmd := exec.CommandContext(ctx, shell, "-c", scriptStr)
+		cmd.Dir = projectDir
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(),
+			"PATH="+binDir+string(os.PathListSeparator)+os.Getenv("PATH"),
+			"npm_lifecycle_event="+event,
+			"npm_package_name="+packageNameStr,
+			"npm_package_version="+packageVersionStr,
+		)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s script failed: %w", event, err)
+		}
+	}
+
+	return nil
+}
+
+// Get the "scripts" of a package.json in the order they are declared, all of them must be strings
+func ParseScripts(packageJson *orderedmap.OrderedMap) (*orderedmap.OrderedMap, error) {
+	scripts := orderedmap.New()
+	if _, ok := packageJson.Get("scripts"); !ok {
+		return scripts, nil
+	}
+
+	declared, err := ParseDependencies(packageJson, "scripts")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range declared.Keys() {
+		script, _ := declared.Get(name)
+		scriptStr, ok := script.(string)
+		if !ok {
+			return nil, fmt.Errorf("script %s must be a string, got %T", name, script)
+		}
+		scripts.Set(name, scriptStr)
+	}
+	return scripts, nil
+}
+
+// Quote an argument so the shell passes it through as a single word
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
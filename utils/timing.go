@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"sort"
+	"time"
+)
+
+// PackageTiming is how long each phase of installing one package took, not counting its dependencies
+type PackageTiming struct {
+	Name     string        `json:"name"`
+	Version  string        `json:"version"`
+	Resolve  time.Duration `json:"resolve"`  // Fetching the metadata and picking a version
+	Download time.Duration `json:"download"` // Fetching and verifying the tarball, or copying it from the cache
+	Extract  time.Duration `json:"extract"`
+}
+
+// Total is the time spent on the package across all phases
+func (t PackageTiming) Total() time.Duration {
+	return t.Resolve + t.Download + t.Extract
+}
+
+// Record the phase timings of a package put on disk when the install asked for them
+func (c *InstallContext) addTiming(timing PackageTiming) {
+	if !c.Timing {
+		return
+	}
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+	c.timings = append(c.timings, timing)
+}
+
+// Get the recorded timings, slowest first
+func (c *InstallContext) timingsSlowestFirst() []PackageTiming {
+	timings := append([]PackageTiming(nil), c.timings...)
+	sort.SliceStable(timings, func(i, j int) bool {
+		if timings[i].Total() != timings[j].Total() {
+			return timings[i].Total() > timings[j].Total()
+		}
+		return timings[i].Name < timings[j].Name
+	})
+	return timings
+}
@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TreeNode is a package in the tree `npm ls --json` prints. Only the root has a name, everyone else is keyed
+// by name in its parent's dependencies
+type TreeNode struct {
+	Name         string               `json:"name,omitempty"`
+	Version      string               `json:"version,omitempty"`
+	Required     string               `json:"required,omitempty"`   // The range asked for, set when it is missing
+	Missing      bool                 `json:"missing,omitempty"`    // Nothing on disk resolves the dependency
+	Invalid      string               `json:"invalid,omitempty"`    // The range and dependent the version doesn't satisfy
+	Extraneous   bool                 `json:"extraneous,omitempty"` // In node_modules but nothing depends on it
+	Problems     []string             `json:"problems,omitempty"`
+	Dependencies map[string]*TreeNode `json:"dependencies,omitempty"`
+}
+
+// dependencyTree walks node_modules the way Node resolves require calls, memoizing each package directory so
+// shared subtrees are built once
+type dependencyTree struct {
+	root     *TreeNode
+	nodes    map[string]*TreeNode
+	building map[string]bool
+	seen     map[string]bool
+}
+
+// Build the installed dependency tree of package.json, and its workspaces, in the shape of `npm ls --json`.
+// Packages deeper than depth have their dependencies left out, a negative depth keeps the whole tree.
+// Missing, invalid and extraneous packages are reported on their node and in the root's problems
+func DependencyTree(installCtx *InstallContext, pathToJSON string, depth int) (*TreeNode, error) {
+	rootJson, err := readTreePackageJson(pathToJSON)
+	if err != nil {
+		return nil, err
+	}
+	packageJson, err := ParsePackageJson(pathToJSON)
+	if err != nil {
+		return nil, err
+	}
+	workspaces, err := FindWorkspaces(pathToJSON, packageJson)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeModulesDir, err := filepath.Abs(installCtx.NodeModulesDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", installCtx.NodeModulesDir, err)
+	}
+	tree := &dependencyTree{
+		root:     &TreeNode{Name: rootJson.Name, Version: rootJson.Version},
+		nodes:    make(map[string]*TreeNode),
+		building: make(map[string]bool),
+		seen:     make(map[string]bool),
+	}
+	chain := []string{nodeModulesDir}
+	tree.root.Dependencies = tree.dependencies(rootJson, true, "the root project", describe(rootJson), chain)
+
+	// Workspace members are linked into node_modules, their dependencies resolve from their own directory
+	for _, workspace := range workspaces {
+		memberJson, err := readTreePackageJson(workspace.PackageJsonPath)
+		if err != nil {
+			return nil, err
+		}
+		memberChain := append([]string{filepath.Join(filepath.Dir(workspace.PackageJsonPath), "node_modules")}, chain...)
+		node := &TreeNode{Version: memberJson.Version}
+		tree.seen[filepath.Join(nodeModulesDir, workspace.Name)] = true
+		node.Dependencies = tree.dependencies(memberJson, true, workspace.Name, describe(memberJson), memberChain)
+		if tree.root.Dependencies == nil {
+			tree.root.Dependencies = make(map[string]*TreeNode)
+		}
+		tree.root.Dependencies[workspace.Name] = node
+	}
+
+	// Whatever the walk didn't reach at the top level is extraneous
+	installed, err := ListInstalledPackages(installCtx)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range installed {
+		dir, err := filepath.Abs(pkg.Dir)
+		if err != nil || containingNodeModules(dir, pkg.Name) != nodeModulesDir || tree.seen[dir] {
+			continue
+		}
+		node := &TreeNode{Version: pkg.Version, Extraneous: true}
+		tree.problem(node, fmt.Sprintf("extraneous: %s@%s %s", pkg.Name, pkg.Version, dir))
+		if tree.root.Dependencies == nil {
+			tree.root.Dependencies = make(map[string]*TreeNode)
+		}
+		tree.root.Dependencies[pkg.Name] = node
+	}
+
+	// The root's own dependencies are depth 0
+	if depth >= 0 {
+		depth++
+	}
+	return trimTree(tree.root, depth), nil
+}
+
+// Resolve the dependencies a package.json declares against chain, the node_modules directories Node would
+// search, nearest first. from names the dependent in invalid messages and requiredBy in missing ones
+func (t *dependencyTree) dependencies(packageJson *treePackageJson, withDev bool, from, requiredBy string, chain []string) map[string]*TreeNode {
+	declared := []dependencyGroup{{packageJson.Dependencies, false}, {packageJson.OptionalDependencies, true}}
+	if withDev {
+		declared = append(declared, dependencyGroup{packageJson.DevDependencies, false})
+	}
+
+	var nodes map[string]*TreeNode
+	for _, group := range declared {
+		for _, name := range sortedDependencyNames(group.deps) {
+			if nodes[name] != nil {
+				continue // Listed twice, e.g. in dependencies and optionalDependencies
+			}
+			versionRange := group.deps[name]
+			node := t.resolve(name, versionRange, from, requiredBy, group.optional, chain)
+			if node == nil {
+				continue
+			}
+			if nodes == nil {
+				nodes = make(map[string]*TreeNode)
+			}
+			nodes[name] = node
+		}
+	}
+	return nodes
+}
+
+// dependencyGroup is one dependency type of a package.json, missing optional ones aren't problems
+type dependencyGroup struct {
+	deps     map[string]string
+	optional bool
+}
+
+// Find name in the nearest node_modules of chain and build its node, nil for a missing optional dependency
+func (t *dependencyTree) resolve(name, versionRange, from, requiredBy string, optional bool, chain []string) *TreeNode {
+	for i, nodeModulesDir := range chain {
+		dir := filepath.Join(nodeModulesDir, name)
+		packageJson, err := readTreePackageJson(filepath.Join(dir, "package.json"))
+		if err != nil {
+			continue
+		}
+		t.seen[dir] = true
+
+		node := t.node(dir, packageJson, append([]string{filepath.Join(dir, "node_modules")}, chain[i:]...))
+		if isSemverRange(versionRange) && !satisfies(packageJson.Version, versionRange) {
+			// The shared node must stay valid for dependents it does satisfy
+			invalid := *node
+			invalid.Invalid = fmt.Sprintf("%q from %s", versionRange, from)
+			invalid.Problems = nil
+			t.problem(&invalid, fmt.Sprintf("invalid: %s@%s %s", name, packageJson.Version, dir))
+			return &invalid
+		}
+		return node
+	}
+
+	if optional {
+		return nil
+	}
+	node := &TreeNode{Required: versionRange, Missing: true}
+	t.problem(node, fmt.Sprintf("missing: %s@%s, required by %s", name, versionRange, requiredBy))
+	return node
+}
+
+// Build, or reuse, the node of the package installed at dir. A package depending on itself through a cycle
+// gets a node without dependencies so the tree stays finite
+func (t *dependencyTree) node(dir string, packageJson *treePackageJson, chain []string) *TreeNode {
+	if node, ok := t.nodes[dir]; ok {
+		return node
+	}
+	if t.building[dir] {
+		return &TreeNode{Version: packageJson.Version}
+	}
+
+	t.building[dir] = true
+	node := &TreeNode{Version: packageJson.Version}
+	node.Dependencies = t.dependencies(packageJson, false, relativeToProject(dir, chain), describe(packageJson), chain)
+	delete(t.building, dir)
+	t.nodes[dir] = node
+	return node
+}
+
+// Record a problem on node and once in the root's list
+func (t *dependencyTree) problem(node *TreeNode, problem string) {
+	node.Problems = append(node.Problems, problem)
+	for _, existing := range t.root.Problems {
+		if existing == problem {
+			return
+		}
+	}
+	t.root.Problems = append(t.root.Problems, problem)
+}
+
+// Copy node with the dependencies below depth left out, shared nodes are copied per position
+func trimTree(node *TreeNode, depth int) *TreeNode {
+	trimmed := *node
+	if depth == 0 {
+		trimmed.Dependencies = nil
+		return &trimmed
+	}
+	if node.Dependencies != nil {
+		trimmed.Dependencies = make(map[string]*TreeNode, len(node.Dependencies))
+		for name, child := range node.Dependencies {
+			trimmed.Dependencies[name] = trimTree(child, depth-1)
+		}
+	}
+	return &trimmed
+}
+
+// The package's path from the project, like node_modules/foo/node_modules/bar, for invalid messages
+func relativeToProject(dir string, chain []string) string {
+	project := filepath.Dir(chain[len(chain)-1])
+	if rel, err := filepath.Rel(project, dir); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return dir
+}
+
+// name@version, or just the name when there is no version
+func describe(packageJson *treePackageJson) string {
+	if packageJson.Version == "" {
+		return packageJson.Name
+	}
+	return packageJson.Name + "@" + packageJson.Version
+}
+
+// treePackageJson is the part of a package.json the tree walk needs
+type treePackageJson struct {
+	Name                 string            `json:"name"`
+	Version              string            `json:"version"`
+	Dependencies         map[string]string `json:"dependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+	DevDependencies      map[string]string `json:"devDependencies"`
+}
+
+func readTreePackageJson(path string) (*treePackageJson, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	packageJson := &treePackageJson{}
+	if err := json.Unmarshal(content, packageJson); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return packageJson, nil
+}
@@ -2,64 +2,422 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/briandowns/spinner"
+	"github.com/Masterminds/semver/v3"
 	"github.com/dominikbraun/graph"
 	"github.com/iancoleman/orderedmap"
 	"github.com/jamesjellow/fpm/pkgmanager"
 )
 
-var (
-	NodeModulesDir     = "./node_modules"
-	installingPackages = make(map[string]bool)
-	installMutex       sync.Mutex
+const (
+	DefaultNodeModulesDir = "./node_modules"
+	DefaultConcurrency    = 8
+	DefaultMaxDepth       = 100
+
+	// Extracting 96 tarballs of 300 files each on an SSD was fastest with 2 to 4 at once and slower than
+	// sequential beyond 16, while downloads mostly wait on the network
+	DefaultDownloadConcurrency = 16
+	DefaultExtractConcurrency  = 4
 )
 
-// Runner for handlers to install a package
-func RunInstallPackage(packageName string, packageVersion string, depGraph *graph.Graph[string, string], forDevDependency bool) (string, error) {
-	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
-	s.Suffix = fmt.Sprintf(" Installing %s@%s", packageName, packageVersion)
-	s.Start()
-	defer s.Stop()
+var packageJsonLocks sync.Map // Absolute package.json path to the *sync.Mutex serializing its read-modify-write
+
+// InstallContext carries the per-invocation install settings so installs into different targets don't share state
+type InstallContext struct {
+	Context         context.Context   // Cancelling it stops the install and aborts in-flight requests
+	NodeModulesDir  string            // Where packages are extracted
+	Registry        string            // Base URL of the registry metadata is fetched from
+	ScopeRegistries map[string]string // Registries for scoped packages, keyed by "@scope"
+	Concurrency     int               // How many top-level packages install at once
+	Downloads       int               // How many tarballs download at once, FPM_DOWNLOAD_CONCURRENCY
+	Extractions     int               // How many tarballs extract at once, FPM_EXTRACT_CONCURRENCY
+	CacheDir        string            // Where verified tarballs are cached, empty disables the cache
+	Bail            bool              // Stop on the first failure instead of installing everything possible
+	MaxDepth        int               // How many levels of transitive dependencies are allowed before giving up
+	Observer        Observer          // Told about install events, e.g. to show progress
+	Overrides       map[string]string // Versions forced for a package name wherever it appears in the tree, from "overrides"
+	RunScripts      bool              // Run preinstall/install/postinstall scripts, off by default since they run arbitrary code
+	ScriptShell     string            // Shell lifecycle scripts run with, empty uses sh
+	Output          io.Writer         // Where progress messages are printed, stdout unless the output is JSON
+	PeerStrategy    PeerStrategy      // How missing and conflicting peerDependencies are handled
+	Pins            *LockPins         // Versions imported from a package-lock.json or yarn.lock, nil resolves every range
+	Timing          bool              // Record how long each package took to resolve, download and extract
+	EngineStrict    bool              // Fail packages whose engines.node the Node.js version doesn't satisfy instead of reporting them
+	IgnoreEngines   bool              // Don't check engines.node at all
+	NodeVersion     string            // The Node.js version engines are checked against, empty runs `node --version`
+	Layout          Layout            // Where dependencies are placed, hoisted at the top level unless nested
+	RecordFiles     bool              // Hash every installed file into the manifest so `fpm verify --files` can detect changes
+	SavePrefix      string            // Put before versions saved to package.json, "^" or "~", empty saves them exact
+	TempDir         string            // Where tarballs are downloaded and extracted before moving into node_modules, FPM_TMPDIR
+	Before          time.Time         // Only resolve to versions published before this, zero resolves among every version
+	Repair          bool              // Walk the dependencies of kept packages too, so the ones RepairInstall removed are put back
+	UpgradeSHA512   bool              // Fetch the metadata of every kept package whose manifest entry has no sha512 integrity to record it
+
+	Client *pkgmanager.Client // Fetches metadata and tarballs with the install's proxy, TLS and auth settings
+
+	reportMutex sync.Mutex
+	failures    []error                    // Transitive install failures that were logged and skipped
+	warnings    []string                   // Non fatal notices, e.g. deprecated packages, shown once the install finishes
+	resolved    map[string]ResolvedPackage // Every package this install put on disk, keyed by name@version
+	timings     []PackageTiming            // Phase timings of the packages put on disk, only recorded with Timing
+	skipped     map[string]bool            // Packages left out on purpose, e.g. for another platform
+	engines     []EngineMismatch           // Packages installed although the Node.js version is outside their engines.node
+	paths       map[string]string          // Lowercased package paths of this install to the path as installed
+
+	installMutex sync.Mutex
+	installing   map[string]*installFlight // Packages being installed, keyed by the directory they install into
+
+	planMutex sync.Mutex
+	versions  *pkgmanager.Resolver                // Resolves the versions of this install and keeps the metadata it fetched, created on first use
+	tree      *pkgmanager.ResolvedTree            // The tree BuildGraph planned, nil resolves each package as the install reaches it
+	plan      map[string]*pkgmanager.ResolvedNode // The version BuildGraph planned at the top level for each package name
+	extracted map[string]extractedPackage         // Packages ExtractInOrder put in place the install hasn't reached, by path
+	walked    map[string]bool                     // Paths of kept packages whose dependencies a repair already walked
+
+	slotsMutex    sync.Mutex
+	downloadSlots chan struct{} // Semaphores of the download and extract phases, sized on first use
+	extractSlots  chan struct{}
+	reservedSpace int64 // Bytes the extractions in progress are expected to unpack to
+}
+
+// Create an install context targeting the given node_modules directory with the default registry and concurrency
+func NewInstallContext(nodeModulesDir string) *InstallContext {
+	return &InstallContext{
+		Context:         context.Background(),
+		NodeModulesDir:  nodeModulesDir,
+		Registry:        pkgmanager.DefaultRegistry,
+		Client:          &pkgmanager.Client{},
+		ScopeRegistries: make(map[string]string),
+		Concurrency:     DefaultConcurrency,
+		Downloads:       concurrencyFromEnv("FPM_DOWNLOAD_CONCURRENCY", DefaultDownloadConcurrency),
+		Extractions:     concurrencyFromEnv("FPM_EXTRACT_CONCURRENCY", DefaultExtractConcurrency),
+		CacheDir:        pkgmanager.DefaultCacheDir(),
+		TempDir:         pkgmanager.DefaultTempDir(),
+		Bail:            true,
+		MaxDepth:        DefaultMaxDepth,
+		Observer:        NopObserver{},
+		Overrides:       make(map[string]string),
+		Output:          os.Stdout,
+		PeerStrategy:    PeerStrict,
+		Layout:          LayoutHoisted,
+	}
+}
+
+// Read a concurrency limit from the environment, an unset or invalid value keeps the default
+func concurrencyFromEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		log.Printf("ignoring %s=%s, expected a number of at least 1", name, value)
+		return fallback
+	}
+	return limit
+}
+
+// Wait for a slot of a phase semaphore, creating it with room for limit on first use. Returns the function
+// that frees the slot
+func (c *InstallContext) acquire(slots *chan struct{}, limit int) func() {
+	c.slotsMutex.Lock()
+	if *slots == nil {
+		*slots = make(chan struct{}, max(limit, 1))
+	}
+	semaphore := *slots
+	c.slotsMutex.Unlock()
+
+	semaphore <- struct{}{}
+	return func() { <-semaphore }
+}
+
+// Get the registry a package's metadata is fetched from, scoped packages can have their own
+func (c *InstallContext) RegistryFor(packageName string) string {
+	return c.resolver().RegistryFor(packageName)
+}
+
+// Get the resolver of the install, created the first time from the install's registries, cache, client, Before
+// cutoff and MaxDepth. Its dependencies resolve with the aliases, overrides and lockfile pins of effectiveSpec,
+// file: directories and kept copies are read from disk and packages for another platform bring no dependencies
+func (c *InstallContext) resolver() *pkgmanager.Resolver {
+	c.planMutex.Lock()
+	defer c.planMutex.Unlock()
+	if c.versions == nil {
+		c.versions = &pkgmanager.Resolver{
+			Context:         c.Context,
+			Registry:        c.Registry,
+			ScopeRegistries: c.ScopeRegistries,
+			CacheDir:        c.CacheDir,
+			Client:          c.Client,
+			Before:          c.Before,
+			MaxDepth:        c.MaxDepth,
+			Rewrite: func(name, versionRange string) (string, string) {
+				targetName, versionRange, _ := c.effectiveSpec(name, versionRange)
+				return targetName, versionRange
+			},
+			Local: c.resolveLocal,
+			Leaf: func(packageInfo *pkgmanager.PackageInfo) bool {
+				return unsupportedPlatform(packageInfo.OS, packageInfo.CPU) != ""
+			},
+		}
+	}
+	return c.versions
+}
+
+// Get the package a dependency installs and the range it installs it with. An alias installs another package
+// under its own name, everything on disk goes by the alias, and an override or an imported lockfile pin wins over
+// the range the dependent asked for. Also returns whether an override replaced the range
+func (c *InstallContext) effectiveSpec(packageName, packageVersion string) (string, string, bool) {
+	targetName := packageName
+	if target, versionRange, ok := ParseAlias(packageVersion); ok {
+		targetName, packageVersion = target, versionRange
+	}
+
+	if override, ok := c.Overrides[packageName]; ok && override != packageVersion {
+		return targetName, override, true
+	} else if pinned, ok := c.Pins.Version(packageName, packageVersion); ok {
+		packageVersion = pinned
+	}
+	return targetName, packageVersion, false
+}
+
+// Resolve a version of packageName from its registry with the install's resolver, which fetches the metadata once
+// per install
+func (c *InstallContext) fetchPackageInfo(packageName, versionRange string) (*pkgmanager.PackageInfo, error) {
+	return c.resolver().Resolve(packageName, versionRange)
+}
+
+// Record a failure that was logged and skipped so it can be reported once the install finishes
+func (c *InstallContext) addFailure(err error) {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+	c.failures = append(c.failures, err)
+}
 
+// Decide what a failure means for the install: with Bail, or once the install is cancelled, it is returned
+// so the install stops, otherwise it is logged and recorded for the end of install report and nil is returned
+func (c *InstallContext) HandleFailure(err error) error {
+	if c.Bail || c.Context.Err() != nil {
+		return err
+	}
+	log.Printf("\n  - Error installing %v", err)
+	c.addFailure(err)
+	return nil
+}
+
+// Record a warning to show once the install finishes
+func (c *InstallContext) addWarning(warning string) {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+	c.warnings = append(c.warnings, warning)
+}
+
+// Get the warnings recorded so far
+func (c *InstallContext) Warnings() []string {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+	return append([]string(nil), c.warnings...)
+}
+
+// Get the failures recorded so far, an install only succeeded if this is empty
+func (c *InstallContext) Failures() []error {
+	c.reportMutex.Lock()
+	defer c.reportMutex.Unlock()
+	return append([]error(nil), c.failures...)
+}
+
+// Runner for handlers to install a package
+func RunInstallPackage(installCtx *InstallContext, packageName string, packageVersion string, depGraph *graph.Graph[string, string], forDevDependency bool) (string, error) {
 	visited := make(map[string]bool)
-	actualVersion, err := installPackage(packageName, packageVersion, depGraph, visited)
+	actualVersion, err := installPackage(installCtx, installCtx.NodeModulesDir, packageName, packageVersion, depGraph, visited, 0, forDevDependency, false)
 	if err != nil {
 		return actualVersion, err
 	}
 
-	s.Stop()
-	fmt.Printf("✔ Installed %s@%s\n", packageName, actualVersion)
+	fmt.Fprintf(installCtx.Output, "✔ Installed %s@%s\n", packageName, actualVersion)
 
 	return actualVersion, nil
 }
 
 // Read a package.json file and returns its contents as an ordered map
 func ParsePackageJson(pathToJSON string) (*orderedmap.OrderedMap, error) {
-	file, err := os.Open(pathToJSON)
+	content, err := os.ReadFile(pathToJSON)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %v", err)
 	}
-	defer file.Close()
+
+	// Decode generically first, its errors carry the offset to point the user at the problem
+	var decoded interface{}
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		return nil, jsonError(pathToJSON, content, err)
+	}
+	if err := validatePackageJson(pathToJSON, decoded); err != nil {
+		return nil, err
+	}
 
 	result := orderedmap.New()
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(result); err != nil {
-		return nil, fmt.Errorf("failed to decode JSON: %v", err)
+	if err := result.UnmarshalJSON(content); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON in %s: %v", pathToJSON, err)
 	}
 
 	return result, nil
 }
 
+// Fields of package.json that must be objects when present
+var packageJsonObjectFields = []string{"dependencies", "devDependencies", "optionalDependencies", "peerDependencies", "overrides", "resolutions", "scripts"}
+
+// Check that package.json has the shape the rest of fpm expects, so mistakes surface as a clear error
+func validatePackageJson(pathToJSON string, decoded interface{}) error {
+	fields, ok := decoded.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: expected a JSON object, got %s", pathToJSON, jsonTypeName(decoded))
+	}
+
+	for _, field := range packageJsonObjectFields {
+		value, ok := fields[field]
+		if !ok || value == nil {
+			continue // null is read as an empty object
+		}
+		if _, ok := value.(map[string]interface{}); !ok {
+			return fmt.Errorf("%s: %q must be an object, got %s", pathToJSON, field, jsonTypeName(value))
+		}
+	}
+
+	for _, field := range []string{"name", "version"} {
+		value, ok := fields[field]
+		if !ok {
+			continue
+		}
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: %q must be a string, got %s", pathToJSON, field, jsonTypeName(value))
+		}
+	}
+
+	return nil
+}
+
+// Describe a decoded JSON value's type the way a user writing package.json thinks of it
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case float64:
+		return "a number"
+	case string:
+		return "a string"
+	case []interface{}:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// Turn a JSON decode error into one naming the file and, when the decoder knows the offset, the line and column
+func jsonError(pathToJSON string, content []byte, err error) error {
+	var offset int64 = -1
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	}
+	if offset < 0 {
+		return fmt.Errorf("failed to decode JSON in %s: %v", pathToJSON, err)
+	}
+
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	// The offset is just past the byte that failed, point at that byte
+	if offset > 0 {
+		offset--
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("failed to decode JSON in %s at line %d, column %d: %v", pathToJSON, line, column, err)
+}
+
+// Prefixes of specs that aren't registry versions, like aliases, local paths, git and tarball URLs
+var specialSpecPrefixes = []string{"npm:", "file:", "link:", "workspace:", "git+", "git:", "github:", "http://", "https://"}
+
+// Check a dependency's version spec before anything is fetched, so a typo is reported with the package it belongs
+// to. Specs that look like a range must parse as one, anything else URL safe is a dist-tag for the registry to resolve
+func ValidateVersionSpec(packageName, spec string) error {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "*" {
+		return nil
+	}
+	if strings.HasPrefix(spec, "npm:") {
+		target, versionRange, ok := ParseAlias(spec)
+		if !ok {
+			return fmt.Errorf("invalid alias %q for %s, expected npm:<package>@<version>", spec, packageName)
+		}
+		return ValidateVersionSpec(target, versionRange)
+	}
+	for _, prefix := range specialSpecPrefixes {
+		if strings.HasPrefix(spec, prefix) {
+			return nil
+		}
+	}
+
+	_, err := semver.NewConstraint(spec)
+	if err == nil {
+		return nil
+	}
+	looksLikeRange := strings.ContainsAny(spec[:1], "0123456789^~<>=")
+	if !looksLikeRange && isDistTag(spec) {
+		return nil
+	}
+	return fmt.Errorf("invalid version %q for %s, expected a semver range like ^1.2.0 or a dist-tag like latest: %v", spec, packageName, err)
+}
+
+// Format the version spec saved to package.json for a resolved version. prefix is "^" or "~" from save-prefix, empty
+// or exact saves the version as is, and so does a version that isn't semver
+func FormatVersionSpec(version, prefix string, exact bool) string {
+	if exact || prefix == "" {
+		return version
+	}
+	if _, err := semver.StrictNewVersion(version); err != nil {
+		return version
+	}
+	return prefix + version
+}
+
+// Whether spec can be a dist-tag, npm only allows tags that need no escaping in a URL
+func isDistTag(spec string) bool {
+	return spec != "" && url.PathEscape(spec) == spec && !strings.ContainsAny(spec, "/@:")
+}
+
+// Split an alias spec like npm:bar@^1.2.0 into the package it installs and its range, npm:bar alone means latest
+func ParseAlias(spec string) (string, string, bool) {
+	target, ok := strings.CutPrefix(strings.TrimSpace(spec), "npm:")
+	if !ok || target == "" || strings.HasPrefix(target, "@") && !strings.Contains(target, "/") {
+		return "", "", false
+	}
+	name, versionRange := ParsePackageArg(target)
+	if name == "" {
+		return "", "", false
+	}
+	return name, versionRange, true
+}
+
 // Parse a package argument and returns the name of the package and its version example: react@latest
 func ParsePackageArg(arg string) (string, string) {
 	if strings.HasPrefix(arg, "@") {
@@ -77,85 +435,201 @@ func ParsePackageArg(arg string) (string, string) {
 	return arg, "latest"
 }
 
-// Logic for installing a package and keeping track of known deps in a graph.
-func installPackage(packageName string, packageVersion string, depGraph *graph.Graph[string, string], visited map[string]bool) (string, error) {
-	installMutex.Lock()
-	if installingPackages[packageName] {
-		installMutex.Unlock()
-		return packageVersion, nil // Already being installed, avoid cycles
+// installFlight is a package install in progress, resolved is closed once the version it installs is decided or
+// the install failed before that
+type installFlight struct {
+	resolved chan struct{}
+	once     sync.Once
+	version  string
+	err      error
+}
+
+// Publish the version the install decided on, later calls are ignored
+func (f *installFlight) resolve(version string, err error) {
+	f.once.Do(func() {
+		f.version, f.err = version, err
+		close(f.resolved)
+	})
+}
+
+// Logic for installing a package into nodeModulesDir and keeping track of known deps in a graph.
+func installPackage(installCtx *InstallContext, nodeModulesDir, packageName string, packageVersion string, depGraph *graph.Graph[string, string], visited map[string]bool, depth int, dev, optional bool) (version string, err error) {
+	// Stop descending once the install is cancelled
+	if err := installCtx.Context.Err(); err != nil {
+		return "", err
+	}
+
+	// Bound the recursion so pathological metadata fails clearly instead of exhausting resources
+	if depth > installCtx.MaxDepth {
+		return "", fmt.Errorf("dependency tree deeper than the max depth of %d at %s", installCtx.MaxDepth, packageName)
+	}
+
+	requestedVersion := packageVersion
+	targetName, effectiveVersion, overridden := installCtx.effectiveSpec(packageName, packageVersion)
+	if overridden {
+		log.Printf("override: installing %s@%s instead of %s", packageName, effectiveVersion, packageVersion)
+	}
+	packageVersion = effectiveVersion
+
+	// A production dependency reaching a package installed for dev means it isn't dev only, likewise for optional
+	if !dev {
+		installCtx.markProduction(packageName)
+	}
+	if !optional {
+		installCtx.markRequired(packageName)
+	}
+
+	// A nested dependency on a package it is already inside of resolves to that ancestor
+	if installCtx.Layout == LayoutNested {
+		if ancestorDir, ok := nestedAncestor(installCtx.NodeModulesDir, nodeModulesDir, packageName); ok {
+			return installedVersion(ancestorDir), nil
+		}
+	}
+
+	// Key by target directory so the same package can install into different node_modules at once
+	installKey := filepath.Join(nodeModulesDir, packageName)
+
+	installCtx.installMutex.Lock()
+	if flight, ok := installCtx.installing[installKey]; ok {
+		installCtx.installMutex.Unlock()
+		// Already being installed, wait for the version it picked rather than echo the range back. That version
+		// is decided before the install descends into its dependencies, so a cycle can't wait on itself
+		select {
+		case <-flight.resolved:
+		case <-installCtx.Context.Done():
+			return "", installCtx.Context.Err()
+		}
+		return flight.version, flight.err
 	}
-	installingPackages[packageName] = true
-	installMutex.Unlock()
+	flight := &installFlight{resolved: make(chan struct{})}
+	if installCtx.installing == nil {
+		installCtx.installing = make(map[string]*installFlight)
+	}
+	installCtx.installing[installKey] = flight
+	installCtx.installMutex.Unlock()
 
 	// Remember to cleanup after done installing
 	defer func() {
-		installMutex.Lock()
-		delete(installingPackages, packageName)
-		installMutex.Unlock()
+		flight.resolve(version, err)
+		installCtx.installMutex.Lock()
+		delete(installCtx.installing, installKey)
+		installCtx.installMutex.Unlock()
 	}()
 
-	if visited[packageName] {
-		return packageVersion, nil // Already visited, avoid cycles
+	if visited[installKey] {
+		// Already installed by this run, avoid cycles
+		if installed, ok := installCtx.resolvedVersion(packageName); ok {
+			return installed, nil
+		}
+		return packageVersion, nil
 	}
-	visited[packageName] = true
+	visited[installKey] = true
 
 	// Check if the package is installed, if so add a vertex to the dep graph
-	packagePath := filepath.Join(NodeModulesDir, packageName)
+	packagePath := filepath.Join(nodeModulesDir, packageName)
 	if strings.HasPrefix(packageName, "@") {
 		parts := strings.SplitN(packageName, "/", 2)
 		if len(parts) == 2 {
-			packagePath = filepath.Join(NodeModulesDir, parts[0], parts[1])
+			packagePath = filepath.Join(nodeModulesDir, parts[0], parts[1])
 		}
 	}
-	_, err := os.Stat(packagePath)
-	if err == nil {
+	if err := pkgmanager.CheckDir(packagePath); err != nil {
+		return "", err
+	}
+	if err := installCtx.claimPath(packageName, packagePath); err != nil {
+		return "", installCtx.fail(packageName, err)
+	}
+	if localDir, ok := strings.CutPrefix(packageVersion, "file:"); ok {
+		return installLocal(installCtx, nodeModulesDir, packageName, localDir, packagePath, depGraph, visited, depth, dev, optional)
+	}
+	installed, keep, err := keepInstalled(installCtx, packageName, packageVersion, packagePath)
+	if err != nil {
+		return "", installCtx.fail(packageName, err)
+	}
+	if keep {
 		if err := (*depGraph).AddVertex(packageName); err != nil && err != graph.ErrVertexAlreadyExists {
 			return "", fmt.Errorf("failed to add vertex: %v", err)
 		}
-		return packageVersion, nil
+		// A repair goes on below the copy an earlier install left, the dependencies it removed may be down there
+		if installCtx.Repair && installCtx.walkOnce(packagePath) {
+			packageJsonPath := filepath.Join(packagePath, "package.json")
+			if err := processPackageJson(installCtx, installCtx.dependenciesDir(nodeModulesDir, packagePath), packageJsonPath, packageName, depGraph, visited, depth, dev, optional); err != nil {
+				return "", err
+			}
+		}
+		return installed, nil
 	}
 
-	// Get the package info from the registry
-	packageInfo, err := pkgmanager.FetchPackageInfo(packageName, packageVersion)
+	// Get the package info of the planned version from the registry, a dependency the plan doesn't have, like one
+	// of a package.json nested in a package, is resolved here
+	timing := PackageTiming{Name: packageName}
+	phaseStart := time.Now()
+	resolveName, resolveVersion := targetName, packageVersion
+	if node, ok := installCtx.planned(packageName, requestedVersion); ok {
+		resolveName, resolveVersion = node.Name, node.Version
+		if node.AliasOf != "" {
+			resolveName = node.AliasOf
+		}
+	}
+	packageInfo, err := installCtx.fetchPackageInfo(resolveName, resolveVersion)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch package info: %v", err)
+		return "", installCtx.fail(packageName, fmt.Errorf("failed to fetch package info: %w", err))
 	}
 	actualVersion := packageInfo.Version
-
-	// Download
-	tarballURL := packageInfo.Dist["tarball"].(string)
-	expectedShasum := packageInfo.Dist["shasum"].(string)
-	tarballPath, err := pkgmanager.DownloadPackage(tarballURL, expectedShasum, NodeModulesDir)
-	if err != nil {
-		return "", fmt.Errorf("failed to download package: %v", err)
+	timing.Version, timing.Resolve = actualVersion, time.Since(phaseStart)
+	// A package put in place in dependency order was reported as resolved then
+	extracted, ok := installCtx.takeExtracted(packagePath)
+	if !ok {
+		installCtx.Observer.OnResolve(packageName, packageVersion, actualVersion)
+	}
+	if packageInfo.Deprecated != "" {
+		installCtx.addWarning(fmt.Sprintf("npm WARN deprecated %s@%s: %s", packageName, actualVersion, packageInfo.Deprecated))
 	}
 
-	// Extract
-	extractDir := NodeModulesDir
-	if strings.HasPrefix(packageName, "@") {
-		parts := strings.SplitN(packageName, "/", 2)
-		if len(parts) == 2 {
-			extractDir = filepath.Join(NodeModulesDir, parts[0])
+	// Platform specific packages are skipped where they can't run, that is expected for optional ones
+	if reason := unsupportedPlatform(packageInfo.OS, packageInfo.CPU); reason != "" {
+		installCtx.addSkipped(packageName)
+		if optional {
+			log.Printf("skipping optional %s@%s, %s", packageName, actualVersion, reason)
+		} else {
+			installCtx.addWarning(fmt.Sprintf("fpm WARN skipped %s@%s, %s", packageName, actualVersion, reason))
 		}
+		return actualVersion, nil
 	}
-	if err := pkgmanager.ExtractTarball(tarballPath, extractDir, packageName); err != nil {
-		return "", fmt.Errorf("failed to extract package: %v", err)
+	if err := installCtx.checkEngines(packageName, actualVersion, packageInfo.Engines); err != nil {
+		return "", installCtx.fail(packageName, err)
 	}
+	flight.resolve(actualVersion, nil)
+
+	// Download and extract, unless the install already put the planned version in its place in dependency order
+	if ok {
+		timing.Download, timing.Extract = extracted.download, extracted.extract
+	} else if timing.Download, timing.Extract, err = fetchIntoPlace(installCtx, packageInfo, packageName, packagePath); err != nil {
+		return "", installCtx.fail(packageName, err)
+	}
+	installCtx.addTiming(timing)
 
 	// Add to dep graph
 	if err := (*depGraph).AddVertex(packageName); err != nil && err != graph.ErrVertexAlreadyExists {
 		return "", fmt.Errorf("failed to add vertex: %v", err)
 	}
+	resolved := ResolvedPackage{Name: packageName, Version: actualVersion, Dev: dev, Optional: optional, Integrity: packageInfo.Integrity}
+	if targetName != packageName {
+		resolved.AliasOf = targetName
+	}
+	installCtx.addResolved(resolved)
+	installCtx.Observer.OnInstalled(packageName, actualVersion)
 
 	// Find the first package JSON
-	packageJsonPath, err := findPackageJson(packageName)
+	packageJsonPath, err := findPackageJson(nodeModulesDir, packageName)
 	if err != nil {
 		log.Printf("Warning: %v, skipping dependency installation", err)
 		return actualVersion, nil
 	}
 
 	// Process the main package.json
-	if err := processPackageJson(packageJsonPath, packageName, depGraph, visited); err != nil {
+	dependenciesDir := installCtx.dependenciesDir(nodeModulesDir, packagePath)
+	if err := processPackageJson(installCtx, dependenciesDir, packageJsonPath, packageName, depGraph, visited, depth, dev, optional); err != nil {
 		return "", err
 	}
 
@@ -166,17 +640,128 @@ func installPackage(packageName string, packageVersion string, depGraph *graph.G
 		log.Printf("Warning: Error finding additional package.json files: %v", err)
 	} else {
 		for _, additionalPath := range additionalPackageJsons {
-			if err := processPackageJson(additionalPath, packageName, depGraph, visited); err != nil {
-				log.Printf("Warning: Error processing additional package.json at %s: %v", additionalPath, err)
+			if err := processPackageJson(installCtx, dependenciesDir, additionalPath, packageName, depGraph, visited, depth, dev, optional); err != nil {
+				if err := installCtx.HandleFailure(fmt.Errorf("%s: %w", additionalPath, err)); err != nil {
+					return "", err
+				}
 			}
 		}
 	}
 
+	// Lifecycle scripts run once the dependencies they may need are in place
+	if err := runLifecycleScripts(installCtx, packageJsonPath, packageName, actualVersion); err != nil {
+		return "", installCtx.fail(packageName, err)
+	}
+
 	return actualVersion, nil
 }
 
+// Download the tarball of packageInfo and extract it to packagePath. Downloading waits for one of the install's
+// download slots and extracting for one of its extraction slots, returns how long each took without the wait
+func fetchIntoPlace(installCtx *InstallContext, packageInfo *pkgmanager.PackageInfo, packageName, packagePath string) (time.Duration, time.Duration, error) {
+	if err := packageInfo.CheckDist(); err != nil {
+		return 0, 0, err
+	}
+	if installCtx.TempDir != "" {
+		if err := pkgmanager.EnsureDir(installCtx.TempDir); err != nil {
+			return 0, 0, err
+		}
+	}
+	progress := func(done, total int64) { installCtx.Observer.OnDownloadProgress(packageName, done, total) }
+	release := installCtx.acquire(&installCtx.downloadSlots, installCtx.Downloads)
+	phaseStart := time.Now()
+	tarballPath, err := installCtx.Client.DownloadPackage(installCtx.Context, packageInfo.Tarball, packageInfo.Shasum, packageInfo.Integrity, installCtx.TempDir, installCtx.CacheDir, progress)
+	release()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to download package: %w", err)
+	}
+	download := time.Since(phaseStart)
+
+	// Extract into a staging directory and move the package into place, so a partial package never shows up in
+	// node_modules. A scoped name already includes its scope directory
+	release = installCtx.acquire(&installCtx.extractSlots, installCtx.Extractions)
+	unreserve, err := installCtx.reserveSpace(packageName, packageInfo.Version, packageInfo.UnpackedSize)
+	if err != nil {
+		release()
+		os.Remove(tarballPath)
+		return download, 0, err
+	}
+	phaseStart = time.Now()
+	err = extractIntoPlace(installCtx, tarballPath, packageName, packagePath)
+	unreserve()
+	release()
+	if err != nil {
+		return download, 0, fmt.Errorf("failed to extract package: %w", err)
+	}
+	return download, time.Since(phaseStart), nil
+}
+
+// Extract the tarball into a staging directory in the install's TempDir and move the package to packagePath.
+// The staging directory is removed whether or not that worked
+func extractIntoPlace(installCtx *InstallContext, tarballPath, packageName, packagePath string) error {
+	stagingDir, err := os.MkdirTemp(installCtx.TempDir, "fpm-extract-*")
+	if err != nil {
+		os.Remove(tarballPath)
+		return pkgmanager.Classify(pkgmanager.ErrFilesystem, fmt.Errorf("failed to create a staging directory: %v", err))
+	}
+	defer func() {
+		if err := os.RemoveAll(stagingDir); err != nil {
+			log.Printf("failed to remove staging directory %s: %v", stagingDir, err)
+		}
+	}()
+
+	if err := pkgmanager.ExtractTarball(installCtx.Context, tarballPath, stagingDir, packageName); err != nil {
+		return err
+	}
+	if err := pkgmanager.EnsureDir(filepath.Dir(packagePath)); err != nil {
+		return err
+	}
+	return pkgmanager.MoveDir(filepath.Join(stagingDir, packageName), packagePath)
+}
+
+// Decide whether the copy of a package already in node_modules stays. A copy this install put there, as the first
+// of conflicting ranges did, and a linked workspace member always stay. A copy left by an earlier install stays
+// when its version satisfies versionRange, or when versionRange is a dist-tag that can't be checked offline,
+// otherwise it is removed so the right version is installed in its place. Returns the version that stays
+func keepInstalled(installCtx *InstallContext, packageName, versionRange, packagePath string) (string, bool, error) {
+	info, err := os.Lstat(packagePath)
+	if err != nil {
+		return "", false, nil
+	}
+	installed := installedVersion(packagePath)
+	if info.Mode()&os.ModeSymlink != 0 {
+		return installed, true, nil
+	}
+	// Only the top level is shared, a nested path is only ever installed once
+	if version, ok := installCtx.resolvedVersion(packageName); ok && installCtx.Layout != LayoutNested {
+		return version, true, nil
+	}
+	// Put there ahead of its dependents, the install reaching it only records it
+	if installCtx.isExtracted(packagePath) {
+		return "", false, nil
+	}
+
+	if strings.TrimSpace(versionRange) == "" {
+		versionRange = "*"
+	}
+	if installed != "" && (!isSemverRange(versionRange) || satisfies(installed, versionRange)) {
+		return installed, true, nil
+	}
+
+	log.Printf("replacing %s@%s, it doesn't satisfy %s", packageName, installed, versionRange)
+	if err := os.RemoveAll(packagePath); err != nil {
+		return "", false, pkgmanager.Classify(pkgmanager.ErrFilesystem, fmt.Errorf("failed to remove %s: %v", packagePath, err))
+	}
+	return "", false, nil
+}
+
 // As the name implies, get all the deps from the package.json file and return a map of them
 func getDependenciesFromPackageJson(packageJsonPath string) (map[string]string, error) {
+	return readDependencies(packageJsonPath, "dependencies")
+}
+
+// Get the deps of one dependency type, like "optionalDependencies", from a package.json file
+func readDependencies(packageJsonPath, depType string) (map[string]string, error) {
 	content, err := os.ReadFile(packageJsonPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read package.json: %v", err)
@@ -187,22 +772,38 @@ func getDependenciesFromPackageJson(packageJsonPath string) (map[string]string,
 		return nil, fmt.Errorf("failed to parse package.json: %v", err)
 	}
 
+	// Like the registry metadata, a range that isn't a string is dropped instead of failing the dependent
 	dependencies := make(map[string]string)
-	if deps, ok := packageJson["dependencies"].(map[string]interface{}); ok {
+	if deps, ok := packageJson[depType].(map[string]interface{}); ok {
 		for name, version := range deps {
-			dependencies[name] = version.(string)
+			versionRange, ok := version.(string)
+			if !ok {
+				log.Printf("ignoring %s %s in %s, its version is %s instead of a string", depType, name, packageJsonPath, jsonTypeName(version))
+				continue
+			}
+			dependencies[name] = versionRange
 		}
 	}
 
 	return dependencies, nil
 }
 
-// Find the package json for the given package name and return the path to its package json file
-func findPackageJson(packageName string) (string, error) {
+// Get the dependency names in sorted order, maps have no stable iteration order
+func sortedDependencyNames(dependencies map[string]string) []string {
+	names := make([]string, 0, len(dependencies))
+	for name := range dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Find the package json for the given package name in nodeModulesDir and return the path to its package json file
+func findPackageJson(nodeModulesDir, packageName string) (string, error) {
 	possiblePaths := []string{
-		filepath.Join(NodeModulesDir, packageName, "package.json"),
-		filepath.Join(NodeModulesDir, strings.Replace(packageName, "/", "/@", 1), "package.json"),
-		filepath.Join(NodeModulesDir, strings.Replace(packageName, "/", "/@", 1), packageName, "package.json"),
+		filepath.Join(nodeModulesDir, packageName, "package.json"),
+		filepath.Join(nodeModulesDir, strings.Replace(packageName, "/", "/@", 1), "package.json"),
+		filepath.Join(nodeModulesDir, strings.Replace(packageName, "/", "/@", 1), packageName, "package.json"),
 	}
 
 	for _, path := range possiblePaths {
@@ -211,35 +812,41 @@ func findPackageJson(packageName string) (string, error) {
 		}
 	}
 
-	// If not found in predefined paths, do a recursive search
+	// If not found in predefined paths, search the package's own directory, never the whole node_modules
 	var packageJsonPath string
-	err := filepath.Walk(NodeModulesDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	for _, dir := range []string{filepath.Dir(possiblePaths[0]), filepath.Dir(possiblePaths[1])} {
+		if _, err := os.Stat(dir); err != nil {
+			continue
 		}
-		if info.Name() == "package.json" && strings.Contains(path, packageName) {
-			packageJsonPath = path
-			return filepath.SkipDir
+		err := walkPackageDir(dir, func(path string) error {
+			if filepath.Base(path) == "package.json" {
+				packageJsonPath = path
+				return errStopWalk
+			}
+			return nil
+		})
+		if err != nil && err != errStopWalk {
+			return "", err
+		}
+		if packageJsonPath != "" {
+			return packageJsonPath, nil
 		}
-		return nil
-	})
-
-	if err != nil {
-		return "", err
-	}
-	if packageJsonPath == "" {
-		return "", fmt.Errorf("package.json not found for %s", packageName)
 	}
-	return packageJsonPath, nil
+	return "", fmt.Errorf("package.json not found for %s", packageName)
 }
 
-// Write to the packageJson with the new dependencies that you are adding
-func UpdatePackageJson(pathToJSON string, newDependencies map[string]string, forDev bool) error {
+// Write to the packageJson with the new dependencies that you are adding. Concurrent updates of the same file are
+// serialized so none of them is lost, and the file is replaced atomically so it is never left truncated.
+// bundle also lists the new dependencies in bundledDependencies so they are packed along at publish time
+func UpdatePackageJson(pathToJSON string, newDependencies map[string]string, forDev, bundle bool) error {
 	dependencyKey := "dependencies"
 	if forDev {
 		dependencyKey = "devDependencies"
 	}
 
+	unlock := lockPackageJson(pathToJSON)
+	defer unlock()
+
 	packageJson, err := ParsePackageJson(pathToJSON)
 	if err != nil {
 		return err
@@ -263,6 +870,11 @@ func UpdatePackageJson(pathToJSON string, newDependencies map[string]string, for
 	}
 
 	packageJson.Set(dependencyKey, sortedDeps)
+	if bundle {
+		if err := addBundledDependencies(packageJson, newDependencies); err != nil {
+			return err
+		}
+	}
 
 	var buffer bytes.Buffer
 	encoder := json.NewEncoder(&buffer)
@@ -275,18 +887,98 @@ func UpdatePackageJson(pathToJSON string, newDependencies map[string]string, for
 
 	data := bytes.ReplaceAll(buffer.Bytes(), []byte("\\u0026"), []byte("&"))
 
-	err = os.WriteFile(pathToJSON, data, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write package.json: %v", err)
+	if err := writeFileAtomic(pathToJSON, data); err != nil {
+		return pkgmanager.Classify(pkgmanager.ErrFilesystem, fmt.Errorf("failed to write package.json: %v", err))
+	}
+
+	return nil
+}
+
+// Add the names of deps to the bundled list of packageJson, sorted and without duplicates. The list is created
+// as bundledDependencies unless the file spells it bundleDependencies, true already bundles everything
+func addBundledDependencies(packageJson *orderedmap.OrderedMap, deps map[string]string) error {
+	key := "bundledDependencies"
+	if _, ok := packageJson.Get(key); !ok {
+		if _, ok := packageJson.Get("bundleDependencies"); ok {
+			key = "bundleDependencies"
+		}
+	}
+
+	names := make(map[string]bool)
+	switch existing, _ := packageJson.Get(key); existing := existing.(type) {
+	case nil:
+	case bool:
+		if existing {
+			return nil
+		}
+	case []interface{}:
+		for _, name := range existing {
+			nameStr, ok := name.(string)
+			if !ok {
+				return fmt.Errorf("failed to parse %s: expected package names, got %v", key, name)
+			}
+			names[nameStr] = true
+		}
+	default:
+		return fmt.Errorf("failed to parse %s: expected an array of package names", key)
+	}
+	for name := range deps {
+		names[name] = true
 	}
 
+	bundled := make([]string, 0, len(names))
+	for name := range names {
+		bundled = append(bundled, name)
+	}
+	sort.Strings(bundled)
+	packageJson.Set(key, bundled)
 	return nil
 }
 
+// Take the lock of a package.json for a read-modify-write, call the returned func to release it
+func lockPackageJson(pathToJSON string) func() {
+	key, err := filepath.Abs(pathToJSON)
+	if err != nil {
+		key = pathToJSON
+	}
+	lock, _ := packageJsonLocks.LoadOrStore(key, &sync.Mutex{})
+	mutex := lock.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// Replace a file by writing a temp file next to it and renaming it over, keeping the original permissions
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 // Get the (dependency, version) returned as an ordered map
 func ParseDependencies(packageJson *orderedmap.OrderedMap, dependencyType string) (*orderedmap.OrderedMap, error) {
 	deps, ok := packageJson.Get(dependencyType)
-	if !ok {
+	if !ok || deps == nil {
+		// A missing or null dependency type is an empty one
 		deps = orderedmap.New()
 		packageJson.Set(dependencyType, deps)
 	}
@@ -299,27 +991,41 @@ func ParseDependencies(packageJson *orderedmap.OrderedMap, dependencyType string
 	case *orderedmap.OrderedMap:
 		depsMap = v
 	default:
-		return nil, fmt.Errorf("unexpected type for dependencies: %T", v)
+		return nil, fmt.Errorf("%q in package.json must be an object mapping package names to versions, like {\"react\": \"^18.2.0\"}, got %s", dependencyType, jsonTypeName(v))
 	}
 
 	return depsMap, nil
 }
 
 // Try to recursively process all the dependencies in the package.json file and add them to the graph
-func processPackageJson(packageJsonPath, packageName string, depGraph *graph.Graph[string, string], visited map[string]bool) error {
+func processPackageJson(installCtx *InstallContext, nodeModulesDir, packageJsonPath, packageName string, depGraph *graph.Graph[string, string], visited map[string]bool, depth int, dev, optional bool) error {
 	dependencies, err := getDependenciesFromPackageJson(packageJsonPath)
 	if err != nil {
 		return err
 	}
+	optionalDependencies, err := readDependencies(packageJsonPath, "optionalDependencies")
+	if err != nil {
+		return err
+	}
+	// Like npm an optional dependency wins over a regular one of the same name
+	for name, version := range optionalDependencies {
+		dependencies[name] = version
+	}
 
-	for depName, depVersion := range dependencies {
+	// Iterate in sorted order so logs and the graph are the same on every run
+	for _, depName := range sortedDependencyNames(dependencies) {
+		depVersion := dependencies[depName]
 		if err := (*depGraph).AddVertex(depName); err != nil && err != graph.ErrVertexAlreadyExists {
 			log.Printf("Warning: failed to add vertex for %s: %v", depName, err)
 			continue
 		}
 
 		err := (*depGraph).AddEdge(packageName, depName)
-		if err != nil {
+		// A nested layout installs a copy for every dependent, even when the graph already knows the edge, and
+		// so does a planned install since BuildGraph added the edges it follows
+		known := err == graph.ErrEdgeAlreadyExists || (err != nil && strings.Contains(err.Error(), "cycle"))
+		planned := err == graph.ErrEdgeAlreadyExists && installCtx.tree != nil
+		if err != nil && !planned && !(known && installCtx.Layout == LayoutNested) {
 			if err == graph.ErrEdgeAlreadyExists {
 				// Edge already exists, this is fine, continue
 				continue
@@ -333,9 +1039,12 @@ func processPackageJson(packageJsonPath, packageName string, depGraph *graph.Gra
 			continue
 		}
 
-		if _, err := installPackage(depName, depVersion, depGraph, visited); err != nil {
-			// Log the error but continue with other dependencies
-			log.Printf("\n  - Error installing dependency %s: %v", depName, err)
+		// Everything an optional dependency pulls in is optional too
+		_, isOptional := optionalDependencies[depName]
+		if _, err := installPackage(installCtx, nodeModulesDir, depName, depVersion, depGraph, visited, depth+1, dev, optional || isOptional); err != nil {
+			if err := installCtx.HandleFailure(fmt.Errorf("%s@%s: %w", depName, depVersion, err)); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -345,14 +1054,70 @@ func processPackageJson(packageJsonPath, packageName string, depGraph *graph.Gra
 // See if there's any more package jsons in the current directory. Ifso, return them. Otherwise, return an empty array and no error.
 func findAdditionalPackageJsons(dir string) ([]string, error) {
 	var paths []string
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.Name() == "package.json" && path != filepath.Join(dir, "package.json") {
+	err := walkPackageDir(dir, func(path string) error {
+		if filepath.Base(path) == "package.json" && path != filepath.Join(dir, "package.json") {
 			paths = append(paths, path)
 		}
 		return nil
 	})
 	return paths, err
 }
+
+// errStopWalk ends a walkPackageDir early without failing it
+var errStopWalk = errors.New("stop walking")
+
+// Call fn for every file of the package in dir, depth first in lexical order. Nested node_modules hold other
+// packages and are skipped. Symlinked directories are followed only when they resolve inside the package, and
+// each real directory is visited once so a link back up the tree can't loop
+func walkPackageDir(dir string, fn func(path string) error) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	visited := make(map[string]bool)
+
+	var walk func(dir, realDir string) error
+	walk = func(dir, realDir string) error {
+		if visited[realDir] {
+			return nil
+		}
+		visited[realDir] = true
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.Name() == "node_modules" {
+				continue
+			}
+			if entry.Type()&os.ModeSymlink != 0 {
+				realPath, err := filepath.EvalSymlinks(path)
+				if err != nil || !isInside(realPath, root) {
+					continue // Dangling, or pointing out of the package
+				}
+				info, err := os.Stat(realPath)
+				if err != nil {
+					continue
+				}
+				if info.IsDir() {
+					if err := walk(path, realPath); err != nil {
+						return err
+					}
+					continue
+				}
+			} else if entry.IsDir() {
+				if err := walk(path, filepath.Join(realDir, entry.Name())); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fn(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(dir, root)
+}
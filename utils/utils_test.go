@@ -0,0 +1,2280 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dominikbraun/graph"
+	"github.com/jamesjellow/fpm/internal/fpmtest"
+	"github.com/jamesjellow/fpm/pkgmanager"
+)
+
+// Create an install context for a temporary node_modules that installs from the given registry without a cache
+func newTestInstallContext(t *testing.T, registry *httptest.Server) *InstallContext {
+	installCtx := NewInstallContext(filepath.Join(t.TempDir(), "node_modules"))
+	installCtx.Registry = registry.URL
+	installCtx.CacheDir = ""
+	if err := os.MkdirAll(installCtx.NodeModulesDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	return installCtx
+}
+
+func TestSortedDependencyNames(t *testing.T) {
+	deps := map[string]string{"zod": "1", "express": "4", "@types/node": "20", "lodash": "4"}
+
+	for i := 0; i < 10; i++ {
+		got := sortedDependencyNames(deps)
+		want := []string{"@types/node", "express", "lodash", "zod"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestLinkBins(t *testing.T) {
+	dir := t.TempDir()
+	installCtx := NewInstallContext(filepath.Join(dir, "node_modules"))
+	binDir := filepath.Join(dir, "bin")
+
+	packageDir := filepath.Join(installCtx.NodeModulesDir, "@scope", "tool")
+	if err := os.MkdirAll(filepath.Join(packageDir, "bin"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(packageDir, "bin", "tool.js"), []byte("#!/usr/bin/env node\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(packageDir, "package.json"), []byte(`{"name": "@scope/tool", "bin": "bin/tool.js"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	linked, err := LinkBins(installCtx, "@scope/tool", binDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(linked, []string{"tool"}) {
+		t.Errorf("unexpected linked bins: %v", linked)
+	}
+
+	target, err := os.Readlink(filepath.Join(binDir, "tool"))
+	if err != nil {
+		t.Fatalf("expected bin link: %v", err)
+	}
+	if filepath.Base(target) != "tool.js" {
+		t.Errorf("unexpected link target: %s", target)
+	}
+}
+
+func TestInstallPackageSkipsInstalledPackagePerTarget(t *testing.T) {
+	for _, dir := range []string{t.TempDir(), t.TempDir()} {
+		installCtx := NewInstallContext(filepath.Join(dir, "node_modules"))
+		lodashDir := filepath.Join(installCtx.NodeModulesDir, "lodash")
+		if err := os.MkdirAll(lodashDir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(lodashDir, "package.json"), []byte(`{"name": "lodash", "version": "4.17.21"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+		version, err := installPackage(installCtx, installCtx.NodeModulesDir, "lodash", "4.17.21", &depGraph, make(map[string]bool), 0, false, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if version != "4.17.21" {
+			t.Errorf("unexpected version: %s", version)
+		}
+		if _, err := depGraph.Vertex("lodash"); err != nil {
+			t.Errorf("expected lodash vertex in graph: %v", err)
+		}
+	}
+}
+
+func TestInstallPackageReplacesOutOfRangeVersion(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "left-pad", Version: "1.3.0", PackageJson: `{"name": "left-pad", "version": "1.3.0"}`},
+		fpmtest.Package{Name: "left-pad", Version: "2.0.0", PackageJson: `{"name": "left-pad", "version": "2.0.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if version, err := RunInstallPackage(installCtx, "left-pad", "^1.0.0", &depGraph, false); err != nil || version != "1.3.0" {
+		t.Fatalf("expected 1.3.0, got %s %v", version, err)
+	}
+	if err := os.WriteFile(filepath.Join(installCtx.NodeModulesDir, "left-pad", "stale.js"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh install with the same range keeps the copy, a range it no longer satisfies replaces it
+	for _, test := range []struct{ versionRange, expected string }{{"^1.2.0", "1.3.0"}, {"^2.0.0", "2.0.0"}} {
+		nodeModulesDir := installCtx.NodeModulesDir
+		installCtx = NewInstallContext(nodeModulesDir)
+		installCtx.Registry, installCtx.CacheDir = registry.URL, ""
+		version, err := RunInstallPackage(installCtx, "left-pad", test.versionRange, &depGraph, false)
+		if err != nil || version != test.expected {
+			t.Errorf("%s: expected %s, got %s %v", test.versionRange, test.expected, version, err)
+		}
+		if installed := installedVersion(filepath.Join(installCtx.NodeModulesDir, "left-pad")); installed != test.expected {
+			t.Errorf("%s: expected %s on disk, got %s", test.versionRange, test.expected, installed)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(installCtx.NodeModulesDir, "left-pad", "stale.js")); !os.IsNotExist(err) {
+		t.Errorf("expected the old copy to be removed before installing the new one, got %v", err)
+	}
+}
+
+func TestFindAndLinkWorkspaces(t *testing.T) {
+	dir := t.TempDir()
+	rootJson := filepath.Join(dir, "package.json")
+	files := map[string]string{
+		rootJson: `{"name": "root", "workspaces": ["packages/*"]}`,
+		filepath.Join(dir, "packages", "app", "package.json"): `{"name": "app", "dependencies": {"@acme/lib": "*"}}`,
+		filepath.Join(dir, "packages", "lib", "package.json"): `{"name": "@acme/lib"}`,
+		filepath.Join(dir, "packages", "README.md"):           `not a workspace`,
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	packageJson, err := ParsePackageJson(rootJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaces, err := FindWorkspaces(rootJson, packageJson)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(workspaces) != 2 || workspaces[0].Name != "@acme/lib" || workspaces[1].Name != "app" {
+		t.Fatalf("unexpected workspaces: %+v", workspaces)
+	}
+
+	installCtx := NewInstallContext(filepath.Join(dir, "node_modules"))
+	if err := LinkWorkspaces(installCtx, workspaces); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(installCtx.NodeModulesDir, "@acme", "lib", "package.json")); err != nil {
+		t.Errorf("expected @acme/lib to be linked: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(installCtx.NodeModulesDir, "app", "package.json")); err != nil {
+		t.Errorf("expected app to be linked: %v", err)
+	}
+}
+
+func TestInstallContextFailures(t *testing.T) {
+	installCtx := NewInstallContext(t.TempDir())
+	if len(installCtx.Failures()) != 0 {
+		t.Fatalf("expected no failures on a new context")
+	}
+
+	installCtx.addFailure(fmt.Errorf("left-pad@1.0.0: not found"))
+	failures := installCtx.Failures()
+	if len(failures) != 1 || failures[0].Error() != "left-pad@1.0.0: not found" {
+		t.Errorf("unexpected failures: %v", failures)
+	}
+}
+
+func TestListInstalledPackages(t *testing.T) {
+	installCtx := NewInstallContext(filepath.Join(t.TempDir(), "node_modules"))
+	files := map[string]string{
+		filepath.Join("express", "package.json"):                          `{"name": "express", "version": "4.18.2"}`,
+		filepath.Join("@types", "node", "package.json"):                   `{"name": "@types/node", "version": "20.1.0"}`,
+		filepath.Join("express", "node_modules", "debug", "package.json"): `{"name": "debug", "version": "2.6.9"}`,
+		filepath.Join(".bin", "package.json"):                             `{}`,
+		filepath.Join("not-a-package", "index.js"):                        ``,
+	}
+	for path, content := range files {
+		path = filepath.Join(installCtx.NodeModulesDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	installed, err := ListInstalledPackages(installCtx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, pkg := range installed {
+		got = append(got, pkg.Name+"@"+pkg.Version)
+	}
+	want := []string{"@types/node@20.1.0", "debug@2.6.9", "express@4.18.2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestInstallContextHandleFailure(t *testing.T) {
+	installCtx := NewInstallContext(t.TempDir())
+	failure := fmt.Errorf("left-pad@1.0.0: not found")
+
+	if err := installCtx.HandleFailure(failure); err != failure {
+		t.Errorf("expected the failure to be returned when bailing, got %v", err)
+	}
+	if len(installCtx.Failures()) != 0 {
+		t.Errorf("expected nothing recorded when bailing")
+	}
+
+	installCtx.Bail = false
+	if err := installCtx.HandleFailure(failure); err != nil {
+		t.Errorf("expected nil without bail, got %v", err)
+	}
+	if len(installCtx.Failures()) != 1 {
+		t.Errorf("expected the failure to be recorded without bail")
+	}
+}
+
+func TestInstallPackageMaxDepth(t *testing.T) {
+	installCtx := NewInstallContext(t.TempDir())
+	installCtx.MaxDepth = 2
+
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	_, err := installPackage(installCtx, installCtx.NodeModulesDir, "deep", "1.0.0", &depGraph, make(map[string]bool), 3, false, false)
+	if err == nil || !strings.Contains(err.Error(), "max depth of 2") {
+		t.Errorf("expected a max depth error, got %v", err)
+	}
+}
+
+func TestRunLifecycleScripts(t *testing.T) {
+	installCtx := NewInstallContext(t.TempDir())
+	packageDir := filepath.Join(installCtx.NodeModulesDir, "native")
+	if err := os.MkdirAll(packageDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	packageJsonPath := filepath.Join(packageDir, "package.json")
+	scripts := `{"scripts": {"postinstall": "echo $npm_lifecycle_event >> ran", "preinstall": "echo $npm_lifecycle_event >> ran", "test": "exit 1"}}`
+	if err := os.WriteFile(packageJsonPath, []byte(scripts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skipped by default, with a warning
+	if err := runLifecycleScripts(installCtx, packageJsonPath, "native", "1.0.0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(packageDir, "ran")); !os.IsNotExist(err) {
+		t.Errorf("expected scripts to be skipped by default")
+	}
+	if warnings := installCtx.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "preinstall/postinstall") {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	installCtx.RunScripts = true
+	if err := runLifecycleScripts(installCtx, packageJsonPath, "native", "1.0.0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ran, err := os.ReadFile(filepath.Join(packageDir, "ran"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ran) != "preinstall\npostinstall\n" {
+		t.Errorf("unexpected scripts run: %q", ran)
+	}
+}
+
+func TestRunLifecycleScriptsFailure(t *testing.T) {
+	installCtx := NewInstallContext(t.TempDir())
+	installCtx.RunScripts = true
+	packageJsonPath := filepath.Join(t.TempDir(), "package.json")
+	if err := os.WriteFile(packageJsonPath, []byte(`{"scripts": {"install": "echo compiling failed; exit 3"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runLifecycleScripts(installCtx, packageJsonPath, "native", "1.0.0")
+	if err == nil || !strings.Contains(err.Error(), "install script failed") || !strings.Contains(err.Error(), "compiling failed") {
+		t.Errorf("expected the failing script and its output, got %v", err)
+	}
+}
+
+func TestInstallResult(t *testing.T) {
+	appLib := fpmtest.Package{Name: "app-lib", Version: "1.0.0", PackageJson: `{"name": "app-lib", "version": "1.0.0", "dependencies": {"shared": "^2.0.0"}}`}
+	testLib := fpmtest.Package{Name: "test-lib", Version: "3.0.0", PackageJson: `{"name": "test-lib", "version": "3.0.0", "dependencies": {"shared": "^2.0.0"}}`}
+	shared := fpmtest.Package{Name: "shared", Version: "2.1.0", PackageJson: `{"name": "shared", "version": "2.1.0"}`}
+	registry := fpmtest.NewRegistry(t, appLib, testLib, shared)
+	installCtx := newTestInstallContext(t, registry)
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	if _, err := RunInstallPackage(installCtx, "test-lib", "3.0.0", &depGraph, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := RunInstallPackage(installCtx, "app-lib", "^1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []ResolvedPackage{
+		{Name: "app-lib", Version: "1.0.0", Integrity: appLib.Integrity()},
+		{Name: "shared", Version: "2.1.0", Integrity: shared.Integrity()},
+		{Name: "test-lib", Version: "3.0.0", Dev: true, Integrity: testLib.Integrity()},
+	}
+	if got := installCtx.Result().Packages; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestInstallResultMergesDevAndProd(t *testing.T) {
+	installCtx := NewInstallContext(t.TempDir())
+	installCtx.addResolved(ResolvedPackage{Name: "shared", Version: "2.1.0", Dev: true})
+	installCtx.addResolved(ResolvedPackage{Name: "shared", Version: "2.1.0"})
+
+	packages := installCtx.Result().Packages
+	if len(packages) != 1 || packages[0].Dev {
+		t.Errorf("expected a single non-dev package, got %+v", packages)
+	}
+}
+
+func TestNpmPlatformNames(t *testing.T) {
+	archs := map[string]string{"amd64": "x64", "386": "ia32", "arm64": "arm64", "arm": "arm", "ppc64le": "ppc64", "s390x": "s390x"}
+	for goarch, expected := range archs {
+		if got := npmArch(goarch); got != expected {
+			t.Errorf("npmArch(%s) = %s, expected %s", goarch, got, expected)
+		}
+	}
+	platforms := map[string]string{"windows": "win32", "darwin": "darwin", "linux": "linux", "solaris": "sunos"}
+	for goos, expected := range platforms {
+		if got := npmPlatform(goos); got != expected {
+			t.Errorf("npmPlatform(%s) = %s, expected %s", goos, got, expected)
+		}
+	}
+}
+
+func TestPlatformSupported(t *testing.T) {
+	tests := []struct {
+		allowed  []string
+		expected bool
+	}{
+		{nil, true},
+		{[]string{"linux", "darwin"}, true},
+		{[]string{"win32"}, false},
+		{[]string{"!win32"}, true},
+		{[]string{"!linux"}, false},
+		{[]string{"darwin", "!linux"}, false},
+	}
+	for _, test := range tests {
+		if got := platformSupported(test.allowed, "linux"); got != test.expected {
+			t.Errorf("platformSupported(%v, linux) = %v, expected %v", test.allowed, got, test.expected)
+		}
+	}
+}
+
+func TestInstallSkipsUnsupportedPlatforms(t *testing.T) {
+	otherOS := "win32"
+	if npmPlatform(runtime.GOOS) == otherOS {
+		otherOS = "linux"
+	}
+	app := fpmtest.Package{Name: "app", Version: "1.0.0", PackageJson: `{"name": "app", "version": "1.0.0", "dependencies": {"native": "1.0.0"}, "optionalDependencies": {"binary": "1.0.0", "portable": "1.0.0"}}`}
+	portable := fpmtest.Package{Name: "portable", Version: "1.0.0", PackageJson: `{"name": "portable", "version": "1.0.0"}`}
+	registry := fpmtest.NewRegistry(t,
+		app,
+		fpmtest.Package{Name: "binary", Version: "1.0.0", PackageJson: `{"name": "binary", "version": "1.0.0", "os": ["` + otherOS + `"]}`},
+		fpmtest.Package{Name: "native", Version: "1.0.0", PackageJson: `{"name": "native", "version": "1.0.0", "cpu": ["!` + npmArch(runtime.GOARCH) + `"]}`},
+		portable,
+	)
+	installCtx := newTestInstallContext(t, registry)
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	if _, err := RunInstallPackage(installCtx, "app", "1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []ResolvedPackage{
+		{Name: "app", Version: "1.0.0", Integrity: app.Integrity()},
+		{Name: "portable", Version: "1.0.0", Optional: true, Integrity: portable.Integrity()},
+	}
+	if got := installCtx.Result().Packages; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+	warnings := installCtx.Warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "skipped native@1.0.0") {
+		t.Errorf("expected only the required package to be warned about, got %v", warnings)
+	}
+}
+
+func TestInstallIgnoresRangesThatArentStrings(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "app", Version: "1.0.0", PackageJson: `{"name": "app", "version": "1.0.0", "dependencies": {"broken": 1, "dep": "^1.0.0"}, "optionalDependencies": {"odd": {"version": "1.0.0"}}}`},
+		fpmtest.Package{Name: "dep", Version: "1.0.0", PackageJson: `{"name": "dep", "version": "1.0.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	if _, err := RunInstallPackage(installCtx, "app", "1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := installedVersion(filepath.Join(installCtx.NodeModulesDir, "dep")); got != "1.0.0" {
+		t.Errorf("expected dep@1.0.0 next to the ranges that were ignored, got %q", got)
+	}
+	for _, name := range []string{"broken", "odd"} {
+		if _, err := os.Stat(filepath.Join(installCtx.NodeModulesDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be ignored, got %v", name, err)
+		}
+	}
+}
+
+func TestInstallReportsEngineMismatches(t *testing.T) {
+	newEngineInstall := func(configure func(*InstallContext)) (*InstallContext, error) {
+		registry := fpmtest.NewRegistry(t,
+			fpmtest.Package{Name: "app", Version: "1.0.0", PackageJson: `{"name": "app", "version": "1.0.0", "dependencies": {"modern": "1.0.0", "newer": "1.0.0", "old": "1.0.0", "any": "1.0.0"}}`},
+			fpmtest.Package{Name: "modern", Version: "1.0.0", PackageJson: `{"name": "modern", "version": "1.0.0", "engines": {"node": ">=18"}}`},
+			fpmtest.Package{Name: "newer", Version: "1.0.0", PackageJson: `{"name": "newer", "version": "1.0.0", "engines": {"node": ">=18", "npm": ">=9"}}`},
+			fpmtest.Package{Name: "old", Version: "1.0.0", PackageJson: `{"name": "old", "version": "1.0.0", "engines": {"node": "^16.0.0"}}`},
+			fpmtest.Package{Name: "any", Version: "1.0.0", PackageJson: `{"name": "any", "version": "1.0.0", "engines": ["node >= 0.4"]}`},
+		)
+		installCtx := newTestInstallContext(t, registry)
+		installCtx.NodeVersion = "v16.20.0"
+		configure(installCtx)
+		depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+		_, err := RunInstallPackage(installCtx, "app", "1.0.0", &depGraph, false)
+		return installCtx, err
+	}
+
+	installCtx, err := newEngineInstall(func(*InstallContext) {})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []EngineMismatch{
+		{Name: "modern", Version: "1.0.0", Required: ">=18", Detected: "16.20.0"},
+		{Name: "newer", Version: "1.0.0", Required: ">=18", Detected: "16.20.0"},
+	}
+	if got := installCtx.EngineMismatches(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+	if len(installCtx.Result().Packages) != 5 || len(installCtx.Warnings()) != 0 {
+		t.Errorf("expected every package installed without inline warnings, got %+v and %v", installCtx.Result().Packages, installCtx.Warnings())
+	}
+	report := EngineReport(installCtx.EngineMismatches())
+	if len(report) != 2 || !strings.HasPrefix(report[0], "fpm WARN 2 packages don't support node 16.20.0") || report[1] != "  node >=18: modern@1.0.0, newer@1.0.0" {
+		t.Errorf("unexpected report %q", report)
+	}
+
+	installCtx, err = newEngineInstall(func(installCtx *InstallContext) { installCtx.IgnoreEngines = true })
+	if err != nil || len(installCtx.EngineMismatches()) != 0 {
+		t.Errorf("expected engines to be ignored, got %v and %+v", err, installCtx.EngineMismatches())
+	}
+
+	_, err = newEngineInstall(func(installCtx *InstallContext) { installCtx.EngineStrict = true })
+	if err == nil || !strings.Contains(err.Error(), "@1.0.0: wants node >=18, this is 16.20.0") {
+		t.Errorf("expected --engine-strict to fail the install, got %v", err)
+	}
+}
+
+// blockingObserver holds the first resolve of a package until release is closed
+type blockingObserver struct {
+	NopObserver
+	resolving chan struct{}
+	release   chan struct{}
+	once      sync.Once
+}
+
+func (o *blockingObserver) OnResolve(name, versionRange, version string) {
+	o.once.Do(func() {
+		close(o.resolving)
+		<-o.release
+	})
+}
+
+func TestConcurrentInstallReturnsResolvedVersion(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "shared", Version: "1.0.0", PackageJson: `{"name": "shared", "version": "1.0.0"}`},
+		fpmtest.Package{Name: "shared", Version: "1.2.0", PackageJson: `{"name": "shared", "version": "1.2.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	observer := &blockingObserver{resolving: make(chan struct{}), release: make(chan struct{})}
+	installCtx.Observer = observer
+
+	versions := make(chan string, 2)
+	install := func() {
+		depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+		version, err := installPackage(installCtx, installCtx.NodeModulesDir, "shared", "^1.0.0", &depGraph, make(map[string]bool), 0, false, false)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		versions <- version
+	}
+	go install()
+	<-observer.resolving
+	// The second install finds the first in flight and waits for its version
+	go install()
+	time.Sleep(20 * time.Millisecond)
+	close(observer.release)
+
+	for i := 0; i < 2; i++ {
+		if version := <-versions; version != "1.2.0" {
+			t.Errorf("expected both installs to report 1.2.0, got %q", version)
+		}
+	}
+}
+
+func TestRepairInstall(t *testing.T) {
+	installCtx := NewInstallContext(filepath.Join(t.TempDir(), "node_modules"))
+	for path, content := range map[string]string{
+		"ok/package.json":                        `{"name": "ok", "version": "1.0.0"}`,
+		"ok/node_modules/nested/package.json":    `{"name": "nested", "version": "1.0.0",`,
+		"@scope/partial/index.js":                `module.exports = 1`,
+		"changed/package.json":                   `{"name": "changed", "version": "2.0.0"}`,
+		"edited/package.json":                    `{"name": "edited", "version": "1.0.0"}`,
+		"edited/index.js":                        `module.exports = 2`,
+		"ok/node_modules/nested-ok/package.json": `{"name": "nested-ok", "version": "1.0.0"}`,
+	} {
+		path = filepath.Join(installCtx.NodeModulesDir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := Manifest{Packages: map[string]ManifestEntry{
+		"ok":      {Name: "ok", Version: "1.0.0"},
+		"changed": {Name: "changed", Version: "1.0.0"},
+		"edited":  {Name: "edited", Version: "1.0.0", Files: map[string]string{"package.json": "sha256-stale", "index.js": "sha256-stale"}},
+	}}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(installCtx.NodeModulesDir, ManifestFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repaired, err := RepairInstall(installCtx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var paths []string
+	for _, pkg := range repaired {
+		paths = append(paths, pkg.Path)
+	}
+	expected := []string{"@scope/partial", "changed", "edited", "ok/node_modules/nested"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected %v to be repaired, got %+v", expected, repaired)
+	}
+	if repaired[1].Problem != "expected version 1.0.0, found 2.0.0" {
+		t.Errorf("unexpected problem: %s", repaired[1].Problem)
+	}
+	for _, path := range expected {
+		if _, err := os.Stat(filepath.Join(installCtx.NodeModulesDir, filepath.FromSlash(path))); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", path)
+		}
+	}
+	for _, path := range []string{"ok", "ok/node_modules/nested-ok"} {
+		if _, err := os.Stat(filepath.Join(installCtx.NodeModulesDir, filepath.FromSlash(path))); err != nil {
+			t.Errorf("expected %s to stay: %v", path, err)
+		}
+	}
+}
+
+func TestRepairReinstallsBelowKeptPackages(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "app", Version: "1.0.0", PackageJson: `{"name": "app", "version": "1.0.0", "dependencies": {"dep": "^1.0.0"}}`},
+		fpmtest.Package{Name: "dep", Version: "1.0.0", PackageJson: `{"name": "dep", "version": "1.0.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := RunInstallPackage(installCtx, "app", "^1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// An install interrupted while extracting dep, app is fine and is kept
+	if err := os.Remove(filepath.Join(installCtx.NodeModulesDir, "dep", "package.json")); err != nil {
+		t.Fatal(err)
+	}
+	nodeModulesDir := installCtx.NodeModulesDir
+	installCtx = NewInstallContext(nodeModulesDir)
+	installCtx.Registry, installCtx.CacheDir, installCtx.Repair = registry.URL, "", true
+	repaired, err := RepairInstall(installCtx)
+	if err != nil || len(repaired) != 1 || repaired[0].Path != "dep" {
+		t.Fatalf("expected dep to be repaired, got %+v %v", repaired, err)
+	}
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := RunInstallPackage(installCtx, "app", "^1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := installedVersion(filepath.Join(nodeModulesDir, "dep")); got != "1.0.0" {
+		t.Errorf("expected dep@1.0.0 back, got %q", got)
+	}
+	if packages := installCtx.Result().Packages; len(packages) != 1 || packages[0].Name != "dep" {
+		t.Errorf("expected only dep to be installed again, got %+v", packages)
+	}
+}
+
+func TestInstallNestedLayout(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "app", Version: "1.0.0", PackageJson: `{"name": "app", "version": "1.0.0", "dependencies": {"a": "1.0.0", "b": "1.0.0"}}`},
+		fpmtest.Package{Name: "a", Version: "1.0.0", PackageJson: `{"name": "a", "version": "1.0.0", "dependencies": {"shared": "^1.0.0"}}`},
+		fpmtest.Package{Name: "b", Version: "1.0.0", PackageJson: `{"name": "b", "version": "1.0.0", "dependencies": {"shared": "^2.0.0"}}`},
+		fpmtest.Package{Name: "shared", Version: "1.0.0", PackageJson: `{"name": "shared", "version": "1.0.0", "dependencies": {"a": "1.0.0"}}`},
+		fpmtest.Package{Name: "shared", Version: "2.0.0", PackageJson: `{"name": "shared", "version": "2.0.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	installCtx.Layout = LayoutNested
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	if _, err := RunInstallPackage(installCtx, "app", "1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for dir, expected := range map[string]string{
+		"app":                                    "1.0.0",
+		"app/node_modules/a":                     "1.0.0",
+		"app/node_modules/b":                     "1.0.0",
+		"app/node_modules/a/node_modules/shared": "1.0.0",
+		"app/node_modules/b/node_modules/shared": "2.0.0",
+		"app/node_modules/a/node_modules/shared/node_modules/a": "",
+		"a": "",
+	} {
+		if got := installedVersion(filepath.Join(installCtx.NodeModulesDir, filepath.FromSlash(dir))); got != expected {
+			t.Errorf("expected %q in %s, got %q", expected, dir, got)
+		}
+	}
+	if ghosts, err := CheckGraphOnDisk(installCtx, &depGraph); err != nil || len(ghosts) != 0 {
+		t.Errorf("expected every nested package to be found, got %v %v", ghosts, err)
+	}
+}
+
+func TestBuildGraphIsDeterministic(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "a", Version: "1.0.0", PackageJson: `{"name": "a", "version": "1.0.0", "dependencies": {"b": "^1.0.0"}}`},
+		fpmtest.Package{Name: "b", Version: "1.0.0", PackageJson: `{"name": "b", "version": "1.0.0", "dependencies": {"a": "^1.0.0", "c": "^1.0.0"}}`},
+		fpmtest.Package{Name: "c", Version: "1.0.0", PackageJson: `{"name": "c", "version": "1.0.0"}`},
+	)
+
+	// Installing a and b concurrently used to decide by timing which of a -> b and b -> a the graph rejected
+	for i := 0; i < 5; i++ {
+		installCtx := newTestInstallContext(t, registry)
+		depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+		if err := BuildGraph(installCtx, map[string]string{"b": "^1.0.0", "a": "^1.0.0"}, &depGraph); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		planned, err := depGraph.AdjacencyMap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := planned["a"]["b"]; !ok || len(planned["b"]) != 1 {
+			t.Fatalf("expected a -> b and b -> c with b -> a rejected as a cycle, got %v", planned)
+		}
+		if _, ok := planned["b"]["c"]; !ok {
+			t.Fatalf("expected b -> c, got %v", planned)
+		}
+
+		var wg sync.WaitGroup
+		for _, name := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				if _, err := RunInstallPackage(installCtx, name, "^1.0.0", &depGraph, false); err != nil {
+					t.Errorf("unexpected error installing %s: %v", name, err)
+				}
+			}(name)
+		}
+		wg.Wait()
+
+		installed, err := depGraph.AdjacencyMap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(edgeList(installed), edgeList(planned)) {
+			t.Errorf("expected the install to keep the planned graph %v, got %v", edgeList(planned), edgeList(installed))
+		}
+		for _, name := range []string{"a", "b", "c"} {
+			if got := installedVersion(filepath.Join(installCtx.NodeModulesDir, name)); got != "1.0.0" {
+				t.Errorf("expected %s@1.0.0 to be installed, got %q", name, got)
+			}
+		}
+	}
+}
+
+// downloadOrderObserver records the order packages start downloading in
+type downloadOrderObserver struct {
+	NopObserver
+	mu    sync.Mutex
+	order []string
+}
+
+func (o *downloadOrderObserver) OnDownloadProgress(name string, done, total int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, seen := range o.order {
+		if seen == name {
+			return
+		}
+	}
+	o.order = append(o.order, name)
+}
+
+func TestFindDependencyPaths(t *testing.T) {
+	dir := writePackageDir(t, map[string]string{
+		"package.json":                `{"name": "app", "dependencies": {"a": "^1.0.0"}, "devDependencies": {"b": "^1.0.0"}}`,
+		"node_modules/a/package.json": `{"name": "a", "version": "1.0.0", "dependencies": {"c": "^1.0.0"}}`,
+		"node_modules/b/package.json": `{"name": "b", "version": "1.0.0", "dependencies": {"c": "^1.0.0"}}`,
+		"node_modules/c/package.json": `{"name": "c", "version": "1.0.0"}`,
+	})
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	root, err := BuildInstalledGraph(NewInstallContext(filepath.Join(dir, "node_modules")), filepath.Join(dir, "package.json"), &depGraph)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if root != "app" {
+		t.Errorf("expected the project name as the root, got %s", root)
+	}
+
+	// Both routes to c are found, sorted
+	paths, err := FindDependencyPaths(&depGraph, root, "c")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := [][]string{{"app", "a", "c"}, {"app", "b", "c"}}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+
+	if _, err := FindDependencyPaths(&depGraph, root, "d"); err == nil || !strings.Contains(err.Error(), "not in the dependency graph") {
+		t.Errorf("expected an error for a package outside the graph, got %v", err)
+	}
+}
+
+func TestBuildGraphPlansTheInstall(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "a", Version: "1.0.0", PackageJson: `{"name": "a", "version": "1.0.0", "dependencies": {"d": "^1.0.0"}}`},
+		fpmtest.Package{Name: "d", Version: "1.0.0", PackageJson: `{"name": "d", "version": "1.0.0"}`},
+		fpmtest.Package{Name: "d", Version: "1.1.0", PackageJson: `{"name": "d", "version": "1.1.0", "dependencies": {"e": "^1.0.0"}}`},
+		fpmtest.Package{Name: "e", Version: "1.0.0", PackageJson: `{"name": "e", "version": "1.0.0"}`},
+	)
+
+	// The root's d is planned at the top level, so a's ^1.0.0 installs it too instead of resolving 1.1.0 again
+	installCtx := newTestInstallContext(t, registry)
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if err := BuildGraph(installCtx, map[string]string{"a": "^1.0.0", "d": "1.0.0"}, &depGraph); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := RunInstallPackage(installCtx, "a", "^1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := installedVersion(filepath.Join(installCtx.NodeModulesDir, "d")); got != "1.0.0" {
+		t.Errorf("expected the planned d@1.0.0, got %q", got)
+	}
+
+	// A tree deeper than MaxDepth fails instead of being cut off, the override puts e two levels down
+	installCtx = newTestInstallContext(t, registry)
+	installCtx.MaxDepth = 1
+	installCtx.Overrides["d"] = "1.1.0"
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	var unresolvable *pkgmanager.UnresolvableError
+	if err := BuildGraph(installCtx, map[string]string{"a": "^1.0.0"}, &depGraph); !errors.As(err, &unresolvable) || unresolvable.Name != "e" || !strings.Contains(err.Error(), "max depth of 1") {
+		t.Errorf("expected e to be past the max depth, got %v", err)
+	}
+
+	// So does a dependency that can't be resolved
+	installCtx = newTestInstallContext(t, registry)
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if err := BuildGraph(installCtx, map[string]string{"a": "^2.0.0"}, &depGraph); !errors.As(err, &unresolvable) || unresolvable.Name != "a" {
+		t.Errorf("expected a to be unresolvable, got %v", err)
+	}
+}
+
+func TestInstallInTopologicalOrder(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "a", Version: "1.0.0", PackageJson: `{"name": "a", "version": "1.0.0", "dependencies": {"b": "^1.0.0", "c": "^1.0.0"}}`},
+		fpmtest.Package{Name: "b", Version: "1.0.0", PackageJson: `{"name": "b", "version": "1.0.0", "dependencies": {"d": "^1.0.0"}}`},
+		fpmtest.Package{Name: "c", Version: "1.0.0", PackageJson: `{"name": "c", "version": "1.0.0", "dependencies": {"d": "^1.0.0"}}`},
+		fpmtest.Package{Name: "d", Version: "1.0.0", PackageJson: `{"name": "d", "version": "1.0.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	observer := &downloadOrderObserver{}
+	installCtx.Observer = observer
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	if err := BuildGraph(installCtx, map[string]string{"a": "^1.0.0"}, &depGraph); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	layers, err := InstallOrder(&depGraph)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := [][]string{{"d"}, {"b", "c"}, {"a"}}; !reflect.DeepEqual(layers, expected) {
+		t.Errorf("expected the layers %v, got %v", expected, layers)
+	}
+
+	if err := ExtractInOrder(installCtx, &depGraph); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := RunInstallPackage(installCtx, "a", "^1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(observer.order) != 4 || observer.order[0] != "d" || observer.order[3] != "a" {
+		t.Errorf("expected d first and a last, both b and c in between, got %v", observer.order)
+	}
+	if packages := installCtx.Result().Packages; len(packages) != 4 {
+		t.Errorf("expected the install to record all 4 packages, got %v", packages)
+	}
+	if ghosts, err := CheckGraphOnDisk(installCtx, &depGraph); err != nil || len(ghosts) != 0 {
+		t.Errorf("expected every package on disk, got %v %v", ghosts, err)
+	}
+}
+
+func TestExtractInOrderStopsOnTheFirstFailure(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "a", Version: "1.0.0", PackageJson: `{"name": "a", "version": "1.0.0", "dependencies": {"b": "^1.0.0", "c": "^1.0.0"}}`},
+		fpmtest.Package{Name: "b", Version: "1.0.0", PackageJson: `{"name": "b", "version": "1.0.0", "dependencies": {"d": "^1.0.0"}}`},
+		fpmtest.Package{Name: "c", Version: "1.0.0", PackageJson: `{"name": "c", "version": "1.0.0"}`},
+		fpmtest.Package{Name: "d", Version: "1.0.0", PackageJson: `{"name": "d", "version": "1.0.0", "engines": {"node": ">=18"}}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	installCtx.EngineStrict = true
+	installCtx.NodeVersion = "v16.20.0"
+	observer := &downloadOrderObserver{}
+	installCtx.Observer = observer
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if err := BuildGraph(installCtx, map[string]string{"a": "^1.0.0"}, &depGraph); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// c shares d's layer and is put in place, the layers of b and a aren't started
+	err := ExtractInOrder(installCtx, &depGraph)
+	if err == nil || !strings.HasPrefix(err.Error(), "d@1.0.0: unsupported engine") {
+		t.Fatalf("expected d's engine to stop the install, got %v", err)
+	}
+	if !reflect.DeepEqual(observer.order, []string{"c"}) {
+		t.Errorf("expected only c downloaded, got %v", observer.order)
+	}
+	for _, name := range []string{"a", "b", "d"} {
+		if _, err := os.Stat(filepath.Join(installCtx.NodeModulesDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be installed, got %v", name, err)
+		}
+	}
+}
+
+// List the edges of an adjacency map as sorted "from -> to" strings
+func edgeList(adjacency map[string]map[string]graph.Edge[string]) []string {
+	var edges []string
+	for from, targets := range adjacency {
+		for to := range targets {
+			edges = append(edges, from+" -> "+to)
+		}
+	}
+	sort.Strings(edges)
+	return edges
+}
+
+func TestInstallNestedLayoutDuplicatesSharedDependency(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "a", Version: "1.0.0", PackageJson: `{"name": "a", "version": "1.0.0", "dependencies": {"shared": "^1.0.0"}}`},
+		fpmtest.Package{Name: "b", Version: "1.0.0", PackageJson: `{"name": "b", "version": "1.0.0", "dependencies": {"shared": "1.0.0"}}`},
+		fpmtest.Package{Name: "shared", Version: "1.0.0", PackageJson: `{"name": "shared", "version": "1.0.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	installCtx.Layout = LayoutNested
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	for _, name := range []string{"a", "b"} {
+		if _, err := RunInstallPackage(installCtx, name, "1.0.0", &depGraph, false); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// Hoisting would leave a single copy at the top level
+	for dir, expected := range map[string]string{"a/node_modules/shared": "1.0.0", "b/node_modules/shared": "1.0.0", "shared": ""} {
+		if got := installedVersion(filepath.Join(installCtx.NodeModulesDir, filepath.FromSlash(dir))); got != expected {
+			t.Errorf("expected %q in %s, got %q", expected, dir, got)
+		}
+	}
+}
+
+func TestInstallStagesInTempDir(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.Package{Name: "@scope/pkg", Version: "1.0.0", PackageJson: `{"name": "@scope/pkg", "version": "1.0.0"}`})
+	installCtx := newTestInstallContext(t, registry)
+	installCtx.TempDir = filepath.Join(t.TempDir(), "scratch")
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	if _, err := RunInstallPackage(installCtx, "@scope/pkg", "1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version := installedVersion(filepath.Join(installCtx.NodeModulesDir, "@scope", "pkg")); version != "1.0.0" {
+		t.Errorf("expected the package moved into node_modules, got %q", version)
+	}
+	for _, dir := range []string{installCtx.TempDir, installCtx.NodeModulesDir} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "fpm-") {
+				t.Errorf("expected no staged files left, found %s in %s", entry.Name(), dir)
+			}
+		}
+	}
+}
+
+func TestInstallFromFileTarballs(t *testing.T) {
+	tarball := fpmtest.Tarball(`{"name": "local", "version": "1.0.0"}`)
+
+	dir := t.TempDir()
+	tarballPath := filepath.Join(dir, "local-1.0.0.tgz")
+	if err := os.WriteFile(tarballPath, tarball, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tarballURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(tarballPath)}).String()
+	for name, shasum := range map[string]string{"local": fmt.Sprintf("%x", sha1.Sum(tarball)), "tampered": strings.Repeat("0", 40)} {
+		document := fmt.Sprintf(`{"dist-tags": {"latest": "1.0.0"}, "versions": {"1.0.0": {"name": %q, "version": "1.0.0", "dist": {"tarball": %q, "shasum": %q}}}}`, name, tarballURL, shasum)
+		if err := os.WriteFile(filepath.Join(dir, name+".json"), []byte(document), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	installCtx := newTestInstallContext(t, fpmtest.NewRegistry(t))
+	installCtx.Client.MetadataDir = dir
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := RunInstallPackage(installCtx, "local", "^1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version := installedVersion(filepath.Join(installCtx.NodeModulesDir, "local")); version != "1.0.0" {
+		t.Errorf("expected local@1.0.0 installed from disk, got %q", version)
+	}
+
+	if _, err := RunInstallPackage(installCtx, "tampered", "^1.0.0", &depGraph, false); !errors.Is(err, pkgmanager.ErrIntegrity) {
+		t.Errorf("expected an integrity error for a tarball that doesn't match its shasum, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(installCtx.NodeModulesDir, "tampered")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing installed for the tampered tarball, got %v", err)
+	}
+}
+
+func TestInstallDetectsNamesDifferingByCase(t *testing.T) {
+	defer func(insensitive bool) { caseInsensitive = insensitive }(caseInsensitive)
+	for _, insensitive := range []bool{true, false} {
+		caseInsensitive = insensitive
+		registry := fpmtest.NewRegistry(t,
+			fpmtest.Package{Name: "app", Version: "1.0.0", PackageJson: `{"name": "app", "version": "1.0.0", "dependencies": {"JSONStream": "1.0.0", "jsonstream": "1.0.0"}}`},
+			fpmtest.Package{Name: "JSONStream", Version: "1.0.0", PackageJson: `{"name": "JSONStream", "version": "1.0.0"}`},
+			fpmtest.Package{Name: "jsonstream", Version: "1.0.0", PackageJson: `{"name": "jsonstream", "version": "1.0.0"}`},
+		)
+		installCtx := newTestInstallContext(t, registry)
+		depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+		_, err := RunInstallPackage(installCtx, "app", "1.0.0", &depGraph, false)
+		conflict := filepath.Join(installCtx.NodeModulesDir, "JSONStream") + " and " + filepath.Join(installCtx.NodeModulesDir, "jsonstream") + " differ only by case"
+		if insensitive {
+			if !errors.Is(err, pkgmanager.ErrFilesystem) || !strings.Contains(err.Error(), "can't install jsonstream: "+conflict) {
+				t.Errorf("expected the second casing to fail, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if warnings := installCtx.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], conflict) {
+			t.Errorf("expected a warning about the casing, got %v", warnings)
+		}
+	}
+}
+
+func TestParseAlias(t *testing.T) {
+	for _, test := range []struct {
+		arg, name, target, versionRange string
+	}{
+		{"foo@npm:bar@1.2.3", "foo", "bar", "1.2.3"},
+		{"foo@npm:bar", "foo", "bar", "latest"},
+		{"@my/foo@npm:@scope/bar@^2.0.0", "@my/foo", "@scope/bar", "^2.0.0"},
+	} {
+		name, spec := ParsePackageArg(test.arg)
+		target, versionRange, ok := ParseAlias(spec)
+		if name != test.name || target != test.target || versionRange != test.versionRange || !ok {
+			t.Errorf("%s: expected %s aliasing %s@%s, got %s aliasing %s@%s %v", test.arg, test.name, test.target, test.versionRange, name, target, versionRange, ok)
+		}
+	}
+	for _, spec := range []string{"^1.0.0", "npm:", "npm:@scope", "file:../bar"} {
+		if _, _, ok := ParseAlias(spec); ok {
+			t.Errorf("expected %q not to be an alias", spec)
+		}
+	}
+}
+
+func TestInstallAlias(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "app", Version: "1.0.0", PackageJson: `{"name": "app", "version": "1.0.0", "dependencies": {"pad3": "npm:bar@^3.0.0"}}`},
+		fpmtest.Package{Name: "bar", Version: "2.0.0", PackageJson: `{"name": "bar", "version": "2.0.0"}`},
+		fpmtest.Package{Name: "bar", Version: "3.1.0", PackageJson: `{"name": "bar", "version": "3.1.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	for _, spec := range [][2]string{{"app", "1.0.0"}, {"bar2", "npm:bar@2.0.0"}} {
+		if _, err := RunInstallPackage(installCtx, spec[0], spec[1], &depGraph, false); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for dir, expected := range map[string]string{"bar2": "2.0.0", "pad3": "3.1.0", "bar": ""} {
+		if got := installedVersion(filepath.Join(installCtx.NodeModulesDir, dir)); got != expected {
+			t.Errorf("expected %q in %s, got %q", expected, dir, got)
+		}
+	}
+	for _, pkg := range installCtx.Result().Packages {
+		if pkg.Name == "bar2" && pkg.AliasOf != "bar" {
+			t.Errorf("expected bar2 recorded as an alias of bar, got %+v", pkg)
+		}
+	}
+}
+
+func TestCheckPeerDependencies(t *testing.T) {
+	newPeerInstall := func(strategy PeerStrategy) (*InstallContext, error) {
+		registry := fpmtest.NewRegistry(t,
+			fpmtest.Package{Name: "react", Version: "17.0.2", PackageJson: `{"name": "react", "version": "17.0.2"}`},
+			fpmtest.Package{Name: "react", Version: "18.3.1", PackageJson: `{"name": "react", "version": "18.3.1"}`},
+			fpmtest.Package{Name: "react", Version: "19.0.0", PackageJson: `{"name": "react", "version": "19.0.0"}`},
+			fpmtest.Package{Name: "react-dom", Version: "18.3.1", PackageJson: `{"name": "react-dom", "version": "18.3.1", "peerDependencies": {"react": "^18.0.0 || ^19.0.0"}}`},
+			fpmtest.Package{Name: "router", Version: "6.0.0", PackageJson: `{"name": "router", "version": "6.0.0", "peerDependencies": {"react": ">=16.8.0 <19.0.0", "history": "^5.0.0"}, "peerDependenciesMeta": {"history": {"optional": true}}}`},
+		)
+		installCtx := newTestInstallContext(t, registry)
+		installCtx.PeerStrategy = strategy
+		depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+		for _, spec := range [][2]string{{"react", "17.0.2"}, {"react-dom", "18.3.1"}, {"router", "6.0.0"}} {
+			if _, err := RunInstallPackage(installCtx, spec[0], spec[1], &depGraph, false); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		return installCtx, CheckPeerDependencies(installCtx, &depGraph)
+	}
+
+	if _, err := newPeerInstall(PeerStrict); err == nil || !strings.Contains(err.Error(), "react-dom@18.3.1 needs peer react@^18.0.0 || ^19.0.0 but 17.0.2 is installed") {
+		t.Errorf("expected strict to fail on the conflict, got %v", err)
+	}
+	if _, err := newPeerInstall(PeerLegacy); err != nil {
+		t.Errorf("expected legacy-peer-deps to ignore peers, got %v", err)
+	}
+
+	installCtx, err := newPeerInstall(PeerResolve)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version := installedVersion(filepath.Join(installCtx.NodeModulesDir, "react")); version != "18.3.1" {
+		t.Errorf("expected the highest react satisfying both peers, got %s", version)
+	}
+	for _, pkg := range installCtx.Result().Packages {
+		if pkg.Name == "react" && pkg.Version != "18.3.1" {
+			t.Errorf("expected the replaced react to leave the result, got %+v", pkg)
+		}
+	}
+}
+
+func TestIntersectRanges(t *testing.T) {
+	if got := intersectRanges([]string{"^1.0.0 || ^2.0.0", ">=1.5.0", ""}); got != "^1.0.0, >=1.5.0, * || ^2.0.0, >=1.5.0, *" {
+		t.Errorf("unexpected intersection: %s", got)
+	}
+}
+
+func TestValidateVersionSpec(t *testing.T) {
+	valid := []string{"", "*", "latest", "next", "v2-beta", "^1.2.0", "~1.2", ">=1.0.0 <2.0.0", "1.x || 2.x", "npm:lodash@^4.0.0", "file:../lib", "https://example.com/pkg.tgz"}
+	for _, spec := range valid {
+		if err := ValidateVersionSpec("foo", spec); err != nil {
+			t.Errorf("expected %q to be accepted, got %v", spec, err)
+		}
+	}
+
+	if err := ValidateVersionSpec("foo", "npm:bar@^1.2.3.4"); err == nil || !strings.Contains(err.Error(), `invalid version "^1.2.3.4" for bar`) {
+		t.Errorf("expected the aliased range to be checked, got %v", err)
+	}
+
+	invalid := []string{"^1.2.3.4", ">=abc", "1.0.0 -", "latest version"}
+	for _, spec := range invalid {
+		err := ValidateVersionSpec("foo", spec)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("invalid version %q for foo", spec)) {
+			t.Errorf("expected %q to be rejected naming the package, got %v", spec, err)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	projectDir := t.TempDir()
+	installCtx := NewInstallContext(filepath.Join(projectDir, "node_modules"))
+	writePackage := func(dir, packageJson string) {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(packageJson), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := installCtx.NodeModulesDir
+	writePackage(projectDir, `{"name": "app", "dependencies": {"express": "^4.0.0"}, "devDependencies": {"jest": "^29.0.0"}}`)
+	writePackage(filepath.Join(root, "express"), `{"version": "4.18.2", "dependencies": {"debug": "^2.6.9"}, "optionalDependencies": {"@scope/native": "1.0.0"}}`)
+	writePackage(filepath.Join(root, "debug"), `{"version": "2.6.9"}`)
+	writePackage(filepath.Join(root, "@scope", "native"), `{"version": "1.0.0"}`)
+	writePackage(filepath.Join(root, "jest"), `{"version": "29.7.0"}`)
+	writePackage(filepath.Join(root, "left-pad"), `{"version": "1.3.0"}`)
+	writePackage(filepath.Join(root, "@old", "unused"), `{"version": "0.1.0"}`)
+
+	pathToJSON := filepath.Join(projectDir, "package.json")
+	newGraph := func() *graph.Graph[string, string] {
+		depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+		return &depGraph
+	}
+	names := func(packages []InstalledPackage) []string {
+		var names []string
+		for _, pkg := range packages {
+			names = append(names, pkg.Name)
+		}
+		return names
+	}
+
+	removed, err := Prune(installCtx, pathToJSON, newGraph(), true, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"@old/unused", "jest", "left-pad"}; !reflect.DeepEqual(names(removed), expected) {
+		t.Errorf("expected a production dry run to list %v, got %v", expected, names(removed))
+	}
+	if _, err := os.Stat(filepath.Join(root, "jest")); err != nil {
+		t.Errorf("expected a dry run to leave node_modules alone: %v", err)
+	}
+
+	removed, err = Prune(installCtx, pathToJSON, newGraph(), false, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"@old/unused", "left-pad"}; !reflect.DeepEqual(names(removed), expected) {
+		t.Errorf("expected %v to be removed, got %v", expected, names(removed))
+	}
+	for _, dir := range []string{"left-pad", "@old"} {
+		if _, err := os.Stat(filepath.Join(root, dir)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", dir, err)
+		}
+	}
+	for _, dir := range []string{"express", "debug", "@scope/native", "jest"} {
+		if _, err := os.Stat(filepath.Join(root, dir)); err != nil {
+			t.Errorf("expected %s to be kept: %v", dir, err)
+		}
+	}
+}
+
+func TestDependencyTree(t *testing.T) {
+	projectDir := t.TempDir()
+	installCtx := NewInstallContext(filepath.Join(projectDir, "node_modules"))
+	writePackage := func(dir, packageJson string) {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(packageJson), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := installCtx.NodeModulesDir
+	writePackage(projectDir, `{"name": "app", "version": "1.0.0", "dependencies": {"express": "^4.0.0", "left-pad": "^2.0.0", "missing": "^1.0.0"}, "devDependencies": {"jest": "^29.0.0"}}`)
+	writePackage(filepath.Join(root, "express"), `{"version": "4.18.2", "dependencies": {"debug": "^2.6.9", "ms": "^2.0.0"}, "optionalDependencies": {"fsevents": "^2.0.0"}}`)
+	writePackage(filepath.Join(root, "express", "node_modules", "debug"), `{"version": "2.6.9", "dependencies": {"ms": "2.0.0", "express": "*"}}`)
+	writePackage(filepath.Join(root, "ms"), `{"version": "2.1.3"}`)
+	writePackage(filepath.Join(root, "left-pad"), `{"version": "1.3.0"}`)
+	writePackage(filepath.Join(root, "jest"), `{"version": "29.7.0"}`)
+	writePackage(filepath.Join(root, "unused"), `{"version": "0.1.0"}`)
+	pathToJSON := filepath.Join(projectDir, "package.json")
+
+	tree, err := DependencyTree(installCtx, pathToJSON, -1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tree.Name != "app" || tree.Version != "1.0.0" {
+		t.Errorf("unexpected root: %s@%s", tree.Name, tree.Version)
+	}
+	express := tree.Dependencies["express"]
+	if express == nil || express.Version != "4.18.2" || express.Dependencies["debug"].Version != "2.6.9" {
+		t.Fatalf("expected express and its nested debug, got %+v", express)
+	}
+	if _, ok := express.Dependencies["fsevents"]; ok {
+		t.Errorf("expected a missing optional dependency to be left out")
+	}
+	// debug resolves ms from the top level, which doesn't satisfy it, and express through the cycle
+	debug := express.Dependencies["debug"]
+	if debug.Dependencies["ms"].Invalid != `"2.0.0" from node_modules/express/node_modules/debug` {
+		t.Errorf("unexpected invalid message: %q", debug.Dependencies["ms"].Invalid)
+	}
+	if express.Dependencies["ms"].Invalid != "" {
+		t.Errorf("expected ms to stay valid for express, got %q", express.Dependencies["ms"].Invalid)
+	}
+	if cycle := debug.Dependencies["express"]; cycle == nil || cycle.Version != "4.18.2" || cycle.Dependencies != nil {
+		t.Errorf("expected the cycle back to express to stop, got %+v", cycle)
+	}
+	if missing := tree.Dependencies["missing"]; missing == nil || !missing.Missing || missing.Required != "^1.0.0" {
+		t.Errorf("expected missing to be reported, got %+v", missing)
+	}
+	if tree.Dependencies["jest"] == nil || !tree.Dependencies["unused"].Extraneous {
+		t.Errorf("expected dev dependencies to be listed and unused to be extraneous, got %+v", tree.Dependencies)
+	}
+
+	expected := []string{
+		`invalid: ms@2.1.3 ` + filepath.Join(root, "ms"),
+		`invalid: left-pad@1.3.0 ` + filepath.Join(root, "left-pad"),
+		"missing: missing@^1.0.0, required by app@1.0.0",
+		"extraneous: unused@0.1.0 " + filepath.Join(root, "unused"),
+	}
+	if !reflect.DeepEqual(tree.Problems, expected) {
+		t.Errorf("expected problems %q, got %q", expected, tree.Problems)
+	}
+
+	tree, err = DependencyTree(installCtx, pathToJSON, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tree.Dependencies["express"] == nil || tree.Dependencies["express"].Dependencies != nil {
+		t.Errorf("expected depth 0 to list only the top level, got %+v", tree.Dependencies["express"])
+	}
+}
+
+func TestParseNpmLockfile(t *testing.T) {
+	lockfiles := []string{
+		`{"lockfileVersion": 3, "packages": {
+			"": {"name": "app"},
+			"node_modules/@types/node": {"version": "20.1.0", "dev": true, "integrity": "sha512-types"},
+			"node_modules/left-pad": {"version": "1.3.0", "integrity": "sha512-pad"},
+			"node_modules/left-pad/node_modules/nested": {"version": "0.1.0"},
+			"node_modules/member": {"resolved": "packages/member", "link": true}
+		}}`,
+		`{"lockfileVersion": 1, "dependencies": {
+			"@types/node": {"version": "20.1.0", "dev": true, "integrity": "sha512-types"},
+			"left-pad": {"version": "1.3.0", "integrity": "sha512-pad", "dependencies": {"nested": {"version": "0.1.0"}}}
+		}}`,
+	}
+
+	expected := []ResolvedPackage{
+		{Name: "@types/node", Version: "20.1.0", Dev: true, Integrity: "sha512-types"},
+		{Name: "left-pad", Version: "1.3.0", Integrity: "sha512-pad"},
+	}
+	for _, lockfile := range lockfiles {
+		projectDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(projectDir, "package-lock.json"), []byte(lockfile), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pins, err := ImportLockfile(projectDir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if pins.Source != "package-lock.json" || !reflect.DeepEqual(pins.Packages, expected) {
+			t.Errorf("expected %+v, got %+v", expected, pins.Packages)
+		}
+		if version, ok := pins.Version("left-pad", "^1.0.0"); !ok || version != "1.3.0" {
+			t.Errorf("expected left-pad to be pinned to 1.3.0, got %s %v", version, ok)
+		}
+		if _, ok := pins.Version("left-pad", "^2.0.0"); ok {
+			t.Errorf("expected a pin outside the range to be ignored")
+		}
+	}
+}
+
+func TestParseYarnLockfile(t *testing.T) {
+	lockfiles := []string{
+		`# yarn lockfile v1
+
+
+"@babel/code@^7.0.0", "@babel/code@^7.10.4":
+  version "7.12.13"
+  resolved "https://registry.yarnpkg.com/@babel/code/-/code-7.12.13.tgz"
+  integrity sha512-babel
+  dependencies:
+    left-pad "^1.0.0"
+
+left-pad@^1.0.0:
+  version "1.3.0"
+  integrity sha512-pad
+
+left-pad@^0.9.0:
+  version "0.9.1"
+`,
+		`__metadata:
+  version: 6
+
+"@babel/code@npm:^7.0.0, @babel/code@npm:^7.10.4":
+  version: 7.12.13
+  resolution: "@babel/code@npm:7.12.13"
+  dependencies:
+    left-pad: "npm:^1.0.0"
+
+"app@workspace:.":
+  version: 0.0.0-use.local
+
+"left-pad@npm:^1.0.0":
+  version: 1.3.0
+
+"left-pad@npm:^0.9.0":
+  version: 0.9.1
+`,
+	}
+
+	for i, lockfile := range lockfiles {
+		projectDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(projectDir, "yarn.lock"), []byte(lockfile), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pins, err := ImportLockfile(projectDir)
+		if err != nil {
+			t.Fatalf("lockfile %d: unexpected error: %v", i, err)
+		}
+		if len(pins.Packages) != 3 || pins.Packages[0].Name != "@babel/code" {
+			t.Errorf("lockfile %d: unexpected packages %+v", i, pins.Packages)
+		}
+		for _, pin := range [][3]string{{"@babel/code", "^7.10.4", "7.12.13"}, {"left-pad", "^1.0.0", "1.3.0"}, {"left-pad", "^0.9.0", "0.9.1"}} {
+			if version, ok := pins.Version(pin[0], pin[1]); !ok || version != pin[2] {
+				t.Errorf("lockfile %d: expected %s@%s to be pinned to %s, got %s", i, pin[0], pin[1], pin[2], version)
+			}
+		}
+		if requires := pins.requires["@babel/code"]; !reflect.DeepEqual(requires, []string{"left-pad"}) {
+			t.Errorf("lockfile %d: expected @babel/code to require left-pad, got %v", i, requires)
+		}
+	}
+}
+
+func TestCheckLockfile(t *testing.T) {
+	projectDir := t.TempDir()
+	pathToJSON := filepath.Join(projectDir, "package.json")
+	packageJson := `{
+		"dependencies": {"express": "^4.18.0", "left-pad": "^2.0.0", "missing": "^1.0.0", "beta": "next"},
+		"devDependencies": {"jest": "^29.0.0"}
+	}`
+	lockfile := `{"lockfileVersion": 3, "packages": {
+		"": {"name": "app"},
+		"node_modules/express": {"version": "4.18.2", "dependencies": {"debug": "2.6.9"}},
+		"node_modules/debug": {"version": "2.6.9", "dependencies": {"ms": "2.0.0"}},
+		"node_modules/ms": {"version": "2.0.0"},
+		"node_modules/left-pad": {"version": "1.3.0"},
+		"node_modules/beta": {"version": "3.0.0-rc.1"},
+		"node_modules/jest": {"version": "29.7.0", "dev": true},
+		"node_modules/removed": {"version": "1.0.0"}
+	}}`
+	for path, content := range map[string]string{pathToJSON: packageJson, filepath.Join(projectDir, "package-lock.json"): lockfile} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pins, problems, err := CheckLockfile(pathToJSON)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		"left-pad@^2.0.0 is locked at 1.3.0 in package-lock.json, which doesn't satisfy it",
+		"missing@^1.0.0 is not in package-lock.json",
+		"removed@1.0.0 is in package-lock.json but nothing in package.json depends on it",
+	}
+	if pins.Source != "package-lock.json" || !reflect.DeepEqual(problems, expected) {
+		t.Errorf("expected %q, got %q", expected, problems)
+	}
+
+	if _, _, err := CheckLockfile(filepath.Join(t.TempDir(), "package.json")); err == nil {
+		t.Errorf("expected an error without a lockfile")
+	}
+}
+
+func TestInstallUsesLockPins(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "left-pad", Version: "1.2.0", PackageJson: `{"name": "left-pad", "version": "1.2.0"}`},
+		fpmtest.Package{Name: "left-pad", Version: "1.3.0", PackageJson: `{"name": "left-pad", "version": "1.3.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	installCtx.Pins = &LockPins{byName: map[string]string{"left-pad": "1.2.0"}}
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	version, err := RunInstallPackage(installCtx, "left-pad", "^1.0.0", &depGraph, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version != "1.2.0" {
+		t.Errorf("expected the pinned 1.2.0 instead of the newest match, got %s", version)
+	}
+}
+
+func TestRemoveInstalled(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "app-lib", Version: "1.0.0", PackageJson: `{"name": "app-lib", "version": "1.0.0", "dependencies": {"@scope/shared": "^2.0.0"}}`},
+		fpmtest.Package{Name: "@scope/shared", Version: "2.1.0", PackageJson: `{"name": "@scope/shared", "version": "2.1.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := RunInstallPackage(installCtx, "app-lib", "1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if removed := RemoveInstalled(installCtx, installCtx.Result()); len(removed) != 2 {
+		t.Errorf("expected both packages to be removed, got %+v", removed)
+	}
+	for _, name := range []string{"app-lib", "@scope/shared"} {
+		if _, err := os.Stat(filepath.Join(installCtx.NodeModulesDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	installCtx := NewInstallContext(filepath.Join(t.TempDir(), "node_modules"))
+	writePackage := func(dir, packageJson string) {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(packageJson), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := installCtx.NodeModulesDir
+	writePackage(filepath.Join(root, "shared"), `{"version": "1.5.0"}`)
+	writePackage(filepath.Join(root, "a"), `{"version": "1.0.0", "dependencies": {"shared": "^1.0.0"}}`)
+	writePackage(filepath.Join(root, "a", "node_modules", "shared"), `{"version": "1.1.0"}`)
+	writePackage(filepath.Join(root, "c"), `{"version": "1.0.0", "dependencies": {"shared": "^1.2.0"}}`)
+	writePackage(filepath.Join(root, "c", "node_modules", "shared"), `{"version": "1.3.0"}`)
+	writePackage(filepath.Join(root, "d"), `{"version": "1.0.0", "dependencies": {"@scope/e": "^2.0.0"}}`)
+	writePackage(filepath.Join(root, "d", "node_modules", "@scope", "e"), `{"version": "2.0.0", "dependencies": {"shared": "^1.0.0"}}`)
+	writePackage(filepath.Join(root, "old"), `{"version": "1.0.0", "dependencies": {"shared": "^0.5.0"}}`)
+	writePackage(filepath.Join(root, "old", "node_modules", "shared"), `{"version": "0.5.0"}`)
+
+	result, err := Dedupe(installCtx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Removed) != 2 || len(result.Hoisted) != 1 {
+		t.Errorf("expected 2 removed and 1 hoisted, got %+v", result)
+	}
+
+	for _, path := range []string{filepath.Join(root, "a", "node_modules", "shared"), filepath.Join(root, "c", "node_modules", "shared"), filepath.Join(root, "d", "node_modules", "@scope", "e")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be gone", path)
+		}
+	}
+	for _, path := range []string{filepath.Join(root, "@scope", "e"), filepath.Join(root, "old", "node_modules", "shared")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to exist: %v", path, err)
+		}
+	}
+}
+
+func TestParsePackageJsonErrors(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected string
+	}{
+		{"{\n    \"name\": \"app\",\n    \"dependencies\": {\"react\": \"18.0.0\",}\n}", "at line 3, column 40"},
+		{`{"dependencies": ["react"]}`, `"dependencies" must be an object, got an array`},
+		{`{"version": 1}`, `"version" must be a string, got a number`},
+		{`[]`, "expected a JSON object, got an array"},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "package.json")
+		if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := ParsePackageJson(path)
+		if err == nil || !strings.Contains(err.Error(), test.expected) || !strings.Contains(err.Error(), path) {
+			t.Errorf("expected an error mentioning %q and the path, got %v", test.expected, err)
+		}
+	}
+}
+
+// recordingObserver keeps the install events it is told about
+type recordingObserver struct {
+	NopObserver
+	events   []string
+	progress int64
+}
+
+func (o *recordingObserver) OnResolve(name, versionRange, version string) {
+	o.events = append(o.events, fmt.Sprintf("resolve %s@%s %s", name, versionRange, version))
+}
+
+func (o *recordingObserver) OnDownloadProgress(name string, done, total int64) {
+	o.progress = done
+}
+
+func (o *recordingObserver) OnInstalled(name, version string) {
+	o.events = append(o.events, fmt.Sprintf("installed %s@%s", name, version))
+}
+
+func (o *recordingObserver) OnError(name string, err error) {
+	o.events = append(o.events, "error "+name)
+}
+
+func TestInstallObserver(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "app", Version: "1.0.0", PackageJson: `{"name": "app", "version": "1.0.0", "dependencies": {"missing": "^1.0.0"}}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	installCtx.Bail = false
+	observer := &recordingObserver{}
+	installCtx.Observer = observer
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	if _, err := RunInstallPackage(installCtx, "app", "^1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"resolve app@^1.0.0 1.0.0", "installed app@1.0.0", "error missing"}
+	if !reflect.DeepEqual(observer.events, expected) {
+		t.Errorf("expected %v, got %v", expected, observer.events)
+	}
+	if observer.progress == 0 {
+		t.Errorf("expected download progress to be reported")
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "package.json")
+	content := `{
+		"dependencies": {"minimist": "^1.2.8"},
+		"overrides": {"lodash": "4.17.21", "minimist": "$minimist", "semver": {".": "7.5.4", "lru-cache": "6.0.0"}}
+	}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	packageJson, err := ParsePackageJson(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overrides, err := ParseOverrides(packageJson)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"lodash": "4.17.21", "minimist": "^1.2.8", "semver": "7.5.4"}
+	if !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("expected %v, got %v", expected, overrides)
+	}
+}
+
+func TestParseOverridesReadsResolutions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "package.json")
+	content := `{
+		"overrides": {"lodash": "4.17.21"},
+		"resolutions": {
+			"**/lodash": "4.17.20",
+			"**/@types/node": "20.11.0",
+			"minimist": "1.2.8",
+			"webpack/terser": "5.0.0",
+			"semver@^5.0.0": "5.7.2"
+		}
+	}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	packageJson, err := ParsePackageJson(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overrides, err := ParseOverrides(packageJson)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"lodash": "4.17.21", "@types/node": "20.11.0", "minimist": "1.2.8"}
+	if !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("expected %v, got %v", expected, overrides)
+	}
+}
+
+func TestInstallRecordsTimings(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "app", Version: "1.0.0", PackageJson: `{"name": "app", "version": "1.0.0", "dependencies": {"dep": "^1.0.0"}}`},
+		fpmtest.Package{Name: "dep", Version: "1.0.0", PackageJson: `{"name": "dep", "version": "1.0.0"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := RunInstallPackage(installCtx, "app", "1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if timings := installCtx.Result().Timings; len(timings) != 0 {
+		t.Errorf("expected no timings unless asked for, got %+v", timings)
+	}
+
+	installCtx = newTestInstallContext(t, registry)
+	installCtx.Timing = true
+	depGraph = graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := RunInstallPackage(installCtx, "app", "1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	timings := installCtx.Result().Timings
+	if len(timings) != 2 {
+		t.Fatalf("expected a timing for each package, got %+v", timings)
+	}
+	for i, timing := range timings {
+		if timing.Version != "1.0.0" || timing.Resolve <= 0 || timing.Download <= 0 || timing.Extract <= 0 {
+			t.Errorf("expected every phase to be timed, got %+v", timing)
+		}
+		if i > 0 && timing.Total() > timings[i-1].Total() {
+			t.Errorf("expected the slowest package first, got %+v", timings)
+		}
+	}
+}
+
+func TestInstallAppliesOverrides(t *testing.T) {
+	registry := fpmtest.NewRegistry(t,
+		fpmtest.Package{Name: "app", Version: "1.0.0", PackageJson: `{"name": "app", "version": "1.0.0", "dependencies": {"vulnerable": "^1.0.0"}}`},
+		fpmtest.Package{Name: "vulnerable", Version: "1.0.0", PackageJson: `{"name": "vulnerable", "version": "1.0.0"}`},
+		fpmtest.Package{Name: "vulnerable", Version: "2.0.1", PackageJson: `{"name": "vulnerable", "version": "2.0.1"}`},
+	)
+	installCtx := newTestInstallContext(t, registry)
+	installCtx.Overrides = map[string]string{"vulnerable": "2.0.1"}
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	if _, err := RunInstallPackage(installCtx, "app", "1.0.0", &depGraph, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(installCtx.NodeModulesDir, "vulnerable", "package.json"))
+	if err != nil || !strings.Contains(string(content), `"2.0.1"`) {
+		t.Errorf("expected the overridden version to be installed, got %s %v", content, err)
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	installCtx := NewInstallContext(filepath.Join(t.TempDir(), "node_modules"))
+	for name, version := range map[string]string{"a": "1.0.0", "b": "2.0.0"} {
+		dir := filepath.Join(installCtx.NodeModulesDir, name)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(`{"version": "`+version+`"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result := &InstallResult{Packages: []ResolvedPackage{{Name: "a", Version: "1.0.0", Integrity: "sha512-a"}}}
+	if err := WriteManifest(installCtx, result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	manifest, err := ReadManifest(installCtx)
+	if err != nil || manifest == nil {
+		t.Fatalf("expected a manifest, got %v", err)
+	}
+	if manifest.Packages["a"].Integrity != "sha512-a" {
+		t.Errorf("expected the integrity to be recorded, got %+v", manifest.Packages["a"])
+	}
+
+	if discrepancies, err := VerifyManifest(installCtx, manifest); err != nil || len(discrepancies) != 0 {
+		t.Errorf("expected no drift, got %v %v", discrepancies, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(installCtx.NodeModulesDir, "b", "package.json"), []byte(`{"version": "2.1.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(installCtx.NodeModulesDir, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	discrepancies, err := VerifyManifest(installCtx, manifest)
+	expected := []string{"changed b at b: expected 2.0.0, found 2.1.0", "missing a@1.0.0 at a"}
+	if err != nil || !reflect.DeepEqual(discrepancies, expected) {
+		t.Errorf("expected %v, got %v %v", expected, discrepancies, err)
+	}
+}
+
+func TestVerifyFiles(t *testing.T) {
+	installCtx := NewInstallContext(filepath.Join(t.TempDir(), "node_modules"))
+	installCtx.RecordFiles = true
+	dir := filepath.Join(installCtx.NodeModulesDir, "a")
+	for path, content := range map[string]string{"package.json": `{"version": "1.0.0"}`, "index.js": "module.exports = 1", "lib/util.js": "exports.x = 1", "node_modules/b/package.json": `{"version": "2.0.0"}`} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result := &InstallResult{Packages: []ResolvedPackage{{Name: "a", Version: "1.0.0"}, {Name: "b", Version: "2.0.0"}}}
+	if err := WriteManifest(installCtx, result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	manifest, err := ReadManifest(installCtx)
+	if err != nil || manifest == nil {
+		t.Fatalf("expected a manifest, got %v", err)
+	}
+	if files := manifest.Packages["a"].Files; len(files) != 3 || files["lib/util.js"] == "" {
+		t.Errorf("expected the files of a without its node_modules, got %v", files)
+	}
+	if checked, changed, err := VerifyFiles(installCtx, manifest); err != nil || checked != 2 || len(changed) != 0 {
+		t.Errorf("expected 2 unchanged packages, got %d %v %v", checked, changed, err)
+	}
+
+	// A later install that doesn't touch a keeps the hashes from when it was installed
+	if err := os.WriteFile(filepath.Join(dir, "index.js"), []byte("module.exports = evil()"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "lib", "util.js")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "extra.js"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteManifest(installCtx, &InstallResult{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if manifest, err = ReadManifest(installCtx); err != nil {
+		t.Fatal(err)
+	}
+	_, changed, err := VerifyFiles(installCtx, manifest)
+	expected := []string{"added a/extra.js to a@1.0.0", "modified a/index.js of a@1.0.0", "removed a/lib/util.js from a@1.0.0"}
+	if err != nil || !reflect.DeepEqual(changed, expected) {
+		t.Errorf("expected %v, got %v %v", expected, changed, err)
+	}
+}
+
+func TestHandleFailureStopsOnceCancelled(t *testing.T) {
+	installCtx := NewInstallContext(t.TempDir())
+	installCtx.Bail = false
+	ctx, cancel := context.WithCancel(context.Background())
+	installCtx.Context = ctx
+	cancel()
+
+	if err := installCtx.HandleFailure(context.Canceled); err == nil {
+		t.Errorf("expected the failure to be returned once the install is cancelled")
+	}
+
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	if _, err := installPackage(installCtx, installCtx.NodeModulesDir, "lodash", "4.17.21", &depGraph, make(map[string]bool), 0, false, false); err != context.Canceled {
+		t.Errorf("expected installPackage to stop, got %v", err)
+	}
+}
+
+func TestUpdatePackageJsonConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "package.json")
+	if err := os.WriteFile(path, []byte(`{"name": "app", "dependencies": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- UpdatePackageJson(path, map[string]string{fmt.Sprintf("pkg-%02d", i): "1.0.0"}, i%2 == 0, false)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	packageJson, err := ParsePackageJson(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps, _ := ParseDependencies(packageJson, "dependencies")
+	devDeps, _ := ParseDependencies(packageJson, "devDependencies")
+	if len(deps.Keys())+len(devDeps.Keys()) != 20 {
+		t.Errorf("expected all 20 dependencies to be saved, got %v and %v", deps.Keys(), devDeps.Keys())
+	}
+}
+
+func TestUpdatePackageJsonBundles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "package.json")
+	if err := os.WriteFile(path, []byte(`{"name": "app", "bundledDependencies": ["zod"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, deps := range []map[string]string{{"lodash": "4.17.21", "zod": "3.22.0"}, {"chalk": "5.3.0"}} {
+		if err := UpdatePackageJson(path, deps, false, true); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := UpdatePackageJson(path, map[string]string{"jest": "29.0.0"}, true, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	packageJson, err := ParsePackageJson(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundled, _ := packageJson.Get("bundledDependencies")
+	if !reflect.DeepEqual(bundled, []interface{}{"chalk", "lodash", "zod"}) {
+		t.Errorf("expected the bundled names sorted without duplicates, got %v", bundled)
+	}
+
+	for document, key := range map[string]string{`{"bundleDependencies": []}`: "bundleDependencies", `{"dependencies": {}}`: "bundledDependencies"} {
+		if err := os.WriteFile(path, []byte(document), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := UpdatePackageJson(path, map[string]string{"lodash": "4.17.21"}, false, true); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		packageJson, _ := ParsePackageJson(path)
+		if bundled, _ := packageJson.Get(key); !reflect.DeepEqual(bundled, []interface{}{"lodash"}) {
+			t.Errorf("expected lodash in %s for %s, got %v", key, document, bundled)
+		}
+	}
+}
+
+func TestParseDependencies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "package.json")
+	if err := os.WriteFile(path, []byte(`{"dependencies": null, "devDependencies": {"jest": "^29.0.0", "ts-jest": "^29.1.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	packageJson, err := ParsePackageJson(path)
+	if err != nil {
+		t.Fatalf("expected null dependencies to be accepted, got %v", err)
+	}
+
+	deps, err := ParseDependencies(packageJson, "dependencies")
+	if err != nil || len(deps.Keys()) != 0 {
+		t.Errorf("expected null to be an empty object, got %v, %v", deps, err)
+	}
+	devDeps, err := ParseDependencies(packageJson, "devDependencies")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version, _ := devDeps.Get("ts-jest"); !reflect.DeepEqual(devDeps.Keys(), []string{"jest", "ts-jest"}) || version != "^29.1.0" {
+		t.Errorf("unexpected devDependencies: %v", devDeps.Keys())
+	}
+
+	// Manifests built in code skip the validation ParsePackageJson does
+	packageJson.Set("optionalDependencies", []interface{}{"fsevents"})
+	if _, err := ParseDependencies(packageJson, "optionalDependencies"); err == nil || !strings.Contains(err.Error(), `"optionalDependencies" in package.json must be an object`) || !strings.Contains(err.Error(), "got an array") {
+		t.Errorf("expected an error naming the key, got %v", err)
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	projectDir := t.TempDir()
+	packageJson := `{"name": "app", "scripts": {
+		"prebuild": "echo pre >> out",
+		"build": "echo $npm_package_name >> out; printf '%s\\n' >> out",
+		"postbuild": "echo post >> out",
+		"fail": "exit 7"
+	}}`
+	if err := os.WriteFile(filepath.Join(projectDir, "package.json"), []byte(packageJson), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RunScript(context.Background(), projectDir, "", "build", []string{"it's", "--flag"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out, err := os.ReadFile(filepath.Join(projectDir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "pre\napp\nit's\n--flag\npost\n" {
+		t.Errorf("unexpected script output: %q", out)
+	}
+
+	err = RunScript(context.Background(), projectDir, "", "fail", nil)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 7 {
+		t.Errorf("expected the script's exit code 7, got %v", err)
+	}
+
+	if err := RunScript(context.Background(), projectDir, "", "missing", nil); err == nil || !strings.Contains(err.Error(), "missing script") {
+		t.Errorf("expected a missing script error, got %v", err)
+	}
+}
+
+func TestFindAdditionalPackageJsonsStaysInThePackage(t *testing.T) {
+	packageDir := filepath.Join(t.TempDir(), "node_modules", "tool")
+	for _, path := range []string{"package.json", filepath.Join("lib", "package.json"), filepath.Join("node_modules", "dep", "package.json")} {
+		path = filepath.Join(packageDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(`{}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link back up the tree and one out of the package
+	if err := os.Symlink("..", filepath.Join(packageDir, "lib", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Dir(packageDir), filepath.Join(packageDir, "outside")); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := findAdditionalPackageJsons(packageDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{filepath.Join(packageDir, "lib", "package.json")}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+}
+
+func TestInstallScopedPackageFromRegistrySubpath(t *testing.T) {
+	tarball := fpmtest.Tarball(`{"name": "@types/node", "version": "20.1.0"}`)
+
+	// Answer only the requests npm itself sends, the metadata of a scoped name has its slash escaped
+	var server *httptest.Server
+	metadataRequests := 0
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.RequestURI {
+		case "/npm/@types%2Fnode":
+			metadataRequests++
+			fmt.Fprintf(w, `{"name": "@types/node", "dist-tags": {"latest": "20.1.0"}, "versions": {"20.1.0": {"name": "@types/node", "version": "20.1.0", "dist": {"tarball": "%s/npm/@types/node/-/node-20.1.0.tgz", "shasum": "%x"}}}}`, server.URL, sha1.Sum(tarball))
+		case "/npm/@types/node/-/node-20.1.0.tgz":
+			w.Write(tarball)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	nodeModulesDir := filepath.Join(t.TempDir(), "node_modules")
+	if err := os.MkdirAll(nodeModulesDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		installCtx := NewInstallContext(nodeModulesDir)
+		installCtx.Registry = server.URL + "/npm/"
+		installCtx.CacheDir = ""
+		depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+		version, err := installPackage(installCtx, installCtx.NodeModulesDir, "@types/node", "^20.0.0", &depGraph, make(map[string]bool), 0, false, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if version != "20.1.0" {
+			t.Errorf("unexpected version: %s", version)
+		}
+	}
+	if installedVersion(filepath.Join(nodeModulesDir, "@types", "node")) != "20.1.0" {
+		t.Errorf("expected @types/node in node_modules/@types/node")
+	}
+	if _, err := os.Stat(filepath.Join(nodeModulesDir, "@types", "@types")); !os.IsNotExist(err) {
+		t.Errorf("expected no doubled scope directory, got %v", err)
+	}
+	if metadataRequests != 1 {
+		t.Errorf("expected the second install to keep the installed copy, got %d metadata requests", metadataRequests)
+	}
+}
+
+func TestCheckGraphOnDisk(t *testing.T) {
+	installCtx := NewInstallContext(filepath.Join(t.TempDir(), "node_modules"))
+	for name, content := range map[string]string{"express": `{"name": "express"}`, "broken": `{"name": `} {
+		dir := filepath.Join(installCtx.NodeModulesDir, name)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	installCtx.addSkipped("fsevents")
+
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+	for _, name := range []string{"express", "broken", "ghost", "fsevents"} {
+		depGraph.AddVertex(name)
+	}
+	ghosts, err := CheckGraphOnDisk(installCtx, &depGraph)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ghosts) != 2 || !strings.Contains(ghosts[0].Error(), "broken is in the dependency graph but") || !strings.Contains(ghosts[1].Error(), "ghost is in the dependency graph but missing") {
+		t.Errorf("expected broken and ghost to be reported, got %v", ghosts)
+	}
+}
+
+func TestFindProjectRoot(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"package.json": `{"name": "monorepo", "workspaces": ["packages/*"]}`,
+		filepath.Join("packages", "app", "package.json"):            `{"name": "app"}`,
+		filepath.Join("tools", "standalone", "package.json"):        `{"name": "standalone"}`,
+		filepath.Join("packages", "app", "src", "components", ".k"): ``,
+	}
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]string{
+		filepath.Join("packages", "app", "src", "components"): root,
+		filepath.Join("tools", "standalone"):                  filepath.Join(root, "tools", "standalone"),
+		"packages":                                            root,
+	}
+	for start, expected := range tests {
+		got, err := FindProjectRoot(filepath.Join(root, start))
+		if err != nil || got != expected {
+			t.Errorf("FindProjectRoot(%s) = %s, %v, expected %s", start, got, err, expected)
+		}
+	}
+	if nearest, err := FindNearestPackage(filepath.Join(root, "packages", "app", "src")); err != nil || nearest != filepath.Join(root, "packages", "app") {
+		t.Errorf("expected the member to be the nearest package, got %s %v", nearest, err)
+	}
+
+	if _, err := FindProjectRoot(t.TempDir()); err == nil || !strings.Contains(err.Error(), "no package.json found") {
+		t.Errorf("expected no package.json to be found, got %v", err)
+	}
+}
+
+func TestPhaseConcurrency(t *testing.T) {
+	t.Setenv("FPM_DOWNLOAD_CONCURRENCY", "3")
+	t.Setenv("FPM_EXTRACT_CONCURRENCY", "none")
+	installCtx := NewInstallContext(t.TempDir())
+	if installCtx.Downloads != 3 || installCtx.Extractions != DefaultExtractConcurrency {
+		t.Errorf("expected 3 downloads and the default extractions, got %d and %d", installCtx.Downloads, installCtx.Extractions)
+	}
+
+	installCtx.Extractions = 2
+	var mu sync.Mutex
+	running, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := installCtx.acquire(&installCtx.extractSlots, installCtx.Extractions)
+			defer release()
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Errorf("expected at most 2 extractions at once, got %d", peak)
+	}
+}
+
+func TestReserveSpace(t *testing.T) {
+	defer func(original func(string) (int64, error)) { freeSpace = original }(freeSpace)
+	freeSpace = func(string) (int64, error) { return 10 << 20, nil }
+	installCtx := NewInstallContext(t.TempDir())
+
+	release, err := installCtx.reserveSpace("big", "1.0.0", 8<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The extraction in progress still holds its 8 MiB
+	_, err = installCtx.reserveSpace("other", "2.0.0", 4<<20)
+	if !errors.Is(err, pkgmanager.ErrFilesystem) || !strings.Contains(err.Error(), "it unpacks to 4.0 MiB, 2.0 MiB is free") {
+		t.Errorf("expected a disk space error, got %v", err)
+	}
+	release()
+	if release, err := installCtx.reserveSpace("other", "2.0.0", 4<<20); err != nil {
+		t.Errorf("expected room once the first extraction finished, got %v", err)
+	} else {
+		release()
+	}
+
+	// Unknown sizes and unknown free space aren't checked
+	if _, err := installCtx.reserveSpace("unknown", "1.0.0", 0); err != nil {
+		t.Errorf("expected no check without a size, got %v", err)
+	}
+	freeSpace = func(string) (int64, error) { return -1, nil }
+	if _, err := installCtx.reserveSpace("huge", "1.0.0", 1<<50); err != nil {
+		t.Errorf("expected no check without the free space, got %v", err)
+	}
+}
+
+func TestFormatVersionSpec(t *testing.T) {
+	tests := []struct {
+		version, prefix string
+		exact           bool
+		expected        string
+	}{
+		{"1.3.0", "", false, "1.3.0"},
+		{"1.3.0", "^", false, "^1.3.0"},
+		{"1.3.0", "~", false, "~1.3.0"},
+		{"1.3.0", "^", true, "1.3.0"},
+		{"2.0.0-beta.1", "~", false, "~2.0.0-beta.1"},
+		{"latest", "^", false, "latest"},
+	}
+	for _, test := range tests {
+		if got := FormatVersionSpec(test.version, test.prefix, test.exact); got != test.expected {
+			t.Errorf("FormatVersionSpec(%q, %q, %v): expected %q, got %q", test.version, test.prefix, test.exact, test.expected, got)
+		}
+	}
+}
+
+func TestLinkGlobalAndIntoProject(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need extra privileges on Windows")
+	}
+	prefix := t.TempDir()
+	library := filepath.Join(t.TempDir(), "lib")
+	if err := os.MkdirAll(filepath.Join(library, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(library, "package.json"), []byte(`{"name": "@scope/lib", "version": "0.0.0", "bin": {"lib": "bin/lib.js"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(library, "bin", "lib.js"), []byte("#!/usr/bin/env node\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	name, bins, err := LinkGlobal(prefix, library)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name != "@scope/lib" || !reflect.DeepEqual(bins, []string{"lib"}) {
+		t.Errorf("unexpected link: %s %v", name, bins)
+	}
+	if _, err := os.Stat(filepath.Join(GlobalBinDir(prefix), "lib")); err != nil {
+		t.Errorf("expected the bin linked globally: %v", err)
+	}
+
+	nodeModulesDir := filepath.Join(t.TempDir(), "node_modules")
+	target, err := LinkFromGlobal(prefix, nodeModulesDir, "@scope/lib")
+	if err != nil || target != library {
+		t.Fatalf("expected a link to %s, got %s %v", library, target, err)
+	}
+	if content, err := os.ReadFile(filepath.Join(nodeModulesDir, "@scope", "lib", "package.json")); err != nil || !strings.Contains(string(content), "@scope/lib") {
+		t.Errorf("expected the library reachable through node_modules: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(nodeModulesDir, ".bin", "lib")); err != nil {
+		t.Errorf("expected the bin linked into node_modules/.bin: %v", err)
+	}
+	if _, err := LinkFromGlobal(prefix, nodeModulesDir, "unlinked"); err == nil {
+		t.Errorf("expected an error for a package that isn't linked")
+	}
+
+	// Once the library is gone its global link is stale
+	if err := os.RemoveAll(library); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := RemoveStaleLinks(prefix)
+	if err != nil || !reflect.DeepEqual(removed, []string{"@scope/lib"}) {
+		t.Errorf("expected the stale link removed, got %v %v", removed, err)
+	}
+	if _, err := os.Lstat(filepath.Join(GlobalNodeModulesDir(prefix), "@scope", "lib")); !os.IsNotExist(err) {
+		t.Errorf("expected no global link left, got %v", err)
+	}
+}
+
+// Write the files of a package directory, keyed by slash separated path
+func writePackageDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPackFiles(t *testing.T) {
+	common := map[string]string{
+		"README.md":            "",
+		"LICENSE":              "",
+		"index.js":             "",
+		"lib/util.js":          "",
+		"lib/util.test.js":     "",
+		"lib/fixtures/big.bin": "",
+		"dist/bundle.js":       "",
+		"test/index.test.js":   "",
+		"package-lock.json":    "",
+		"node_modules/x/a.js":  "",
+		".git/HEAD":            "",
+	}
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected []string
+	}{
+		{
+			name:     "everything without files or ignore files",
+			files:    map[string]string{"package.json": `{"name": "lib"}`},
+			expected: []string{"LICENSE", "README.md", "dist/bundle.js", "index.js", "lib/fixtures/big.bin", "lib/util.js", "lib/util.test.js", "package.json", "test/index.test.js"},
+		},
+		{
+			name:     ".npmignore wins over .gitignore",
+			files:    map[string]string{"package.json": `{"name": "lib"}`, ".gitignore": "index.js\n", ".npmignore": "test/\n*.test.js\n/lib/fixtures\n"},
+			expected: []string{"LICENSE", "README.md", "dist/bundle.js", "index.js", "lib/util.js", "package.json"},
+		},
+		{
+			name:     ".gitignore without .npmignore",
+			files:    map[string]string{"package.json": `{"name": "lib"}`, ".gitignore": "dist\n**/fixtures/\n"},
+			expected: []string{"LICENSE", "README.md", "index.js", "lib/util.js", "lib/util.test.js", "package.json", "test/index.test.js"},
+		},
+		{
+			name:     "files is an allowlist the root ignore file doesn't override",
+			files:    map[string]string{"package.json": `{"name": "lib", "files": ["lib", "dist/"]}`, ".npmignore": "dist\n"},
+			expected: []string{"LICENSE", "README.md", "dist/bundle.js", "lib/fixtures/big.bin", "lib/util.js", "lib/util.test.js", "package.json"},
+		},
+		{
+			name:     "an ignore file in a subdirectory still applies with files",
+			files:    map[string]string{"package.json": `{"name": "lib", "files": ["lib/**", "!lib/util.test.js"]}`, "lib/.npmignore": "fixtures/\n"},
+			expected: []string{"LICENSE", "README.md", "lib/util.js", "package.json"},
+		},
+		{
+			name:     "main and bin are packed whatever files and the ignore files say",
+			files:    map[string]string{"package.json": `{"name": "lib", "main": "./dist/bundle.js", "bin": "index.js", "files": ["lib/util.js"]}`, ".gitignore": "dist\n"},
+			expected: []string{"LICENSE", "README.md", "dist/bundle.js", "index.js", "lib/util.js", "package.json"},
+		},
+		{
+			name:     "an ignored directory only gives up its main file",
+			files:    map[string]string{"package.json": `{"name": "lib", "main": "dist/bundle.js"}`, ".npmignore": "dist\n", "dist/bundle.js.map": ""},
+			expected: []string{"LICENSE", "README.md", "dist/bundle.js", "index.js", "lib/fixtures/big.bin", "lib/util.js", "lib/util.test.js", "package.json", "test/index.test.js"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := make(map[string]string)
+			for name, content := range common {
+				files[name] = content
+			}
+			for name, content := range test.files {
+				files[name] = content
+			}
+			got, err := PackFiles(writePackageDir(t, files))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestInstallLocalDirectoryCopiesPackedFiles(t *testing.T) {
+	registry := fpmtest.NewRegistry(t, fpmtest.Package{Name: "dep", Version: "1.0.0", PackageJson: `{"name": "dep", "version": "1.0.0"}`})
+	installCtx := newTestInstallContext(t, registry)
+	library := writePackageDir(t, map[string]string{
+		"package.json":     `{"name": "lib", "version": "0.3.0", "files": ["lib"], "dependencies": {"dep": "^1.0.0"}}`,
+		"lib/index.js":     "",
+		"test/fixture.bin": "",
+	})
+	depGraph := graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles())
+
+	version, err := RunInstallPackage(installCtx, "lib", "file:"+library, &depGraph, false)
+	if err != nil || version != "0.3.0" {
+		t.Fatalf("expected lib@0.3.0, got %q %v", version, err)
+	}
+	libDir := filepath.Join(installCtx.NodeModulesDir, "lib")
+	if _, err := os.Stat(filepath.Join(libDir, "lib", "index.js")); err != nil {
+		t.Errorf("expected the listed files copied: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(libDir, "test")); !os.IsNotExist(err) {
+		t.Errorf("expected the unlisted test directory left behind, got %v", err)
+	}
+	if installedVersion(filepath.Join(installCtx.NodeModulesDir, "dep")) != "1.0.0" {
+		t.Errorf("expected the local package's dependencies installed")
+	}
+}
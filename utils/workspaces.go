@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/iancoleman/orderedmap"
+)
+
+// Workspace is a member package of a monorepo declared through the root package.json "workspaces" field
+type Workspace struct {
+	Name            string
+	Dir             string
+	PackageJsonPath string
+}
+
+// Expand the "workspaces" globs of the root package.json into its member packages, sorted by name
+func FindWorkspaces(pathToJSON string, packageJson *orderedmap.OrderedMap) ([]Workspace, error) {
+	patterns, err := parseWorkspacePatterns(packageJson)
+	if err != nil {
+		return nil, err
+	}
+
+	rootDir := filepath.Dir(pathToJSON)
+	seen := make(map[string]bool)
+	var workspaces []Workspace
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(rootDir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid workspace pattern %s: %v", pattern, err)
+		}
+
+		for _, dir := range matches {
+			memberJsonPath := filepath.Join(dir, "package.json")
+			if _, err := os.Stat(memberJsonPath); err != nil {
+				continue // Not a package, e.g. a stray file matched by the glob
+			}
+
+			memberJson, err := ParsePackageJson(memberJsonPath)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := memberJson.Get("name")
+			nameStr, isString := name.(string)
+			if !ok || !isString || nameStr == "" {
+				return nil, fmt.Errorf("workspace %s has no name in its package.json", dir)
+			}
+			if seen[nameStr] {
+				return nil, fmt.Errorf("workspace name %s is used more than once", nameStr)
+			}
+			seen[nameStr] = true
+
+			workspaces = append(workspaces, Workspace{Name: nameStr, Dir: dir, PackageJsonPath: memberJsonPath})
+		}
+	}
+
+	sort.Slice(workspaces, func(i, j int) bool {
+		return workspaces[i].Name < workspaces[j].Name
+	})
+
+	return workspaces, nil
+}
+
+// The "workspaces" field is either an array of globs or an object with a "packages" array of globs
+func parseWorkspacePatterns(packageJson *orderedmap.OrderedMap) ([]string, error) {
+	value, ok := packageJson.Get("workspaces")
+	if !ok {
+		return nil, nil
+	}
+
+	switch v := value.(type) {
+	case orderedmap.OrderedMap:
+		value, _ = v.Get("packages")
+	case *orderedmap.OrderedMap:
+		value, _ = v.Get("packages")
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected type for workspaces: %T", value)
+	}
+
+	patterns := make([]string, 0, len(list))
+	for _, item := range list {
+		pattern, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("workspace pattern is not a string: %T", item)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// Symlink each workspace into node_modules under its package name so other members and dependencies resolve to it
+func LinkWorkspaces(installCtx *InstallContext, workspaces []Workspace) error {
+	for _, workspace := range workspaces {
+		linkPath := filepath.Join(installCtx.NodeModulesDir, workspace.Name)
+		if err := os.MkdirAll(filepath.Dir(linkPath), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create directory for workspace %s: %v", workspace.Name, err)
+		}
+
+		target, err := filepath.Abs(workspace.Dir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve workspace %s: %v", workspace.Name, err)
+		}
+		absLink, err := filepath.Abs(filepath.Dir(linkPath))
+		if err != nil {
+			return fmt.Errorf("failed to resolve workspace %s: %v", workspace.Name, err)
+		}
+		relTarget, err := filepath.Rel(absLink, target)
+		if err != nil {
+			return fmt.Errorf("failed to resolve workspace %s: %v", workspace.Name, err)
+		}
+
+		// Replace whatever was there before, a stale link or a registry copy of the same name
+		if err := os.RemoveAll(linkPath); err != nil {
+			return fmt.Errorf("failed to replace %s: %v", linkPath, err)
+		}
+		if err := os.Symlink(relTarget, linkPath); err != nil {
+			return fmt.Errorf("failed to link workspace %s: %v", workspace.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Find the nearest directory from startDir upwards that has a package.json, failing once the filesystem root
+// is reached without one
+func FindNearestPackage(startDir string) (string, error) {
+	start, err := filepath.Abs(startDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", startDir, err)
+	}
+	for dir := start; ; dir = filepath.Dir(dir) {
+		if info, err := os.Stat(filepath.Join(dir, "package.json")); err == nil && !info.IsDir() {
+			return dir, nil
+		}
+		if filepath.Dir(dir) == dir {
+			return "", fmt.Errorf("no package.json found in %s or any of its parent directories", start)
+		}
+	}
+}
+
+// Find the project a command run in startDir works on: the nearest directory upwards with a package.json, or,
+// when that is a workspace member, the root whose "workspaces" include it
+func FindProjectRoot(startDir string) (string, error) {
+	nearest, err := FindNearestPackage(startDir)
+	if err != nil {
+		return "", err
+	}
+	for dir := filepath.Dir(nearest); filepath.Dir(dir) != dir; dir = filepath.Dir(dir) {
+		pathToJSON := filepath.Join(dir, "package.json")
+		if _, err := os.Stat(pathToJSON); err != nil {
+			continue
+		}
+		packageJson, err := ParsePackageJson(pathToJSON)
+		if err != nil {
+			return "", err
+		}
+		workspaces, err := FindWorkspaces(pathToJSON, packageJson)
+		if err != nil {
+			return "", err
+		}
+		for _, workspace := range workspaces {
+			if member, err := filepath.Abs(workspace.Dir); err == nil && member == nearest {
+				return dir, nil
+			}
+		}
+	}
+	return nearest, nil
+}